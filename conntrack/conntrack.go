@@ -0,0 +1,258 @@
+// Package conntrack deletes connection tracking entries through ctnetlink.
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Message types and attributes of ctnetlink, see
+// include/uapi/linux/netfilter/nfnetlink_conntrack.h.
+const (
+	ipctnlMsgCtGet    = 1
+	ipctnlMsgCtDelete = 2
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaZone       = 18
+
+	ctaTupleIP = 1
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+)
+
+// entry is a conntrack entry as needed to delete it.
+type entry struct {
+	family uint8
+	// orig is the encoded original tuple identifying the entry and zone the
+	// encoded zone, if any.
+	orig []byte
+	zone []byte
+	// addrs are the addresses in the original and reply tuple.
+	addrs []netip.Addr
+}
+
+// dumpBufferSize is the size of the buffer a dump is received into. The
+// kernel limits the messages of a dump to 32 KiB.
+const dumpBufferSize = 32 * 1024
+
+// FlushAddrs deletes all conntrack entries of which one of the addresses in
+// the original or reply direction is in addrs. It returns the number of
+// entries deleted. Only the entries of the address families of addrs are
+// dumped by the kernel, and they are deleted while the dump is received
+// instead of loading the whole table first.
+func FlushAddrs(addrs []netip.Addr) (int, error) {
+	wanted := make(map[netip.Addr]bool)
+	families := make(map[uint8]bool)
+	for _, a := range addrs {
+		wanted[a] = true
+		if a.Is4() {
+			families[unix.AF_INET] = true
+		} else {
+			families[unix.AF_INET6] = true
+		}
+	}
+	if len(wanted) == 0 {
+		return 0, nil
+	}
+	// Entries are deleted through a separate socket, as the one receiving
+	// the dump cannot be used for other requests until it is done.
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return 0, fmt.Errorf("while opening ctnetlink socket: %w", err)
+	}
+	defer conn.Close()
+	var deleted int
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if !families[family] {
+			continue
+		}
+		err := dump(family, func(e entry) error {
+			if !e.matches(wanted) {
+				return nil
+			}
+			_, err := conn.Execute(netlink.Message{
+				Header: netlink.Header{
+					Type:  ctnetlinkType(ipctnlMsgCtDelete),
+					Flags: netlink.Request | netlink.Acknowledge,
+				},
+				Data: e.deleteRequest(),
+			})
+			// Entries may expire between dumping and deleting them
+			if errors.Is(err, unix.ENOENT) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("while deleting conntrack entry: %w", err)
+			}
+			deleted++
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// dump calls fn for every conntrack entry of the given address family while
+// receiving them from the kernel.
+func dump(family uint8, fn func(entry) error) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("while opening ctnetlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+	kernel := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("while binding ctnetlink socket: %w", err)
+	}
+	if err := unix.Sendto(fd, dumpRequest(family), 0, kernel); err != nil {
+		return fmt.Errorf("while dumping conntrack entries: %w", err)
+	}
+	buf := make([]byte, dumpBufferSize)
+	return readDump(func() ([]byte, error) {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}, fn)
+}
+
+// dumpRequest returns the netlink message requesting a dump of the conntrack
+// entries of the given address family.
+func dumpRequest(family uint8) []byte {
+	data := nfgenmsg(family)
+	b := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(data))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(unix.NLMSG_HDRLEN+len(data)))
+	binary.NativeEndian.PutUint16(b[4:6], uint16(ctnetlinkType(ipctnlMsgCtGet)))
+	binary.NativeEndian.PutUint16(b[6:8], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	return append(b, data...)
+}
+
+// readDump calls fn for every conntrack entry in the messages returned by
+// recv until the dump is done.
+func readDump(recv func() ([]byte, error), fn func(entry) error) error {
+	for {
+		b, err := recv()
+		if err != nil {
+			return fmt.Errorf("while dumping conntrack entries: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(b)
+		if err != nil {
+			return fmt.Errorf("while parsing conntrack dump: %w", err)
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return errors.New("truncated netlink error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return fmt.Errorf("while dumping conntrack entries: %w", unix.Errno(-errno))
+				}
+				continue
+			}
+			e, err := parseEntry(m.Data)
+			if err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func ctnetlinkType(msg uint16) netlink.HeaderType {
+	return netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | msg)
+}
+
+// nfgenmsg returns the nfnetlink header for the given address family.
+func nfgenmsg(family uint8) []byte {
+	return []byte{family, unix.NFNETLINK_V0, 0, 0}
+}
+
+// parseEntry parses a conntrack entry from the data of a ctnetlink message.
+func parseEntry(b []byte) (entry, error) {
+	if len(b) < 4 {
+		return entry{}, fmt.Errorf("conntrack message too short: %d bytes", len(b))
+	}
+	e := entry{family: b[0]}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return entry{}, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaTupleOrig, ctaTupleReply:
+			if ad.Type() == ctaTupleOrig {
+				e.orig = ad.Bytes()
+			}
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == ctaTupleIP {
+						nad.Nested(e.parseIPs)
+					}
+				}
+				return nil
+			})
+		case ctaZone:
+			e.zone = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return entry{}, fmt.Errorf("while parsing conntrack entry: %w", err)
+	}
+	if e.orig == nil {
+		return entry{}, errors.New("conntrack entry without original tuple")
+	}
+	return e, nil
+}
+
+func (e *entry) parseIPs(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case ctaIPv4Src, ctaIPv4Dst, ctaIPv6Src, ctaIPv6Dst:
+			if a, ok := netip.AddrFromSlice(ad.Bytes()); ok {
+				e.addrs = append(e.addrs, a)
+			}
+		}
+	}
+	return nil
+}
+
+// matches returns true if one of the addresses of e is in addrs.
+func (e *entry) matches(addrs map[netip.Addr]bool) bool {
+	for _, a := range e.addrs {
+		if addrs[a] {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteRequest returns the data of a ctnetlink message deleting e.
+func (e *entry) deleteRequest() []byte {
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(ctaTupleOrig|unix.NLA_F_NESTED, e.orig)
+	if e.zone != nil {
+		ae.Bytes(ctaZone, e.zone)
+	}
+	// Encoding raw attributes cannot fail
+	attrs, _ := ae.Encode()
+	return append(nfgenmsg(e.family), attrs...)
+}
@@ -0,0 +1,132 @@
+package conntrack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func encodeTuple(ae *netlink.AttributeEncoder, typ uint16, src, dst string) {
+	ae.Nested(typ, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIP, func(ipae *netlink.AttributeEncoder) error {
+			ipae.Bytes(ctaIPv4Src, netip.MustParseAddr(src).AsSlice())
+			ipae.Bytes(ctaIPv4Dst, netip.MustParseAddr(dst).AsSlice())
+			return nil
+		})
+		// CTA_TUPLE_PROTO with CTA_PROTO_NUM
+		nae.Nested(2, func(pae *netlink.AttributeEncoder) error {
+			pae.Uint8(1, unix.IPPROTO_TCP)
+			return nil
+		})
+		return nil
+	})
+}
+
+func TestParseEntry(t *testing.T) {
+	ae := netlink.NewAttributeEncoder()
+	// A connection to a Service IP DNATed to a pod
+	encodeTuple(ae, ctaTupleOrig, "10.0.0.2", "10.96.0.1")
+	encodeTuple(ae, ctaTupleReply, "10.0.0.1", "10.0.0.2")
+	ae.Bytes(ctaZone, []byte{0, 5})
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseEntry(append(nfgenmsg(unix.AF_INET), attrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.family != unix.AF_INET || len(e.addrs) != 4 {
+		t.Fatalf("expected IPv4 entry with 4 addresses, got %+v", e)
+	}
+	if !e.matches(map[netip.Addr]bool{netip.MustParseAddr("10.0.0.1"): true}) {
+		t.Error("expected entry to match the pod it was DNATed to")
+	}
+	if e.matches(map[netip.Addr]bool{netip.MustParseAddr("10.0.0.9"): true}) {
+		t.Error("expected entry not to match unrelated address")
+	}
+
+	// The delete request identifies the entry by its original tuple and zone
+	req := e.deleteRequest()
+	if req[0] != unix.AF_INET {
+		t.Errorf("expected IPv4 family in delete request, got %d", req[0])
+	}
+	got, err := netlink.UnmarshalAttributes(req[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Type&^unix.NLA_F_NESTED != ctaTupleOrig || !bytes.Equal(got[0].Data, e.orig) || got[1].Type != ctaZone || !bytes.Equal(got[1].Data, []byte{0, 5}) {
+		t.Errorf("unexpected delete request attributes %+v", got)
+	}
+}
+
+func TestParseEntryWithoutTuple(t *testing.T) {
+	if _, err := parseEntry(nfgenmsg(unix.AF_INET)); err == nil {
+		t.Error("expected entry without original tuple to be rejected")
+	}
+	if _, err := parseEntry([]byte{2}); err == nil {
+		t.Error("expected truncated message to be rejected")
+	}
+}
+
+// netlinkMessage encodes a netlink message of the given type.
+func netlinkMessage(typ uint16, data []byte) []byte {
+	b, err := (&netlink.Message{
+		Header: netlink.Header{Length: uint32(unix.NLMSG_HDRLEN + len(data)), Type: netlink.HeaderType(typ), Flags: netlink.Multi},
+		Data:   data,
+	}).MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestReadDump(t *testing.T) {
+	var entries [][]byte
+	for _, src := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		ae := netlink.NewAttributeEncoder()
+		encodeTuple(ae, ctaTupleOrig, src, "192.0.2.1")
+		attrs, err := ae.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, netlinkMessage(uint16(ctnetlinkType(ipctnlMsgCtGet)), append(nfgenmsg(unix.AF_INET), attrs...)))
+	}
+	// Entries arrive in several reads, the last one ending the dump
+	reads := [][]byte{
+		append(entries[0], entries[1]...),
+		append(entries[2], netlinkMessage(unix.NLMSG_DONE, make([]byte, 4))...),
+	}
+	recv := func() ([]byte, error) {
+		if len(reads) == 0 {
+			t.Fatal("expected dump to end with the done message")
+		}
+		b := reads[0]
+		reads = reads[1:]
+		return b, nil
+	}
+	var srcs []netip.Addr
+	err := readDump(recv, func(e entry) error {
+		srcs = append(srcs, e.addrs[0])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srcs) != 3 || srcs[2] != netip.MustParseAddr("10.0.0.3") {
+		t.Errorf("expected all 3 entries in order, got %v", srcs)
+	}
+
+	errno := -int32(unix.EPERM)
+	errMsg := make([]byte, 4)
+	binary.NativeEndian.PutUint32(errMsg, uint32(errno))
+	reads = [][]byte{netlinkMessage(unix.NLMSG_ERROR, errMsg)}
+	if err := readDump(recv, func(entry) error { return nil }); !errors.Is(err, unix.EPERM) {
+		t.Errorf("expected dump to fail with EPERM, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/metrics"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nftctrl"
+	"k8s.io/klog/v2"
+)
+
+// footprintKinds are the kinds of objects whose footprint is exposed, in
+// label order.
+var footprintKinds = []string{"pod", "policy", "rule"}
+
+func footprintByKind(f nftctrl.Footprint) []nftctrl.ObjectFootprint {
+	return []nftctrl.ObjectFootprint{f.Pods, f.Policies, f.Rules}
+}
+
+func (c *Controller) footprint() nftctrl.Footprint {
+	c.nftMu.Lock()
+	defer c.nftMu.Unlock()
+	return c.nft.Footprint()
+}
+
+// footprintMaxAge is how long a footprint is reused by the metrics, so
+// walking all objects happens once per scrape instead of once per metric.
+const footprintMaxAge = time.Second
+
+// registerFootprintMetrics registers metrics describing the objects kept in
+// memory, so their growth can be noticed before the controller runs out of
+// memory.
+func (c *Controller) registerFootprintMetrics() {
+	var mu sync.Mutex
+	var last nftctrl.Footprint
+	var lastAt time.Time
+	footprint := func() nftctrl.Footprint {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(lastAt) > footprintMaxAge {
+			last, lastAt = c.footprint(), time.Now()
+		}
+		return last
+	}
+	perKind := func(value func(nftctrl.ObjectFootprint) int) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			samples := make([]metrics.Sample, len(footprintKinds))
+			for i, of := range footprintByKind(footprint()) {
+				samples[i] = metrics.Sample{LabelValues: []string{footprintKinds[i]}, Value: float64(value(of))}
+			}
+			return samples
+		}
+	}
+	kindLabels := []string{"kind"}
+	metrics.Default.NewGaugeVecFunc("npc_objects", "Number of objects of a kind kept in memory.", kindLabels, perKind(func(of nftctrl.ObjectFootprint) int { return of.Count }))
+	metrics.Default.NewGaugeVecFunc("npc_objects_estimated_bytes", "Rough estimate of the memory used by the objects of a kind, excluding the informer caches and nftables objects.", kindLabels, perKind(func(of nftctrl.ObjectFootprint) int { return of.EstimatedBytes }))
+}
+
+// warnFootprint periodically checks the number of objects of each kind
+// against the thresholds, which are disabled if zero. It logs a warning when
+// one is exceeded and again once it is no longer.
+func (c *Controller) warnFootprint(ctx context.Context, interval time.Duration, thresholds []int) {
+	exceeded := make([]bool, len(footprintKinds))
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		for i, of := range footprintByKind(c.footprint()) {
+			threshold := thresholds[i]
+			switch {
+			case threshold <= 0:
+			case of.Count > threshold && !exceeded[i]:
+				klog.Warningf("Keeping %d %s objects in memory, more than the threshold of %d, estimated size %d bytes", of.Count, footprintKinds[i], threshold, of.EstimatedBytes)
+				exceeded[i] = true
+			case of.Count <= threshold && exceeded[i]:
+				klog.Infof("Keeping %d %s objects in memory, no longer more than the threshold of %d", of.Count, footprintKinds[i], threshold)
+				exceeded[i] = false
+			}
+		}
+	}
+}
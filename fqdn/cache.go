@@ -0,0 +1,146 @@
+package fqdn
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Cache keeps the addresses of a set of names, resolving them again once
+// their TTL expired. If resolving a name fails with a transient error, its
+// previous addresses are kept and it is retried after RetryInterval, so a
+// flaky resolver does not cut off traffic to addresses which are likely
+// still valid. Addresses a name no longer resolves to are kept for the TTL of
+// the records they were returned in, as clients may still have them cached.
+type Cache struct {
+	Resolver Resolver
+	// MinTTL is the minimum time names are cached for, so names with very
+	// short TTLs do not cause a constant stream of queries.
+	MinTTL time.Duration
+	// RetryInterval is the time after which a failed resolution is retried.
+	RetryInterval time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	// now returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+type entry struct {
+	// addrs are the sorted addresses of the name.
+	addrs []netip.Addr
+	// ttl is the TTL of the records addrs were returned in.
+	ttl     time.Duration
+	expires time.Time
+	// dropped contains the addresses the name no longer resolves to and the
+	// time until which clients may still use them.
+	dropped map[netip.Addr]time.Time
+}
+
+// update replaces the addresses of e with the sorted addrs, keeping the ones
+// dropped for the previous TTL.
+func (e *entry) update(now time.Time, addrs []netip.Addr, ttl time.Duration) {
+	for _, a := range e.addrs {
+		if _, ok := slices.BinarySearchFunc(addrs, a, netip.Addr.Compare); !ok {
+			if e.dropped == nil {
+				e.dropped = make(map[netip.Addr]time.Time)
+			}
+			e.dropped[a] = now.Add(e.ttl)
+		}
+	}
+	for _, a := range addrs {
+		delete(e.dropped, a)
+	}
+	for a, until := range e.dropped {
+		if !now.Before(until) {
+			delete(e.dropped, a)
+		}
+	}
+	e.addrs, e.ttl = addrs, ttl
+}
+
+func (c *Cache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Update makes the cache contain exactly names, resolving the ones which are
+// new or expired.
+func (c *Cache) Update(ctx context.Context, names []string) {
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*entry)
+	}
+	keep := make(map[string]bool)
+	var due []string
+	now := c.clock()
+	for _, name := range names {
+		keep[name] = true
+		if e, ok := c.entries[name]; !ok || !now.Before(e.expires) {
+			due = append(due, name)
+		}
+	}
+	for name := range c.entries {
+		if !keep[name] {
+			delete(c.entries, name)
+		}
+	}
+	c.mu.Unlock()
+
+	// Resolve without holding the lock, so Addrs is not blocked by slow
+	// queries.
+	for _, name := range due {
+		addrs, ttl, err := c.Resolver.Resolve(ctx, name)
+		if ctx.Err() != nil {
+			return
+		}
+		c.mu.Lock()
+		e, ok := c.entries[name]
+		if !ok {
+			e = &entry{}
+		}
+		now := c.clock()
+		switch {
+		case err == nil || errors.Is(err, ErrNotFound):
+			if err != nil {
+				klog.Warningf("FQDN peer %s does not exist", name)
+			}
+			slices.SortFunc(addrs, netip.Addr.Compare)
+			e.update(now, slices.Compact(addrs), ttl)
+			e.expires = now.Add(max(ttl, c.MinTTL))
+		default:
+			klog.Warningf("Failed to resolve FQDN peer %s, keeping %d previous addresses: %v", name, len(e.addrs), err)
+			e.expires = now.Add(c.RetryInterval)
+		}
+		c.entries[name] = e
+		c.mu.Unlock()
+	}
+}
+
+// Addrs returns the addresses of all names in the cache, including dropped
+// ones which may still be in use. Names which have never been resolved
+// successfully have none.
+func (c *Cache) Addrs() map[string][]netip.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock()
+	out := make(map[string][]netip.Addr, len(c.entries))
+	for name, e := range c.entries {
+		addrs := slices.Clone(e.addrs)
+		for a, until := range e.dropped {
+			if now.Before(until) {
+				addrs = append(addrs, a)
+			}
+		}
+		slices.SortFunc(addrs, netip.Addr.Compare)
+		out[name] = addrs
+	}
+	return out
+}
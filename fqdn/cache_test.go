@@ -0,0 +1,111 @@
+package fqdn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	addrs   map[string][]netip.Addr
+	ttl     time.Duration
+	err     error
+	queries []string
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, name string) ([]netip.Addr, time.Duration, error) {
+	r.queries = append(r.queries, name)
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	addrs, ok := r.addrs[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return addrs, r.ttl, nil
+}
+
+func addrs(s ...string) []netip.Addr {
+	var out []netip.Addr
+	for _, a := range s {
+		out = append(out, netip.MustParseAddr(a))
+	}
+	return out
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := &fakeResolver{
+		addrs: map[string][]netip.Addr{"example.com": addrs("192.0.2.2", "2001:db8::1", "192.0.2.1", "192.0.2.2")},
+		ttl:   time.Minute,
+	}
+	c := &Cache{Resolver: r, MinTTL: 30 * time.Second, RetryInterval: 10 * time.Second, now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	c.Update(ctx, []string{"example.com", "missing.example.com"})
+	expected := map[string][]netip.Addr{
+		"example.com":         addrs("192.0.2.1", "192.0.2.2", "2001:db8::1"),
+		"missing.example.com": nil,
+	}
+	if got := c.Addrs(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Nothing is resolved again before the TTL expired
+	r.queries = nil
+	now = now.Add(59 * time.Second)
+	c.Update(ctx, []string{"example.com"})
+	if len(r.queries) != 0 {
+		t.Errorf("expected no queries before expiry, got %v", r.queries)
+	}
+	if _, ok := c.Addrs()["missing.example.com"]; ok {
+		t.Error("expected names no longer used to be removed")
+	}
+
+	// Transient failures keep the previous addresses and are retried
+	// earlier
+	now = now.Add(time.Second)
+	r.err = errors.New("timeout")
+	c.Update(ctx, []string{"example.com"})
+	if got := c.Addrs()["example.com"]; len(got) != 3 {
+		t.Errorf("expected previous addresses to be kept, got %v", got)
+	}
+	r.err = nil
+	r.addrs["example.com"] = addrs("192.0.2.3")
+	r.ttl = time.Second
+	now = now.Add(10 * time.Second)
+	c.Update(ctx, []string{"example.com"})
+	// Dropped addresses are kept for their previous TTL of a minute
+	if got := c.Addrs()["example.com"]; !reflect.DeepEqual(got, addrs("192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1")) {
+		t.Errorf("expected addresses to be updated after the retry interval, keeping dropped ones, got %v", got)
+	}
+
+	// Short TTLs are raised to MinTTL
+	r.queries = nil
+	now = now.Add(29 * time.Second)
+	c.Update(ctx, []string{"example.com"})
+	if len(r.queries) != 0 {
+		t.Errorf("expected no queries before MinTTL, got %v", r.queries)
+	}
+
+	// Names which no longer exist lose their addresses once the TTLs of
+	// the records they were returned in expired
+	delete(r.addrs, "example.com")
+	now = now.Add(time.Second)
+	c.Update(ctx, []string{"example.com"})
+	if got := c.Addrs()["example.com"]; !reflect.DeepEqual(got, addrs("192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1")) {
+		t.Errorf("expected dropped addresses to be kept until their TTL expired, got %v", got)
+	}
+	now = now.Add(time.Second)
+	if got := c.Addrs()["example.com"]; !reflect.DeepEqual(got, addrs("192.0.2.1", "192.0.2.2", "2001:db8::1")) {
+		t.Errorf("expected address with a TTL of 1s to be removed, got %v", got)
+	}
+	now = now.Add(29 * time.Second)
+	if got := c.Addrs()["example.com"]; len(got) != 0 {
+		t.Errorf("expected no addresses for a name which does not exist, got %v", got)
+	}
+}
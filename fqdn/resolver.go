@@ -0,0 +1,205 @@
+// Package fqdn resolves the domain names used as policy peers and caches
+// their addresses for as long as their records permit.
+package fqdn
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver resolves a name to its addresses and the time they may be cached
+// for.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) ([]netip.Addr, time.Duration, error)
+}
+
+// ErrNotFound is returned by DNSResolver if the name does not exist. Unlike
+// other errors, it is not transient.
+var ErrNotFound = errors.New("name does not exist")
+
+// DNSResolver queries the A and AAAA records of names from a recursive
+// resolver. Responses truncated over UDP are retried over TCP.
+type DNSResolver struct {
+	// Server is the host:port of the recursive resolver.
+	Server string
+	// Timeout limits each query. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// Resolve returns the IPv4 and IPv6 addresses of name, following CNAMEs,
+// and the lowest TTL of the records involved. A name without any addresses
+// is not an error.
+func (r *DNSResolver) Resolve(ctx context.Context, name string) ([]netip.Addr, time.Duration, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	var addrs []netip.Addr
+	var ttl uint32
+	haveTTL := false
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		a, t, ok, err := r.query(ctx, qname, typ)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs = append(addrs, a...)
+		if ok && (!haveTTL || t < ttl) {
+			ttl, haveTTL = t, true
+		}
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// query queries the records of type typ of qname. ok is false if no record
+// carried a TTL.
+func (r *DNSResolver) query(ctx context.Context, qname dnsmessage.Name, typ dnsmessage.Type) (addrs []netip.Addr, ttl uint32, ok bool, err error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// A random ID makes spoofing responses over UDP harder
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, 0, false, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	question := dnsmessage.Question{Name: qname, Type: typ, Class: dnsmessage.ClassINET}
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	req, err := q.Pack()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	resp, err := exchange(ctx, "udp", r.Server, req)
+	if err == nil && resp.Header.Truncated {
+		resp, err = exchange(ctx, "tcp", r.Server, req)
+	}
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("while querying %v %v: %w", typ, qname, err)
+	}
+	if resp.Header.ID != id {
+		return nil, 0, false, fmt.Errorf("response to %v %v has mismatched ID", typ, qname)
+	}
+	if !sameQuestion(resp.Questions, question) {
+		return nil, 0, false, fmt.Errorf("response to %v %v has mismatched question %v", typ, qname, resp.Questions)
+	}
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, false, fmt.Errorf("%v: %w", qname, ErrNotFound)
+	default:
+		return nil, 0, false, fmt.Errorf("query for %v %v failed: %v", typ, qname, resp.Header.RCode)
+	}
+	// Recursive resolvers return the CNAME chain in order, followed by the
+	// addresses of its target.
+	names := map[string]bool{strings.ToLower(qname.String()): true}
+	minTTL := func(t uint32) {
+		if !ok || t < ttl {
+			ttl, ok = t, true
+		}
+	}
+	for _, rr := range resp.Answers {
+		if !names[strings.ToLower(rr.Header.Name.String())] {
+			continue
+		}
+		switch b := rr.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			names[strings.ToLower(b.CNAME.String())] = true
+			minTTL(rr.Header.TTL)
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(b.A))
+			minTTL(rr.Header.TTL)
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(b.AAAA))
+			minTTL(rr.Header.TTL)
+		}
+	}
+	return addrs, ttl, ok, nil
+}
+
+// sameQuestion returns true if questions consists of q only. Names are
+// compared case-insensitively, as resolvers may change their case.
+func sameQuestion(questions []dnsmessage.Question, q dnsmessage.Question) bool {
+	return len(questions) == 1 && questions[0].Type == q.Type && questions[0].Class == q.Class &&
+		strings.EqualFold(questions[0].Name.String(), q.Name.String())
+}
+
+// exchange sends the packed query req to server over network and returns the
+// parsed response.
+func exchange(ctx context.Context, network, server string, req []byte) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	var resp []byte
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(req))), req...)); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, 65535)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp = resp[:n]
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &msg, nil
+}
+
+// SystemServer returns the first nameserver in /etc/resolv.conf as host:port.
+func SystemServer() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
@@ -0,0 +1,146 @@
+package fqdn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer answers queries from records over UDP and TCP on the same local
+// port. If truncate is set, UDP responses are truncated. If question is
+// set, it is returned instead of the question of the query.
+type testServer struct {
+	records  map[dnsmessage.Question][]dnsmessage.Resource
+	truncate bool
+	question *dnsmessage.Question
+}
+
+func (s *testServer) respond(t *testing.T, req []byte, udp bool) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(req); err != nil {
+		t.Errorf("invalid query: %v", err)
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+	if s.question != nil {
+		resp.Questions = []dnsmessage.Question{*s.question}
+	}
+	if udp && s.truncate {
+		resp.Header.Truncated = true
+	} else if rrs, ok := s.records[q.Questions[0]]; ok {
+		resp.Answers = rrs
+	} else {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+		for k := range s.records {
+			if k.Name == q.Questions[0].Name {
+				resp.Header.RCode = dnsmessage.RCodeSuccess
+			}
+		}
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		t.Errorf("failed to pack response: %v", err)
+	}
+	return out
+}
+
+func (s *testServer) start(t *testing.T) string {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(s.respond(t, buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err == nil {
+				req := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, req); err == nil {
+					resp := s.respond(t, req, false)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return udp.LocalAddr().String()
+}
+
+func TestDNSResolver(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.com.")
+	target := dnsmessage.MustNewName("cdn.example.net.")
+	other := dnsmessage.MustNewName("other.example.net.")
+	hdr := func(n dnsmessage.Name, typ dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: n, Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	s := &testServer{records: map[dnsmessage.Question][]dnsmessage.Resource{
+		{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}: {
+			{Header: hdr(name, dnsmessage.TypeCNAME, 300), Body: &dnsmessage.CNAMEResource{CNAME: target}},
+			{Header: hdr(target, dnsmessage.TypeA, 60), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}},
+			// Records of names outside the chain are ignored
+			{Header: hdr(other, dnsmessage.TypeA, 1), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 9}}},
+		},
+		{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}: {
+			{Header: hdr(name, dnsmessage.TypeCNAME, 300), Body: &dnsmessage.CNAMEResource{CNAME: target}},
+			{Header: hdr(target, dnsmessage.TypeAAAA, 120), Body: &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()}},
+		},
+	}}
+	r := &DNSResolver{Server: s.start(t), Timeout: time.Second}
+	ctx := context.Background()
+
+	for _, truncate := range []bool{false, true} {
+		s.truncate = truncate
+		addrs, ttl, err := r.Resolve(ctx, "www.example.com")
+		if err != nil {
+			t.Fatalf("truncate %v: %v", truncate, err)
+		}
+		expected := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Errorf("truncate %v: expected %v, got %v", truncate, expected, addrs)
+		}
+		if ttl != time.Minute {
+			t.Errorf("truncate %v: expected lowest TTL of 1m, got %v", truncate, ttl)
+		}
+	}
+	s.truncate = false
+
+	if _, _, err := r.Resolve(ctx, "missing.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Responses to a different question are rejected
+	s.question = &dnsmessage.Question{Name: other, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	if _, _, err := r.Resolve(ctx, "www.example.com"); err == nil {
+		t.Error("expected response to a different question to be rejected")
+	}
+}
@@ -2,24 +2,46 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/google/nftables"
 	v1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	cv1if "k8s.io/client-go/informers/core/v1"
 	nwkv1if "k8s.io/client-go/informers/networking/v1"
 	"k8s.io/client-go/kubernetes"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/cache/synctrack"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 	"k8s.io/kubectl/pkg/scheme"
 
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/conntrack"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/fqdn"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/metrics"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
 	"git.dolansoft.org/dolansoft/k8s-nft-npc/nftctrl"
 )
 
@@ -28,18 +50,112 @@ var (
 		"The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
 	kubeconfig = flag.String("kubeconfig", "",
 		"Path to a kubeconfig. Only required if out-of-cluster.")
-	podIfaceGroup = flag.Uint("pod-interface-group", 0, "Interface group id for pod-facing interfaces. Recommended in most use cases, required if the nodes also act as routers for non-local traffic.")
+	podIfaceGroup             = flag.Uint("pod-interface-group", 0, "Interface group id for pod-facing interfaces. Recommended in most use cases, required if the nodes also act as routers for non-local traffic.")
+	elementComments           = flag.Bool("element-comments", false, "Attach the namespace/name of the pod to set elements derived from it. Makes nft list output easier to read, but increases netlink traffic.")
+	eventDedupInterval        = flag.Duration("event-dedup-interval", 10*time.Minute, "Suppress events identical to one emitted for the same object within this interval. 0 disables deduplication.")
+	ifaceScoped               = flag.Bool("interface-scoped", false, "Scope pod verdict maps to the interface a pod IP is routed through, or the one named by its npc.dolansoft.org/interface annotation. Only traffic to/from a pod IP on that interface is policed. Useful on routers where the same IP can appear on multiple interfaces.")
+	ctZones                   = flag.String("ct-zones", "", "Comma-separated conntrack zone assignments for traffic entering the node, in the form iifgroup:<group>=<zone> or mark:<mark>=<zone>. The first match wins. Changes conntrack behavior node-wide, disabled by default.")
+	pprofAddr                 = flag.String("pprof-addr", "", "Address to serve pprof profiling endpoints on, e.g. 127.0.0.1:6060. Disabled if empty. Exposes sensitive internals, do not make it reachable from untrusted networks.")
+	table                     = flag.String("table", "k8s-nft-npc", "Name of the nftables table to program.")
+	adoptTable                = flag.Bool("adopt-table", false, "Add chains and sets to an existing table given by -table instead of creating a dedicated one. The table needs to exist in the ip and ip6 families. The controller still adds its own base chains. Only objects with names reserved for the controller are touched, see the README.")
+	baseChainPolicy           = flag.String("base-chain-policy", "", "Policy of the base chains, accept or drop. With drop, forwarded traffic to/from pod interfaces with IPs not (yet) known to belong to a pod is dropped. Requires -pod-interface-group. Defaults to the kernel default (accept).")
+	debugAddr                 = flag.String("debug-addr", "", "Address to serve debugging endpoints like the connectivity graph on, e.g. 127.0.0.1:6061. Disabled if empty. Exposes all pods and policies, do not make it reachable from untrusted networks.")
+	resyncPeriod              = flag.Duration("resync-period", 0, "Period in which all objects are reprocessed from the informer caches as a safety net. Unchanged objects do not cause ruleset updates. The elements of the sets maintained by the controller are also read back from the kernel in this period and drifted ones repaired. 0 disables periodic resyncs.")
+	maxSetElements            = flag.Int("max-set-elements", 0, "Maximum number of pod IPs in the peer set of a rule. Rules exceeding it permit all peers on their ports instead, until their pods fit again, and a warning event is emitted. 0 means unlimited.")
+	rejectWith                = flag.String("reject-with", "icmp-admin-prohibited", "How traffic not permitted by policies is rejected, icmp-admin-prohibited or tcp-reset. With tcp-reset, TCP connections are reset so clients fail immediately, other traffic is still rejected with an ICMP error.")
+	defaultDenyIngress        = flag.String("default-deny-ingress", "", "Label selector of pods isolated for ingress even if no NetworkPolicy selects them, as if every namespace had a default deny policy. * selects all pods. Disabled if empty.")
+	defaultDenyEgress         = flag.String("default-deny-egress", "", "Like -default-deny-ingress, but for egress.")
+	sharedPortSetMin          = flag.Int("shared-port-set-min", 0, "Minimum number of ports or port ranges of a rule for them to be matched using a named portset_ set shared between all rules with the same ports, instead of an anonymous set per rule. 0 disables shared sets.")
+	metricsAddr               = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9100. Disabled if empty.")
+	allowMulticast            = flag.Bool("allow-multicast", false, "Accept traffic to multicast (224.0.0.0/4, ff00::/8) and broadcast destinations from isolated pods, so cluster discovery protocols like mDNS keep working.")
+	ruleCounters              = flag.Bool("rule-counters", false, "Count traffic rejected for each isolated pod and expose it as the npc_pod_rejected_packets_total and npc_pod_rejected_bytes_total metrics. Reading the counters requires dumping the rules of all isolated pods, which is done at most every 30 seconds.")
+	configFile                = flag.String("config", "", "Path to a file with flag values in the form name=value, one per line, overriding the command line. It is re-read on SIGHUP. Log verbosity and -event-dedup-interval are applied immediately, flags affecting the ruleset cause it to be rebuilt and changes to other flags are rejected.")
+	gcOrphans                 = flag.Bool("gc-orphans", false, "After the initial sync, delete chains and sets in the table which look like they are owned by the controller, but are not part of the current ruleset. They are always logged.")
+	auditNamedPorts           = flag.Bool("audit-named-ports", false, "Emit a Normal event on policies with rules whose named ports are not exposed with the given protocol by any selected pod, which usually indicates a typo.")
+	excludeHostNetworkPeers   = flag.Bool("exclude-host-network-peers", false, "Do not treat host-network pods as peers selected by policies. As they use the IPs of their node, selecting them permits all traffic from the node. An event is emitted on policies selecting them either way.")
+	detailedMetricsNamespaces = flag.String("detailed-metrics-namespaces", "", "Comma-separated list of namespaces for which per-policy and per-pod metrics are exposed, * for all. Other namespaces only get metrics aggregated per namespace, which bounds their cardinality on clusters with many policies.")
+	nftScript                 = flag.String("nft-script", "", "Write all changes applied to the ruleset as nft commands to this file (appending), - for stdout.")
+	nftScriptOnly             = flag.Bool("nft-script-only", false, "Only write the ruleset built from the API as nft commands to the file given by -nft-script and exit. Does not modify anything.")
+	flushRetries              = flag.Int("flush-retries", 3, "Number of times the ruleset is rebuilt in a row after a flush failed with a transient error or the nftables connection was lost. If the flush still fails, the ruleset is rebuilt by the next flush. Objects whose changes are rejected as invalid are kept at their last good version as dead letters until they change.")
+	selectorAnnotations       = flag.String("selector-annotations", "", "Comma-separated list of pod annotation keys which can be matched by NetworkPolicy pod selectors like labels. An annotation prefix/name is available as the label prefix.annotation.npc.dolansoft.org/name, an unprefixed one as annotation.npc.dolansoft.org/name.")
+	policyCounters            = flag.Bool("policy-counters", false, "Count new connections accepted by each network policy in a named counter shared by its rules and expose them as the npc_policy_accepted_connections_total metric. Unlike -rule-counters, the counts are kept when a policy is updated, and across restarts unless the table schema changes. With -stateless, packets are counted instead of connections.")
+	rejectRate                = flag.String("reject-rate", "", "Limit the rate at which traffic is rejected for each isolated pod and direction, as rate/unit [burst n] with unit second, minute, hour, day or week. Traffic exceeding it is dropped without an ICMP error or TCP reset. Unlimited if empty.")
+	validateSetKeys           = flag.Bool("validate-set-keys", false, "Check the key and value lengths of all set elements against the types of their set before sending them. Invalid elements are logged in detail, skipped and counted in the npc_invalid_set_elements_total metric. Intended for tests and staging.")
+	egressOriginalSource      = flag.Bool("egress-original-source", false, "Attribute egress traffic to pods by the original source address recorded by conntrack instead of the source of the packet, for setups translating the source before the forward hook")
+	readableIDs               = flag.Bool("readable-ids", false, "Append the truncated namespace/name to the UIDs used in chain and set names of objects whose names are too long to be used directly, so they can be found by name")
+	namespaceRejectInterval   = flag.Duration("namespace-reject-interval", 0, "Sum up the traffic rejected for the pods of each namespace at this interval and expose it as the npc_namespace_rejected_packets_total and npc_namespace_rejected_bytes_total metrics. Requires -rule-counters. Every update dumps the rules of all isolated pods. 0 disables it.")
+	egressOriginalDestination = flag.Bool("egress-original-destination", false, "Match egress ipBlock peers against the original destination address recorded by conntrack instead of the destination of the packet, so ipBlocks of Service CIDRs permit traffic DNATed by kube-proxy")
+	ruleChains                = flag.Bool("rule-chains", false, "Add the rules of each network policy rule to a separate chain named after its index, which the policy chain jumps to. This makes the ruleset map directly to the rules of policies, for example for debugging.")
+	allowSelfTraffic          = flag.Bool("allow-self-traffic", false, "Accept traffic from a pod IP to the same IP, for example health checks of a pod reaching itself through a service, regardless of policies. Only traffic entering and leaving through the pod's interface with -interface-scoped, or through interfaces in -pod-interface-group otherwise, is accepted; one of them is required.")
+	excludeInitContainerPorts = flag.Bool("exclude-init-container-ports", false, "Do not resolve named ports of policies to ports of init containers, as they do not serve traffic once the pod is running. Ports of sidecar containers are still included.")
+	adminAddr                 = flag.String("admin-addr", "", "Address to serve administrative endpoints like forced reconciliation of single objects on, e.g. 127.0.0.1:6062. Disabled if empty. Do not make it reachable from untrusted networks.")
+	bypassCIDRs               = flag.String("bypass-cidrs", "", "Comma-separated list of CIDRs exempt from policy enforcement, e.g. a management network. Traffic of pods to and from them is always accepted.")
+	l2AntiSpoofing            = flag.Bool("l2-anti-spoofing", false, "Drop traffic from pod IPs not originating from the MAC address or VLAN the pod is pinned to with the npc.dolansoft.org/mac and npc.dolansoft.org/vlan annotations")
+	maxIPBlockRanges          = flag.Int("max-ipblock-ranges", 0, "Maximum number of address ranges the ipBlock peers of a rule are split into by their excepts. The ipBlock peers of rules exceeding it are ignored and a warning event is emitted. 0 means unlimited.")
+	readyPeers                = flag.Bool("ready-peers", false, "Track pod readiness, so policies with the npc.dolansoft.org/ready-peers annotation only select Ready pods as peers")
+	warnPodCount              = flag.Int("warn-pod-count", 0, "Log a warning when the controller keeps more pods than this in memory. 0 disables the warning.")
+	warnPolicyCount           = flag.Int("warn-policy-count", 0, "Log a warning when the controller keeps more NetworkPolicies than this in memory. 0 disables the warning.")
+	warnRuleCount             = flag.Int("warn-rule-count", 0, "Log a warning when the controller keeps more NetworkPolicy rules than this in memory. 0 disables the warning.")
+	stateless                 = flag.Bool("stateless", false, "Do not rely on conntrack. Instead of accepting established and related traffic, every policy rule gets a mirrored rule accepting the replies to the traffic it permits. See the README for the differences in semantics.")
+	allowICMPv6ND             = flag.Bool("allow-icmpv6-nd", true, "Accept ICMPv6 neighbor and router solicitations and advertisements regardless of policies, so isolating pods does not break IPv6 connectivity")
+	identity                  = flag.String("identity", "", "Identity of this controller instance, for example its pod name, recorded in the comment of a single set in the table to show which instance manages it. Individual objects are not labeled. If the table is taken over by an instance with a different identity, orphaned objects are not deleted by -gc-orphans. Empty disables recording it.")
+	flushConntrackOnExit      = flag.Bool("flush-conntrack-on-exit", false, "On shutdown, delete the conntrack entries of the IPs of the pods on this node, so established connections permitted by this instance are re-evaluated by the ruleset of its replacement. Resets connections whose state cannot be picked up again, see the README. Requires -node-name.")
+	nodeName                  = flag.String("node-name", "", "Name of the node the controller runs on, for example set from spec.nodeName through the downward API. Used to determine the pods on this node for -flush-conntrack-on-exit.")
+	fqdnPeers                 = flag.Bool("fqdn-peers", false, "Enable the npc.dolansoft.org/fqdns-egress-<index> annotation, which adds the addresses of domain names as peers of egress rules. Names are resolved periodically, so this is best-effort, see the README.")
+	fqdnServer                = flag.String("fqdn-server", "", "Address of the recursive DNS resolver used for -fqdn-peers, as host:port. Defaults to the first nameserver in /etc/resolv.conf.")
+	fqdnMinTTL                = flag.Duration("fqdn-min-ttl", 30*time.Second, "Minimum time the addresses of names used with -fqdn-peers are cached for, even if their records have a shorter TTL.")
+	disableEgress             = flag.Bool("disable-egress", false, "Only enforce ingress, ignoring the Egress policy type of NetworkPolicies, so egress enforcement can be rolled out later. Cannot be combined with -default-deny-egress.")
+	verify                    = flag.Bool("verify", false, "Build the expected ruleset from the API, compare it to the one in the kernel and exit. Exits non-zero if they differ. Does not modify anything.")
 )
 
 type Controller struct {
+	// nftMu protects nft, which is used by the worker and debug endpoints.
+	nftMu           sync.Mutex
 	nft             *nftctrl.Controller
+	nftConn         *nfds.Conn
+	nftCfg          nftctrl.Config
+	dedupRecorder   *nftctrl.DedupRecorder
 	informerFactory informers.SharedInformerFactory
 	podInformer     cv1if.PodInformer
 	nsInformer      cv1if.NamespaceInformer
 	nwpInformer     nwkv1if.NetworkPolicyInformer
 
 	q            workqueue.TypedInterface[workItem]
-	hasProcessed synctrack.AsyncTracker[workItem]
+	hasProcessed syncTracker
+	// deadLetters contains the objects whose changes were rejected by the
+	// kernel as invalid with the error, protected by nftMu. Until they are
+	// processed again, the ruleset is rebuilt with their last good version.
+	deadLetters map[workItem]error
+	// lastGood contains the versions of all objects which were last flushed
+	// successfully and pending the versions processed since, protected by
+	// nftMu. Deleted objects are nil in pending and absent from lastGood.
+	lastGood map[workItem]runtime.Object
+	pending  map[workItem]runtime.Object
+	// stale is set if a flush failed, so the ruleset in the kernel does not
+	// match nft. It is rebuilt by the next flush. Protected by nftMu.
+	stale bool
+
+	// podRejects are the reject counters last read by podRejectCounters at
+	// podRejectsRead, protected by nftMu.
+	podRejects     []nftctrl.PodCounter
+	podRejectsRead time.Time
+
+	// nsRejectsMu protects nsRejects, which is updated periodically if
+	// enabled by -namespace-reject-interval.
+	nsRejectsMu sync.Mutex
+	nsRejects   *nftctrl.NamespaceRejectTotals
+
+	// prevIdentity is the identity of the instance which managed the table
+	// before this one started, see nftctrl.Controller.PreviousIdentity.
+	prevIdentity string
+
+	// fqdns caches the addresses of the FQDN peers of rules if -fqdn-peers
+	// is set. It is kept across rebuilds.
+	fqdns *fqdn.Cache
+
+	// ifaceRetry wakes up retryIfaces when a pod has IPs whose interface
+	// could not be resolved.
+	ifaceRetry chan struct{}
 
 	eventRecorder record.EventRecorder
 }
@@ -52,7 +168,11 @@ type workItem struct {
 type updateEnqueuer struct {
 	typ          string
 	q            workqueue.TypedInterface[workItem]
-	hasProcessed *synctrack.AsyncTracker[workItem]
+	hasProcessed *syncTracker
+	// processUnchanged enqueues updates even if the object is unchanged.
+	// Processing them is cheap as unchanged objects are detected by the
+	// nftables controller and do not generate any nftables operations.
+	processUnchanged bool
 }
 
 func (c *updateEnqueuer) OnAdd(obj interface{}, isInInitialList bool) {
@@ -68,6 +188,13 @@ func (c *updateEnqueuer) OnAdd(obj interface{}, isInInitialList bool) {
 }
 
 func (c *updateEnqueuer) OnUpdate(oldObj, newObj interface{}) {
+	oldMeta, oldErr := meta.Accessor(oldObj)
+	newMeta, newErr := meta.Accessor(newObj)
+	if !c.processUnchanged && oldErr == nil && newErr == nil && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+		// Re-lists and resyncs deliver unchanged objects as updates. Skip
+		// them to avoid processing and flushing the whole world again.
+		return
+	}
 	name, err := cache.ObjectToName(newObj)
 	if err != nil {
 		klog.Warningf("OnAdd name for type %q cannot be derived: %v", c.typ, err)
@@ -87,53 +214,511 @@ func (c *updateEnqueuer) OnDelete(obj interface{}) {
 func (c *Controller) worker() {
 	for {
 		i, shut := c.q.Get()
-		switch i.typ {
-		case "pod":
-			pod, _ := c.podInformer.Lister().Pods(i.name.Namespace).Get(i.name.Name)
-			klog.Infof("Syncing pod %v", i.name)
-			c.nft.SetPod(i.name, pod)
-			c.q.Done(i)
-			if c.hasProcessed.HasSynced() {
-				if err := c.nft.Flush(); err != nil {
-					klog.Warningf("Failed to flush pod %v: %v", i.name, err)
+		if shut {
+			// The zero item returned on shutdown was never added to the
+			// queue, so it must not be marked as done or processed.
+			return
+		}
+		c.nftMu.Lock()
+		c.process(i)
+		c.nftMu.Unlock()
+	}
+}
+
+// process applies the object belonging to i from the informer caches to the
+// nftables controller. nftMu needs to be held.
+func (c *Controller) process(i workItem) {
+	ok := c.sync(i)
+	c.q.Done(i)
+	if !ok {
+		return
+	}
+	if c.hasProcessed.HasSynced() {
+		c.flushItem(i)
+	}
+	c.hasProcessed.Finished(i)
+}
+
+// sync applies the current version of i from the informer cache to nft
+// without flushing. It returns false for unknown item types. nftMu needs to
+// be held.
+func (c *Controller) sync(i workItem) bool {
+	// Changed objects get another chance
+	delete(c.deadLetters, i)
+	var obj runtime.Object
+	switch i.typ {
+	case "pod":
+		pod, _ := c.podInformer.Lister().Pods(i.name.Namespace).Get(i.name.Name)
+		klog.Infof("Syncing pod %v", i.name)
+		c.nft.SetPod(i.name, pod)
+		if c.nft.IfacesUnresolved(i.name) {
+			c.wakeIfaceRetry()
+		}
+		if pod != nil {
+			obj = pod
+		}
+	case "nwp":
+		nwp, _ := c.nwpInformer.Lister().NetworkPolicies(i.name.Namespace).Get(i.name.Name)
+		klog.Infof("Syncing NWP %v", i.name)
+		c.nft.SetNetworkPolicy(i.name, nwp)
+		if nwp != nil {
+			obj = nwp
+		}
+	case "ns":
+		// We assume that K8s will delete all resources in a namespace
+		// that is going away
+		klog.Infof("Syncing NS %v", i.name)
+		ns, _ := c.nsInformer.Lister().Get(i.name.Name)
+		c.nft.SetNamespace(i.name.Name, ns)
+		if ns != nil {
+			obj = ns
+		}
+	default:
+		return false
+	}
+	c.pending[i] = obj
+	return true
+}
+
+// forget removes i from nft without flushing, so syncing it afterwards
+// creates all of its objects again even if it did not change. nftMu needs to
+// be held.
+func (c *Controller) forget(i workItem) {
+	switch i.typ {
+	case "pod":
+		c.nft.SetPod(i.name, nil)
+	case "nwp":
+		c.nft.SetNetworkPolicy(i.name, nil)
+	case "ns":
+		c.nft.SetNamespace(i.name.Name, nil)
+	}
+}
+
+// flush flushes the nftables controller. nftMu needs to be held. If the
+// connection was lost or the flush failed with a transient error, the batch
+// is gone and the kernel ruleset is in an unknown state, so it is rebuilt
+// from the informer caches up to -flush-retries times. If the flush still
+// fails, the ruleset is stale and the next flush rebuilds it.
+func (c *Controller) flush() error {
+	var err error
+	if c.stale {
+		klog.Info("Rebuilding ruleset after a failed flush")
+		err = c.rebuild()
+	} else {
+		err = c.nft.Flush()
+		if err == nil {
+			for i, obj := range c.pending {
+				if obj == nil {
+					delete(c.lastGood, i)
+				} else {
+					c.lastGood[i] = obj
 				}
 			}
-			c.hasProcessed.Finished(i)
-		case "nwp":
-			nwp, _ := c.nwpInformer.Lister().NetworkPolicies(i.name.Namespace).Get(i.name.Name)
-			klog.Infof("Syncing NWP %v", i.name)
-			c.nft.SetNetworkPolicy(i.name, nwp)
-			c.q.Done(i)
-			if c.hasProcessed.HasSynced() {
-				if err := c.nft.Flush(); err != nil {
-					klog.Warningf("Failed to flush nwp %v: %v", i.name, err)
-				}
+			clear(c.pending)
+		}
+		c.stale = err != nil
+	}
+	for i := 0; i < *flushRetries && (errors.Is(err, nfds.ErrConnLost) || errors.Is(err, nfds.ErrTransient)); i++ {
+		klog.Errorf("%v, rebuilding ruleset", err)
+		err = c.rebuild()
+	}
+	return err
+}
+
+// flushRetryInterval is the time after which an object whose changes could
+// not be flushed for reasons other than being invalid is processed again.
+const flushRetryInterval = 10 * time.Second
+
+// flushItem flushes the changes caused by processing i. nftMu needs to be
+// held. If the ruleset was not stale, all earlier changes have been flushed
+// before, so if the kernel rejects the batch as invalid, i is the cause. It is
+// logged as a dead letter and the ruleset is rebuilt with the last version of
+// it which could be flushed, so a single bad object does not block updates of
+// all others. Other errors are not attributed to i, the kernel keeps the last
+// ruleset applied successfully and i is processed again later.
+func (c *Controller) flushItem(i workItem) {
+	wasStale := c.stale
+	err := c.flush()
+	if err == nil {
+		return
+	}
+	if wasStale || !errors.Is(err, nfds.ErrInvalid) {
+		klog.Errorf("Failed to flush %s %v, retrying in %v: %v", i.typ, i.name, flushRetryInterval, err)
+		time.AfterFunc(flushRetryInterval, func() { c.q.Add(i) })
+		return
+	}
+	c.deadLetters[i] = err
+	delete(c.pending, i)
+	klog.Errorf("Dead letter: keeping last good version of %s %v (%s) until it changes, flushing it failed: %v", i.typ, i.name, c.deadLetterContext(i), err)
+	if err := c.rebuild(); err != nil {
+		klog.Errorf("Failed to rebuild ruleset without changes of %s %v: %v", i.typ, i.name, err)
+	}
+}
+
+// deadLetterContext identifies the version of the object belonging to i in
+// the informer caches for logging. The object itself is not logged as pods
+// can contain secrets in their environment.
+func (c *Controller) deadLetterContext(i workItem) string {
+	var obj metav1.Object
+	var err error
+	switch i.typ {
+	case "pod":
+		obj, err = c.podInformer.Lister().Pods(i.name.Namespace).Get(i.name.Name)
+	case "nwp":
+		obj, err = c.nwpInformer.Lister().NetworkPolicies(i.name.Namespace).Get(i.name.Name)
+	case "ns":
+		obj, err = c.nsInformer.Lister().Get(i.name.Name)
+	}
+	if err != nil {
+		return fmt.Sprintf("object unavailable: %v", err)
+	}
+	return fmt.Sprintf("uid %s, resourceVersion %s", obj.GetUID(), obj.GetResourceVersion())
+}
+
+// goodVersion returns the version of obj belonging to i to build the ruleset
+// from. For dead letters, this is the last version flushed successfully or, if
+// there is none, a degraded version. nftMu needs to be held.
+func (c *Controller) goodVersion(i workItem, obj runtime.Object) runtime.Object {
+	if _, ok := c.deadLetters[i]; !ok {
+		return obj
+	}
+	if prev, ok := c.lastGood[i]; ok {
+		return prev
+	}
+	return degraded(obj)
+}
+
+// degraded returns a version of obj reduced to what is needed to keep pods
+// isolated, for dead letters which never were flushed successfully. Leaving
+// them out would fail open, for example a new policy would not isolate the
+// pods it selects. Policies lose all their rules, pods and namespaces all
+// annotations and pods additionally their named ports.
+func degraded(obj runtime.Object) runtime.Object {
+	switch o := obj.(type) {
+	case *nwkv1.NetworkPolicy:
+		policyTypes := o.Spec.PolicyTypes
+		if len(policyTypes) == 0 {
+			// Keep the types defaulted from the rules being present
+			policyTypes = []nwkv1.PolicyType{nwkv1.PolicyTypeIngress}
+			if len(o.Spec.Egress) > 0 {
+				policyTypes = append(policyTypes, nwkv1.PolicyTypeEgress)
 			}
-			c.hasProcessed.Finished(i)
-		case "ns":
-			// We assume that K8s will delete all resources in a namespace
-			// that is going away
-			klog.Infof("Syncing NS %v", i.name)
-			ns, _ := c.nsInformer.Lister().Get(i.name.Name)
-			c.nft.SetNamespace(i.name.Name, ns)
-			c.q.Done(i)
-			if c.hasProcessed.HasSynced() {
-				if err := c.nft.Flush(); err != nil {
-					klog.Warningf("Failed to flush ns %v: %v", i.name.Name, err)
-				}
+		}
+		return &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: o.Namespace, Name: o.Name, UID: o.UID, ResourceVersion: o.ResourceVersion},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: o.Spec.PodSelector,
+				PolicyTypes: policyTypes,
+			},
+		}
+	case *v1.Pod:
+		d := o.DeepCopy()
+		d.Annotations = nil
+		for _, containers := range [][]v1.Container{d.Spec.Containers, d.Spec.InitContainers} {
+			for j := range containers {
+				containers[j].Ports = nil
 			}
-			c.hasProcessed.Finished(i)
-		default:
-			c.q.Done(i)
 		}
-		if shut {
+		return d
+	case *v1.Namespace:
+		d := o.DeepCopy()
+		d.Annotations = nil
+		return d
+	}
+	return obj
+}
+
+// rebuild replaces the nftables controller with a new one populated with all
+// objects in the informer caches and atomically replaces the ruleset with its
+// own. Dead letters are added in their last good version. nftMu needs to be
+// held.
+func (c *Controller) rebuild() error {
+	c.stale = true
+	nft, err := nftctrl.New(c.eventRecorder, c.nftConn, c.nftCfg)
+	if err != nil {
+		return err
+	}
+	good := make(map[workItem]runtime.Object)
+	namespaces, err := c.nsInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		i := workItem{typ: "ns", name: cache.ObjectName{Name: ns.Name}}
+		ns := c.goodVersion(i, ns).(*v1.Namespace)
+		nft.SetNamespace(ns.Name, ns)
+		good[i] = ns
+	}
+	nwps, err := c.nwpInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, nwp := range nwps {
+		i := workItem{typ: "nwp", name: cache.MetaObjectToName(nwp)}
+		nwp := c.goodVersion(i, nwp).(*nwkv1.NetworkPolicy)
+		nft.SetNetworkPolicy(i.name, nwp)
+		good[i] = nwp
+	}
+	pods, err := c.podInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		i := workItem{typ: "pod", name: cache.MetaObjectToName(pod)}
+		pod := c.goodVersion(i, pod).(*v1.Pod)
+		nft.SetPod(i.name, pod)
+		good[i] = pod
+	}
+	c.applyFQDNAddrs(nft)
+	c.nft = nft
+	if len(nft.UnresolvedIfacePods()) > 0 {
+		c.wakeIfaceRetry()
+	}
+	if err := nft.Flush(); err != nil {
+		return err
+	}
+	c.stale = false
+	c.lastGood = good
+	clear(c.pending)
+	return nil
+}
+
+// rejectCountersMaxAge is the time the reject counters of pods are reused
+// for, as reading them dumps the rules of all isolated pods.
+const rejectCountersMaxAge = 30 * time.Second
+
+// podRejectCounters returns the reject counters of all isolated pods, read at
+// most rejectCountersMaxAge ago. It returns nil if rule counters are
+// disabled. nftMu needs to be held.
+func (c *Controller) podRejectCounters() ([]nftctrl.PodCounter, error) {
+	if !c.nftCfg.RuleCounters {
+		return nil, nil
+	}
+	if !c.podRejectsRead.IsZero() && time.Since(c.podRejectsRead) < rejectCountersMaxAge {
+		return c.podRejects, nil
+	}
+	counters, err := c.nft.PodRejectCounters()
+	if err != nil {
+		return nil, err
+	}
+	c.podRejects, c.podRejectsRead = counters, time.Now()
+	return counters, nil
+}
+
+// registerRejectMetrics registers the metrics exposing the traffic rejected
+// for each pod. They are empty if rule counters are disabled.
+func (c *Controller) registerRejectMetrics() {
+	collect := func(value func(nftctrl.PodCounter) uint64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			c.nftMu.Lock()
+			counters, err := c.podRejectCounters()
+			c.nftMu.Unlock()
+			if err != nil {
+				klog.Warningf("Failed to read reject counters: %v", err)
+				return nil
+			}
+			samples := make([]metrics.Sample, len(counters))
+			for i, pc := range counters {
+				samples[i] = metrics.Sample{LabelValues: []string{pc.Pod.Namespace, pc.Pod.Name}, Value: float64(value(pc))}
+			}
+			return samples
+		}
+	}
+	labels := []string{"namespace", "pod"}
+	metrics.Default.NewCounterVecFunc("npc_pod_rejected_packets_total", "Number of packets rejected for an isolated pod. Read at most every 30 seconds.", labels,
+		collect(func(pc nftctrl.PodCounter) uint64 { return pc.Packets }))
+	metrics.Default.NewCounterVecFunc("npc_pod_rejected_bytes_total", "Number of bytes rejected for an isolated pod. Read at most every 30 seconds.", labels,
+		collect(func(pc nftctrl.PodCounter) uint64 { return pc.Bytes }))
+}
+
+// registerNamespaceRejectMetrics registers the metrics exposing the traffic
+// rejected for the pods of each namespace. They are updated by
+// updateNamespaceRejects.
+func (c *Controller) registerNamespaceRejectMetrics() {
+	collect := func(value func(nftctrl.NamespaceCounter) uint64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			c.nsRejectsMu.Lock()
+			counters := c.nsRejects.Counters()
+			c.nsRejectsMu.Unlock()
+			samples := make([]metrics.Sample, len(counters))
+			for i, nc := range counters {
+				samples[i] = metrics.Sample{LabelValues: []string{nc.Namespace}, Value: float64(value(nc))}
+			}
+			return samples
+		}
+	}
+	labels := []string{"namespace"}
+	metrics.Default.NewCounterVecFunc("npc_namespace_rejected_packets_total", "Number of packets rejected for isolated pods of a namespace. Only exposed with -namespace-reject-interval.", labels,
+		collect(func(nc nftctrl.NamespaceCounter) uint64 { return nc.Packets }))
+	metrics.Default.NewCounterVecFunc("npc_namespace_rejected_bytes_total", "Number of bytes rejected for isolated pods of a namespace. Only exposed with -namespace-reject-interval.", labels,
+		collect(func(nc nftctrl.NamespaceCounter) uint64 { return nc.Bytes }))
+}
+
+// updateNamespaceRejects reads the reject counters of all pods at the given
+// interval and adds them to the namespace totals until ctx is done. Reading
+// them on every scrape would make the cost of scrapes unbounded.
+func (c *Controller) updateNamespaceRejects(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
 			return
 		}
+		c.nftMu.Lock()
+		enabled := c.nftCfg.RuleCounters
+		counters, err := c.podRejectCounters()
+		c.nftMu.Unlock()
+		if !enabled {
+			continue
+		}
+		if err != nil {
+			klog.Warningf("Failed to read reject counters: %v", err)
+			continue
+		}
+		c.nsRejectsMu.Lock()
+		c.nsRejects.Update(counters)
+		c.nsRejects.Prune(func(ns string) bool {
+			_, err := c.nsInformer.Lister().Get(ns)
+			return !apierrors.IsNotFound(err)
+		})
+		c.nsRejectsMu.Unlock()
+	}
+}
+
+// registerAcceptMetrics registers the metric exposing the connections
+// accepted by each policy. It is empty if policy counters are disabled.
+func (c *Controller) registerAcceptMetrics() {
+	metrics.Default.NewCounterVecFunc("npc_policy_accepted_connections_total", "Number of new connections accepted by the rules of a network policy.", []string{"namespace", "policy"}, func() []metrics.Sample {
+		c.nftMu.Lock()
+		if !c.nftCfg.PolicyCounters {
+			c.nftMu.Unlock()
+			return nil
+		}
+		counters, err := c.nft.PolicyCounters()
+		c.nftMu.Unlock()
+		if err != nil {
+			klog.Warningf("Failed to read policy counters: %v", err)
+			return nil
+		}
+		samples := make([]metrics.Sample, len(counters))
+		for i, pc := range counters {
+			samples[i] = metrics.Sample{LabelValues: []string{pc.Policy.Namespace, pc.Policy.Name}, Value: float64(pc.Packets)}
+		}
+		return samples
+	})
+}
+
+// parseDefaultDenySelector parses the value of a default deny flag. It
+// returns nil if it is disabled.
+func parseDefaultDenySelector(s string) (labels.Selector, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "*":
+		return labels.Everything(), nil
+	default:
+		return labels.Parse(s)
 	}
 }
 
+// nftConfig returns the configuration of the nftables controller given by the
+// flags.
+func nftConfig() (nftctrl.Config, error) {
+	cfg := nftctrl.Config{
+		PodIfaceGroup:             uint32(*podIfaceGroup),
+		Table:                     *table,
+		AdoptTable:                *adoptTable,
+		Identity:                  *identity,
+		DisableEgress:             *disableEgress,
+		ElementComments:           *elementComments,
+		ReadableIDs:               *readableIDs,
+		MaxSetElements:            *maxSetElements,
+		MaxIPBlockRanges:          *maxIPBlockRanges,
+		SharedPortSetMin:          *sharedPortSetMin,
+		AllowMulticast:            *allowMulticast,
+		AllowSelfTraffic:          *allowSelfTraffic,
+		AllowICMPv6ND:             *allowICMPv6ND,
+		L2AntiSpoofing:            *l2AntiSpoofing,
+		ReadyPeers:                *readyPeers,
+		FQDNPeers:                 *fqdnPeers,
+		Stateless:                 *stateless,
+		RuleCounters:              *ruleCounters,
+		PolicyCounters:            *policyCounters,
+		RuleChains:                *ruleChains,
+		AuditNamedPorts:           *auditNamedPorts,
+		ExcludeHostNetworkPeers:   *excludeHostNetworkPeers,
+		ExcludeInitContainerPorts: *excludeInitContainerPorts,
+		EgressOriginalSource:      *egressOriginalSource,
+		EgressOriginalDestination: *egressOriginalDestination,
+	}
+	for _, key := range strings.Split(*selectorAnnotations, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			cfg.SelectorAnnotations = append(cfg.SelectorAnnotations, key)
+		}
+	}
+	for _, cidr := range strings.Split(*bypassCIDRs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -bypass-cidrs: %w", err)
+		}
+		cfg.BypassCIDRs = append(cfg.BypassCIDRs, prefix)
+	}
+	var err error
+	cfg.CtZones, err = nftctrl.ParseCtZones(*ctZones)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid -ct-zones: %w", err)
+	}
+	if *baseChainPolicy != "" {
+		var policy nftables.ChainPolicy
+		switch *baseChainPolicy {
+		case "accept":
+			policy = nftables.ChainPolicyAccept
+		case "drop":
+			policy = nftables.ChainPolicyDrop
+		default:
+			return cfg, fmt.Errorf("invalid -base-chain-policy %q, expected accept or drop", *baseChainPolicy)
+		}
+		cfg.BaseChainPolicy = &policy
+	}
+	cfg.DefaultDenyIngress, err = parseDefaultDenySelector(*defaultDenyIngress)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid -default-deny-ingress: %w", err)
+	}
+	cfg.DefaultDenyEgress, err = parseDefaultDenySelector(*defaultDenyEgress)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid -default-deny-egress: %w", err)
+	}
+	cfg.RejectWith, err = nftctrl.ParseRejectMode(*rejectWith)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid -reject-with: %w", err)
+	}
+	cfg.RejectRate, err = nftctrl.ParseRejectRate(*rejectRate)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid -reject-rate: %w", err)
+	}
+	if *ifaceScoped {
+		cfg.IfaceResolver = (&nftctrl.RouteIfaceResolver{MaxAge: routeDumpMaxAge}).Resolve
+	}
+	return cfg, nil
+}
+
 func main() {
+	klog.InitFlags(nil)
 	flag.Parse()
+	if *configFile != "" {
+		settings, err := readConfigFile(*configFile)
+		if err != nil {
+			klog.Fatalf("Error reading config file: %s", err.Error())
+		}
+		if _, _, err := applySettings(settings, false); err != nil {
+			klog.Fatalf("Error applying config file: %s", err.Error())
+		}
+	}
 
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
 
@@ -149,41 +734,562 @@ func main() {
 
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(klog.Infof)
-	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	if *nftScriptOnly && *nftScript == "" {
+		klog.Fatal("-nft-script-only requires -nft-script")
+	}
+	if *flushConntrackOnExit && *nodeName == "" {
+		klog.Fatal("-flush-conntrack-on-exit requires -node-name")
+	}
+	// Offline modes build the ruleset in memory only and don't record events
+	offline := *verify || *nftScriptOnly
+	if !offline {
+		eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	}
 
-	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "npc"})
-	nft, err := nftctrl.New(recorder, uint32(*podIfaceGroup))
+	var nftConn *nfds.Conn
+	if offline {
+		// Build the expected ruleset in memory only
+		nftConn = nfds.WrapConn(nfds.NewMemory())
+	} else {
+		nftConn, err = nfds.Dial()
+		if err != nil {
+			klog.Fatalf("Error opening nftables netlink connection: %s", err.Error())
+		}
+		// Only handle IPv4 instead of failing if the kernel lacks IPv6
+		// support. This happens once before any scripts are recorded, as
+		// the probe is not part of the ruleset.
+		if err := nftConn.DetectIPv6(*table + "_probe"); err != nil {
+			klog.Fatalf("Error checking for nftables IPv6 support: %s", err.Error())
+		}
+	}
+	nftConn.ValidateSetKeys(*validateSetKeys)
+	if *nftScript != "" {
+		w := io.Writer(os.Stdout)
+		if *nftScript != "-" {
+			f, err := os.OpenFile(*nftScript, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				klog.Fatalf("Error opening nft script file: %s", err.Error())
+			}
+			defer f.Close()
+			w = f
+		}
+		nftConn.RecordScript(w)
+	}
+	// The verbosity is checked on every change, so tracing can be enabled by
+	// reloading the config file.
+	nftConn.Trace(func() bool { return klog.V(4).Enabled() }, func(line string) {
+		klog.Infof("nft: %s", line)
+	})
+
+	// Events are always deduplicated using the recorder so the interval can
+	// be changed at runtime, an interval of 0 disables it.
+	dedupRecorder := nftctrl.NewDedupRecorder(eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "npc"}), *eventDedupInterval)
+	var recorder record.EventRecorder = dedupRecorder
+	nftCfg, err := nftConfig()
+	if err != nil {
+		klog.Fatal(err)
+	}
+	if offline {
+		// The expected ruleset is built in an empty in-memory backend
+		nftCfg.AdoptTable = false
+	}
+	nft, err := nftctrl.New(recorder, nftConn, nftCfg)
 	if err != nil {
 		klog.Fatalf("Error creating nftables controller: %s", err.Error())
 	}
+	if prev := nft.PreviousSchemaVersion; prev != "" && prev != nftctrl.SchemaVersion {
+		klog.Infof("Replacing ruleset with schema version %s by version %s", prev, nftctrl.SchemaVersion)
+	}
+	if prev := nft.PreviousIdentity; prev != "" && prev != nftCfg.Identity {
+		klog.Warningf("Taking over table %q from controller instance %q", nftCfg.Table, prev)
+	}
 
 	c := Controller{
 		nft:           nft,
+		nftConn:       nftConn,
+		nftCfg:        nftCfg,
+		prevIdentity:  nft.PreviousIdentity,
+		dedupRecorder: dedupRecorder,
 		eventRecorder: recorder,
+		deadLetters:   make(map[workItem]error),
+		lastGood:      make(map[workItem]runtime.Object),
+		pending:       make(map[workItem]runtime.Object),
+		nsRejects:     nftctrl.NewNamespaceRejectTotals(),
+		ifaceRetry:    make(chan struct{}, 1),
 	}
+	if *fqdnPeers && !offline {
+		server := *fqdnServer
+		if server == "" {
+			server, err = fqdn.SystemServer()
+			if err != nil {
+				klog.Fatalf("Error determining DNS resolver for -fqdn-peers: %s", err.Error())
+			}
+		}
+		c.fqdns = &fqdn.Cache{
+			Resolver:      &fqdn.DNSResolver{Server: server},
+			MinTTL:        *fqdnMinTTL,
+			RetryInterval: fqdnRetryInterval,
+		}
+	}
+	metrics.Default.NewCounterFunc("npc_netlink_reconnects_total", "Number of times the nftables netlink connection died and was reopened.", func() float64 {
+		return float64(nftConn.Reconnects())
+	})
+	metrics.Default.NewCounterFunc("npc_invalid_set_elements_total", "Number of set elements skipped because their lengths do not match the types of their set. Only counted with -validate-set-keys.", func() float64 {
+		return float64(nftConn.InvalidElements())
+	})
+	metrics.Default.NewGaugeFunc("npc_dead_letters", "Number of objects kept at their last good version because the kernel rejected their changes.", func() float64 {
+		c.nftMu.Lock()
+		defer c.nftMu.Unlock()
+		return float64(len(c.deadLetters))
+	})
+	c.registerRejectMetrics()
+	c.registerNamespaceRejectMetrics()
+	c.registerAcceptMetrics()
+	detailedNamespaces := parseNamespaceFilter(*detailedMetricsNamespaces)
+	c.registerPolicyMetrics(detailedNamespaces)
+	c.registerIsolationMetrics(detailedNamespaces)
+	c.hasProcessed.registerMetrics()
+	c.registerFootprintMetrics()
 
-	c.informerFactory = informers.NewSharedInformerFactory(kubeClient, 0)
+	c.informerFactory = informers.NewSharedInformerFactory(kubeClient, *resyncPeriod)
 	c.q = workqueue.NewTyped[workItem]()
 
 	c.nsInformer = c.informerFactory.Core().V1().Namespaces()
-	nsHandler, _ := c.nsInformer.Informer().AddEventHandler(&updateEnqueuer{q: c.q, typ: "ns", hasProcessed: &c.hasProcessed})
+	nsHandler, _ := c.nsInformer.Informer().AddEventHandler(&updateEnqueuer{q: c.q, typ: "ns", hasProcessed: &c.hasProcessed, processUnchanged: *resyncPeriod > 0})
 	c.podInformer = c.informerFactory.Core().V1().Pods()
-	podHandler, _ := c.podInformer.Informer().AddEventHandler(&updateEnqueuer{q: c.q, typ: "pod", hasProcessed: &c.hasProcessed})
+	podHandler, _ := c.podInformer.Informer().AddEventHandler(&updateEnqueuer{q: c.q, typ: "pod", hasProcessed: &c.hasProcessed, processUnchanged: *resyncPeriod > 0})
 	c.nwpInformer = c.informerFactory.Networking().V1().NetworkPolicies()
-	nwpHandler, _ := c.nwpInformer.Informer().AddEventHandler(&updateEnqueuer{q: c.q, typ: "nwp", hasProcessed: &c.hasProcessed})
+	nwpHandler, _ := c.nwpInformer.Informer().AddEventHandler(&updateEnqueuer{q: c.q, typ: "nwp", hasProcessed: &c.hasProcessed, processUnchanged: *resyncPeriod > 0})
 	c.hasProcessed.UpstreamHasSynced = func() bool {
 		return nsHandler.HasSynced() && podHandler.HasSynced() && nwpHandler.HasSynced()
 	}
+	c.hasProcessed.markStarted()
 	c.informerFactory.Start(ctx.Done())
+	go c.hasProcessed.logProgress(ctx, 10*time.Second)
+	if *warnPodCount > 0 || *warnPolicyCount > 0 || *warnRuleCount > 0 {
+		go c.warnFootprint(ctx, time.Minute, []int{*warnPodCount, *warnPolicyCount, *warnRuleCount})
+	}
+
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr)
+	}
+
+	if *debugAddr != "" {
+		go c.serveDebug(*debugAddr)
+	}
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	if *adminAddr != "" {
+		go c.serveAdmin(*adminAddr)
+	}
 
 	klog.Info("Starting k8s-nft-npc worker")
 	go c.worker()
 
-	cache.WaitForNamedCacheSync("k8s-nft-npc", ctx.Done(), c.hasProcessed.HasSynced)
-	if err := c.nft.Flush(); err != nil { // Flush once after enabling
+	if *configFile != "" {
+		go c.reloadOnSignal(ctx)
+	}
+
+	if *namespaceRejectInterval > 0 {
+		go c.updateNamespaceRejects(ctx, *namespaceRejectInterval)
+	}
+
+	if c.fqdns != nil {
+		go c.resolveFQDNs(ctx)
+	}
+
+	go c.retryIfaces(ctx)
+
+	if cache.WaitForNamedCacheSync("k8s-nft-npc", ctx.Done(), c.hasProcessed.HasSynced) {
+		c.hasProcessed.markSynced()
+	}
+	if *verify {
+		c.q.ShutDown()
+		os.Exit(runVerify(c.nft))
+	}
+	if *nftScriptOnly {
+		c.q.ShutDown()
+		c.nftMu.Lock()
+		if err := c.flush(); err != nil {
+			klog.Fatalf("Error writing nft script: %s", err.Error())
+		}
+		c.nftMu.Unlock()
+		klog.Flush()
+		os.Exit(0)
+	}
+	c.nftMu.Lock()
+	if err := c.flush(); err != nil { // Flush once after enabling
 		klog.Errorf("Initial flush failed: %v", err)
 	}
+	c.auditOrphans()
+	c.reconcileSets()
+	c.nftMu.Unlock()
+	if *resyncPeriod > 0 {
+		go c.reconcileSetsPeriodically(ctx, *resyncPeriod)
+	}
 	<-ctx.Done()
 	klog.Warning("Received signal, shutting down")
 	c.q.ShutDown()
+	if *flushConntrackOnExit {
+		c.flushConntrack()
+	}
+}
+
+// flushConntrack deletes the conntrack entries of the IPs of the pods on this
+// node. The ruleset stays in place on shutdown, but connections accepted as
+// established would otherwise bypass the policies of the next instance.
+// Entries of pods on other nodes are left alone, as their traffic is not
+// policed by this instance.
+func (c *Controller) flushConntrack() {
+	c.nftMu.Lock()
+	ips := c.localPodIPs()
+	c.nftMu.Unlock()
+	deleted, err := conntrack.FlushAddrs(ips)
+	if err != nil {
+		klog.Errorf("Failed to flush conntrack entries of pods: %v", err)
+	}
+	klog.Infof("Deleted %d conntrack entries of %d pod IPs", deleted, len(ips))
+}
+
+// localPodIPs returns the IPs of the pods scheduled to this node which are
+// known to the ruleset, excluding host-network pods. nftMu needs to be held.
+func (c *Controller) localPodIPs() []netip.Addr {
+	known := c.nft.PodIPs()
+	pods, err := c.podInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list pods: %v", err)
+		return nil
+	}
+	var ips []netip.Addr
+	for _, pod := range pods {
+		if pod.Spec.NodeName != *nodeName || pod.Spec.HostNetwork {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			ip, err := netip.ParseAddr(podIP.IP)
+			if err != nil {
+				continue
+			}
+			if _, ok := slices.BinarySearchFunc(known, ip, netip.Addr.Compare); ok {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// auditOrphans logs objects left behind in the table and deletes them if
+// enabled. nftMu needs to be held.
+func (c *Controller) auditOrphans() {
+	orphans, err := c.nft.Orphans()
+	if err != nil {
+		klog.Errorf("Failed to list orphaned objects: %v", err)
+		return
+	}
+	for _, o := range orphans {
+		klog.Warningf("Orphaned object not part of the ruleset: %s", o)
+	}
+	if len(orphans) == 0 || !*gcOrphans {
+		return
+	}
+	// The identity in the table is already overwritten by the initial
+	// flush, so the one read on startup is checked.
+	if c.nftCfg.Identity != "" && c.prevIdentity != "" && c.prevIdentity != c.nftCfg.Identity {
+		klog.Warningf("Not deleting orphaned objects, table was managed by controller instance %q", c.prevIdentity)
+		return
+	}
+	if err := c.nft.DelOrphans(); err != nil {
+		klog.Errorf("Failed to delete orphaned objects: %v", err)
+		return
+	}
+	if err := c.flush(); err != nil {
+		klog.Errorf("Failed to delete orphaned objects: %v", err)
+		return
+	}
+	klog.Infof("Deleted %d orphaned objects", len(orphans))
+}
+
+// reconcileSets repairs drift of the elements of the sets maintained by the
+// controller. Pending changes are flushed first, as the current elements are
+// read from the kernel. nftMu needs to be held.
+func (c *Controller) reconcileSets() {
+	if err := c.flush(); err != nil {
+		klog.Errorf("Failed to flush before reconciling sets: %v", err)
+		return
+	}
+	res, err := c.nft.ReconcileSets()
+	if err != nil {
+		klog.Errorf("Failed to reconcile set elements: %v", err)
+	}
+	if !res.Changed() {
+		return
+	}
+	klog.Warningf("Set elements drifted from the expected state, adding %d and deleting %d", res.ElementsAdded, res.ElementsDeleted)
+	if err := c.flush(); err != nil {
+		klog.Errorf("Failed to flush reconciled set elements: %v", err)
+	}
+}
+
+// reconcileSetsPeriodically calls reconcileSets every interval until ctx is
+// done.
+func (c *Controller) reconcileSetsPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		c.nftMu.Lock()
+		c.reconcileSets()
+		c.nftMu.Unlock()
+	}
+}
+
+// fqdnRetryInterval is the time after which resolving the name of an FQDN
+// peer is retried if it failed.
+const fqdnRetryInterval = 10 * time.Second
+
+// resolveFQDNs keeps the addresses of the FQDN peers of rules up to date
+// until ctx is done. Names are resolved without holding nftMu, only new and
+// expired ones are resolved on every tick.
+func (c *Controller) resolveFQDNs(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		c.nftMu.Lock()
+		names := c.nft.FQDNs()
+		c.nftMu.Unlock()
+		c.fqdns.Update(ctx, names)
+		c.nftMu.Lock()
+		// Before the initial sync, the addresses are flushed with it
+		if c.applyFQDNAddrs(c.nft) && c.hasProcessed.HasSynced() {
+			if err := c.flush(); err != nil {
+				klog.Errorf("Failed to flush addresses of FQDN peers: %v", err)
+			}
+		}
+		c.nftMu.Unlock()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applyFQDNAddrs sets the cached addresses of FQDN peers in nft. It returns
+// true if the ruleset was changed.
+func (c *Controller) applyFQDNAddrs(nft *nftctrl.Controller) bool {
+	if c.fqdns == nil {
+		return false
+	}
+	changed := false
+	for name, addrs := range c.fqdns.Addrs() {
+		changed = nft.SetFQDNAddrs(name, addrs) || changed
+	}
+	return changed
+}
+
+// routeDumpMaxAge is the time a dump of the routing table is reused for to
+// resolve the interfaces of pod IPs with -interface-scoped.
+const routeDumpMaxAge = 5 * time.Second
+
+// ifaceRetryInterval is the interval at which pods with IPs whose interface
+// could not be resolved are processed again.
+const ifaceRetryInterval = 10 * time.Second
+
+// wakeIfaceRetry makes retryIfaces retry the pods with IPs whose interface
+// could not be resolved if it is not already doing so.
+func (c *Controller) wakeIfaceRetry() {
+	select {
+	case c.ifaceRetry <- struct{}{}:
+	default:
+	}
+}
+
+// retryIfaces requeues the pods with IPs whose interface could not be
+// resolved until ctx is done, as they are not policed until then. It is
+// idle while there are no such pods.
+func (c *Controller) retryIfaces(ctx context.Context) {
+	for {
+		select {
+		case <-c.ifaceRetry:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			select {
+			case <-time.After(ifaceRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+			c.nftMu.Lock()
+			pods := c.nft.UnresolvedIfacePods()
+			c.nftMu.Unlock()
+			if len(pods) == 0 {
+				break
+			}
+			for _, name := range pods {
+				c.q.Add(workItem{typ: "pod", name: name})
+			}
+		}
+	}
+}
+
+// reloadOnSignal reloads the config file whenever SIGHUP is received until
+// ctx is done.
+func (c *Controller) reloadOnSignal(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			klog.Info("Received SIGHUP, reloading config file")
+			if err := c.reload(); err != nil {
+				klog.Errorf("Failed to reload config file: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// servePprof serves the pprof endpoints on their own mux so they are never
+// exposed together with other endpoints.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	klog.Infof("Serving pprof on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("pprof server failed: %v", err)
+	}
+}
+
+// serveMetrics serves the metrics endpoint.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	klog.Infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("Metrics server failed: %v", err)
+	}
+}
+
+// serveDebug serves debugging endpoints exposing the controller state.
+func (c *Controller) serveDebug(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graph", c.handleGraph)
+	klog.Infof("Serving debug endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("Debug server failed: %v", err)
+	}
+}
+
+// serveAdmin serves administrative endpoints changing the controller state.
+// They are kept apart from the read-only debugging endpoints.
+func (c *Controller) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reconcile", c.handleReconcile)
+	klog.Infof("Serving admin endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("Admin server failed: %v", err)
+	}
+}
+
+// handleReconcile recreates the objects in the ruleset of the object given
+// by the kind (pod, nwp or ns), namespace and name parameters from its
+// version in the informer cache. They are deleted and added again in the same
+// flush, as syncing an unchanged object does not touch the ruleset.
+func (c *Controller) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	item := workItem{typ: query.Get("kind"), name: cache.ObjectName{Namespace: query.Get("namespace"), Name: query.Get("name")}}
+	switch item.typ {
+	case "pod", "nwp":
+		if item.name.Namespace == "" {
+			http.Error(w, "namespace is required", http.StatusBadRequest)
+			return
+		}
+	case "ns":
+		if item.name.Namespace != "" {
+			http.Error(w, "namespaces are not namespaced, use name", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown kind %q, expected pod, nwp or ns", item.typ), http.StatusBadRequest)
+		return
+	}
+	if item.name.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	klog.Infof("Reconciling %s %v on request", item.typ, item.name)
+	c.nftMu.Lock()
+	c.forget(item)
+	c.sync(item)
+	if c.hasProcessed.HasSynced() {
+		c.flushItem(item)
+	}
+	c.nftMu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleGraph returns the connectivity graph between pods as JSON. Pods are
+// selected by one or more namespace parameters and an optional label
+// selector parameter.
+func (c *Controller) handleGraph(w http.ResponseWriter, r *http.Request) {
+	filter := nftctrl.GraphFilter{Namespaces: r.URL.Query()["namespace"]}
+	if sel := r.URL.Query().Get("selector"); sel != "" {
+		var err error
+		filter.Selector, err = labels.Parse(sel)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid selector: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	// Only the snapshot is taken under the lock, computing the graph from it
+	// takes time quadratic in the number of pods.
+	c.nftMu.Lock()
+	s, err := c.nft.SnapshotGraph(filter)
+	c.nftMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Graph()); err != nil {
+		klog.Warningf("Failed to write graph: %v", err)
+	}
+}
+
+// runVerify compares the expected ruleset with the one in the kernel, prints
+// all differences and returns the process exit code.
+func runVerify(nft *nftctrl.Controller) int {
+	kernelConn, err := nfds.Dial()
+	if err != nil {
+		klog.Fatalf("Error opening nftables netlink connection: %s", err.Error())
+	}
+	diffs, err := nft.Verify(kernelConn)
+	if err != nil {
+		klog.Fatalf("Error verifying ruleset: %s", err.Error())
+	}
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		klog.Errorf("Kernel ruleset has drifted from expected state (%d differences)", len(diffs))
+		klog.Flush()
+		return 1
+	}
+	klog.Info("Kernel ruleset is consistent with expected state")
+	klog.Flush()
+	return 0
 }
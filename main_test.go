@@ -0,0 +1,265 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+	v1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nftctrl"
+)
+
+// flakyBackend is a Memory failing the given number of flushes with err.
+type flakyBackend struct {
+	*nfds.Memory
+	failures int
+	err      error
+}
+
+func (b *flakyBackend) Flush() error {
+	if err := b.Memory.Flush(); err != nil || b.failures == 0 {
+		return err
+	}
+	b.failures--
+	return b.err
+}
+
+// newTestController returns a Controller whose informers are never started.
+// Objects are added to their caches using set.
+func newTestController(t *testing.T) (*Controller, *flakyBackend) {
+	t.Helper()
+	b := &flakyBackend{Memory: nfds.NewMemory()}
+	conn := nfds.WrapConn(b)
+	rec := record.NewFakeRecorder(1000)
+	nft, err := nftctrl.New(rec, conn, nftctrl.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := informers.NewSharedInformerFactory(nil, 0)
+	c := &Controller{
+		nft:           nft,
+		nftConn:       conn,
+		eventRecorder: rec,
+		podInformer:   factory.Core().V1().Pods(),
+		nsInformer:    factory.Core().V1().Namespaces(),
+		nwpInformer:   factory.Networking().V1().NetworkPolicies(),
+		q:             workqueue.NewTyped[workItem](),
+		deadLetters:   make(map[workItem]error),
+		lastGood:      make(map[workItem]runtime.Object),
+		pending:       make(map[workItem]runtime.Object),
+	}
+	t.Cleanup(c.q.ShutDown)
+	c.hasProcessed.UpstreamHasSynced = func() bool { return true }
+	return c, b
+}
+
+// set adds or updates obj in the informer cache and processes it.
+func (c *Controller) set(t *testing.T, obj runtime.Object) workItem {
+	t.Helper()
+	var informer cache.SharedIndexInformer
+	var i workItem
+	switch o := obj.(type) {
+	case *v1.Pod:
+		informer, i = c.podInformer.Informer(), workItem{typ: "pod", name: cache.MetaObjectToName(o)}
+	case *v1.Namespace:
+		informer, i = c.nsInformer.Informer(), workItem{typ: "ns", name: cache.MetaObjectToName(o)}
+	case *nwkv1.NetworkPolicy:
+		informer, i = c.nwpInformer.Informer(), workItem{typ: "nwp", name: cache.MetaObjectToName(o)}
+	}
+	if err := informer.GetIndexer().Update(obj); err != nil {
+		t.Fatal(err)
+	}
+	c.process(i)
+	return i
+}
+
+func testObjects() (*v1.Namespace, *v1.Pod, *nwkv1.NetworkPolicy) {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: types.UID("uid-web")},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}},
+	}
+	nwp := &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deny", UID: types.UID("uid-deny"), ResourceVersion: "1"},
+	}
+	return ns, pod, nwp
+}
+
+func (c *Controller) policyRules(t *testing.T) int {
+	t.Helper()
+	stats := c.nft.PolicyStats()
+	if len(stats) != 1 {
+		t.Fatalf("expected a single policy, got %v", stats)
+	}
+	return stats[0].Rules
+}
+
+func (c *Controller) ingressIsolated(t *testing.T) bool {
+	t.Helper()
+	iso := c.nft.PodIsolation()
+	if len(iso) != 1 {
+		t.Fatalf("expected a single pod, got %v", iso)
+	}
+	return iso[0].Ingress
+}
+
+func TestDeadLetterKeepsLastGoodVersion(t *testing.T) {
+	c, b := newTestController(t)
+	ns, pod, nwp := testObjects()
+	c.set(t, ns)
+	c.set(t, pod)
+	c.set(t, nwp)
+	if !c.ingressIsolated(t) || len(c.deadLetters) != 0 {
+		t.Fatalf("expected pod to be isolated without dead letters, got %v", c.deadLetters)
+	}
+
+	updated := nwp.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{}}
+	b.failures, b.err = 1, unix.EINVAL
+	i := c.set(t, updated)
+	if _, ok := c.deadLetters[i]; !ok {
+		t.Fatalf("expected policy to be a dead letter, got %v", c.deadLetters)
+	}
+	if n := c.policyRules(t); n != 0 || !c.ingressIsolated(t) {
+		t.Errorf("expected last good version without rules to keep the pod isolated, got %d rules", n)
+	}
+	if c.stale {
+		t.Error("expected ruleset to be rebuilt")
+	}
+
+	// Processing it again once it can be flushed clears the dead letter
+	c.set(t, updated)
+	if len(c.deadLetters) != 0 || c.policyRules(t) != 1 {
+		t.Errorf("expected updated policy to be applied, got dead letters %v", c.deadLetters)
+	}
+}
+
+func TestDeadLetterWithoutGoodVersionIsolates(t *testing.T) {
+	c, b := newTestController(t)
+	ns, pod, nwp := testObjects()
+	c.set(t, ns)
+	c.set(t, pod)
+	nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{}}
+	b.failures, b.err = 1, unix.EINVAL
+	i := c.set(t, nwp)
+	if _, ok := c.deadLetters[i]; !ok {
+		t.Fatalf("expected policy to be a dead letter, got %v", c.deadLetters)
+	}
+	if n := c.policyRules(t); n != 0 || !c.ingressIsolated(t) {
+		t.Errorf("expected degraded policy without rules isolating the pod, got %d rules", n)
+	}
+}
+
+func TestTransientFlushFailureNotDeadLettered(t *testing.T) {
+	c, b := newTestController(t)
+	ns, pod, nwp := testObjects()
+	c.set(t, ns)
+	c.set(t, pod)
+	// Fails the flush as well as all rebuilds
+	b.failures, b.err = 100, unix.EBUSY
+	c.set(t, nwp)
+	if len(c.deadLetters) != 0 {
+		t.Errorf("expected transient failure not to cause a dead letter, got %v", c.deadLetters)
+	}
+	if !c.stale {
+		t.Fatal("expected ruleset to be stale after failed rebuilds")
+	}
+
+	// The next flush, for example when retrying the object, rebuilds it
+	b.failures = 0
+	c.set(t, nwp)
+	if c.stale || !c.ingressIsolated(t) {
+		t.Errorf("expected ruleset to be rebuilt with the policy")
+	}
+	if _, ok := c.lastGood[workItem{typ: "nwp", name: cache.MetaObjectToName(nwp)}]; !ok {
+		t.Error("expected policy to be recorded as good after the rebuild")
+	}
+}
+
+func TestHandleReconcileRecreates(t *testing.T) {
+	c, b := newTestController(t)
+	ns, pod, nwp := testObjects()
+	nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{}}
+	c.set(t, ns)
+	c.set(t, pod)
+	c.set(t, nwp)
+	policyChainRules := func() int {
+		t.Helper()
+		chains, err := b.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, ch := range chains {
+			if strings.HasPrefix(ch.Name, "pol_") {
+				rules, err := b.GetRules(ch.Table, ch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				n += len(rules)
+			}
+		}
+		return n
+	}
+	want := policyChainRules()
+	if want == 0 {
+		t.Fatal("expected policy rules")
+	}
+
+	// Simulate the kernel ruleset drifting
+	chains, _ := b.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	for _, ch := range chains {
+		if strings.HasPrefix(ch.Name, "pol_") {
+			b.FlushChain(ch)
+		}
+	}
+	if err := b.Memory.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	c.handleReconcile(w, httptest.NewRequest("POST", "/reconcile?kind=nwp&namespace=default&name=deny", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", w.Code, w.Body)
+	}
+	if got := policyChainRules(); got != want {
+		t.Errorf("expected %d policy rules to be recreated, got %d", want, got)
+	}
+}
+
+func TestLocalPodIPs(t *testing.T) {
+	c, _ := newTestController(t)
+	prev := *nodeName
+	*nodeName = "node-a"
+	t.Cleanup(func() { *nodeName = prev })
+	ns, local, _ := testObjects()
+	local.Spec.NodeName = "node-a"
+	remote := local.DeepCopy()
+	remote.Name, remote.UID, remote.Spec.NodeName = "remote", "uid-remote", "node-b"
+	remote.Status.PodIPs = []v1.PodIP{{IP: "10.0.0.2"}}
+	hostNetwork := local.DeepCopy()
+	hostNetwork.Name, hostNetwork.UID, hostNetwork.Spec.HostNetwork = "host", "uid-host", true
+	hostNetwork.Status.PodIPs = []v1.PodIP{{IP: "192.0.2.1"}}
+	for _, obj := range []runtime.Object{ns, local, remote, hostNetwork} {
+		c.set(t, obj)
+	}
+	if ips := c.localPodIPs(); !slices.Equal(ips, []netip.Addr{netip.MustParseAddr("10.0.0.1")}) {
+		t.Errorf("expected only the IP of the local pod, got %v", ips)
+	}
+}
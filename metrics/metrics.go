@@ -0,0 +1,171 @@
+// Package metrics implements a minimal set of metric types exposed in the
+// Prometheus text format, avoiding a dependency on the Prometheus client.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Sample is a value of a metric with labels.
+type Sample struct {
+	// LabelValues are the values of the labels in the order of the label
+	// names of the metric.
+	LabelValues []string
+	Value       float64
+}
+
+type metric struct {
+	name, help, typ string
+	labelNames      []string
+	collect         func() []Sample
+}
+
+// Registry is a set of metrics which can be served over HTTP.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// Default is the registry used by the controller.
+var Default = &Registry{}
+
+func (r *Registry) register(name, help, typ string, labelNames []string, collect func() []Sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		if m.name == name {
+			panic(fmt.Sprintf("metric %q registered twice", name))
+		}
+	}
+	r.metrics = append(r.metrics, &metric{name: name, help: help, typ: typ, labelNames: labelNames, collect: collect})
+}
+
+// NewCounter registers and returns a new counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", nil, func() []Sample {
+		return []Sample{{Value: float64(c.Value())}}
+	})
+	return c
+}
+
+// NewGauge registers and returns a new gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, help, "gauge", nil, func() []Sample {
+		return []Sample{{Value: g.Value()}}
+	})
+	return g
+}
+
+// NewCounterFunc registers a counter whose value is obtained by calling f
+// on every scrape. f needs to be safe for concurrent use.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(name, help, "counter", nil, func() []Sample {
+		return []Sample{{Value: f()}}
+	})
+}
+
+// NewGaugeFunc registers a gauge whose value is obtained by calling f on
+// every scrape. f needs to be safe for concurrent use.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, help, "gauge", nil, func() []Sample {
+		return []Sample{{Value: f()}}
+	})
+}
+
+// NewCounterVecFunc registers a counter with labels whose samples are
+// obtained by calling f on every scrape. f needs to be safe for concurrent
+// use.
+func (r *Registry) NewCounterVecFunc(name, help string, labelNames []string, f func() []Sample) {
+	r.register(name, help, "counter", labelNames, f)
+}
+
+// NewGaugeVecFunc registers a gauge with labels whose samples are obtained
+// by calling f on every scrape. f needs to be safe for concurrent use.
+func (r *Registry) NewGaugeVecFunc(name, help string, labelNames []string, f func() []Sample) {
+	r.register(name, help, "gauge", labelNames, f)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.typ)
+		for _, s := range m.collect() {
+			b.WriteString(m.name)
+			if len(m.labelNames) > 0 {
+				b.WriteByte('{')
+				for i, l := range m.labelNames {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", l, labelEscaper.Replace(s.LabelValues[i]))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
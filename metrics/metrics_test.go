@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	var r Registry
+	c := r.NewCounter("test_total", "A counter.")
+	g := r.NewGauge("test_gauge", "A gauge\nwith two lines.")
+	r.NewCounterFunc("test_func_total", "A counter func.", func() float64 { return 42 })
+	r.NewGaugeFunc("test_gauge_func", "A gauge func.", func() float64 { return -1 })
+	r.NewCounterVecFunc("test_vec_total", "A counter vec.", []string{"a", "b"}, func() []Sample {
+		return []Sample{{LabelValues: []string{"x", `q"\`}, Value: 1}, {LabelValues: []string{"y", ""}, Value: 2}}
+	})
+	r.NewGaugeVecFunc("test_gauge_vec", "A gauge vec.", []string{"a"}, func() []Sample {
+		return []Sample{{LabelValues: []string{"z"}, Value: 7}}
+	})
+	c.Add(3)
+	g.Set(1.5)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_func_total A counter func.
+# TYPE test_func_total counter
+test_func_total 42
+# HELP test_gauge A gauge\nwith two lines.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_gauge_func A gauge func.
+# TYPE test_gauge_func gauge
+test_gauge_func -1
+# HELP test_gauge_vec A gauge vec.
+# TYPE test_gauge_vec gauge
+test_gauge_vec{a="z"} 7
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3
+# HELP test_vec_total A counter vec.
+# TYPE test_vec_total counter
+test_vec_total{a="x",b="q\"\\"} 1
+test_vec_total{a="y",b=""} 2
+`
+	if b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
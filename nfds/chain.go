@@ -1,6 +1,9 @@
 package nfds
 
-import "github.com/google/nftables"
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
 
 type Chain struct {
 	Name     string
@@ -16,6 +19,7 @@ type Chain struct {
 }
 
 func (cc *Conn) AddChain(c *Chain) *Chain {
+	cc.stats.ChainsAdded++
 	c.v4 = cc.c.AddChain(&nftables.Chain{
 		Name:     c.Name,
 		Table:    c.Table.v4,
@@ -25,6 +29,9 @@ func (cc *Conn) AddChain(c *Chain) *Chain {
 		Policy:   c.Policy,
 		Device:   c.Device,
 	})
+	if c.Table.v6 == nil {
+		return c
+	}
 	c.v6 = cc.c.AddChain(&nftables.Chain{
 		Name:     c.Name,
 		Table:    c.Table.v6,
@@ -38,6 +45,33 @@ func (cc *Conn) AddChain(c *Chain) *Chain {
 }
 
 func (cc *Conn) DelChain(c *Chain) {
+	cc.stats.ChainsDeleted++
 	cc.c.DelChain(c.v4)
-	cc.c.DelChain(c.v6)
+	if c.v6 != nil {
+		cc.c.DelChain(c.v6)
+	}
+}
+
+// ChainCounter returns the sum of all counters in the rules of c in both
+// families.
+func (cc *Conn) ChainCounter(c *Chain) (expr.Counter, error) {
+	var sum expr.Counter
+	for _, fc := range []*nftables.Chain{c.v4, c.v6} {
+		if fc == nil {
+			continue
+		}
+		rules, err := cc.c.GetRules(fc.Table, fc)
+		if err != nil {
+			return expr.Counter{}, err
+		}
+		for _, r := range rules {
+			for _, e := range r.Exprs {
+				if ctr, ok := e.(*expr.Counter); ok {
+					sum.Packets += ctr.Packets
+					sum.Bytes += ctr.Bytes
+				}
+			}
+		}
+	}
+	return sum, nil
 }
@@ -1,17 +1,154 @@
 package nfds
 
-import "github.com/google/nftables"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Backend is the subset of *nftables.Conn used by Conn. It is implemented by
+// the real netlink connection as well as by Memory.
+type Backend interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	FlushTable(t *nftables.Table)
+	ListTables() ([]*nftables.Table, error)
+
+	AddChain(c *nftables.Chain) *nftables.Chain
+	DelChain(c *nftables.Chain)
+	FlushChain(c *nftables.Chain)
+	ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error)
+
+	AddRule(r *nftables.Rule) *nftables.Rule
+	InsertRule(r *nftables.Rule) *nftables.Rule
+	DelRule(r *nftables.Rule) error
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	DelSet(s *nftables.Set)
+	SetAddElements(s *nftables.Set, vals []nftables.SetElement) error
+	SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error
+	GetSets(t *nftables.Table) ([]*nftables.Set, error)
+	GetSetElements(s *nftables.Set) ([]nftables.SetElement, error)
+
+	AddObj(o nftables.Obj) nftables.Obj
+	DeleteObject(o nftables.Obj)
+	GetObject(o nftables.Obj) (nftables.Obj, error)
+	GetNamedObjects(t *nftables.Table) ([]nftables.Obj, error)
+
+	Flush() error
+	CloseLasting() error
+}
 
 type Conn struct {
-	c *nftables.Conn
+	c Backend
+	// dial reopens the backend after its connection died. If nil, dead
+	// connections are not detected.
+	dial       func() (Backend, error)
+	reconnects atomic.Uint64
+	// validateSetKeys enables checking the lengths of set elements, see
+	// ValidateSetKeys. invalidElements counts the elements skipped by it.
+	validateSetKeys bool
+	invalidElements atomic.Uint64
+	// noIPv6 is set if the IPv6 family is not supported, see DetectIPv6.
+	noIPv6 bool
+	// stats counts the changes queued through the Conn, see Stats.
+	stats OpStats
+	// traceEnabled is set by Trace and traceContext by SetTraceContext.
+	traceEnabled func() bool
+	traceContext string
 }
 
-func WrapConn(c *nftables.Conn) *Conn {
+func WrapConn(c Backend) *Conn {
 	return &Conn{c: c}
 }
 
+// WrapConnRedialable is like WrapConn, but reopens the backend using dial if
+// its connection dies.
+func WrapConnRedialable(c Backend, dial func() (Backend, error)) *Conn {
+	return &Conn{c: c, dial: dial}
+}
+
+// ErrConnLost is wrapped by errors returned from Flush if the connection
+// died. All operations of the batch are lost and the ruleset in the kernel is
+// in an unknown state, so it needs to be rebuilt from scratch.
+var ErrConnLost = errors.New("nftables connection lost")
+
+// Dial opens a lasting netlink connection to nftables with buffers large
+// enough for big batches. The connection is reopened if it dies.
+func Dial() (*Conn, error) {
+	b, err := dialBackend()
+	if err != nil {
+		return nil, err
+	}
+	return WrapConnRedialable(b, dialBackend), nil
+}
+
+func dialBackend() (Backend, error) {
+	nftc, err := nftables.New(nftables.AsLasting(), nftables.WithSockOptions(func(conn *netlink.Conn) error {
+		if err := conn.SetWriteBuffer(1 << 22); err != nil {
+			return err
+		}
+		if err := conn.SetReadBuffer(1 << 22); err != nil {
+			return err
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return nftc, nil
+}
+
+// DelTableIfExists deletes all families of the table with the given name
+// which are currently present.
+func (c *Conn) DelTableIfExists(name string) error {
+	tables, err := c.c.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if t.Name == name && (t.Family == nftables.TableFamilyIPv4 || t.Family == nftables.TableFamilyIPv6) {
+			c.c.DelTable(&nftables.Table{Family: t.Family, Name: name})
+		}
+	}
+	return nil
+}
+
+// connDead returns true if err indicates that the netlink socket is closed
+// or messages on it were lost.
+func connDead(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, unix.EBADF) ||
+		errors.Is(err, unix.ENOTCONN) || errors.Is(err, unix.ENOBUFS)
+}
+
+// Flush sends all buffered operations to the backend. If the connection died,
+// it is reopened and the returned error wraps ErrConnLost. Errors are
+// classified as ErrTransient or ErrInvalid where possible.
 func (c *Conn) Flush() error {
-	return c.c.Flush()
+	err := classify(c.c.Flush())
+	if err == nil || c.dial == nil || !connDead(err) {
+		return err
+	}
+	c.c.CloseLasting()
+	b, dialErr := c.dial()
+	if dialErr != nil {
+		return fmt.Errorf("%w: %w, reopening failed: %w", ErrConnLost, err, dialErr)
+	}
+	c.c = b
+	c.reconnects.Add(1)
+	return fmt.Errorf("%w: %w", ErrConnLost, err)
+}
+
+// Reconnects returns the number of times the connection has been reopened.
+// It is safe for concurrent use.
+func (c *Conn) Reconnects() uint64 {
+	return c.reconnects.Load()
 }
 
 func (c *Conn) CloseLasting() error {
@@ -0,0 +1,43 @@
+package nfds
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// deadBackend is a Memory whose connection has died.
+type deadBackend struct {
+	*Memory
+}
+
+func (deadBackend) Flush() error {
+	return net.ErrClosed
+}
+
+func TestFlushReconnects(t *testing.T) {
+	fresh := NewMemory()
+	cc := WrapConnRedialable(deadBackend{NewMemory()}, func() (Backend, error) {
+		return fresh, nil
+	})
+	cc.AddTable(&Table{Name: "test"})
+	if err := cc.Flush(); !errors.Is(err, ErrConnLost) {
+		t.Fatalf("expected ErrConnLost, got %v", err)
+	}
+	if n := cc.Reconnects(); n != 1 {
+		t.Errorf("expected one reconnect, got %d", n)
+	}
+	cc.AddTable(&Table{Name: "test"})
+	if err := cc.Flush(); err != nil {
+		t.Fatalf("expected flush on reopened connection to succeed, got %v", err)
+	}
+	if tables, _ := fresh.ListTables(); len(tables) != 2 {
+		t.Errorf("expected both table families on the reopened connection, got %v", tables)
+	}
+
+	// Without a dial function, dead connections are not detected
+	plain := WrapConn(deadBackend{NewMemory()})
+	if err := plain.Flush(); errors.Is(err, ErrConnLost) || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected plain error without redialing, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package nfds
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Counter is a named counter object in both families. Unlike anonymous
+// counters in rules, it keeps its value when the rules referencing it using
+// CounterRef are replaced.
+type Counter struct {
+	Name  string
+	Table *Table
+
+	v4 *nftables.NamedObj
+	v6 *nftables.NamedObj
+}
+
+func (cc *Conn) AddCounter(c *Counter) *Counter {
+	c.v4 = &nftables.NamedObj{Table: c.Table.v4, Name: c.Name, Type: nftables.ObjTypeCounter, Obj: &expr.Counter{}}
+	cc.c.AddObj(c.v4)
+	if c.Table.v6 != nil {
+		c.v6 = &nftables.NamedObj{Table: c.Table.v6, Name: c.Name, Type: nftables.ObjTypeCounter, Obj: &expr.Counter{}}
+		cc.c.AddObj(c.v6)
+	}
+	return c
+}
+
+func (cc *Conn) DelCounter(c *Counter) {
+	cc.c.DeleteObject(c.v4)
+	if c.v6 != nil {
+		cc.c.DeleteObject(c.v6)
+	}
+}
+
+// CounterValue returns the sum of the values of c in both families.
+func (cc *Conn) CounterValue(c *Counter) (expr.Counter, error) {
+	var sum expr.Counter
+	for _, o := range []*nftables.NamedObj{c.v4, c.v6} {
+		if o == nil {
+			continue
+		}
+		obj, err := cc.c.GetObject(o)
+		if err != nil {
+			return expr.Counter{}, err
+		}
+		no, ok := obj.(*nftables.NamedObj)
+		if !ok {
+			return expr.Counter{}, fmt.Errorf("counter %q: unexpected object type %T", c.Name, obj)
+		}
+		ctr, ok := no.Obj.(*expr.Counter)
+		if !ok {
+			return expr.Counter{}, fmt.Errorf("counter %q: unexpected object data %T", c.Name, no.Obj)
+		}
+		sum.Packets += ctr.Packets
+		sum.Bytes += ctr.Bytes
+	}
+	return sum, nil
+}
+
+// CounterRef returns an expression incrementing the named counter c.
+func CounterRef(c *Counter) *expr.Objref {
+	return &expr.Objref{Type: int(nftables.ObjTypeCounter), Name: c.Name}
+}
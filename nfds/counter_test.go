@@ -0,0 +1,57 @@
+package nfds
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestCounterLifecycle(t *testing.T) {
+	cc := WrapConn(NewMemory())
+	table := cc.AddTable(&Table{Name: "test"})
+	ctr := cc.AddCounter(&Counter{Table: table, Name: "own_cnt"})
+	ch := cc.AddChain(&Chain{Table: table, Name: "own_chain", Type: nftables.ChainTypeFilter})
+	cc.AddRule(&Rule{Table: table, Chain: ch, Exprs: []expr.Any{CounterRef(ctr), &expr.Verdict{Kind: expr.VerdictAccept}}})
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := cc.CounterValue(ctr); err != nil || val.Packets != 0 || val.Bytes != 0 {
+		t.Fatalf("expected empty counter, got %+v, %v", val, err)
+	}
+
+	cc.DelCounter(ctr)
+	if err := cc.Flush(); !errors.Is(err, syscall.EBUSY) {
+		t.Fatalf("expected EBUSY deleting referenced counter, got %v", err)
+	}
+
+	owned, err := cc.ListOwned(table, func(name string) bool { return strings.HasPrefix(name, "own_") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(owned, ", ") != "ip chain own_chain, ip counter own_cnt, ip6 chain own_chain, ip6 counter own_cnt" {
+		t.Errorf("unexpected owned objects %v", owned)
+	}
+	if err := cc.DelOwned(table, func(name string) bool { return strings.HasPrefix(name, "own_") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.CounterValue(ctr); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("expected ENOENT reading deleted counter, got %v", err)
+	}
+}
+
+func TestAddRuleUnknownCounter(t *testing.T) {
+	cc := WrapConn(NewMemory())
+	table := cc.AddTable(&Table{Name: "test"})
+	ch := cc.AddChain(&Chain{Table: table, Name: "chain", Type: nftables.ChainTypeFilter})
+	cc.AddRule(&Rule{Table: table, Chain: ch, Exprs: []expr.Any{CounterRef(&Counter{Name: "missing"})}})
+	if err := cc.Flush(); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("expected ENOENT referencing missing counter, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package nfds
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrTransient is wrapped by errors which are expected to go away when
+	// retrying the operation, for example because the kernel was busy or
+	// ran out of buffer space. This includes errors wrapping ErrConnLost.
+	ErrTransient = errors.New("transient nftables error")
+	// ErrInvalid is wrapped by errors the kernel returned because the
+	// operation itself is invalid. Retrying it unchanged will fail again.
+	ErrInvalid = errors.New("invalid nftables operation")
+)
+
+// classifiedError wraps an error together with its class, so both can be
+// matched using errors.Is.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// classify wraps err in ErrTransient or ErrInvalid based on the errno it
+// contains. Other errors are returned unchanged.
+func classify(err error) error {
+	if err == nil || errors.Is(err, ErrTransient) || errors.Is(err, ErrInvalid) {
+		return err
+	}
+	switch {
+	case errors.Is(err, unix.EBUSY), errors.Is(err, unix.EAGAIN), connDead(err):
+		return &classifiedError{class: ErrTransient, err: err}
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.EEXIST):
+		return &classifiedError{class: ErrInvalid, err: err}
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package nfds
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+func TestClassify(t *testing.T) {
+	plain := errors.New("something else")
+	cases := []struct {
+		err   error
+		class error
+	}{
+		{unix.EBUSY, ErrTransient},
+		{unix.ENOBUFS, ErrTransient},
+		{fmt.Errorf("conn.Receive: %w", unix.EBUSY), ErrTransient},
+		{unix.EINVAL, ErrInvalid},
+		{unix.EEXIST, ErrInvalid},
+		{fmt.Errorf("set %q: %w", "test", unix.EEXIST), ErrInvalid},
+		{unix.ENOENT, nil},
+		{plain, nil},
+	}
+	for _, c := range cases {
+		err := classify(c.err)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%v: expected the original error to be wrapped, got %v", c.err, err)
+		}
+		if err.Error() != c.err.Error() {
+			t.Errorf("%v: expected the message to be unchanged, got %q", c.err, err.Error())
+		}
+		for _, class := range []error{ErrTransient, ErrInvalid} {
+			if got := errors.Is(err, class); got != (class == c.class) {
+				t.Errorf("%v: errors.Is(%v) = %v", c.err, class, got)
+			}
+		}
+	}
+	if classify(nil) != nil {
+		t.Error("expected nil to stay nil")
+	}
+}
+
+// failingBackend is a Memory returning err from all operations classified
+// by Conn.
+type failingBackend struct {
+	*Memory
+	err error
+}
+
+func (b failingBackend) AddSet(*nftables.Set, []nftables.SetElement) error         { return b.err }
+func (b failingBackend) SetAddElements(*nftables.Set, []nftables.SetElement) error { return b.err }
+func (b failingBackend) Flush() error                                              { return b.err }
+
+func TestConnClassifiesErrors(t *testing.T) {
+	for _, c := range []struct {
+		err   error
+		class error
+	}{
+		{unix.EBUSY, ErrTransient},
+		{unix.EINVAL, ErrInvalid},
+	} {
+		cc := WrapConn(failingBackend{NewMemory(), c.err})
+		s := &Set{Table: &Table{Name: "test"}, Name: "test", KeyType: nftables.TypeMark}
+		s.Table.v4 = &nftables.Table{Name: "test", Family: nftables.TableFamilyIPv4}
+		s.Table.v6 = &nftables.Table{Name: "test", Family: nftables.TableFamilyIPv6}
+		if err := cc.AddSet(s, nil); !errors.Is(err, c.class) {
+			t.Errorf("AddSet: expected %v, got %v", c.class, err)
+		}
+		if err := cc.SetAddElements(s, nil); !errors.Is(err, c.class) {
+			t.Errorf("SetAddElements: expected %v, got %v", c.class, err)
+		}
+		if err := cc.Flush(); !errors.Is(err, c.class) {
+			t.Errorf("Flush: expected %v, got %v", c.class, err)
+		}
+	}
+}
@@ -0,0 +1,697 @@
+package nfds
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Memory is an in-memory Backend. Operations are applied immediately, errors
+// which the kernel would report are returned by the next Flush. It is used to
+// build the expected ruleset without touching the kernel and as a fake in
+// tests.
+type Memory struct {
+	mu         sync.Mutex
+	tables     map[memTableKey]*memTable
+	nextID     uint32
+	nextHandle uint64
+	err        error
+	// unsupported contains the families tables cannot be added in, see
+	// DisableFamily.
+	unsupported map[nftables.TableFamily]bool
+}
+
+type memTableKey struct {
+	family nftables.TableFamily
+	name   string
+}
+
+type memTable struct {
+	t      *nftables.Table
+	chains map[string]*memChain
+	sets   map[string]*memSet
+	objs   map[string]*memObj
+}
+
+type memChain struct {
+	c     *nftables.Chain
+	rules []*nftables.Rule
+	use   int
+}
+
+// memObj is a stateful object. Only counters are supported.
+type memObj struct {
+	o   *nftables.NamedObj
+	use int
+}
+
+type memSet struct {
+	s     *nftables.Set
+	elems map[string]nftables.SetElement
+	use   int
+}
+
+func NewMemory() *Memory {
+	return &Memory{tables: make(map[memTableKey]*memTable)}
+}
+
+func (m *Memory) setErr(err error) {
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *Memory) table(t *nftables.Table) *memTable {
+	if t == nil {
+		return nil
+	}
+	return m.tables[memTableKey{t.Family, t.Name}]
+}
+
+// DisableFamily makes adding tables of the given family fail like on kernels
+// without support for it.
+func (m *Memory) DisableFamily(family nftables.TableFamily) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unsupported == nil {
+		m.unsupported = make(map[nftables.TableFamily]bool)
+	}
+	m.unsupported[family] = true
+}
+
+func (m *Memory) AddTable(t *nftables.Table) *nftables.Table {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unsupported[t.Family] {
+		m.setErr(fmt.Errorf("table %q: %w", t.Name, syscall.EAFNOSUPPORT))
+		return t
+	}
+	if mt := m.table(t); mt != nil {
+		mt.t.Flags = t.Flags
+		return t
+	}
+	m.tables[memTableKey{t.Family, t.Name}] = &memTable{
+		t:      &nftables.Table{Name: t.Name, Family: t.Family, Flags: t.Flags},
+		chains: make(map[string]*memChain),
+		sets:   make(map[string]*memSet),
+		objs:   make(map[string]*memObj),
+	}
+	return t
+}
+
+// CreateTable adds t like AddTable, but fails the batch if it exists.
+func (m *Memory) CreateTable(t *nftables.Table) *nftables.Table {
+	m.mu.Lock()
+	exists := m.table(t) != nil
+	if exists {
+		m.setErr(fmt.Errorf("table %q: %w", t.Name, syscall.EEXIST))
+	}
+	m.mu.Unlock()
+	if exists {
+		return t
+	}
+	return m.AddTable(t)
+}
+
+func (m *Memory) DelTable(t *nftables.Table) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.table(t) == nil {
+		m.setErr(fmt.Errorf("table %q: %w", t.Name, syscall.ENOENT))
+		return
+	}
+	delete(m.tables, memTableKey{t.Family, t.Name})
+}
+
+func (m *Memory) FlushTable(t *nftables.Table) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(t)
+	if mt == nil {
+		m.setErr(fmt.Errorf("table %q: %w", t.Name, syscall.ENOENT))
+		return
+	}
+	for _, c := range mt.chains {
+		for _, r := range c.rules {
+			mt.unref(r.Exprs)
+		}
+		c.rules = nil
+	}
+}
+
+func (m *Memory) ListTables() ([]*nftables.Table, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*nftables.Table
+	for _, mt := range m.tables {
+		t := *mt.t
+		out = append(out, &t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Family != out[j].Family {
+			return out[i].Family < out[j].Family
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+func (m *Memory) AddChain(c *nftables.Chain) *nftables.Chain {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(c.Table)
+	if mt == nil {
+		m.setErr(fmt.Errorf("chain %q: table: %w", c.Name, syscall.ENOENT))
+		return c
+	}
+	stored := *c
+	stored.Table = mt.t
+	if mc, ok := mt.chains[c.Name]; ok {
+		mc.c = &stored
+		return c
+	}
+	mt.chains[c.Name] = &memChain{c: &stored}
+	return c
+}
+
+func (m *Memory) DelChain(c *nftables.Chain) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(c.Table)
+	if mt == nil || mt.chains[c.Name] == nil {
+		m.setErr(fmt.Errorf("chain %q: %w", c.Name, syscall.ENOENT))
+		return
+	}
+	mc := mt.chains[c.Name]
+	if mc.use > 0 {
+		m.setErr(fmt.Errorf("chain %q is still referenced: %w", c.Name, syscall.EBUSY))
+		return
+	}
+	for _, r := range mc.rules {
+		mt.unref(r.Exprs)
+	}
+	delete(mt.chains, c.Name)
+}
+
+func (m *Memory) FlushChain(c *nftables.Chain) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(c.Table)
+	if mt == nil || mt.chains[c.Name] == nil {
+		m.setErr(fmt.Errorf("chain %q: %w", c.Name, syscall.ENOENT))
+		return
+	}
+	mc := mt.chains[c.Name]
+	for _, r := range mc.rules {
+		mt.unref(r.Exprs)
+	}
+	mc.rules = nil
+}
+
+func (m *Memory) ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*nftables.Chain
+	for k, mt := range m.tables {
+		if k.family != family {
+			continue
+		}
+		for _, mc := range mt.chains {
+			c := *mc.c
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Table.Name != out[j].Table.Name {
+			return out[i].Table.Name < out[j].Table.Name
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// resolveSetName returns the name under which a set referenced by name and ID
+// is stored. Anonymous sets are stored under their ID as the name template is
+// only expanded by the kernel.
+func resolveSetName(name string, id uint32) string {
+	if strings.Contains(name, "%d") {
+		return fmt.Sprintf(name, id)
+	}
+	return name
+}
+
+// resolveExprs resolves family-dependent expressions like the kernel would
+// when the rule is read back.
+func resolveExprs(fam nftables.TableFamily, exprs []expr.Any) []expr.Any {
+	out := make([]expr.Any, 0, len(exprs))
+	for _, e := range exprs {
+		if d, ok := e.(*expr.Dynamic); ok {
+			e = d.Expr(uint8(fam))
+		}
+		if ctr, ok := e.(*expr.Counter); ok {
+			// Like in the kernel, every rule counts on its own, even if
+			// the families share their expressions.
+			copied := *ctr
+			e = &copied
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func (mt *memTable) ref(exprs []expr.Any) error {
+	for i, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Verdict:
+			if e.Kind != expr.VerdictJump && e.Kind != expr.VerdictGoto {
+				continue
+			}
+			mc, ok := mt.chains[e.Chain]
+			if !ok {
+				mt.unref(exprs[:i])
+				return fmt.Errorf("jump target %q: %w", e.Chain, syscall.ENOENT)
+			}
+			mc.use++
+		case *expr.Lookup:
+			ms, ok := mt.sets[resolveSetName(e.SetName, e.SetID)]
+			if !ok {
+				mt.unref(exprs[:i])
+				return fmt.Errorf("lookup set %q: %w", e.SetName, syscall.ENOENT)
+			}
+			if ms.s.Anonymous && ms.use > 0 {
+				// Anonymous sets can only be bound to a single rule
+				mt.unref(exprs[:i])
+				return fmt.Errorf("lookup set %q: anonymous set already bound: %w", e.SetName, syscall.EBUSY)
+			}
+			ms.use++
+		case *expr.Objref:
+			mo, ok := mt.objs[e.Name]
+			if !ok || int(mo.o.Type) != e.Type {
+				mt.unref(exprs[:i])
+				return fmt.Errorf("object %q: %w", e.Name, syscall.ENOENT)
+			}
+			mo.use++
+		}
+	}
+	return nil
+}
+
+func (mt *memTable) unref(exprs []expr.Any) {
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Verdict:
+			if mc, ok := mt.chains[e.Chain]; ok && (e.Kind == expr.VerdictJump || e.Kind == expr.VerdictGoto) {
+				mc.use--
+			}
+		case *expr.Lookup:
+			name := resolveSetName(e.SetName, e.SetID)
+			if ms, ok := mt.sets[name]; ok {
+				ms.use--
+				if ms.use == 0 && ms.s.Anonymous {
+					delete(mt.sets, name)
+				}
+			}
+		case *expr.Objref:
+			if mo, ok := mt.objs[e.Name]; ok {
+				mo.use--
+			}
+		}
+	}
+}
+
+func (m *Memory) newRule(r *nftables.Rule, insert bool) *nftables.Rule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(r.Table)
+	if mt == nil || mt.chains[r.Chain.Name] == nil {
+		m.setErr(fmt.Errorf("rule in chain %q: %w", r.Chain.Name, syscall.ENOENT))
+		return r
+	}
+	mc := mt.chains[r.Chain.Name]
+	stored := &nftables.Rule{
+		Table:    mt.t,
+		Chain:    mc.c,
+		Exprs:    resolveExprs(mt.t.Family, r.Exprs),
+		UserData: r.UserData,
+	}
+	if err := mt.ref(stored.Exprs); err != nil {
+		m.setErr(err)
+		return r
+	}
+	m.nextHandle++
+	stored.Handle = m.nextHandle
+	r.Handle = m.nextHandle
+
+	pos := -1
+	if r.Position != 0 {
+		for i, er := range mc.rules {
+			if er.Handle == r.Position {
+				pos = i
+				break
+			}
+		}
+		if pos == -1 {
+			mt.unref(stored.Exprs)
+			m.setErr(fmt.Errorf("rule position %d: %w", r.Position, syscall.ENOENT))
+			return r
+		}
+		if !insert {
+			pos++
+		}
+	} else if insert {
+		pos = 0
+	} else {
+		pos = len(mc.rules)
+	}
+	mc.rules = append(mc.rules, nil)
+	copy(mc.rules[pos+1:], mc.rules[pos:])
+	mc.rules[pos] = stored
+	return r
+}
+
+func (m *Memory) AddRule(r *nftables.Rule) *nftables.Rule {
+	return m.newRule(r, false)
+}
+
+func (m *Memory) InsertRule(r *nftables.Rule) *nftables.Rule {
+	return m.newRule(r, true)
+}
+
+func (m *Memory) DelRule(r *nftables.Rule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r.Handle == 0 {
+		return fmt.Errorf("rule must have a handle or ID")
+	}
+	mt := m.table(r.Table)
+	if mt == nil || mt.chains[r.Chain.Name] == nil {
+		m.setErr(fmt.Errorf("rule in chain %q: %w", r.Chain.Name, syscall.ENOENT))
+		return nil
+	}
+	mc := mt.chains[r.Chain.Name]
+	for i, er := range mc.rules {
+		if er.Handle == r.Handle {
+			mt.unref(er.Exprs)
+			mc.rules = append(mc.rules[:i], mc.rules[i+1:]...)
+			return nil
+		}
+	}
+	m.setErr(fmt.Errorf("rule handle %d: %w", r.Handle, syscall.ENOENT))
+	return nil
+}
+
+func (m *Memory) GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(t)
+	if mt == nil || mt.chains[c.Name] == nil {
+		return nil, fmt.Errorf("chain %q: %w", c.Name, syscall.ENOENT)
+	}
+	var out []*nftables.Rule
+	for _, r := range m.table(t).chains[c.Name].rules {
+		rc := *r
+		out = append(out, &rc)
+	}
+	return out, nil
+}
+
+// elemID returns a string identifying a set element within its set.
+func elemID(e nftables.SetElement) string {
+	var b strings.Builder
+	b.Write(e.Key)
+	b.WriteByte('/')
+	b.Write(e.KeyEnd)
+	if e.IntervalEnd {
+		b.WriteString("/end")
+	}
+	return b.String()
+}
+
+func sameElemData(a, b nftables.SetElement) bool {
+	if (a.VerdictData == nil) != (b.VerdictData == nil) {
+		return false
+	}
+	if a.VerdictData != nil && (a.VerdictData.Kind != b.VerdictData.Kind || a.VerdictData.Chain != b.VerdictData.Chain) {
+		return false
+	}
+	return bytes.Equal(a.Val, b.Val)
+}
+
+func (m *Memory) addElements(mt *memTable, ms *memSet, vals []nftables.SetElement) error {
+	for _, v := range vals {
+		if len(v.Key) != int(ms.s.KeyType.Bytes) {
+			return fmt.Errorf("set %q: key length %d does not match type %q (%d bytes): %w", ms.s.Name, len(v.Key), ms.s.KeyType.Name, ms.s.KeyType.Bytes, syscall.EINVAL)
+		}
+		id := elemID(v)
+		if old, ok := ms.elems[id]; ok {
+			if !sameElemData(old, v) {
+				return fmt.Errorf("set %q: element already exists with different data: %w", ms.s.Name, syscall.EEXIST)
+			}
+			continue
+		}
+		if v.VerdictData != nil {
+			if err := mt.ref([]expr.Any{v.VerdictData}); err != nil {
+				return err
+			}
+		}
+		ms.elems[id] = v
+	}
+	return nil
+}
+
+func (m *Memory) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.Anonymous && !s.Constant {
+		return fmt.Errorf("anonymous structs must be constant")
+	}
+	if s.ID == 0 {
+		m.nextID++
+		s.ID = m.nextID
+		if s.Anonymous {
+			s.Name = "__set%d"
+			if s.IsMap {
+				s.Name = "__map%d"
+			}
+		}
+	}
+	mt := m.table(s.Table)
+	if mt == nil {
+		m.setErr(fmt.Errorf("set %q: table: %w", s.Name, syscall.ENOENT))
+		return nil
+	}
+	name := resolveSetName(s.Name, s.ID)
+	ms, ok := mt.sets[name]
+	if !ok {
+		stored := *s
+		stored.Name = name
+		stored.Table = mt.t
+		ms = &memSet{s: &stored, elems: make(map[string]nftables.SetElement)}
+		mt.sets[name] = ms
+	}
+	if err := m.addElements(mt, ms, vals); err != nil {
+		m.setErr(err)
+	}
+	return nil
+}
+
+func (m *Memory) DelSet(s *nftables.Set) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(s.Table)
+	name := resolveSetName(s.Name, s.ID)
+	if mt == nil || mt.sets[name] == nil {
+		m.setErr(fmt.Errorf("set %q: %w", s.Name, syscall.ENOENT))
+		return
+	}
+	ms := mt.sets[name]
+	if ms.use > 0 {
+		m.setErr(fmt.Errorf("set %q is still referenced: %w", s.Name, syscall.EBUSY))
+		return
+	}
+	for _, e := range ms.elems {
+		if e.VerdictData != nil {
+			mt.unref([]expr.Any{e.VerdictData})
+		}
+	}
+	delete(mt.sets, name)
+}
+
+func (m *Memory) memSet(s *nftables.Set) (*memTable, *memSet, error) {
+	mt := m.table(s.Table)
+	name := resolveSetName(s.Name, s.ID)
+	if mt == nil || mt.sets[name] == nil {
+		return nil, nil, fmt.Errorf("set %q: %w", s.Name, syscall.ENOENT)
+	}
+	return mt, mt.sets[name], nil
+}
+
+func (m *Memory) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.Anonymous {
+		return fmt.Errorf("anonymous sets cannot be updated")
+	}
+	mt, ms, err := m.memSet(s)
+	if err != nil {
+		m.setErr(err)
+		return nil
+	}
+	if err := m.addElements(mt, ms, vals); err != nil {
+		m.setErr(err)
+	}
+	return nil
+}
+
+func (m *Memory) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.Anonymous {
+		return fmt.Errorf("anonymous sets cannot be updated")
+	}
+	mt, ms, err := m.memSet(s)
+	if err != nil {
+		m.setErr(err)
+		return nil
+	}
+	for _, v := range vals {
+		id := elemID(v)
+		old, ok := ms.elems[id]
+		if !ok {
+			m.setErr(fmt.Errorf("set %q: element not found: %w", s.Name, syscall.ENOENT))
+			return nil
+		}
+		if old.VerdictData != nil {
+			mt.unref([]expr.Any{old.VerdictData})
+		}
+		delete(ms.elems, id)
+	}
+	return nil
+}
+
+func (m *Memory) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(t)
+	if mt == nil {
+		return nil, fmt.Errorf("table %q: %w", t.Name, syscall.ENOENT)
+	}
+	var out []*nftables.Set
+	for _, ms := range mt.sets {
+		s := *ms.s
+		out = append(out, &s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (m *Memory) GetNamedObjects(t *nftables.Table) ([]nftables.Obj, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := m.table(t)
+	if mt == nil {
+		return nil, fmt.Errorf("table %q: %w", t.Name, syscall.ENOENT)
+	}
+	var out []nftables.Obj
+	for _, mo := range mt.objs {
+		ctr := *mo.o.Obj.(*expr.Counter)
+		out = append(out, &nftables.NamedObj{Table: mo.o.Table, Name: mo.o.Name, Type: mo.o.Type, Obj: &ctr})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].(*nftables.NamedObj).Name < out[j].(*nftables.NamedObj).Name })
+	return out, nil
+}
+
+func (m *Memory) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ms, err := m.memSet(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]nftables.SetElement, 0, len(ms.elems))
+	for _, e := range ms.elems {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return elemID(out[i]) < elemID(out[j]) })
+	return out, nil
+}
+
+func (m *Memory) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.err
+	m.err = nil
+	return err
+}
+
+func (m *Memory) CloseLasting() error {
+	return nil
+}
+
+func (m *Memory) AddObj(o nftables.Obj) nftables.Obj {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	no, ok := o.(*nftables.NamedObj)
+	if !ok || no.Type != nftables.ObjTypeCounter {
+		m.setErr(fmt.Errorf("object type %T: %w", o, syscall.EOPNOTSUPP))
+		return o
+	}
+	mt := m.table(no.Table)
+	if mt == nil {
+		m.setErr(fmt.Errorf("object %q: table: %w", no.Name, syscall.ENOENT))
+		return o
+	}
+	if _, ok := mt.objs[no.Name]; ok {
+		// Like the kernel, keep the state of existing objects
+		return o
+	}
+	ctr, _ := no.Obj.(*expr.Counter)
+	if ctr == nil {
+		ctr = &expr.Counter{}
+	}
+	stored := *ctr
+	mt.objs[no.Name] = &memObj{o: &nftables.NamedObj{Table: mt.t, Name: no.Name, Type: no.Type, Obj: &stored}}
+	return o
+}
+
+func (m *Memory) DeleteObject(o nftables.Obj) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	no, ok := o.(*nftables.NamedObj)
+	if !ok {
+		m.setErr(fmt.Errorf("object type %T: %w", o, syscall.EOPNOTSUPP))
+		return
+	}
+	mt := m.table(no.Table)
+	if mt == nil || mt.objs[no.Name] == nil {
+		m.setErr(fmt.Errorf("object %q: %w", no.Name, syscall.ENOENT))
+		return
+	}
+	if mt.objs[no.Name].use > 0 {
+		m.setErr(fmt.Errorf("object %q is still referenced: %w", no.Name, syscall.EBUSY))
+		return
+	}
+	delete(mt.objs, no.Name)
+}
+
+func (m *Memory) GetObject(o nftables.Obj) (nftables.Obj, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	no, ok := o.(*nftables.NamedObj)
+	if !ok {
+		return nil, fmt.Errorf("object type %T: %w", o, syscall.EOPNOTSUPP)
+	}
+	mt := m.table(no.Table)
+	if mt == nil || mt.objs[no.Name] == nil {
+		return nil, fmt.Errorf("object %q: %w", no.Name, syscall.ENOENT)
+	}
+	stored := mt.objs[no.Name].o
+	ctr := *stored.Obj.(*expr.Counter)
+	return &nftables.NamedObj{Table: stored.Table, Name: stored.Name, Type: stored.Type, Obj: &ctr}, nil
+}
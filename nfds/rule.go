@@ -5,68 +5,95 @@ import (
 	"github.com/google/nftables/expr"
 )
 
+// Meta keys loading the current time, which are not defined by the nftables
+// library. MetaKeyTimeDay loads the day of the week as a single byte, with 0
+// being Sunday. MetaKeyTimeHour loads the seconds since midnight UTC as a 32
+// bit integer in host byte order.
+const (
+	MetaKeyTimeDay  expr.MetaKey = 31 // NFT_META_TIME_DAY
+	MetaKeyTimeHour expr.MetaKey = 32 // NFT_META_TIME_HOUR
+)
+
 type Rule struct {
 	Table    *Table
 	Chain    *Chain
 	Position *Rule
 	Exprs    []expr.Any
 	UserData []byte
+	// Family restricts the rule to the table of a single family if set.
+	Family nftables.TableFamily
 
 	v4 *nftables.Rule
 	v6 *nftables.Rule
 }
 
 func (cc *Conn) AddRule(r *Rule) *Rule {
-	r.v4 = &nftables.Rule{
-		Table:    r.Table.v4,
-		Chain:    r.Chain.v4,
-		Exprs:    r.Exprs,
-		UserData: r.UserData,
-	}
-	if r.Position != nil {
-		r.v4.Position = r.Position.v4.Handle
-	}
-	cc.c.AddRule(r.v4)
-	r.v6 = &nftables.Rule{
-		Table:    r.Table.v6,
-		Chain:    r.Chain.v6,
-		Exprs:    r.Exprs,
-		UserData: r.UserData,
+	cc.stats.RulesAdded++
+	if r.Family != nftables.TableFamilyIPv6 {
+		r.v4 = &nftables.Rule{
+			Table:    r.Table.v4,
+			Chain:    r.Chain.v4,
+			Exprs:    r.Exprs,
+			UserData: r.UserData,
+		}
+		if r.Position != nil {
+			r.v4.Position = r.Position.v4.Handle
+		}
+		cc.c.AddRule(r.v4)
 	}
-	if r.Position != nil {
-		r.v6.Position = r.Position.v6.Handle
+	if r.Family != nftables.TableFamilyIPv4 && r.Table.v6 != nil {
+		r.v6 = &nftables.Rule{
+			Table:    r.Table.v6,
+			Chain:    r.Chain.v6,
+			Exprs:    r.Exprs,
+			UserData: r.UserData,
+		}
+		if r.Position != nil {
+			r.v6.Position = r.Position.v6.Handle
+		}
+		cc.c.AddRule(r.v6)
 	}
-	cc.c.AddRule(r.v6)
 	return r
 }
 
 func (cc *Conn) InsertRule(r *Rule) *Rule {
-	r.v4 = &nftables.Rule{
-		Table:    r.Table.v4,
-		Chain:    r.Chain.v4,
-		Exprs:    r.Exprs,
-		UserData: r.UserData,
+	cc.stats.RulesAdded++
+	if r.Family != nftables.TableFamilyIPv6 {
+		r.v4 = &nftables.Rule{
+			Table:    r.Table.v4,
+			Chain:    r.Chain.v4,
+			Exprs:    r.Exprs,
+			UserData: r.UserData,
+		}
+		if r.Position != nil {
+			r.v4.Position = r.Position.v4.Handle
+		}
+		cc.c.InsertRule(r.v4)
 	}
-	if r.Position != nil {
-		r.v4.Position = r.Position.v4.Handle
+	if r.Family != nftables.TableFamilyIPv4 && r.Table.v6 != nil {
+		r.v6 = &nftables.Rule{
+			Table:    r.Table.v6,
+			Chain:    r.Chain.v6,
+			Exprs:    r.Exprs,
+			UserData: r.UserData,
+		}
+		if r.Position != nil {
+			r.v6.Position = r.Position.v6.Handle
+		}
+		cc.c.InsertRule(r.v6)
 	}
-	cc.c.InsertRule(r.v4)
-	r.v6 = &nftables.Rule{
-		Table:    r.Table.v6,
-		Chain:    r.Chain.v6,
-		Exprs:    r.Exprs,
-		UserData: r.UserData,
-	}
-	if r.Position != nil {
-		r.v6.Position = r.Position.v6.Handle
-	}
-	cc.c.InsertRule(r.v6)
 	return r
 }
 
 func (cc *Conn) DelRule(r *Rule) error {
-	if err := cc.c.DelRule(r.v4); err != nil {
-		return err
+	cc.stats.RulesDeleted++
+	if r.v4 != nil {
+		if err := cc.c.DelRule(r.v4); err != nil {
+			return err
+		}
+	}
+	if r.v6 != nil {
+		return cc.c.DelRule(r.v6)
 	}
-	return cc.c.DelRule(r.v6)
+	return nil
 }
@@ -0,0 +1,448 @@
+package nfds
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// Script is a Backend recording all changes passed through it as a script in
+// nft syntax, for example for review before or in addition to applying them.
+// Changes are forwarded to the wrapped backend, which is also used for all
+// reads. The commands of a batch are written once the wrapped backend flushed
+// it successfully, failed batches are discarded.
+type Script struct {
+	Backend
+	w     io.Writer
+	lines []string
+	// sets contains all sets added through the script by family, table and
+	// name, as their types are needed to render elements and lookups.
+	// Anonymous sets are keyed by their ID instead of their name template.
+	sets map[scriptSetKey]*scriptSet
+	// enabled and trace are set for scripts returned by NewTrace. As traces
+	// are not written per batch, anon contains the keys of the anonymous
+	// sets added in the current batch, which are forgotten on flush instead
+	// of being kept for the lifetime of the trace.
+	enabled func() bool
+	trace   func(line string)
+	anon    []scriptSetKey
+	// added contains the rules added in the current batch with the index of
+	// the line adding them, or -1 if it was traced. They have no handle
+	// which could be used to delete them yet.
+	added map[*nftables.Rule]int
+}
+
+type scriptSetKey struct {
+	family nftables.TableFamily
+	table  string
+	name   string
+	id     uint32
+}
+
+type scriptSet struct {
+	s *nftables.Set
+	// elems are the elements of anonymous sets, which are rendered inline.
+	elems []nftables.SetElement
+}
+
+// NewScript returns a Backend forwarding all operations to b and writing the
+// changes as nft commands to w.
+func NewScript(b Backend, w io.Writer) *Script {
+	return &Script{Backend: b, w: w, sets: make(map[scriptSetKey]*scriptSet), added: make(map[*nftables.Rule]int)}
+}
+
+// maxTraceElements is the number of elements of a change rendered by traces,
+// further ones are only counted.
+const maxTraceElements = 16
+
+// NewTrace returns a Backend forwarding all operations to b and passing each
+// change as an nft command to trace as soon as it is queued, while enabled
+// returns true. Nothing is rendered while it returns false. Unlike with
+// NewScript, changes of failed batches are traced as well, and only the
+// first maxTraceElements elements of each change are rendered.
+func NewTrace(b Backend, enabled func() bool, trace func(line string)) *Script {
+	return &Script{Backend: b, sets: make(map[scriptSetKey]*scriptSet), added: make(map[*nftables.Rule]int), enabled: enabled, trace: trace}
+}
+
+// RecordScript makes c write all changes as nft commands to w, including
+// the ones sent after reconnecting.
+func (c *Conn) RecordScript(w io.Writer) {
+	c.c = NewScript(c.c, w)
+	if dial := c.dial; dial != nil {
+		c.dial = func() (Backend, error) {
+			b, err := dial()
+			if err != nil {
+				return nil, err
+			}
+			return NewScript(b, w), nil
+		}
+	}
+}
+
+// Trace makes c pass every change to trace as an nft command as soon as it is
+// queued while enabled returns true, see NewTrace. The context set by
+// SetTraceContext is prepended to each line.
+func (c *Conn) Trace(enabled func() bool, trace func(line string)) {
+	c.traceEnabled = enabled
+	withContext := func(line string) {
+		if c.traceContext != "" {
+			line = c.traceContext + ": " + line
+		}
+		trace(line)
+	}
+	c.c = NewTrace(c.c, enabled, withContext)
+	if dial := c.dial; dial != nil {
+		c.dial = func() (Backend, error) {
+			b, err := dial()
+			if err != nil {
+				return nil, err
+			}
+			return NewTrace(b, enabled, withContext), nil
+		}
+	}
+}
+
+// Tracing returns true if changes are currently traced.
+func (c *Conn) Tracing() bool {
+	return c.traceEnabled != nil && c.traceEnabled()
+}
+
+// SetTraceContext sets a description of what the following changes belong
+// to, which is prepended to traced changes, and returns the previous one.
+func (c *Conn) SetTraceContext(context string) string {
+	prev := c.traceContext
+	c.traceContext = context
+	return prev
+}
+
+func familyKeyword(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	default:
+		return fmt.Sprintf("family%d", f)
+	}
+}
+
+func tableRef(t *nftables.Table) string {
+	return familyKeyword(t.Family) + " " + t.Name
+}
+
+// active returns true if changes are currently rendered.
+func (s *Script) active() bool {
+	return s.enabled == nil || s.enabled()
+}
+
+// addLine renders a change. Callers check active first, so arguments which
+// are expensive to render are skipped while tracing is disabled.
+func (s *Script) addLine(format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	if s.trace != nil {
+		s.trace(line)
+		return
+	}
+	s.lines = append(s.lines, line)
+}
+
+// renderElements renders elems of set, truncated for traces.
+func (s *Script) renderElements(set *nftables.Set, elems []nftables.SetElement) string {
+	if s.trace == nil || len(elems) <= maxTraceElements {
+		return renderElements(set, elems)
+	}
+	rendered := renderElements(set, elems[:maxTraceElements])
+	return fmt.Sprintf("%s (%d more elements)", rendered, len(elems)-maxTraceElements)
+}
+
+func (s *Script) AddTable(t *nftables.Table) *nftables.Table {
+	if s.active() {
+		s.addLine("add table %s", tableRef(t))
+	}
+	return s.Backend.AddTable(t)
+}
+
+func (s *Script) DelTable(t *nftables.Table) {
+	if s.active() {
+		s.addLine("delete table %s", tableRef(t))
+	}
+	for k := range s.sets {
+		if k.family == t.Family && k.table == t.Name {
+			delete(s.sets, k)
+		}
+	}
+	s.Backend.DelTable(t)
+}
+
+func (s *Script) FlushTable(t *nftables.Table) {
+	if s.active() {
+		s.addLine("flush table %s", tableRef(t))
+	}
+	s.Backend.FlushTable(t)
+}
+
+var hookNames = map[nftables.ChainHook]string{
+	*nftables.ChainHookPrerouting:  "prerouting",
+	*nftables.ChainHookInput:       "input",
+	*nftables.ChainHookForward:     "forward",
+	*nftables.ChainHookOutput:      "output",
+	*nftables.ChainHookPostrouting: "postrouting",
+}
+
+func (s *Script) AddChain(c *nftables.Chain) *nftables.Chain {
+	if !s.active() {
+		return s.Backend.AddChain(c)
+	}
+	line := fmt.Sprintf("add chain %s %s", tableRef(c.Table), c.Name)
+	if c.Hooknum != nil {
+		hook, ok := hookNames[*c.Hooknum]
+		if !ok {
+			hook = fmt.Sprint(*c.Hooknum)
+		}
+		var prio nftables.ChainPriority
+		if c.Priority != nil {
+			prio = *c.Priority
+		}
+		line += fmt.Sprintf(" { type %s hook %s priority %d;", c.Type, hook, prio)
+		if c.Device != "" {
+			line += fmt.Sprintf(" device %q;", c.Device)
+		}
+		if c.Policy != nil {
+			policy := "accept"
+			if *c.Policy == nftables.ChainPolicyDrop {
+				policy = "drop"
+			}
+			line += fmt.Sprintf(" policy %s;", policy)
+		}
+		line += " }"
+	}
+	s.addLine("%s", line)
+	return s.Backend.AddChain(c)
+}
+
+func (s *Script) DelChain(c *nftables.Chain) {
+	if s.active() {
+		s.addLine("delete chain %s %s", tableRef(c.Table), c.Name)
+	}
+	s.Backend.DelChain(c)
+}
+
+func (s *Script) FlushChain(c *nftables.Chain) {
+	if s.active() {
+		s.addLine("flush chain %s %s", tableRef(c.Table), c.Name)
+	}
+	s.Backend.FlushChain(c)
+}
+
+func (s *Script) ruleLine(verb string, r *nftables.Rule) string {
+	line := fmt.Sprintf("%s rule %s %s", verb, tableRef(r.Table), r.Chain.Name)
+	if r.Position != 0 {
+		line += fmt.Sprintf(" position %d", r.Position)
+	}
+	return line + " " + s.renderExprs(r.Table, resolveExprs(r.Table.Family, r.Exprs))
+}
+
+// addRuleLine renders a rule added in the current batch and records it in
+// added.
+func (s *Script) addRuleLine(verb string, r *nftables.Rule) {
+	s.addLine("%s", s.ruleLine(verb, r))
+	s.added[r] = len(s.lines) - 1
+	if s.trace != nil {
+		s.added[r] = -1
+	}
+}
+
+func (s *Script) AddRule(r *nftables.Rule) *nftables.Rule {
+	if s.active() {
+		s.addRuleLine("add", r)
+	}
+	return s.Backend.AddRule(r)
+}
+
+func (s *Script) InsertRule(r *nftables.Rule) *nftables.Rule {
+	if s.active() {
+		s.addRuleLine("insert", r)
+	}
+	return s.Backend.InsertRule(r)
+}
+
+// DelRule renders the deletion of a rule by its handle. Rules added in the
+// current batch or without a handle cannot be referenced by nft, so the
+// deletion is rendered as a comment with the content of the rule instead,
+// and the line adding a rule of the current batch is commented out.
+func (s *Script) DelRule(r *nftables.Rule) error {
+	if s.active() {
+		i, pending := s.added[r]
+		switch {
+		case pending:
+			delete(s.added, r)
+			if i >= 0 {
+				s.lines[i] = "# " + s.lines[i]
+			}
+			s.addLine("# %s (added in the same batch)", s.ruleLine("delete", r))
+		case r.Handle == 0:
+			s.addLine("# %s (without handle)", s.ruleLine("delete", r))
+		default:
+			s.addLine("delete rule %s %s handle %d", tableRef(r.Table), r.Chain.Name, r.Handle)
+		}
+	}
+	return s.Backend.DelRule(r)
+}
+
+func (s *Script) setKey(t *nftables.Table, name string, id uint32) scriptSetKey {
+	if strings.Contains(name, "%d") {
+		return scriptSetKey{family: t.Family, table: t.Name, id: id}
+	}
+	return scriptSetKey{family: t.Family, table: t.Name, name: name}
+}
+
+// lookupSet returns the set with the given name or ID, falling back to the
+// wrapped backend for sets not added through the script.
+func (s *Script) lookupSet(t *nftables.Table, name string, id uint32) *scriptSet {
+	if ss, ok := s.sets[s.setKey(t, name, id)]; ok {
+		return ss
+	}
+	sets, err := s.Backend.GetSets(t)
+	if err != nil {
+		return nil
+	}
+	for _, set := range sets {
+		if set.Name == name {
+			ss := &scriptSet{s: set}
+			s.sets[s.setKey(t, name, id)] = ss
+			return ss
+		}
+	}
+	return nil
+}
+
+func (s *Script) AddSet(set *nftables.Set, vals []nftables.SetElement) error {
+	// The backend assigns IDs and names of anonymous sets
+	err := s.Backend.AddSet(set, vals)
+	if set.Anonymous {
+		if s.trace != nil {
+			if !s.active() {
+				return err
+			}
+			s.anon = append(s.anon, s.setKey(set.Table, set.Name, set.ID))
+		}
+		s.sets[s.setKey(set.Table, set.Name, set.ID)] = &scriptSet{s: set, elems: vals}
+		return err
+	}
+	s.sets[s.setKey(set.Table, set.Name, set.ID)] = &scriptSet{s: set}
+	if !s.active() {
+		return err
+	}
+	kind := "set"
+	typ := set.KeyType.Name
+	if set.IsMap {
+		kind = "map"
+		typ += " : " + set.DataType.Name
+	}
+	decl := []string{"type " + typ}
+	var flags []string
+	if set.Constant {
+		flags = append(flags, "constant")
+	}
+	if set.Interval {
+		flags = append(flags, "interval")
+	}
+	if set.HasTimeout {
+		flags = append(flags, "timeout")
+	}
+	if set.Dynamic {
+		flags = append(flags, "dynamic")
+	}
+	if len(flags) > 0 {
+		decl = append(decl, "flags "+strings.Join(flags, ","))
+	}
+	if set.Timeout != 0 {
+		decl = append(decl, fmt.Sprintf("timeout %ds", int64(set.Timeout.Seconds())))
+	}
+	if set.Counter {
+		decl = append(decl, "counter")
+	}
+	if set.Comment != "" {
+		decl = append(decl, fmt.Sprintf("comment %q", set.Comment))
+	}
+	s.addLine("add %s %s %s { %s; }", kind, tableRef(set.Table), set.Name, strings.Join(decl, "; "))
+	if len(vals) > 0 {
+		s.addLine("add element %s %s %s", tableRef(set.Table), set.Name, s.renderElements(set, vals))
+	}
+	return err
+}
+
+func (s *Script) DelSet(set *nftables.Set) {
+	if s.active() {
+		s.addLine("delete set %s %s", tableRef(set.Table), set.Name)
+	}
+	delete(s.sets, s.setKey(set.Table, set.Name, set.ID))
+	s.Backend.DelSet(set)
+}
+
+func (s *Script) SetAddElements(set *nftables.Set, vals []nftables.SetElement) error {
+	if len(vals) > 0 && s.active() {
+		s.addLine("add element %s %s %s", tableRef(set.Table), set.Name, s.renderElements(set, vals))
+	}
+	return s.Backend.SetAddElements(set, vals)
+}
+
+func (s *Script) SetDeleteElements(set *nftables.Set, vals []nftables.SetElement) error {
+	if len(vals) > 0 && s.active() {
+		s.addLine("delete element %s %s %s", tableRef(set.Table), set.Name, s.renderElements(set, vals))
+	}
+	return s.Backend.SetDeleteElements(set, vals)
+}
+
+func (s *Script) AddObj(o nftables.Obj) nftables.Obj {
+	if !s.active() {
+		return s.Backend.AddObj(o)
+	}
+	if no, ok := o.(*nftables.NamedObj); ok && no.Type == nftables.ObjTypeCounter {
+		s.addLine("add counter %s %s", tableRef(no.Table), no.Name)
+	} else {
+		s.addLine("<add object %T>", o)
+	}
+	return s.Backend.AddObj(o)
+}
+
+func (s *Script) DeleteObject(o nftables.Obj) {
+	if !s.active() {
+		s.Backend.DeleteObject(o)
+		return
+	}
+	if no, ok := o.(*nftables.NamedObj); ok && no.Type == nftables.ObjTypeCounter {
+		s.addLine("delete counter %s %s", tableRef(no.Table), no.Name)
+	} else {
+		s.addLine("<delete object %T>", o)
+	}
+	s.Backend.DeleteObject(o)
+}
+
+func (s *Script) Flush() error {
+	for _, k := range s.anon {
+		delete(s.sets, k)
+	}
+	s.anon = nil
+	clear(s.added)
+	lines := s.lines
+	s.lines = nil
+	if err := s.Backend.Flush(); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(s.w, strings.Join(lines, "\n")+"\n")
+	return err
+}
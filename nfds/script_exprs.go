@@ -0,0 +1,578 @@
+package nfds
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// valueKind selects how values compared with or stored in a register are
+// formatted.
+type valueKind uint8
+
+const (
+	kindRaw valueKind = iota
+	kindIPv4
+	kindIPv6
+	kindProto
+	// kindPort is a port or other 16 bit integer in network byte order.
+	kindPort
+	// kindUint is an integer in host byte order.
+	kindUint
+	kindMark
+	kindCtState
+	kindTCPFlags
+	// kindHour is the number of seconds since midnight in network byte
+	// order, as it is compared after converting meta hour. nft interprets
+	// times in the local timezone, so the script needs to be loaded with
+	// TZ=UTC.
+	kindHour
+	kindDay
+	kindEther
+	kindICMPv6Type
+)
+
+// operand is the value loaded into a register, described by the expression
+// it was loaded with.
+type operand struct {
+	text string
+	kind valueKind
+	len  uint32
+	// mask is set if the value was masked by a bitwise expression.
+	mask []byte
+	// data is set for immediate values.
+	data []byte
+}
+
+var datatypeKinds = map[string]valueKind{
+	nftables.TypeIPAddr.Name:      kindIPv4,
+	nftables.TypeIP6Addr.Name:     kindIPv6,
+	nftables.TypeInetProto.Name:   kindProto,
+	nftables.TypeInetService.Name: kindPort,
+	nftables.TypeIFIndex.Name:     kindUint,
+	nftables.TypeDevGroup.Name:    kindUint,
+	nftables.TypeMark.Name:        kindMark,
+	nftables.TypeICMP6Type.Name:   kindICMPv6Type,
+}
+
+var metaKeys = map[expr.MetaKey]struct {
+	name string
+	kind valueKind
+	len  uint32
+}{
+	expr.MetaKeyL4PROTO:  {"meta l4proto", kindProto, 1},
+	expr.MetaKeyMARK:     {"meta mark", kindMark, 4},
+	expr.MetaKeyIIF:      {"meta iif", kindUint, 4},
+	expr.MetaKeyOIF:      {"meta oif", kindUint, 4},
+	expr.MetaKeyIIFGROUP: {"meta iifgroup", kindUint, 4},
+	expr.MetaKeyOIFGROUP: {"meta oifgroup", kindUint, 4},
+	expr.MetaKeyLEN:      {"meta length", kindUint, 4},
+	expr.MetaKeyNFPROTO:  {"meta nfproto", kindRaw, 1},
+	expr.MetaKeyPKTTYPE:  {"meta pkttype", kindRaw, 1},
+	MetaKeyTimeHour:      {"meta hour", kindHour, 4},
+	MetaKeyTimeDay:       {"meta day", kindDay, 1},
+}
+
+var ctKeys = map[expr.CtKey]struct {
+	name string
+	kind valueKind
+	len  uint32
+}{
+	expr.CtKeySTATE: {"ct state", kindCtState, 4},
+	expr.CtKeyMARK:  {"ct mark", kindMark, 4},
+	expr.CtKeyZONE:  {"ct zone", kindUint, 2},
+}
+
+var protoNames = map[byte]string{
+	unix.IPPROTO_ICMP:   "icmp",
+	unix.IPPROTO_TCP:    "tcp",
+	unix.IPPROTO_UDP:    "udp",
+	unix.IPPROTO_SCTP:   "sctp",
+	unix.IPPROTO_ICMPV6: "ipv6-icmp",
+}
+
+var icmpv6TypeNames = map[byte]string{
+	128: "echo-request",
+	129: "echo-reply",
+	133: "nd-router-solicit",
+	134: "nd-router-advert",
+	135: "nd-neighbor-solicit",
+	136: "nd-neighbor-advert",
+}
+
+var ctStateNames = []struct {
+	bit  uint32
+	name string
+}{
+	{expr.CtStateBitINVALID, "invalid"},
+	{expr.CtStateBitESTABLISHED, "established"},
+	{expr.CtStateBitRELATED, "related"},
+	{expr.CtStateBitNEW, "new"},
+	{expr.CtStateBitUNTRACKED, "untracked"},
+}
+
+var tcpFlagNames = []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"}
+
+var dayNames = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+
+// ctAddrOperand describes a ct expression loading a source or destination
+// address, whose length depends on the table family.
+func ctAddrOperand(fam nftables.TableFamily, e *expr.Ct) operand {
+	dir := "original"
+	if e.Direction != 0 {
+		dir = "reply"
+	}
+	addr := "saddr"
+	if e.Key == expr.CtKeyDST {
+		addr = "daddr"
+	}
+	if fam == nftables.TableFamilyIPv6 {
+		return operand{text: fmt.Sprintf("ct %s ip6 %s", dir, addr), kind: kindIPv6, len: 16}
+	}
+	return operand{text: fmt.Sprintf("ct %s ip %s", dir, addr), kind: kindIPv4, len: 4}
+}
+
+// payloadOperand describes a payload expression in the given family.
+func payloadOperand(fam nftables.TableFamily, p *expr.Payload) operand {
+	switch {
+	case p.Base == expr.PayloadBaseNetworkHeader && fam == nftables.TableFamilyIPv4 && p.Len == 2 && p.Offset == 2:
+		return operand{text: "ip length", kind: kindPort, len: 2}
+	case p.Base == expr.PayloadBaseNetworkHeader && fam == nftables.TableFamilyIPv6 && p.Len == 2 && p.Offset == 4:
+		return operand{text: "ip6 length", kind: kindPort, len: 2}
+	case p.Base == expr.PayloadBaseNetworkHeader && fam == nftables.TableFamilyIPv6 && p.Len == 1 && p.Offset == 7:
+		return operand{text: "ip6 hoplimit", kind: kindUint, len: 1}
+	case p.Base == expr.PayloadBaseNetworkHeader && fam == nftables.TableFamilyIPv4 && p.Len == 4 && p.Offset == 12:
+		return operand{text: "ip saddr", kind: kindIPv4, len: 4}
+	case p.Base == expr.PayloadBaseNetworkHeader && fam == nftables.TableFamilyIPv4 && p.Len == 4 && p.Offset == 16:
+		return operand{text: "ip daddr", kind: kindIPv4, len: 4}
+	case p.Base == expr.PayloadBaseNetworkHeader && fam == nftables.TableFamilyIPv6 && p.Len == 16 && p.Offset == 8:
+		return operand{text: "ip6 saddr", kind: kindIPv6, len: 16}
+	case p.Base == expr.PayloadBaseNetworkHeader && fam == nftables.TableFamilyIPv6 && p.Len == 16 && p.Offset == 24:
+		return operand{text: "ip6 daddr", kind: kindIPv6, len: 16}
+	case p.Base == expr.PayloadBaseLLHeader && p.Len == 6 && p.Offset == 6:
+		return operand{text: "ether saddr", kind: kindEther, len: 6}
+	case p.Base == expr.PayloadBaseLLHeader && p.Len == 2 && p.Offset == 12:
+		return operand{text: "ether type", len: 2}
+	case p.Base == expr.PayloadBaseLLHeader && p.Len == 2 && p.Offset == 14:
+		return operand{text: "vlan id", kind: kindPort, len: 2}
+	case p.Base == expr.PayloadBaseTransportHeader && p.Len == 2 && p.Offset == 0:
+		return operand{text: "th sport", kind: kindPort, len: 2}
+	case p.Base == expr.PayloadBaseTransportHeader && p.Len == 2 && p.Offset == 2:
+		return operand{text: "th dport", kind: kindPort, len: 2}
+	case p.Base == expr.PayloadBaseTransportHeader && fam == nftables.TableFamilyIPv6 && p.Len == 1 && p.Offset == 0:
+		return operand{text: "icmpv6 type", kind: kindICMPv6Type, len: 1}
+	case p.Base == expr.PayloadBaseTransportHeader && p.Len == 1 && p.Offset == 13:
+		return operand{text: "tcp flags", kind: kindTCPFlags, len: 1}
+	}
+	base := "nh"
+	switch p.Base {
+	case expr.PayloadBaseLLHeader:
+		base = "ll"
+	case expr.PayloadBaseTransportHeader:
+		base = "th"
+	}
+	return operand{text: fmt.Sprintf("@%s,%d,%d", base, p.Offset*8, p.Len*8), len: p.Len}
+}
+
+func flagList(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return "(" + strings.Join(names, "|") + ")"
+}
+
+func formatValue(kind valueKind, b []byte) string {
+	switch kind {
+	case kindIPv4, kindIPv6:
+		if a, ok := netip.AddrFromSlice(b); ok {
+			return a.String()
+		}
+	case kindProto:
+		if len(b) >= 1 {
+			if name, ok := protoNames[b[0]]; ok {
+				return name
+			}
+			return fmt.Sprint(b[0])
+		}
+	case kindPort:
+		if len(b) >= 2 {
+			return fmt.Sprint(binary.BigEndian.Uint16(b))
+		}
+	case kindUint:
+		switch len(b) {
+		case 1:
+			return fmt.Sprint(b[0])
+		case 2:
+			return fmt.Sprint(binaryutil.NativeEndian.Uint16(b))
+		case 4:
+			return fmt.Sprint(binaryutil.NativeEndian.Uint32(b))
+		}
+	case kindMark:
+		if len(b) == 4 {
+			return fmt.Sprintf("0x%08x", binaryutil.NativeEndian.Uint32(b))
+		}
+	case kindCtState:
+		if len(b) == 4 {
+			v := binaryutil.NativeEndian.Uint32(b)
+			var names []string
+			for _, s := range ctStateNames {
+				if v&s.bit != 0 {
+					names = append(names, s.name)
+					v &^= s.bit
+				}
+			}
+			if v == 0 && len(names) > 0 {
+				return flagList(names)
+			}
+		}
+	case kindHour:
+		if len(b) == 4 {
+			secs := binary.BigEndian.Uint32(b)
+			return fmt.Sprintf("%q", fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs/60%60, secs%60))
+		}
+	case kindDay:
+		if len(b) == 1 && int(b[0]) < len(dayNames) {
+			return fmt.Sprintf("%q", dayNames[b[0]])
+		}
+	case kindEther:
+		if len(b) == 6 {
+			return net.HardwareAddr(b).String()
+		}
+	case kindICMPv6Type:
+		if len(b) == 1 {
+			if name, ok := icmpv6TypeNames[b[0]]; ok {
+				return name
+			}
+			return fmt.Sprint(b[0])
+		}
+	case kindTCPFlags:
+		if len(b) == 1 {
+			var names []string
+			for i, name := range tcpFlagNames {
+				if b[0]&(1<<i) != 0 {
+					names = append(names, name)
+				}
+			}
+			if len(names) > 0 {
+				return flagList(names)
+			}
+		}
+	}
+	return fmt.Sprintf("0x%x", b)
+}
+
+var cmpOps = map[expr.CmpOp]string{
+	expr.CmpOpEq:  "",
+	expr.CmpOpNeq: "!= ",
+	expr.CmpOpLt:  "< ",
+	expr.CmpOpLte: "<= ",
+	expr.CmpOpGt:  "> ",
+	expr.CmpOpGte: ">= ",
+}
+
+func renderVerdict(v *expr.Verdict) string {
+	switch v.Kind {
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictReturn:
+		return "return"
+	case expr.VerdictContinue:
+		return "continue"
+	case expr.VerdictJump:
+		return "jump " + v.Chain
+	case expr.VerdictGoto:
+		return "goto " + v.Chain
+	default:
+		return fmt.Sprintf("<verdict %d>", v.Kind)
+	}
+}
+
+var icmpRejectCodes = map[nftables.TableFamily]map[uint8]string{
+	nftables.TableFamilyIPv4: {0: "net-unreachable", 1: "host-unreachable", 3: "port-unreachable", 13: "admin-prohibited"},
+	nftables.TableFamilyIPv6: {0: "no-route", 1: "admin-prohibited", 3: "addr-unreachable", 4: "port-unreachable"},
+}
+
+func renderReject(fam nftables.TableFamily, r *expr.Reject) string {
+	switch r.Type {
+	case unix.NFT_REJECT_TCP_RST:
+		return "reject with tcp reset"
+	case unix.NFT_REJECT_ICMP_UNREACH:
+		proto := "icmp"
+		if fam == nftables.TableFamilyIPv6 {
+			proto = "icmpv6"
+		}
+		if name, ok := icmpRejectCodes[fam][r.Code]; ok {
+			return fmt.Sprintf("reject with %s %s", proto, name)
+		}
+		return fmt.Sprintf("reject with %s %d", proto, r.Code)
+	}
+	return "reject"
+}
+
+var limitUnits = map[expr.LimitTime]string{
+	expr.LimitTimeSecond: "second",
+	expr.LimitTimeMinute: "minute",
+	expr.LimitTimeHour:   "hour",
+	expr.LimitTimeDay:    "day",
+	expr.LimitTimeWeek:   "week",
+}
+
+func renderLimit(l *expr.Limit) string {
+	var b strings.Builder
+	b.WriteString("limit rate ")
+	if l.Over {
+		b.WriteString("over ")
+	}
+	unit := "packets"
+	if l.Type == expr.LimitTypePktBytes {
+		unit = "bytes"
+	}
+	fmt.Fprintf(&b, "%d", l.Rate)
+	if unit == "bytes" {
+		b.WriteString(" bytes")
+	}
+	fmt.Fprintf(&b, "/%s", limitUnits[l.Unit])
+	if l.Burst != 0 {
+		fmt.Fprintf(&b, " burst %d %s", l.Burst, unit)
+	}
+	return b.String()
+}
+
+// renderExprs renders the expressions of a rule in table t as nft
+// statements. Loads into registers are tracked and rendered as part of the
+// statements using them. Unsupported expressions are rendered in angle
+// brackets, which makes the script invalid instead of silently changing it.
+func (s *Script) renderExprs(t *nftables.Table, exprs []expr.Any) string {
+	regs := make(map[uint32]operand)
+	var stmts []string
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			k, ok := metaKeys[e.Key]
+			if !ok {
+				k.name, k.len = fmt.Sprintf("meta %d", e.Key), 4
+			}
+			if e.SourceRegister {
+				op := regs[e.Register]
+				stmts = append(stmts, fmt.Sprintf("%s set %s", k.name, formatValue(k.kind, op.data)))
+				continue
+			}
+			regs[e.Register] = operand{text: k.name, kind: k.kind, len: k.len}
+		case *expr.Ct:
+			if (e.Key == expr.CtKeySRC || e.Key == expr.CtKeyDST) && !e.SourceRegister {
+				regs[e.Register] = ctAddrOperand(t.Family, e)
+				continue
+			}
+			k, ok := ctKeys[e.Key]
+			if !ok {
+				k.name, k.len = fmt.Sprintf("ct %d", e.Key), 4
+			}
+			if e.SourceRegister {
+				op := regs[e.Register]
+				stmts = append(stmts, fmt.Sprintf("%s set %s", k.name, formatValue(k.kind, op.data)))
+				continue
+			}
+			regs[e.Register] = operand{text: k.name, kind: k.kind, len: k.len}
+		case *expr.Payload:
+			regs[e.DestRegister] = payloadOperand(t.Family, e)
+		case *expr.Immediate:
+			regs[e.Register] = operand{data: e.Data, len: uint32(len(e.Data))}
+		case *expr.Byteorder:
+			// nft converts values in host byte order implicitly where
+			// needed, the kind of the operand describes the result.
+			regs[e.DestRegister] = regs[e.SourceRegister]
+		case *expr.Bitwise:
+			op := regs[e.SourceRegister]
+			if !isZero(e.Xor) {
+				stmts = append(stmts, fmt.Sprintf("<bitwise xor %x>", e.Xor))
+			}
+			op.mask = e.Mask
+			regs[e.DestRegister] = op
+		case *expr.Cmp:
+			op := regs[e.Register]
+			switch {
+			case op.mask != nil && e.Op == expr.CmpOpNeq && isZero(e.Data) && (op.kind == kindCtState || op.kind == kindTCPFlags):
+				// Written as a flag list, e.g. ct state established,related
+				stmts = append(stmts, fmt.Sprintf("%s %s", op.text, strings.Trim(strings.ReplaceAll(formatValue(op.kind, op.mask), "|", ","), "()")))
+			case op.mask != nil:
+				stmts = append(stmts, fmt.Sprintf("%s & %s %s%s", op.text, formatValue(op.kind, op.mask), cmpOpOrEq(e.Op), formatValue(op.kind, e.Data)))
+			default:
+				stmts = append(stmts, fmt.Sprintf("%s %s%s", op.text, cmpOps[e.Op], formatValue(op.kind, e.Data)))
+			}
+		case *expr.Range:
+			op := regs[e.Register]
+			stmts = append(stmts, fmt.Sprintf("%s %s%s-%s", op.text, cmpOps[e.Op], formatValue(op.kind, e.FromData), formatValue(op.kind, e.ToData)))
+		case *expr.Lookup:
+			stmts = append(stmts, s.renderLookup(t, regs, e))
+		case *expr.Counter:
+			stmts = append(stmts, fmt.Sprintf("counter packets %d bytes %d", e.Packets, e.Bytes))
+		case *expr.Objref:
+			if e.Type == int(nftables.ObjTypeCounter) {
+				stmts = append(stmts, fmt.Sprintf("counter name %q", e.Name))
+			} else {
+				stmts = append(stmts, fmt.Sprintf("<objref %d>", e.Type))
+			}
+		case *expr.Log:
+			if e.Key&(1<<unix.NFTA_LOG_PREFIX) != 0 {
+				stmts = append(stmts, fmt.Sprintf("log prefix %q", e.Data))
+			} else {
+				stmts = append(stmts, "log")
+			}
+		case *expr.Limit:
+			stmts = append(stmts, renderLimit(e))
+		case *expr.Reject:
+			stmts = append(stmts, renderReject(t.Family, e))
+		case *expr.Verdict:
+			stmts = append(stmts, renderVerdict(e))
+		default:
+			stmts = append(stmts, fmt.Sprintf("<%T>", e))
+		}
+	}
+	return strings.Join(stmts, " ")
+}
+
+func cmpOpOrEq(op expr.CmpOp) string {
+	if op == expr.CmpOpEq {
+		return "== "
+	}
+	return cmpOps[op]
+}
+
+func (s *Script) renderLookup(t *nftables.Table, regs map[uint32]operand, l *expr.Lookup) string {
+	ss := s.lookupSet(t, l.SetName, l.SetID)
+	if ss == nil {
+		return fmt.Sprintf("<lookup of unknown set %q>", l.SetName)
+	}
+	var keys []string
+	for reg, covered := l.SourceRegister, uint32(0); covered < ss.s.KeyType.Bytes; {
+		op, ok := regs[reg]
+		if !ok || op.len == 0 {
+			return fmt.Sprintf("<lookup from unset register %d>", reg)
+		}
+		keys = append(keys, op.text)
+		words := (op.len + 3) / 4
+		reg += words
+		covered += words * 4
+	}
+	ref := "@" + ss.s.Name
+	if ss.s.Anonymous {
+		ref = renderElements(ss.s, ss.elems)
+	}
+	key := strings.Join(keys, " . ")
+	switch {
+	case l.IsDestRegSet && l.DestRegister == 0:
+		return fmt.Sprintf("%s vmap %s", key, ref)
+	case l.IsDestRegSet:
+		return fmt.Sprintf("<data map lookup into register %d>", l.DestRegister)
+	case l.Invert:
+		return fmt.Sprintf("%s != %s", key, ref)
+	default:
+		return fmt.Sprintf("%s %s", key, ref)
+	}
+}
+
+// keyFields returns the kinds and lengths of the fields of keys of set.
+func keyFields(set *nftables.Set) ([]valueKind, []uint32) {
+	if !set.Concatenation {
+		return []valueKind{datatypeKinds[set.KeyType.Name]}, []uint32{set.KeyType.Bytes}
+	}
+	var kinds []valueKind
+	var lens []uint32
+	for _, name := range strings.Split(set.KeyType.Name, " . ") {
+		kinds = append(kinds, datatypeKinds[name])
+	}
+	for _, t := range nftables.ConcatSetTypeElements(set.KeyType) {
+		lens = append(lens, t.Bytes)
+	}
+	return kinds, lens
+}
+
+// renderKey renders a set key, with the fields of end as the upper bounds of
+// ranges if it is non-nil.
+func renderKey(kinds []valueKind, lens []uint32, key, end []byte) string {
+	var fields []string
+	var off uint32
+	for i, kind := range kinds {
+		l := lens[i]
+		if off+l > uint32(len(key)) {
+			return fmt.Sprintf("0x%x", key)
+		}
+		f := formatValue(kind, key[off:off+l])
+		if end != nil && off+l <= uint32(len(end)) && !slices.Equal(key[off:off+l], end[off:off+l]) {
+			f += "-" + formatValue(kind, end[off:off+l])
+		}
+		fields = append(fields, f)
+		off += (l + 3) / 4 * 4
+	}
+	return strings.Join(fields, " . ")
+}
+
+// decrement returns b minus one as a big endian number.
+func decrement(b []byte) []byte {
+	out := slices.Clone(b)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]--
+		if out[i] != 0xff {
+			break
+		}
+	}
+	return out
+}
+
+func renderElements(set *nftables.Set, elems []nftables.SetElement) string {
+	kinds, lens := keyFields(set)
+	var out []string
+	for i := 0; i < len(elems); i++ {
+		e := elems[i]
+		if e.IntervalEnd {
+			// The end of an interval without a start, used to terminate
+			// intervals starting at zero in some encodings
+			continue
+		}
+		var rendered string
+		switch {
+		case e.KeyEnd != nil:
+			rendered = renderKey(kinds, lens, e.Key, e.KeyEnd)
+		case set.Interval && i+1 < len(elems) && elems[i+1].IntervalEnd:
+			// Interval ends are exclusive
+			rendered = renderKey(kinds, lens, e.Key, decrement(elems[i+1].Key))
+			i++
+		case set.Interval:
+			end := slices.Repeat([]byte{0xff}, len(e.Key))
+			rendered = renderKey(kinds, lens, e.Key, end)
+		default:
+			rendered = renderKey(kinds, lens, e.Key, nil)
+		}
+		if set.IsMap {
+			if e.VerdictData != nil {
+				rendered += " : " + renderVerdict(e.VerdictData)
+			} else {
+				rendered += fmt.Sprintf(" : 0x%x", e.Val)
+			}
+		}
+		if e.Comment != "" {
+			rendered += fmt.Sprintf(" comment %q", e.Comment)
+		}
+		out = append(out, rendered)
+	}
+	return "{ " + strings.Join(out, ", ") + " }"
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
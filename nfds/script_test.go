@@ -0,0 +1,228 @@
+package nfds
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestScript(t *testing.T) {
+	var b strings.Builder
+	cc := WrapConn(NewMemory())
+	cc.RecordScript(&b)
+	table := cc.AddTable(&Table{Name: "test"})
+	drop := nftables.ChainPolicyDrop
+	hook := cc.AddChain(&Chain{
+		Table:    table,
+		Name:     "hook",
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &drop,
+	})
+	target := cc.AddChain(&Chain{Table: table, Name: "target"})
+	ips := &Set{
+		Table:        table,
+		Name:         "ips",
+		Interval:     true,
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		KeyByteOrder: binaryutil.BigEndian,
+	}
+	if err := cc.AddSet(ips, []nftables.SetElement{
+		{Key: []byte{10, 0, 0, 0}}, {Key: []byte{10, 1, 0, 0}, IntervalEnd: true},
+		{Key: []byte{192, 0, 2, 1}, Comment: "ns/pod"}, {Key: []byte{192, 0, 2, 2}, IntervalEnd: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ports := &Set{
+		Table:         table,
+		Anonymous:     true,
+		Constant:      true,
+		Interval:      true,
+		Concatenation: true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService),
+		KeyByteOrder:  binaryutil.BigEndian,
+		Family:        nftables.TableFamilyIPv4,
+	}
+	if err := cc.AddSet(ports, []nftables.SetElement{
+		{Key: []byte{unix.IPPROTO_TCP, 0, 0, 0, 0, 80, 0, 0}, KeyEnd: []byte{unix.IPPROTO_TCP, 0, 0, 0, 0, 90, 0, 0}},
+		{Key: []byte{unix.IPPROTO_UDP, 0, 0, 0, 0, 53, 0, 0}, KeyEnd: []byte{unix.IPPROTO_UDP, 0, 0, 0, 0, 53, 0, 0}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cc.AddRule(&Rule{
+		Table: table,
+		Chain: hook,
+		Exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 9},
+			&expr.Bitwise{SourceRegister: 9, DestRegister: 9, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED), Xor: make([]byte, 4)},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 9, Data: make([]byte, 4)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+	cc.AddRule(&Rule{
+		Table: table,
+		Chain: hook,
+		Exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeySRC, Register: 8},
+			&expr.Lookup{SourceRegister: 8, SetName: ips.Name},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+	cc.AddRule(&Rule{
+		Table:  table,
+		Chain:  target,
+		Family: nftables.TableFamilyIPv4,
+		Exprs: []expr.Any{
+			&expr.Payload{Base: expr.PayloadBaseNetworkHeader, DestRegister: 8, Offset: 12, Len: 4},
+			&expr.Lookup{SourceRegister: 8, SetName: ips.Name},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 8},
+			&expr.Payload{Base: expr.PayloadBaseTransportHeader, DestRegister: 9, Offset: 2, Len: 2},
+			lookupExpr(ports),
+			&expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond, Burst: 5},
+			&expr.Counter{},
+			&expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 13},
+		},
+	})
+	cc.AddRule(&Rule{
+		Table:  table,
+		Chain:  target,
+		Family: nftables.TableFamilyIPv4,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: MetaKeyTimeDay, Register: 8},
+			&expr.Range{Op: expr.CmpOpNeq, Register: 8, FromData: []byte{1}, ToData: []byte{5}},
+			&expr.Meta{Key: MetaKeyTimeHour, Register: 9},
+			&expr.Byteorder{SourceRegister: 9, DestRegister: 9, Op: expr.ByteorderHton, Len: 4, Size: 4},
+			&expr.Range{Op: expr.CmpOpEq, Register: 9, FromData: binaryutil.BigEndian.PutUint32(8 * 3600), ToData: binaryutil.BigEndian.PutUint32(18*3600 - 1)},
+			&expr.Verdict{Kind: expr.VerdictReturn},
+		},
+	})
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `add table ip test
+add table ip6 test
+add chain ip test hook { type filter hook forward priority 0; policy drop; }
+add chain ip6 test hook { type filter hook forward priority 0; policy drop; }
+add chain ip test target
+add chain ip6 test target
+add set ip test ips { type ipv4_addr; flags interval; }
+add element ip test ips { 10.0.0.0-10.0.255.255, 192.0.2.1 comment "ns/pod" }
+add set ip6 test ips { type ipv6_addr; flags interval; }
+add rule ip test hook ct state established,related accept
+add rule ip6 test hook ct state established,related accept
+add rule ip test hook ct original ip saddr @ips accept
+add rule ip6 test hook ct original ip6 saddr @ips accept
+add rule ip test target ip saddr @ips meta l4proto . th dport { tcp . 80-90, udp . 53 } limit rate 10/second burst 5 packets counter packets 0 bytes 0 reject with icmp admin-prohibited
+add rule ip test target meta day != "Monday"-"Friday" meta hour "08:00:00"-"17:59:59" return
+`
+	if b.String() != expected {
+		t.Errorf("expected script\n%s\ngot\n%s", expected, b.String())
+	}
+}
+
+func lookupExpr(s *Set) *expr.Dynamic {
+	return &expr.Dynamic{Expr: func(fam uint8) expr.Any {
+		id, name := s.Reference(fam)
+		return &expr.Lookup{SourceRegister: 8, SetID: id, SetName: name}
+	}}
+}
+
+func TestScriptDiscardsFailedBatch(t *testing.T) {
+	var b strings.Builder
+	cc := WrapConn(NewMemory())
+	cc.RecordScript(&b)
+	table := cc.AddTable(&Table{Name: "test"})
+	ch := cc.AddChain(&Chain{Table: table, Name: "test"})
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	cc.DelChain(ch)
+	cc.DelChain(ch)
+	if err := cc.Flush(); err == nil {
+		t.Fatal("expected deleting a chain twice to fail")
+	}
+	if b.Len() != 0 {
+		t.Errorf("expected failed batch to be discarded, got %q", b.String())
+	}
+}
+
+func TestScriptDeletesPendingRule(t *testing.T) {
+	var b strings.Builder
+	cc := WrapConn(NewMemory())
+	cc.RecordScript(&b)
+	table := cc.AddTable(&Table{Name: "test"})
+	ch := cc.AddChain(&Chain{Table: table, Name: "test"})
+	r := cc.AddRule(&Rule{Table: table, Chain: ch, Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}})
+	if err := cc.DelRule(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.Contains(line, "handle") || strings.HasPrefix(line, "add rule") {
+			t.Errorf("expected pending rule not to be added or deleted by handle, got %q", line)
+		}
+	}
+	if !strings.Contains(b.String(), "# delete rule ip test test accept") {
+		t.Errorf("expected deletion to be rendered by content, got %q", b.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var lines []string
+	enabled := false
+	cc := WrapConn(NewMemory())
+	cc.Trace(func() bool { return enabled }, func(line string) { lines = append(lines, line) })
+	table := cc.AddTable(&Table{Name: "test"})
+	ips := &Set{
+		Table:        table,
+		Name:         "ips",
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		KeyByteOrder: binaryutil.BigEndian,
+		Family:       nftables.TableFamilyIPv4,
+	}
+	if err := cc.AddSet(ips, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cc.Tracing() || len(lines) != 0 {
+		t.Fatalf("expected nothing to be traced while disabled, got %q", lines)
+	}
+
+	enabled = true
+	prev := cc.SetTraceContext("pod ns/pod")
+	var elems []nftables.SetElement
+	for i := range maxTraceElements + 2 {
+		elems = append(elems, nftables.SetElement{Key: []byte{10, 0, 0, byte(i)}})
+	}
+	if err := cc.SetAddElements(ips, elems); err != nil {
+		t.Fatal(err)
+	}
+	cc.SetTraceContext(prev)
+	cc.AddChain(&Chain{Table: table, Name: "target"})
+	// Changes are traced as they are queued, not on flush
+	expected := []string{
+		"pod ns/pod: add element ip test ips { 10.0.0.0, 10.0.0.1, 10.0.0.2, 10.0.0.3, 10.0.0.4, 10.0.0.5, 10.0.0.6, 10.0.0.7, 10.0.0.8, 10.0.0.9, 10.0.0.10, 10.0.0.11, 10.0.0.12, 10.0.0.13, 10.0.0.14, 10.0.0.15 } (2 more elements)",
+		"add chain ip test target",
+		"add chain ip6 test target",
+	}
+	if !slices.Equal(lines, expected) {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != len(expected) {
+		t.Errorf("expected flush not to trace anything, got %q", lines[len(expected):])
+	}
+}
@@ -1,11 +1,14 @@
 package nfds
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
 )
 
 type Set struct {
@@ -32,6 +35,11 @@ type Set struct {
 	// Either host (binaryutil.NativeEndian) or big (binaryutil.BigEndian) endian as per
 	// https://git.netfilter.org/nftables/tree/include/datatype.h?id=d486c9e626405e829221b82d7355558005b26d8a#n109
 	KeyByteOrder binaryutil.ByteOrder
+	// Family restricts the set to the table of a single family if set. Rules
+	// referencing the set need to be restricted to the same family.
+	Family nftables.TableFamily
+	// Comment is stored in the set's userdata.
+	Comment string
 
 	v4 *nftables.Set
 	v6 *nftables.Set
@@ -61,6 +69,7 @@ func (cc *Conn) AddSet(s *Set, elems []nftables.SetElement) error {
 		KeyType:       s.KeyType,
 		DataType:      s.DataType,
 		KeyByteOrder:  s.KeyByteOrder,
+		Comment:       s.Comment,
 	}
 	s.v6 = &nftables.Set{
 		Table:         s.Table.v6,
@@ -75,6 +84,7 @@ func (cc *Conn) AddSet(s *Set, elems []nftables.SetElement) error {
 		Concatenation: s.Concatenation,
 		Timeout:       s.Timeout,
 		KeyByteOrder:  s.KeyByteOrder,
+		Comment:       s.Comment,
 	}
 	if s.KeyType6.GetNFTMagic() == 0 {
 		s.v6.KeyType = s.KeyType
@@ -86,17 +96,84 @@ func (cc *Conn) AddSet(s *Set, elems []nftables.SetElement) error {
 	} else {
 		s.v6.DataType = s.DataType6
 	}
+	elems = cc.validElements(s, elems)
+	cc.stats.SetsAdded++
+	cc.stats.ElementsAdded += uint64(len(elems))
 	vals4, vals6 := cc.splitVals(s, elems)
-	if err := cc.c.AddSet(s.v4, vals4); err != nil {
-		return err
+	if s.Family != nftables.TableFamilyIPv6 {
+		if err := cc.c.AddSet(s.v4, vals4); err != nil {
+			return classify(err)
+		}
 	}
-	return cc.c.AddSet(s.v6, vals6)
-
+	if s.Family != nftables.TableFamilyIPv4 && s.Table.v6 != nil {
+		return classify(cc.c.AddSet(s.v6, vals6))
+	}
+	return nil
 }
 
 func (cc *Conn) DelSet(s *Set) {
-	cc.c.DelSet(s.v4)
-	cc.c.DelSet(s.v6)
+	cc.stats.SetsDeleted++
+	if s.Family != nftables.TableFamilyIPv6 {
+		cc.c.DelSet(s.v4)
+	}
+	if s.Family != nftables.TableFamilyIPv4 && s.Table.v6 != nil {
+		cc.c.DelSet(s.v6)
+	}
+}
+
+// ValidateSetKeys enables or disables checking the lengths of the keys and
+// values of set elements against the types of their set before they are
+// added or deleted. Invalid elements are logged, counted and skipped without
+// failing the batch, so validation does not change the rest of the ruleset.
+// Without validation, such elements make the operation panic or are rejected
+// by the kernel.
+func (cc *Conn) ValidateSetKeys(enable bool) {
+	cc.validateSetKeys = enable
+}
+
+// InvalidElements returns the number of set elements skipped so far by
+// ValidateSetKeys. It is safe for concurrent use.
+func (cc *Conn) InvalidElements() uint64 {
+	return cc.invalidElements.Load()
+}
+
+// validElements returns the elements of vals whose key and value lengths
+// match the types of s in one of its families. Elements ending an interval
+// may have no value.
+func (cc *Conn) validElements(s *Set, vals []nftables.SetElement) []nftables.SetElement {
+	if !cc.validateSetKeys {
+		return vals
+	}
+	var families []*nftables.Set
+	if s.Family != nftables.TableFamilyIPv6 {
+		families = append(families, s.v4)
+	}
+	// Elements of the IPv6 family are valid even if it is not supported, they
+	// are skipped when adding them.
+	if s.Family != nftables.TableFamilyIPv4 {
+		families = append(families, s.v6)
+	}
+	valid := vals[:0:0]
+	for i, val := range vals {
+		ok := false
+		for _, fs := range families {
+			keyOk := len(val.Key) == int(fs.KeyType.Bytes) && (val.KeyEnd == nil || len(val.KeyEnd) == int(fs.KeyType.Bytes))
+			valOk := len(val.Val) == int(fs.DataType.Bytes) || (val.IntervalEnd && len(val.Val) == 0)
+			ok = ok || (keyOk && valOk)
+		}
+		if ok {
+			valid = append(valid, val)
+			continue
+		}
+		var want []string
+		for _, fs := range families {
+			want = append(want, fmt.Sprintf("%s key %d bytes, value %d bytes", familyKeyword(fs.Table.Family), fs.KeyType.Bytes, fs.DataType.Bytes))
+		}
+		err := fmt.Errorf("set %q: element %d has key %x (%d bytes), key end %x, value %x (%d bytes), expected %s", s.Name, i, val.Key, len(val.Key), val.KeyEnd, val.Val, len(val.Val), strings.Join(want, " or "))
+		klog.Errorf("Invalid set element: %v", err)
+		cc.invalidElements.Add(1)
+	}
+	return valid
 }
 
 func (cc *Conn) splitVals(s *Set, vals []nftables.SetElement) (vals4, vals6 []nftables.SetElement) {
@@ -130,18 +207,105 @@ func (cc *Conn) splitVals(s *Set, vals []nftables.SetElement) (vals4, vals6 []nf
 }
 
 func (cc *Conn) SetAddElements(s *Set, vals []nftables.SetElement) error {
+	vals = cc.validElements(s, vals)
+	cc.stats.ElementsAdded += uint64(len(vals))
 	vals4, vals6 := cc.splitVals(s, vals)
-	if err := cc.c.SetAddElements(s.v4, vals4); err != nil {
-		return err
+	if s.Family != nftables.TableFamilyIPv6 {
+		if err := cc.c.SetAddElements(s.v4, vals4); err != nil {
+			return classify(err)
+		}
 	}
-	return cc.c.SetAddElements(s.v6, vals6)
-
+	if s.Family != nftables.TableFamilyIPv4 && s.Table.v6 != nil {
+		return classify(cc.c.SetAddElements(s.v6, vals6))
+	}
+	return nil
 }
 
 func (cc *Conn) SetDeleteElements(s *Set, vals []nftables.SetElement) error {
+	vals = cc.validElements(s, vals)
+	cc.stats.ElementsDeleted += uint64(len(vals))
 	vals4, vals6 := cc.splitVals(s, vals)
-	if err := cc.c.SetDeleteElements(s.v4, vals4); err != nil {
-		return err
+	if s.Family != nftables.TableFamilyIPv6 {
+		if err := cc.c.SetDeleteElements(s.v4, vals4); err != nil {
+			return err
+		}
+	}
+	if s.Family != nftables.TableFamilyIPv4 && s.Table.v6 != nil {
+		return cc.c.SetDeleteElements(s.v6, vals6)
+	}
+	return nil
+}
+
+// SetReconcileElements makes the elements of s equal to want. Instead of
+// blindly adding and deleting elements, which fails if the ruleset drifted
+// from the expected state, the current elements are read and only the
+// difference is queued. Elements whose key exists with different data are
+// replaced. Comments are not compared. It returns the number of elements
+// added and deleted over all families.
+//
+// The current elements are read from the backend, so no changes to s may be
+// pending. Interval sets are not supported.
+func (cc *Conn) SetReconcileElements(s *Set, want []nftables.SetElement) (added, deleted int, err error) {
+	if s.Interval {
+		return 0, 0, fmt.Errorf("set %q: reconciling interval sets is not supported", s.Name)
+	}
+	want = cc.validElements(s, want)
+	want4, want6 := cc.splitVals(s, want)
+	var families []*nftables.Set
+	var wants [][]nftables.SetElement
+	if s.Family != nftables.TableFamilyIPv6 {
+		families = append(families, s.v4)
+		wants = append(wants, want4)
+	}
+	if s.Family != nftables.TableFamilyIPv4 && s.Table.v6 != nil {
+		families = append(families, s.v6)
+		wants = append(wants, want6)
+	}
+	for i, fs := range families {
+		have, err := cc.c.GetSetElements(fs)
+		if err != nil {
+			return added, deleted, classify(fmt.Errorf("while reading elements of set %q: %w", s.Name, err))
+		}
+		haveByID := make(map[string]nftables.SetElement, len(have))
+		for _, e := range have {
+			haveByID[elemID(e)] = e
+		}
+		var add, del []nftables.SetElement
+		seen := make(map[string]bool, len(wants[i]))
+		for _, e := range wants[i] {
+			id := elemID(e)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			old, ok := haveByID[id]
+			if ok && sameElemData(old, e) {
+				continue
+			}
+			if ok {
+				del = append(del, old)
+			}
+			add = append(add, e)
+		}
+		for _, e := range have {
+			if !seen[elemID(e)] {
+				del = append(del, e)
+			}
+		}
+		if len(del) > 0 {
+			if err := cc.c.SetDeleteElements(fs, del); err != nil {
+				return added, deleted, classify(err)
+			}
+		}
+		if len(add) > 0 {
+			if err := cc.c.SetAddElements(fs, add); err != nil {
+				return added, deleted, classify(err)
+			}
+		}
+		added += len(add)
+		deleted += len(del)
 	}
-	return cc.c.SetDeleteElements(s.v6, vals6)
+	cc.stats.ElementsAdded += uint64(added)
+	cc.stats.ElementsDeleted += uint64(deleted)
+	return added, deleted, nil
 }
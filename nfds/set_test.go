@@ -0,0 +1,162 @@
+package nfds
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+func TestSplitValsKeepsComments(t *testing.T) {
+	cc := WrapConn(NewMemory())
+	table := cc.AddTable(&Table{Name: "test"})
+	s := &Set{
+		Table:        table,
+		Name:         "ips",
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		KeyByteOrder: binaryutil.BigEndian,
+	}
+	if err := cc.AddSet(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	vals4, vals6 := cc.splitVals(s, []nftables.SetElement{
+		{Key: []byte{10, 0, 0, 1}, Comment: "ns/pod4"},
+		{Key: make([]byte, 16), Comment: "ns/pod6"},
+	})
+	if len(vals4) != 1 || vals4[0].Comment != "ns/pod4" {
+		t.Errorf("expected v4 element with comment ns/pod4, got %+v", vals4)
+	}
+	if len(vals6) != 1 || vals6[0].Comment != "ns/pod6" {
+		t.Errorf("expected v6 element with comment ns/pod6, got %+v", vals6)
+	}
+}
+
+func TestValidateSetKeys(t *testing.T) {
+	mem := NewMemory()
+	cc := WrapConn(mem)
+	cc.ValidateSetKeys(true)
+	table := cc.AddTable(&Table{Name: "test"})
+	s := &Set{
+		Table:         table,
+		Name:          "namedports",
+		Concatenation: true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService, nftables.TypeIPAddr),
+		KeyType6:      nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService, nftables.TypeIP6Addr),
+	}
+	if err := cc.AddSet(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The components of concatenations are padded to 4 bytes each
+	valid := nftables.SetElement{Key: []byte{6, 0, 0, 0, 0, 80, 0, 0, 10, 0, 0, 1}}
+	unpadded := nftables.SetElement{Key: []byte{6, 0, 80, 10, 0, 0, 1}}
+	withValue := nftables.SetElement{Key: valid.Key, Val: []byte{1}}
+	// Does not panic, unlike splitting the elements without validation
+	cc.SetAddElements(s, []nftables.SetElement{valid, unpadded, withValue})
+	if err := cc.Flush(); err != nil {
+		t.Errorf("expected invalid elements not to fail the batch, got %v", err)
+	}
+	if n := cc.InvalidElements(); n != 2 {
+		t.Errorf("expected 2 invalid elements to be counted, got %d", n)
+	}
+	elems, err := mem.GetSetElements(s.v4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) != 1 {
+		t.Errorf("expected only the valid element to be added, got %v", elems)
+	}
+}
+
+func TestSetReconcileElements(t *testing.T) {
+	mem := NewMemory()
+	cc := WrapConn(mem)
+	table := cc.AddTable(&Table{Name: "test"})
+	s := &Set{
+		Table:        table,
+		Name:         "ips",
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		KeyByteOrder: binaryutil.BigEndian,
+	}
+	stale := nftables.SetElement{Key: []byte{10, 0, 0, 1}}
+	kept := nftables.SetElement{Key: []byte{10, 0, 0, 2}}
+	missing := nftables.SetElement{Key: []byte{10, 0, 0, 3}}
+	missing6 := nftables.SetElement{Key: append(make([]byte, 15), 1)}
+	if err := cc.AddSet(s, []nftables.SetElement{stale, kept}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Blindly adding the missing and deleting the stale elements would
+	// fail if one of them is already in the desired state.
+	added, deleted, err := cc.SetReconcileElements(s, []nftables.SetElement{kept, missing, missing6, missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 || deleted != 1 {
+		t.Errorf("expected 2 elements added and 1 deleted, got %d added and %d deleted", added, deleted)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	elems4, _ := mem.GetSetElements(s.v4)
+	elems6, _ := mem.GetSetElements(s.v6)
+	if len(elems4) != 2 || string(elems4[0].Key) != string(kept.Key) || string(elems4[1].Key) != string(missing.Key) {
+		t.Errorf("expected v4 elements %v and %v, got %v", kept.Key, missing.Key, elems4)
+	}
+	if len(elems6) != 1 || string(elems6[0].Key) != string(missing6.Key) {
+		t.Errorf("expected v6 element %v, got %v", missing6.Key, elems6)
+	}
+	added, deleted, err = cc.SetReconcileElements(s, []nftables.SetElement{kept, missing, missing6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 || deleted != 0 {
+		t.Errorf("expected no changes to a reconciled set, got %d added and %d deleted", added, deleted)
+	}
+}
+
+func TestSetReconcileElementsReplacesData(t *testing.T) {
+	mem := NewMemory()
+	cc := WrapConn(mem)
+	table := cc.AddTable(&Table{Name: "test"})
+	cc.AddChain(&Chain{Table: table, Name: "a"})
+	cc.AddChain(&Chain{Table: table, Name: "b"})
+	s := &Set{
+		Table:        table,
+		Name:         "vmap",
+		IsMap:        true,
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		DataType:     nftables.TypeVerdict,
+		KeyByteOrder: binaryutil.BigEndian,
+	}
+	key := []byte{10, 0, 0, 1}
+	if err := cc.AddSet(s, []nftables.SetElement{{Key: key, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "a"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := nftables.SetElement{Key: key, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "b"}}
+	added, deleted, err := cc.SetReconcileElements(s, []nftables.SetElement{want})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || deleted != 1 {
+		t.Errorf("expected the element to be replaced, got %d added and %d deleted", added, deleted)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	elems, _ := mem.GetSetElements(s.v4)
+	if len(elems) != 1 || elems[0].VerdictData.Chain != "b" {
+		t.Errorf("expected element jumping to b, got %+v", elems)
+	}
+}
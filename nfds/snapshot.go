@@ -0,0 +1,247 @@
+package nfds
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Snapshot is a normalized view of the contents of a single table family,
+// suitable for comparing the state of two backends. Rules are described by
+// their expressions after a netlink round-trip with counter values, set IDs
+// and the names of anonymous sets cleared as those are not stable across
+// backends. Rule handles are not part of the descriptions for the same
+// reason.
+type Snapshot struct {
+	Chains map[string]ChainSnapshot
+	// Sets contains all named sets with their elements.
+	Sets map[string][]string
+}
+
+type ChainSnapshot struct {
+	Hook  string
+	Rules []string
+}
+
+func describeChain(c *nftables.Chain) string {
+	if c.Hooknum == nil {
+		return ""
+	}
+	var prio string
+	if c.Priority != nil {
+		prio = fmt.Sprint(*c.Priority)
+	}
+	// The kernel reports the implicit accept policy of base chains.
+	policy := nftables.ChainPolicyAccept
+	if c.Policy != nil {
+		policy = *c.Policy
+	}
+	return fmt.Sprintf("type %s hook %d priority %s policy %d", c.Type, *c.Hooknum, prio, policy)
+}
+
+// anonymousSetName returns name, or a placeholder if it is the name of an
+// anonymous set or map generated by the backend, like __set0 or __map1.
+func anonymousSetName(name string) string {
+	if strings.HasPrefix(name, "__") {
+		return "<anonymous>"
+	}
+	return name
+}
+
+// describeExpr returns the contents of an expression as they would be read
+// back from the kernel.
+func describeExpr(fam byte, e expr.Any) string {
+	// Normalized copies are assigned to e, which te must not shadow
+	switch te := e.(type) {
+	case *expr.Verdict:
+		return fmt.Sprintf("verdict(%d,%s)", te.Kind, te.Chain)
+	case *expr.Lookup:
+		l := *te
+		l.SetID = 0
+		l.SetName = anonymousSetName(l.SetName)
+		e = &l
+	case *expr.Dynset:
+		d := *te
+		d.SetID = 0
+		d.SetName = anonymousSetName(d.SetName)
+		e = &d
+	case *expr.Counter:
+		return "Counter"
+	}
+	name := strings.TrimPrefix(fmt.Sprintf("%T", e), "*expr.")
+	data, err := expr.MarshalExprData(fam, e)
+	if err != nil {
+		return fmt.Sprintf("%s(invalid: %v)", name, err)
+	}
+	rt := reflect.New(reflect.TypeOf(e).Elem()).Interface().(expr.Any)
+	if err := expr.Unmarshal(fam, data, rt); err != nil {
+		return fmt.Sprintf("%s(invalid: %v)", name, err)
+	}
+	if l, ok := rt.(*expr.Log); ok {
+		// Key only records which attributes are present.
+		l.Key = 0
+	}
+	return fmt.Sprintf("%s%+v", name, reflect.ValueOf(rt).Elem().Interface())
+}
+
+func describeRule(r *nftables.Rule) string {
+	fam := uint8(r.Table.Family)
+	var parts []string
+	for _, e := range r.Exprs {
+		if d, ok := e.(*expr.Dynamic); ok {
+			e = d.Expr(fam)
+		}
+		parts = append(parts, describeExpr(fam, e))
+	}
+	return strings.Join(parts, " ")
+}
+
+func describeElement(e nftables.SetElement) string {
+	s := fmt.Sprintf("%x", e.Key)
+	if e.KeyEnd != nil {
+		s += fmt.Sprintf("-%x", e.KeyEnd)
+	}
+	if e.IntervalEnd {
+		s += " end"
+	}
+	if e.Val != nil {
+		s += fmt.Sprintf(" : %x", e.Val)
+	}
+	if e.VerdictData != nil {
+		s += fmt.Sprintf(" : verdict(%d,%s)", e.VerdictData.Kind, e.VerdictData.Chain)
+	}
+	return s
+}
+
+// TakeSnapshot reads the chains and sets for which owned returns true from
+// the given table. A table which does not exist results in an empty snapshot.
+func (cc *Conn) TakeSnapshot(name string, family nftables.TableFamily, owned func(name string) bool) (*Snapshot, error) {
+	snap := Snapshot{
+		Chains: make(map[string]ChainSnapshot),
+		Sets:   make(map[string][]string),
+	}
+	tables, err := cc.c.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("while listing tables: %w", err)
+	}
+	var t *nftables.Table
+	for _, et := range tables {
+		if et.Name == name && et.Family == family {
+			t = et
+		}
+	}
+	if t == nil {
+		return &snap, nil
+	}
+	chains, err := cc.c.ListChainsOfTableFamily(family)
+	if err != nil {
+		return nil, fmt.Errorf("while listing chains: %w", err)
+	}
+	for _, c := range chains {
+		if c.Table.Name != name || !owned(c.Name) {
+			continue
+		}
+		rules, err := cc.c.GetRules(t, c)
+		if err != nil {
+			return nil, fmt.Errorf("while listing rules of chain %q: %w", c.Name, err)
+		}
+		cs := ChainSnapshot{Hook: describeChain(c)}
+		for _, r := range rules {
+			r.Table = t
+			cs.Rules = append(cs.Rules, describeRule(r))
+		}
+		snap.Chains[c.Name] = cs
+	}
+	sets, err := cc.c.GetSets(t)
+	if err != nil {
+		return nil, fmt.Errorf("while listing sets: %w", err)
+	}
+	for _, s := range sets {
+		if s.Anonymous || !owned(s.Name) {
+			continue
+		}
+		elems, err := cc.c.GetSetElements(s)
+		if err != nil {
+			return nil, fmt.Errorf("while listing elements of set %q: %w", s.Name, err)
+		}
+		descs := make([]string, 0, len(elems))
+		for _, e := range elems {
+			descs = append(descs, describeElement(e))
+		}
+		sort.Strings(descs)
+		snap.Sets[s.Name] = descs
+	}
+	return &snap, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Diff returns a human-readable list of differences between the expected and
+// the actual snapshot. It is empty if both are consistent.
+func Diff(want, got *Snapshot) []string {
+	var diffs []string
+	for _, name := range sortedKeys(want.Chains) {
+		wc := want.Chains[name]
+		gc, ok := got.Chains[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("chain %q missing", name))
+			continue
+		}
+		if wc.Hook != gc.Hook {
+			diffs = append(diffs, fmt.Sprintf("chain %q: expected %q, got %q", name, wc.Hook, gc.Hook))
+		}
+		if len(wc.Rules) != len(gc.Rules) {
+			diffs = append(diffs, fmt.Sprintf("chain %q: expected %d rules, got %d", name, len(wc.Rules), len(gc.Rules)))
+			continue
+		}
+		for i := range wc.Rules {
+			if wc.Rules[i] != gc.Rules[i] {
+				diffs = append(diffs, fmt.Sprintf("chain %q rule %d: expected %q, got %q", name, i, wc.Rules[i], gc.Rules[i]))
+			}
+		}
+	}
+	for _, name := range sortedKeys(got.Chains) {
+		if _, ok := want.Chains[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected chain %q", name))
+		}
+	}
+	for _, name := range sortedKeys(want.Sets) {
+		gs, ok := got.Sets[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("set %q missing", name))
+			continue
+		}
+		gotElems := make(map[string]bool)
+		for _, e := range gs {
+			gotElems[e] = true
+		}
+		for _, e := range want.Sets[name] {
+			if !gotElems[e] {
+				diffs = append(diffs, fmt.Sprintf("set %q: element %s missing", name, e))
+			}
+			delete(gotElems, e)
+		}
+		for _, e := range gs {
+			if gotElems[e] {
+				diffs = append(diffs, fmt.Sprintf("set %q: unexpected element %s", name, e))
+			}
+		}
+	}
+	for _, name := range sortedKeys(got.Sets) {
+		if _, ok := want.Sets[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected set %q", name))
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,57 @@
+package nfds
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func snapshotWithRule(t *testing.T, port byte, packets uint64) *Snapshot {
+	t.Helper()
+	cc := WrapConn(NewMemory())
+	table := cc.AddTable(&Table{Name: "test"})
+	chain := cc.AddChain(&Chain{Name: "chain", Table: table})
+	cc.AddRule(&Rule{Table: table, Chain: chain, Family: nftables.TableFamilyIPv4, Exprs: []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, port}},
+		&expr.Counter{Packets: packets},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}})
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := cc.TakeSnapshot("test", nftables.TableFamilyIPv4, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap
+}
+
+func TestSnapshotComparesExprContents(t *testing.T) {
+	want := snapshotWithRule(t, 80, 0)
+	if diffs := Diff(want, snapshotWithRule(t, 80, 42)); len(diffs) != 0 {
+		t.Errorf("expected counter values to be ignored, got %v", diffs)
+	}
+	if diffs := Diff(want, snapshotWithRule(t, 81, 0)); len(diffs) != 1 {
+		t.Errorf("expected a single difference in the compared port, got %v", diffs)
+	}
+}
+
+func TestDescribeExprNormalizesGeneratedNames(t *testing.T) {
+	for _, tc := range []struct {
+		a, b expr.Any
+	}{
+		{&expr.Lookup{SourceRegister: 1, SetName: "__set0", SetID: 1}, &expr.Lookup{SourceRegister: 1, SetName: "__set3", SetID: 7}},
+		{&expr.Lookup{SourceRegister: 1, SetName: "__map0", IsDestRegSet: true}, &expr.Lookup{SourceRegister: 1, SetName: "__map2", IsDestRegSet: true}},
+		{&expr.Dynset{SrcRegKey: 1, SetName: "meter", SetID: 1, Operation: 1}, &expr.Dynset{SrcRegKey: 1, SetName: "meter", SetID: 5, Operation: 1}},
+		{&expr.Dynset{SrcRegKey: 1, SetName: "__set0", Operation: 1}, &expr.Dynset{SrcRegKey: 1, SetName: "__set1", Operation: 1}},
+	} {
+		if a, b := describeExpr(2, tc.a), describeExpr(2, tc.b); a != b {
+			t.Errorf("expected generated names and IDs to be ignored, got %q and %q", a, b)
+		}
+	}
+	if a, b := describeExpr(2, &expr.Lookup{SetName: "ips"}), describeExpr(2, &expr.Lookup{SetName: "other"}); a == b {
+		t.Errorf("expected named sets to be distinguished, got %q", a)
+	}
+}
@@ -0,0 +1,20 @@
+package nfds
+
+// OpStats counts the changes sent through a Conn. Every change is counted
+// once, independent of the number of families it is applied to. Changes are
+// counted when they are queued, even if the flush sending them fails later.
+type OpStats struct {
+	ChainsAdded     uint64
+	ChainsDeleted   uint64
+	RulesAdded      uint64
+	RulesDeleted    uint64
+	SetsAdded       uint64
+	SetsDeleted     uint64
+	ElementsAdded   uint64
+	ElementsDeleted uint64
+}
+
+// Stats returns the number of changes sent through cc so far.
+func (cc *Conn) Stats() OpStats {
+	return cc.stats
+}
@@ -1,23 +1,56 @@
 package nfds
 
-import "github.com/google/nftables"
+import (
+	"errors"
+	"fmt"
+	"syscall"
 
+	"github.com/google/nftables"
+	"k8s.io/klog/v2"
+)
+
+// VersionSetName is the name of the set carrying the version marker of a
+// table, see WriteVersion.
+const VersionSetName = "npc_version"
+
+// IdentitySetName is the name of the set carrying the identity of the
+// controller instance managing a table, see WriteIdentity.
+const IdentitySetName = "npc_identity"
+
+// Table is a table in both the IPv4 and IPv6 family. The nftables library does
+// not support table userdata, so markers like the schema version are stored
+// as set comments, see WriteVersion.
 type Table struct {
 	Name  string
 	Use   uint32
 	Flags uint32
+	// Adopt binds to an existing table of the given name instead of creating
+	// it. The table is expected to exist in both families.
+	Adopt bool
 
 	v4 *nftables.Table
+	// v6 is nil if the IPv6 family is not supported, see DetectIPv6. All
+	// objects in the table then only exist in the IPv4 family.
 	v6 *nftables.Table
 }
 
 func (cc *Conn) AddTable(t *Table) *Table {
+	if t.Adopt {
+		t.v4 = &nftables.Table{Name: t.Name, Family: nftables.TableFamilyIPv4}
+		if !cc.noIPv6 {
+			t.v6 = &nftables.Table{Name: t.Name, Family: nftables.TableFamilyIPv6}
+		}
+		return t
+	}
 	t.v4 = cc.c.AddTable(&nftables.Table{
 		Name:   t.Name,
 		Use:    t.Use,
 		Flags:  t.Flags,
 		Family: nftables.TableFamilyIPv4,
 	})
+	if cc.noIPv6 {
+		return t
+	}
 	t.v6 = cc.c.AddTable(&nftables.Table{
 		Name:   t.Name,
 		Use:    t.Use,
@@ -27,7 +60,251 @@ func (cc *Conn) AddTable(t *Table) *Table {
 	return t
 }
 
+// WriteVersion records version as the schema version of the ruleset in the
+// table. The table userdata would be the natural place for it, but the
+// nftables library does not support it, so it is stored as the comment of an
+// empty set named VersionSetName in both families instead.
+func (cc *Conn) WriteVersion(t *Table, version string) error {
+	return cc.AddSet(&Set{
+		Table:    t,
+		Name:     VersionSetName,
+		KeyType:  nftables.TypeMark,
+		KeyType6: nftables.TypeMark,
+		Comment:  version,
+	}, nil)
+}
+
+// ReadVersion returns the version written by WriteVersion to the IPv4 family
+// of the table with the given name. It returns an empty string if the table
+// or the marker do not exist.
+func (cc *Conn) ReadVersion(name string) (string, error) {
+	return cc.readMarker(name, VersionSetName)
+}
+
+// WriteIdentity records identity as the identity of the controller instance
+// managing the table, so objects can be attributed to it when several tools
+// or instances program nftables on the same node. Like the version, it is
+// stored as the comment of an empty set named IdentitySetName in both
+// families. The nftables library does not support chain comments either, so
+// chains are not labeled individually.
+func (cc *Conn) WriteIdentity(t *Table, identity string) error {
+	return cc.AddSet(&Set{
+		Table:    t,
+		Name:     IdentitySetName,
+		KeyType:  nftables.TypeMark,
+		KeyType6: nftables.TypeMark,
+		Comment:  identity,
+	}, nil)
+}
+
+// ReadIdentity returns the identity written by WriteIdentity to the IPv4
+// family of the table with the given name. It returns an empty string if the
+// table or the marker do not exist.
+func (cc *Conn) ReadIdentity(name string) (string, error) {
+	return cc.readMarker(name, IdentitySetName)
+}
+
+// readMarker returns the comment of the set named setName in the IPv4
+// family of the table with the given name.
+func (cc *Conn) readMarker(name, setName string) (string, error) {
+	sets, err := cc.c.GetSets(&nftables.Table{Name: name, Family: nftables.TableFamilyIPv4})
+	if errors.Is(err, syscall.ENOENT) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("while listing sets of table %q: %w", name, err)
+	}
+	for _, s := range sets {
+		if s.Name == setName {
+			return s.Comment, nil
+		}
+	}
+	return "", nil
+}
+
+// DetectIPv6 checks whether tables of the IPv6 family can be created. It is
+// meant to be called once at startup. If an IPv6 table already exists, the
+// family is supported. Otherwise a table with the given name is created
+// exclusively and deleted again in a separate batch, so no existing table is
+// ever deleted. If the family is not supported, for example by minimal
+// kernels built without nf_tables IPv6 support, a warning is logged and
+// tables added afterwards only exist in the IPv4 family. Other errors are
+// returned. Scripts recording the changes of cc are bypassed, as the probe is
+// not part of the ruleset.
+func (cc *Conn) DetectIPv6(name string) error {
+	b := cc.c
+	for {
+		s, ok := b.(*Script)
+		if !ok {
+			break
+		}
+		b = s.Backend
+	}
+	tables, err := b.ListTables()
+	if err != nil {
+		return fmt.Errorf("while listing tables: %w", err)
+	}
+	for _, t := range tables {
+		if t.Family == nftables.TableFamilyIPv6 {
+			return nil
+		}
+	}
+	creator, ok := b.(tableCreator)
+	if !ok {
+		return fmt.Errorf("backend %T cannot create tables exclusively", b)
+	}
+	probe := &nftables.Table{Name: name, Family: nftables.TableFamilyIPv6}
+	creator.CreateTable(probe)
+	b.DelTable(probe)
+	err = b.Flush()
+	if errors.Is(err, syscall.EEXIST) {
+		// Created concurrently, the batch was aborted without deleting it
+		return nil
+	}
+	if errors.Is(err, syscall.EAFNOSUPPORT) || errors.Is(err, syscall.EOPNOTSUPP) {
+		klog.Warningf("IPv6 nftables family not supported, only handling IPv4 traffic: %v", err)
+		cc.noIPv6 = true
+		return nil
+	}
+	return err
+}
+
+// tableCreator is implemented by backends which can create a table only if
+// it does not exist yet, like nft create table.
+type tableCreator interface {
+	CreateTable(t *nftables.Table) *nftables.Table
+}
+
+var (
+	_ tableCreator = (*nftables.Conn)(nil)
+	_ tableCreator = (*Memory)(nil)
+)
+
+// IPv6 returns false if the IPv6 family was found to be unsupported by
+// DetectIPv6.
+func (cc *Conn) IPv6() bool {
+	return !cc.noIPv6
+}
+
+// families returns the tables of t in all supported families.
+func (t *Table) families() []*nftables.Table {
+	if t.v6 == nil {
+		return []*nftables.Table{t.v4}
+	}
+	return []*nftables.Table{t.v4, t.v6}
+}
+
 func (cc *Conn) FlushTable(t *Table) {
-	cc.c.FlushTable(t.v4)
-	cc.c.FlushTable(t.v6)
+	for _, tt := range t.families() {
+		cc.c.FlushTable(tt)
+	}
+}
+
+// ListOwned returns descriptions of all chains, named sets and counters in
+// the table for which owned returns true, like "ip chain foo".
+func (cc *Conn) ListOwned(t *Table, owned func(name string) bool) ([]string, error) {
+	var out []string
+	for _, tt := range t.families() {
+		family := "ip"
+		if tt.Family == nftables.TableFamilyIPv6 {
+			family = "ip6"
+		}
+		chains, err := cc.c.ListChainsOfTableFamily(tt.Family)
+		if err != nil {
+			return nil, fmt.Errorf("while listing chains: %w", err)
+		}
+		for _, c := range chains {
+			if c.Table.Name == tt.Name && owned(c.Name) {
+				out = append(out, fmt.Sprintf("%s chain %s", family, c.Name))
+			}
+		}
+		sets, err := cc.c.GetSets(tt)
+		if err != nil {
+			return nil, fmt.Errorf("while listing sets of table %q: %w", tt.Name, err)
+		}
+		for _, s := range sets {
+			if !s.Anonymous && owned(s.Name) {
+				out = append(out, fmt.Sprintf("%s set %s", family, s.Name))
+			}
+		}
+		objs, err := cc.ownedCounters(tt, owned)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objs {
+			out = append(out, fmt.Sprintf("%s counter %s", family, o.Name))
+		}
+	}
+	return out, nil
+}
+
+// DelOwned deletes all chains, named sets and counters in the table for which
+// owned returns true. Rules in owned chains are flushed first so references
+// between owned objects do not prevent their deletion.
+func (cc *Conn) DelOwned(t *Table, owned func(name string) bool) error {
+	return cc.delOwned(t, owned, true)
+}
+
+// DelOwnedKeepCounters is like DelOwned, but keeps counters. Adding them again
+// keeps their values, so they survive the ruleset being replaced.
+func (cc *Conn) DelOwnedKeepCounters(t *Table, owned func(name string) bool) error {
+	return cc.delOwned(t, owned, false)
+}
+
+func (cc *Conn) delOwned(t *Table, owned func(name string) bool, counters bool) error {
+	for _, tt := range t.families() {
+		chains, err := cc.c.ListChainsOfTableFamily(tt.Family)
+		if err != nil {
+			return fmt.Errorf("while listing chains: %w", err)
+		}
+		var ownedChains []*nftables.Chain
+		for _, c := range chains {
+			if c.Table.Name == tt.Name && owned(c.Name) {
+				c.Table = tt
+				ownedChains = append(ownedChains, c)
+				cc.c.FlushChain(c)
+			}
+		}
+		sets, err := cc.c.GetSets(tt)
+		if err != nil {
+			return fmt.Errorf("while listing sets of table %q: %w", tt.Name, err)
+		}
+		for _, s := range sets {
+			if !s.Anonymous && owned(s.Name) {
+				cc.c.DelSet(s)
+			}
+		}
+		for _, c := range ownedChains {
+			cc.c.DelChain(c)
+		}
+		if !counters {
+			continue
+		}
+		objs, err := cc.ownedCounters(tt, owned)
+		if err != nil {
+			return err
+		}
+		for _, o := range objs {
+			cc.c.DeleteObject(o)
+		}
+	}
+	return nil
+}
+
+// ownedCounters returns the counter objects in tt for which owned returns
+// true.
+func (cc *Conn) ownedCounters(tt *nftables.Table, owned func(name string) bool) ([]*nftables.NamedObj, error) {
+	objs, err := cc.c.GetNamedObjects(tt)
+	if err != nil {
+		return nil, fmt.Errorf("while listing objects of table %q: %w", tt.Name, err)
+	}
+	var out []*nftables.NamedObj
+	for _, o := range objs {
+		no, ok := o.(*nftables.NamedObj)
+		if ok && no.Type == nftables.ObjTypeCounter && owned(no.Name) {
+			no.Table = tt
+			out = append(out, no)
+		}
+	}
+	return out, nil
 }
@@ -0,0 +1,67 @@
+package nfds
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestVersionRoundTrip(t *testing.T) {
+	cc := WrapConn(NewMemory())
+	if v, err := cc.ReadVersion("test"); err != nil || v != "" {
+		t.Fatalf("expected no version for missing table, got %q, %v", v, err)
+	}
+	table := cc.AddTable(&Table{Name: "test"})
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cc.ReadVersion("test"); err != nil || v != "" {
+		t.Fatalf("expected no version for table without marker, got %q, %v", v, err)
+	}
+	if err := cc.WriteVersion(table, "42"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cc.ReadVersion("test"); err != nil || v != "42" {
+		t.Errorf("expected version 42, got %q, %v", v, err)
+	}
+}
+
+func TestDetectIPv6(t *testing.T) {
+	mem := NewMemory()
+	mem.DisableFamily(nftables.TableFamilyIPv6)
+	cc := WrapConn(mem)
+	if err := cc.DetectIPv6("probe"); err != nil {
+		t.Fatal(err)
+	}
+	if cc.IPv6() {
+		t.Error("expected IPv6 to be detected as unsupported")
+	}
+	if tables, _ := mem.ListTables(); len(tables) != 0 {
+		t.Errorf("expected probe to leave no tables behind, got %v", tables)
+	}
+
+	// An existing table named like the probe is never deleted
+	mem = NewMemory()
+	existing := &nftables.Table{Name: "probe", Family: nftables.TableFamilyIPv6}
+	mem.AddTable(existing)
+	cc = WrapConn(mem)
+	if err := cc.DetectIPv6("probe"); err != nil {
+		t.Fatal(err)
+	}
+	if tables, _ := mem.ListTables(); len(tables) != 1 || !cc.IPv6() {
+		t.Errorf("expected existing table to be kept and IPv6 to be supported, got %v", tables)
+	}
+
+	// Without any IPv6 table, the probe is created and deleted again
+	mem = NewMemory()
+	cc = WrapConn(mem)
+	if err := cc.DetectIPv6("probe"); err != nil {
+		t.Fatal(err)
+	}
+	if tables, _ := mem.ListTables(); len(tables) != 0 || !cc.IPv6() {
+		t.Errorf("expected IPv6 to be supported without leftover tables, got %v", tables)
+	}
+}
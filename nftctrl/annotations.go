@@ -0,0 +1,641 @@
+package nftctrl
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+)
+
+// Annotations on NetworkPolicies enabling non-standard extensions.
+const (
+	annotationPrefix = "npc.dolansoft.org/"
+
+	// annotationTCPFlags restricts TCP packets permitted by a policy to ones
+	// where (flags & mask) == value, written as value/mask, e.g. syn/syn,ack.
+	// If the mask is omitted, it is equal to the value. As established and
+	// related traffic is accepted before policies are evaluated, this only
+	// affects packets of new connections. It is not supported with
+	// Config.Stateless.
+	annotationTCPFlags = annotationPrefix + "tcp-flags"
+
+	// annotationSourcePorts restricts the source ports of traffic permitted
+	// by a single rule to a comma-separated list of ports or port ranges,
+	// e.g. 53,1024-65535. The key is suffixed with the direction and index
+	// of the rule, e.g. source-ports-ingress-0. As only TCP, UDP and SCTP
+	// have ports, the rule is restricted to these protocols as well.
+	annotationSourcePorts = annotationPrefix + "source-ports"
+
+	// annotationMode selects whether a policy is enforced (enforce, the
+	// default) or only audited (audit). Traffic to or from pods selected only
+	// by audited policies in a direction which is not permitted by them is
+	// logged and accepted instead of being rejected.
+	annotationMode = annotationPrefix + "mode"
+
+	// annotationLimit rate-limits the new connections permitted by each rule
+	// of a policy, written as rate/unit with an optional burst, e.g.
+	// 10/second or 100/minute burst 20. Units are second, minute, hour, day
+	// and week. Each rule has a separate limit per IP family, which is shared
+	// by all peers.
+	annotationLimit = annotationPrefix + "limit"
+
+	// annotationInterfaceGroup restricts a policy to traffic through pod
+	// interfaces in the given interface group, which is the output interface
+	// for ingress and the input interface for egress. Pods selected by the
+	// policy are still isolated by it on other interfaces. This allows
+	// routers serving multiple networks to permit traffic per network.
+	annotationInterfaceGroup = annotationPrefix + "interface-group"
+
+	// annotationPacketLength restricts the packets permitted by a single
+	// rule to ones whose total IP length including the IP header is in the
+	// given range, written as min-max, e.g. 64-1500. Either bound can be
+	// omitted. Like source-ports, the key is suffixed with the direction and
+	// index of the rule, e.g. packet-length-ingress-0. Only the first packet
+	// of a connection is checked, as established connections are accepted
+	// before policies are evaluated.
+	annotationPacketLength = annotationPrefix + "packet-length"
+
+	// annotationActiveTime restricts the traffic permitted by a policy to a
+	// window of days of the week and/or times of the day in UTC, written as
+	// [day[-day]] [hh:mm-hh:mm], e.g. mon-fri 08:00-18:00. The end time is
+	// exclusive. Windows wrap around the end of the week and midnight if the
+	// end is before the start, e.g. 22:00-06:00.
+	annotationActiveTime = annotationPrefix + "active-time"
+
+	// annotationReadyPeers restricts the pods selected as peers by a policy
+	// to Ready ones if set to true. Requires Config.ReadyPeers.
+	annotationReadyPeers = annotationPrefix + "ready-peers"
+
+	// annotationFQDNs adds the addresses of a comma-separated list of
+	// domain names as peers of a single egress rule, e.g.
+	// fqdns-egress-0: example.com,api.example.org. If the rule has no peers,
+	// it is restricted to them instead of permitting all peers. The names
+	// are resolved periodically, so this is best-effort, see
+	// Config.FQDNPeers.
+	annotationFQDNs = annotationPrefix + "fqdns"
+)
+
+// Annotations on pods pinning their traffic to layer 2 addresses if
+// Config.L2AntiSpoofing is set.
+const (
+	// annotationMAC is the MAC address traffic from the IPs of a pod has to
+	// originate from, e.g. 02:42:ac:11:00:02.
+	annotationMAC = annotationPrefix + "mac"
+
+	// annotationVLAN is the VLAN ID traffic from the IPs of a pod has to be
+	// tagged with, e.g. 100.
+	annotationVLAN = annotationPrefix + "vlan"
+
+	// annotationNetworkStatus is set by Multus and other CNI meta plugins to
+	// the interfaces of a pod. The MAC address of its default network is
+	// used if annotationMAC is not set.
+	annotationNetworkStatus = "k8s.v1.cni.cncf.io/network-status"
+)
+
+// annotationInterface is the name of the node interface the IPs of a pod are
+// reachable through, used by RouteIfaceResolver instead of the routing
+// table. It tells apart pods using the same IP on different interfaces,
+// which have the same route.
+const annotationInterface = annotationPrefix + "interface"
+
+// annotationLabelDomain is the domain of pseudo-labels holding pod
+// annotations.
+const annotationLabelDomain = "annotation.npc.dolansoft.org"
+
+// AnnotationLabelKey returns the key of the pseudo-label holding the pod
+// annotation with the given key if it is listed in SelectorAnnotations. As
+// label keys can only have a single prefix, the prefix of the annotation is
+// prepended to the domain of the pseudo-label, e.g. example.com/team becomes
+// example.com.annotation.npc.dolansoft.org/team. Unprefixed annotations use
+// the domain as their prefix, e.g. annotation.npc.dolansoft.org/team.
+func AnnotationLabelKey(key string) string {
+	prefix, name, ok := strings.Cut(key, "/")
+	if !ok {
+		return annotationLabelDomain + "/" + key
+	}
+	return prefix + "." + annotationLabelDomain + "/" + name
+}
+
+// isAnnotationLabelKey returns true if key is in the domain of pseudo-labels
+// returned by AnnotationLabelKey.
+func isAnnotationLabelKey(key string) bool {
+	prefix, _, ok := strings.Cut(key, "/")
+	return ok && (prefix == annotationLabelDomain || strings.HasSuffix(prefix, "."+annotationLabelDomain))
+}
+
+// extensionAnnotations returns the subset of annotations which enable
+// extensions, or nil if there are none.
+func extensionAnnotations(annotations map[string]string) map[string]string {
+	var out map[string]string
+	for k, v := range annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			if out == nil {
+				out = make(map[string]string)
+			}
+			out[k] = v
+		}
+	}
+	return out
+}
+
+var tcpFlagBits = map[string]uint8{
+	"fin": 0x01,
+	"syn": 0x02,
+	"rst": 0x04,
+	"psh": 0x08,
+	"ack": 0x10,
+	"urg": 0x20,
+	"ece": 0x40,
+	"cwr": 0x80,
+}
+
+func parseTCPFlagList(s string) (uint8, error) {
+	var out uint8
+	for _, f := range strings.Split(s, ",") {
+		bit, ok := tcpFlagBits[strings.TrimSpace(f)]
+		if !ok {
+			return 0, fmt.Errorf("unknown TCP flag %q", f)
+		}
+		out |= bit
+	}
+	return out, nil
+}
+
+// parseTCPFlags parses a value/mask TCP flags specification.
+func parseTCPFlags(s string) (value, mask uint8, err error) {
+	valueStr, maskStr, hasMask := strings.Cut(s, "/")
+	value, err = parseTCPFlagList(valueStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	mask = value
+	if hasMask {
+		mask, err = parseTCPFlagList(maskStr)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if value&mask != value {
+		return 0, 0, fmt.Errorf("value contains flags not in mask")
+	}
+	return value, mask, nil
+}
+
+// addTCPFlagsFilter adds a rule to the head of a policy chain which returns
+// from it for TCP packets not matching the policy's TCP flags annotation,
+// thus preventing all of the policy's rules from accepting them.
+func (c *Controller) addTCPFlagsFilter(ch *nfds.Chain, policy *nwkv1.NetworkPolicy) {
+	spec, ok := policy.Annotations[annotationTCPFlags]
+	if !ok {
+		return
+	}
+	value, mask, err := parseTCPFlags(spec)
+	if err == nil && c.cfg.Stateless {
+		// Every packet of a connection traverses the policy chains
+		err = fmt.Errorf("not supported in stateless mode")
+	}
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", annotationTCPFlags, err)
+		return
+	}
+	c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: []expr.Any{
+			// Only applies to TCP
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: newRegOffset + 0},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: []byte{unix.IPPROTO_TCP}},
+			// Load TCP flags into register 1
+			&expr.Payload{Base: expr.PayloadBaseTransportHeader, DestRegister: newRegOffset + 1, Offset: 13, Len: 1},
+			&expr.Bitwise{SourceRegister: newRegOffset + 1, DestRegister: newRegOffset + 1, Len: 1, Mask: []byte{mask}, Xor: []byte{0}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: newRegOffset + 1, Data: []byte{value}},
+			&expr.Verdict{Kind: expr.VerdictReturn},
+		},
+	})
+}
+
+// parsePortRanges parses a comma-separated list of ports or port ranges.
+func parsePortRanges(s string) (*ranges.Ranges[uint16], error) {
+	out := ranges.New[uint16]()
+	for _, item := range strings.Split(s, ",") {
+		startStr, endStr, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		start, err := strconv.ParseUint(startStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", startStr)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.ParseUint(endStr, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", endStr)
+			}
+			if end < start {
+				return nil, fmt.Errorf("port range %q is reversed", item)
+			}
+		}
+		out.Add(ranges.Range[uint16]{Start: uint16(start), End: uint16(end)})
+	}
+	return out, nil
+}
+
+// ruleAnnotationKey returns the key of the annotation with the given prefix
+// for the idx-th rule in direction dir.
+func ruleAnnotationKey(prefix string, dir direction, idx int) string {
+	dirName := "ingress"
+	if dir == dirEgress {
+		dirName = "egress"
+	}
+	return fmt.Sprintf("%s-%s-%d", prefix, dirName, idx)
+}
+
+// ruleSourcePorts returns the source ports per protocol the idx-th rule in
+// direction dir of policy is restricted to, or nil if it is not restricted.
+func (c *Controller) ruleSourcePorts(policy *nwkv1.NetworkPolicy, dir direction, idx int) []RuleNumberedPortMeta {
+	key := ruleAnnotationKey(annotationSourcePorts, dir, idx)
+	spec, ok := policy.Annotations[key]
+	if !ok {
+		return nil
+	}
+	ports, err := parsePortRanges(spec)
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", key, err)
+		return nil
+	}
+	var out []RuleNumberedPortMeta
+	for _, proto := range []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP} {
+		for it := ports.Iterator(); it.Valid(); it.Next() {
+			rng := it.Item()
+			out = append(out, RuleNumberedPortMeta{Protocol: proto, Port: rng.Start, EndPort: rng.End})
+		}
+	}
+	return out
+}
+
+// ipv6HeaderLen is the length of the fixed IPv6 header, which is not
+// included in its payload length field.
+const ipv6HeaderLen = 40
+
+// parsePacketLength parses a min-max packet length range.
+func parsePacketLength(s string) (ranges.Range[uint16], error) {
+	minStr, maxStr, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return ranges.Range[uint16]{}, fmt.Errorf("expected min-max")
+	}
+	out := ranges.Range[uint16]{Start: 0, End: math.MaxUint16}
+	if minStr != "" {
+		v, err := strconv.ParseUint(minStr, 10, 16)
+		if err != nil {
+			return out, fmt.Errorf("invalid minimum length %q", minStr)
+		}
+		out.Start = uint16(v)
+	}
+	if maxStr != "" {
+		v, err := strconv.ParseUint(maxStr, 10, 16)
+		if err != nil {
+			return out, fmt.Errorf("invalid maximum length %q", maxStr)
+		}
+		out.End = uint16(v)
+	}
+	if out.End < out.Start {
+		return out, fmt.Errorf("length range %q is reversed", s)
+	}
+	if out.End < ipv6HeaderLen {
+		return out, fmt.Errorf("maximum length %d is shorter than an IPv6 header", out.End)
+	}
+	return out, nil
+}
+
+// rulePacketLength returns the range of packet lengths the idx-th rule in
+// direction dir of policy is restricted to, or nil if it is not restricted.
+func (c *Controller) rulePacketLength(policy *nwkv1.NetworkPolicy, dir direction, idx int) *ranges.Range[uint16] {
+	key := ruleAnnotationKey(annotationPacketLength, dir, idx)
+	spec, ok := policy.Annotations[key]
+	if !ok {
+		return nil
+	}
+	length, err := parsePacketLength(spec)
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", key, err)
+		return nil
+	}
+	return &length
+}
+
+// matchPacketLength returns expressions matching packets whose total IP
+// length is in rng. IPv4 has a total length field, while the payload length
+// field of IPv6 excludes the fixed header.
+func matchPacketLength(rng ranges.Range[uint16]) []expr.Any {
+	return []expr.Any{
+		// Load length field into register 0
+		&expr.Dynamic{
+			Expr: func(fam uint8) expr.Any {
+				var offset uint32 = 2
+				if fam == unix.NFPROTO_IPV6 {
+					offset = 4
+				}
+				return &expr.Payload{Base: expr.PayloadBaseNetworkHeader, DestRegister: newRegOffset + 0, Offset: offset, Len: 2}
+			},
+		},
+		&expr.Dynamic{
+			Expr: func(fam uint8) expr.Any {
+				start, end := rng.Start, rng.End
+				if fam == unix.NFPROTO_IPV6 {
+					start = max(start, ipv6HeaderLen) - ipv6HeaderLen
+					end -= ipv6HeaderLen
+				}
+				return &expr.Range{
+					Op:       expr.CmpOpEq,
+					Register: newRegOffset + 0,
+					FromData: binaryutil.BigEndian.PutUint16(start),
+					ToData:   binaryutil.BigEndian.PutUint16(end),
+				}
+			},
+		},
+	}
+}
+
+// ruleExtensions contains the settings of a rule given by annotations.
+type ruleExtensions struct {
+	srcPorts     []RuleNumberedPortMeta
+	packetLength *ranges.Range[uint16]
+	fqdns        []string
+	limit        *expr.Limit
+	counter      *nfds.Counter
+	// podIPSets are the pod IP sets of the rules of the policy created so
+	// far by their peer selectors, which later rules with the same peer
+	// selectors share.
+	podIPSets map[string]*podIPSet
+}
+
+// extensionExprs returns expressions implementing the extensions of r for
+// the traffic permitted on side s. They
+// need to be placed directly before the verdict of every accepting rule, so
+// only packets matching the rest of the rule count towards the limit. As with
+// portProtoExprs, the expressions must not be shared between rules.
+func (c *Controller) extensionExprs(r *Rule, s ruleSide, family nftables.TableFamily) []expr.Any {
+	exprs := c.matchPortProtos(r.SourcePortMeta, s.loadSrcPort, family)
+	if r.PacketLength != nil {
+		exprs = append(exprs, matchPacketLength(*r.PacketLength)...)
+	}
+	if s.reply {
+		// Replies are not limited or counted, so both only see the
+		// permitted traffic itself
+		return exprs
+	}
+	if r.limit != nil {
+		limit := *r.limit
+		exprs = append(exprs, &limit)
+	}
+	if r.counter != nil {
+		exprs = append(exprs, nfds.CounterRef(r.counter))
+	}
+	return exprs
+}
+
+var limitUnits = map[string]expr.LimitTime{
+	"second": expr.LimitTimeSecond,
+	"minute": expr.LimitTimeMinute,
+	"hour":   expr.LimitTimeHour,
+	"day":    expr.LimitTimeDay,
+	"week":   expr.LimitTimeWeek,
+}
+
+// parseLimit parses a rate/unit [burst n] limit specification.
+func parseLimit(s string) (*expr.Limit, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "burst") {
+		return nil, fmt.Errorf("expected rate/unit [burst n]")
+	}
+	rateStr, unitStr, ok := strings.Cut(fields[0], "/")
+	if !ok {
+		return nil, fmt.Errorf("expected rate/unit, got %q", fields[0])
+	}
+	rate, err := strconv.ParseUint(rateStr, 10, 64)
+	if err != nil || rate == 0 {
+		return nil, fmt.Errorf("invalid rate %q", rateStr)
+	}
+	unit, ok := limitUnits[unitStr]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %q", unitStr)
+	}
+	limit := &expr.Limit{Type: expr.LimitTypePkts, Rate: rate, Unit: unit}
+	if len(fields) == 3 {
+		burst, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid burst %q", fields[2])
+		}
+		limit.Burst = uint32(burst)
+	}
+	return limit, nil
+}
+
+// policyLimit returns the limit of the rules of policy, or nil if they are
+// not limited.
+func (c *Controller) policyLimit(policy *nwkv1.NetworkPolicy) *expr.Limit {
+	spec, ok := policy.Annotations[annotationLimit]
+	if !ok {
+		return nil
+	}
+	limit, err := parseLimit(spec)
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", annotationLimit, err)
+		return nil
+	}
+	return limit
+}
+
+// policyIfaceGroup returns the interface group policy is restricted to, or 0
+// if it applies to all interfaces.
+func (c *Controller) policyIfaceGroup(policy *nwkv1.NetworkPolicy) uint32 {
+	spec, ok := policy.Annotations[annotationInterfaceGroup]
+	if !ok {
+		return 0
+	}
+	group, err := strconv.ParseUint(spec, 0, 32)
+	if err == nil && group == 0 {
+		err = fmt.Errorf("group 0 matches interfaces without a group")
+	}
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", annotationInterfaceGroup, err)
+		return 0
+	}
+	return uint32(group)
+}
+
+// policyReadyPeers returns true if policy only selects Ready pods as peers.
+func (c *Controller) policyReadyPeers(policy *nwkv1.NetworkPolicy) bool {
+	spec, ok := policy.Annotations[annotationReadyPeers]
+	if !ok {
+		return false
+	}
+	ready, err := strconv.ParseBool(spec)
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", annotationReadyPeers, err)
+		return false
+	}
+	if ready && !c.cfg.ReadyPeers {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s requires pod readiness to be tracked, ignoring", annotationReadyPeers)
+		return false
+	}
+	return ready
+}
+
+// policyAudited returns true if policy is in audit mode.
+func (c *Controller) policyAudited(policy *nwkv1.NetworkPolicy) bool {
+	mode, ok := policy.Annotations[annotationMode]
+	if !ok {
+		return false
+	}
+	switch mode {
+	case "enforce":
+		return false
+	case "audit":
+		return true
+	default:
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s has unknown mode %q, enforcing policy", annotationMode, mode)
+		return false
+	}
+}
+
+// activeTime is a window in which a policy permits traffic.
+type activeTime struct {
+	// firstDay and lastDay are the days of the week of the window, with 0
+	// being Sunday. If lastDay is before firstDay, the window wraps around
+	// the end of the week.
+	firstDay, lastDay uint8
+	allDays           bool
+	// start and end are the seconds since midnight UTC of the window, end
+	// being exclusive. If end is before start, the window wraps around
+	// midnight.
+	start, end uint32
+	allHours   bool
+}
+
+var dayNumbers = map[string]uint8{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseTimeOfDay parses a hh:mm time. 24:00 is permitted as the end of a
+// day.
+func parseTimeOfDay(s string) (uint32, error) {
+	hStr, mStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("expected hh:mm, got %q", s)
+	}
+	h, err := strconv.ParseUint(hStr, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hour %q", hStr)
+	}
+	m, err := strconv.ParseUint(mStr, 10, 8)
+	if err != nil || m >= 60 {
+		return 0, fmt.Errorf("invalid minute %q", mStr)
+	}
+	secs := uint32(h*3600 + m*60)
+	if secs > 24*3600 {
+		return 0, fmt.Errorf("time %q is after the end of the day", s)
+	}
+	return secs, nil
+}
+
+// parseActiveTime parses an active time window specification.
+func parseActiveTime(s string) (activeTime, error) {
+	at := activeTime{allDays: true, allHours: true}
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return at, fmt.Errorf("expected [day[-day]] [hh:mm-hh:mm]")
+	}
+	for i, f := range fields {
+		first, last, isRange := strings.Cut(f, "-")
+		if strings.Contains(f, ":") {
+			if i != len(fields)-1 || !isRange {
+				return at, fmt.Errorf("expected time range hh:mm-hh:mm, got %q", f)
+			}
+			var err error
+			if at.start, err = parseTimeOfDay(first); err != nil {
+				return at, err
+			}
+			if at.end, err = parseTimeOfDay(last); err != nil {
+				return at, err
+			}
+			if at.start == at.end || at.start == 24*3600 {
+				return at, fmt.Errorf("time range %q is empty", f)
+			}
+			at.allHours = at.start == 0 && at.end == 24*3600
+			continue
+		}
+		if i != 0 {
+			return at, fmt.Errorf("expected time range hh:mm-hh:mm, got %q", f)
+		}
+		if !isRange {
+			last = first
+		}
+		var ok bool
+		if at.firstDay, ok = dayNumbers[strings.ToLower(first)]; !ok {
+			return at, fmt.Errorf("unknown day %q", first)
+		}
+		if at.lastDay, ok = dayNumbers[strings.ToLower(last)]; !ok {
+			return at, fmt.Errorf("unknown day %q", last)
+		}
+		at.allDays = (at.lastDay+1)%7 == at.firstDay
+	}
+	return at, nil
+}
+
+// matchOutside returns a range expression on the value loaded into register
+// 0 which matches outside of [first, last], where last may be before first
+// to wrap around. As values are compared as big endian byte strings, data
+// encodes them.
+func matchOutside[T uint8 | uint32](first, last T, data func(T) []byte) *expr.Range {
+	if first <= last {
+		return &expr.Range{Op: expr.CmpOpNeq, Register: newRegOffset + 0, FromData: data(first), ToData: data(last)}
+	}
+	return &expr.Range{Op: expr.CmpOpEq, Register: newRegOffset + 0, FromData: data(last + 1), ToData: data(first - 1)}
+}
+
+// addActiveTimeFilter adds rules to the head of a policy chain which return
+// from it outside of the policy's active time window. The kernel evaluates
+// the time in UTC.
+func (c *Controller) addActiveTimeFilter(ch *nfds.Chain, policy *nwkv1.NetworkPolicy) {
+	spec, ok := policy.Annotations[annotationActiveTime]
+	if !ok {
+		return
+	}
+	at, err := parseActiveTime(spec)
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", annotationActiveTime, err)
+		return
+	}
+	if !at.allDays {
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: ch,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: nfds.MetaKeyTimeDay, Register: newRegOffset + 0},
+				matchOutside(at.firstDay, at.lastDay, func(d uint8) []byte { return []byte{d} }),
+				&expr.Verdict{Kind: expr.VerdictReturn},
+			},
+		})
+	}
+	if !at.allHours {
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: ch,
+			Exprs: []expr.Any{
+				&expr.Meta{Key: nfds.MetaKeyTimeHour, Register: newRegOffset + 0},
+				// Ranges are compared in network byte order
+				&expr.Byteorder{SourceRegister: newRegOffset + 0, DestRegister: newRegOffset + 0, Op: expr.ByteorderHton, Len: 4, Size: 4},
+				matchOutside(at.start, at.end-1, binaryutil.BigEndian.PutUint32),
+				&expr.Verdict{Kind: expr.VerdictReturn},
+			},
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package nftctrl
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+// syntheticCluster is a cluster of pods and policies with varied selectors
+// used for benchmarks.
+type syntheticCluster struct {
+	namespaces []*corev1.Namespace
+	pods       []*corev1.Pod
+	policies   []*nwkv1.NetworkPolicy
+}
+
+// newSyntheticCluster generates numNS namespaces with podsPerNS pods and
+// policiesPerNS policies each.
+func newSyntheticCluster(numNS, podsPerNS, policiesPerNS int) *syntheticCluster {
+	var sc syntheticCluster
+	ip4 := netip.MustParseAddr("10.0.0.1")
+	ip6 := netip.MustParseAddr("fd00::1")
+	for n := range numNS {
+		ns := fmt.Sprintf("ns-%d", n)
+		sc.namespaces = append(sc.namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   ns,
+			Labels: map[string]string{"team": fmt.Sprintf("team-%d", n%5)},
+		}})
+		for i := range podsPerNS {
+			pod := testPod(ns, fmt.Sprintf("pod-%d", i), map[string]string{
+				"app":  fmt.Sprintf("app-%d", i%20),
+				"tier": fmt.Sprintf("tier-%d", i%3),
+			}, ip4.String(), ip6.String())
+			pod.Spec.Containers = []corev1.Container{{Name: "main", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}
+			sc.pods = append(sc.pods, pod)
+			ip4, ip6 = ip4.Next(), ip6.Next()
+		}
+		for i := range policiesPerNS {
+			sc.policies = append(sc.policies, syntheticPolicy(ns, i))
+		}
+	}
+	return &sc
+}
+
+// syntheticPolicy returns one of several kinds of policies depending on i.
+func syntheticPolicy(ns string, i int) *nwkv1.NetworkPolicy {
+	port := intstr.FromInt32(int32(80 + i%10))
+	namedPort := intstr.FromString("http")
+	endPort := int32(9000)
+	nwp := &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: fmt.Sprintf("pol-%d", i)},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": fmt.Sprintf("app-%d", i%20)}},
+		},
+	}
+	switch i % 4 {
+	case 0:
+		nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{
+			From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": fmt.Sprintf("tier-%d", i%3)}}}},
+			Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+		}}
+	case 1:
+		nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{
+			From: []nwkv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": fmt.Sprintf("team-%d", i%5)}},
+				PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "tier-0"}},
+			}},
+			Ports: []nwkv1.NetworkPolicyPort{{Port: &namedPort}},
+		}}
+	case 2:
+		nwp.Spec.PolicyTypes = []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress}
+		nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{
+			From: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.168.0.0/16", Except: []string{"192.168.1.0/24"}}}},
+		}}
+		nwp.Spec.Egress = []nwkv1.NetworkPolicyEgressRule{{
+			To:    []nwkv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}}},
+			Ports: []nwkv1.NetworkPolicyPort{{Port: &port, EndPort: &endPort}},
+		}}
+	case 3:
+		nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{
+			From: []nwkv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      "team",
+					Operator: metav1.LabelSelectorOpIn,
+					Values:   []string{"team-0", "team-1"},
+				}}},
+			}},
+		}}
+	}
+	return nwp
+}
+
+// apply adds all objects of the cluster to c in the order of an initial
+// sync.
+func (sc *syntheticCluster) apply(c *Controller) {
+	for _, ns := range sc.namespaces {
+		c.SetNamespace(ns.Name, ns)
+	}
+	for _, nwp := range sc.policies {
+		c.SetNetworkPolicy(cache.MetaObjectToName(nwp), nwp)
+	}
+	for _, pod := range sc.pods {
+		c.SetPod(cache.MetaObjectToName(pod), pod)
+	}
+}
+
+func BenchmarkInitialSync(b *testing.B) {
+	sc := newSyntheticCluster(50, 100, 10)
+	b.ResetTimer()
+	for range b.N {
+		b.StopTimer()
+		c, _, _ := newTestController(b, Config{})
+		b.StartTimer()
+		sc.apply(c)
+		mustFlush(b, c)
+	}
+}
+
+func BenchmarkAddPod(b *testing.B) {
+	sc := newSyntheticCluster(50, 100, 10)
+	c, _, _ := newTestController(b, Config{})
+	sc.apply(c)
+	mustFlush(b, c)
+	pod := testPod("ns-0", "new", map[string]string{"app": "app-0", "tier": "tier-0"}, "10.255.0.1", "fd00:ff::1")
+	name := cache.MetaObjectToName(pod)
+	b.ResetTimer()
+	for range b.N {
+		c.SetPod(name, pod)
+		mustFlush(b, c)
+		b.StopTimer()
+		c.SetPod(name, nil)
+		mustFlush(b, c)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkUpdateNamespaceLabels(b *testing.B) {
+	sc := newSyntheticCluster(50, 100, 10)
+	c, _, _ := newTestController(b, Config{})
+	sc.apply(c)
+	mustFlush(b, c)
+	// Flip between two teams selected by different policies
+	nsA := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns-0", Labels: map[string]string{"team": "team-1"}}}
+	nsB := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns-0", Labels: map[string]string{"team": "team-2"}}}
+	b.ResetTimer()
+	for i := range b.N {
+		ns := nsA
+		if i%2 == 1 {
+			ns = nsB
+		}
+		c.SetNamespace(ns.Name, ns)
+		mustFlush(b, c)
+	}
+}
+
+// BenchmarkAddNamespace adds a namespace selected by many rules before any
+// pods are created in it, as happens when deploying new applications.
+func BenchmarkAddNamespace(b *testing.B) {
+	sc := newSyntheticCluster(50, 100, 10)
+	c, _, _ := newTestController(b, Config{})
+	sc.apply(c)
+	mustFlush(b, c)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "new", Labels: map[string]string{"team": "team-0"}}}
+	b.ResetTimer()
+	for range b.N {
+		c.SetNamespace(ns.Name, ns)
+		mustFlush(b, c)
+		b.StopTimer()
+		c.SetNamespace(ns.Name, nil)
+		mustFlush(b, c)
+		b.StartTimer()
+	}
+}
+
+// BenchmarkManyPoliciesPerPod adds a pod selected by 500 policies, which all
+// get a jump rule in its chains.
+func BenchmarkManyPoliciesPerPod(b *testing.B) {
+	c, _, _ := newTestController(b, Config{})
+	for i := range 500 {
+		nwp := syntheticPolicy("default", i)
+		nwp.Spec.PodSelector = metav1.LabelSelector{}
+		c.SetNetworkPolicy(cache.MetaObjectToName(nwp), nwp)
+	}
+	mustFlush(b, c)
+	pod := testPod("default", "pod", nil, "10.0.0.1", "fd00::1")
+	name := cache.MetaObjectToName(pod)
+	b.ResetTimer()
+	for range b.N {
+		c.SetPod(name, pod)
+		mustFlush(b, c)
+		b.StopTimer()
+		c.SetPod(name, nil)
+		mustFlush(b, c)
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,46 @@
+package nftctrl
+
+import (
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// addBypassSet adds the set of BypassCIDRs, merged like ipBlock peers.
+func (c *Controller) addBypassSet() {
+	bypass := ranges.NewWithCompare(lessAddrs, closest)
+	for _, p := range c.cfg.BypassCIDRs {
+		bypass.Add(prefixToRange(p))
+	}
+	var elements []nftables.SetElement
+	for it := bypass.Iterator(); it.Valid(); it.Next() {
+		elements = append(elements, rangeToInterval(it.Item())...)
+	}
+	c.bypassSet = &nfds.Set{
+		Table:        c.table,
+		Name:         "bypass",
+		Constant:     true,
+		Interval:     true,
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		KeyByteOrder: binaryutil.BigEndian,
+	}
+	c.nftConn.AddSet(c.bypassSet, elements)
+}
+
+// addBypassAcceptRule adds a rule to ch accepting traffic whose peer is in
+// the bypass set. The peer address is selected like in loadIP, so it is the
+// source for dirIngress and the destination for dirEgress.
+func (c *Controller) addBypassAcceptRule(ch *nfds.Chain, peer direction) {
+	c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: []expr.Any{
+			loadIP(peer, 0),
+			lookup(Lookup{Set: c.bypassSet, SourceRegister: newRegOffset + 0}),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+}
@@ -0,0 +1,151 @@
+package nftctrl
+
+import (
+	"errors"
+	"sort"
+	"syscall"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables/expr"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PodCounter is the amount of traffic rejected for a pod.
+type PodCounter struct {
+	Pod     cache.ObjectName
+	Packets uint64
+	Bytes   uint64
+
+	// chains contains the counters of the chains of the pod. Chains which are
+	// recreated are new objects, so their counters can be told apart from
+	// the ones of their predecessors.
+	chains map[*nfds.Chain]expr.Counter
+}
+
+// PodRejectCounters returns the traffic rejected for each pod isolated in at
+// least one direction, as counted by the backend. It requires
+// Config.RuleCounters. Chains which have not been flushed yet count as zero.
+func (c *Controller) PodRejectCounters() ([]PodCounter, error) {
+	var out []PodCounter
+	for name, p := range c.pods {
+		if p.ingressChain == nil && p.egressChain == nil {
+			continue
+		}
+		pc := PodCounter{Pod: name, chains: make(map[*nfds.Chain]expr.Counter)}
+		for _, ch := range []*nfds.Chain{p.ingressChain, p.egressChain} {
+			if ch == nil {
+				continue
+			}
+			ctr, err := c.nftConn.ChainCounter(ch)
+			if errors.Is(err, syscall.ENOENT) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			pc.Packets += ctr.Packets
+			pc.Bytes += ctr.Bytes
+			pc.chains[ch] = ctr
+		}
+		out = append(out, pc)
+	}
+	return out, nil
+}
+
+// NamespaceCounter is the amount of traffic rejected for the pods of a
+// namespace.
+type NamespaceCounter struct {
+	Namespace string
+	Packets   uint64
+	Bytes     uint64
+}
+
+// NamespaceRejectTotals sums up the reject counters of pods by namespace.
+// The counters of pods are lost when they are deleted and reset when their
+// chains are recreated, the totals keep the traffic counted until then and
+// thus never decrease. Traffic counted after the last update before a reset
+// is lost. It is not safe for concurrent use.
+type NamespaceRejectTotals struct {
+	// last contains the counters of every pod chain at the last update.
+	last   map[*nfds.Chain]expr.Counter
+	totals map[string]*NamespaceCounter
+}
+
+func NewNamespaceRejectTotals() *NamespaceRejectTotals {
+	return &NamespaceRejectTotals{
+		last:   make(map[*nfds.Chain]expr.Counter),
+		totals: make(map[string]*NamespaceCounter),
+	}
+}
+
+// Update adds the traffic counted since the last update to the totals.
+// counters are the current counters of all isolated pods as returned by
+// PodRejectCounters.
+func (t *NamespaceRejectTotals) Update(counters []PodCounter) {
+	last := t.last
+	t.last = make(map[*nfds.Chain]expr.Counter, len(last))
+	for _, pc := range counters {
+		total := t.totals[pc.Pod.Namespace]
+		if total == nil {
+			total = &NamespaceCounter{Namespace: pc.Pod.Namespace}
+			t.totals[pc.Pod.Namespace] = total
+		}
+		for ch, ctr := range pc.chains {
+			// Chains not seen before were created since the last update
+			prev := last[ch]
+			if ctr.Packets < prev.Packets || ctr.Bytes < prev.Bytes {
+				// The counters have been reset since the last update
+				prev = expr.Counter{}
+			}
+			total.Packets += ctr.Packets - prev.Packets
+			total.Bytes += ctr.Bytes - prev.Bytes
+			t.last[ch] = ctr
+		}
+	}
+}
+
+// Prune forgets the totals of the namespaces for which exists returns false.
+func (t *NamespaceRejectTotals) Prune(exists func(namespace string) bool) {
+	for ns := range t.totals {
+		if !exists(ns) {
+			delete(t.totals, ns)
+		}
+	}
+}
+
+// Counters returns the totals of all namespaces which had isolated pods at
+// any update and were not pruned since, sorted by namespace.
+func (t *NamespaceRejectTotals) Counters() []NamespaceCounter {
+	out := make([]NamespaceCounter, 0, len(t.totals))
+	for _, total := range t.totals {
+		out = append(out, *total)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Namespace < out[j].Namespace })
+	return out
+}
+
+// PolicyCounter is the amount of traffic accepted by the rules of a policy.
+// As packets of established connections are accepted before policies are
+// evaluated, Packets is usually the number of accepted connections.
+type PolicyCounter struct {
+	Policy  cache.ObjectName
+	Packets uint64
+	Bytes   uint64
+}
+
+// PolicyCounters returns the traffic accepted by the rules of each policy, as
+// counted by the backend. It requires Config.PolicyCounters. Counters which
+// have not been flushed yet count as zero.
+func (c *Controller) PolicyCounters() ([]PolicyCounter, error) {
+	var out []PolicyCounter
+	for name, ctr := range c.policyCounters {
+		pc := PolicyCounter{Policy: name}
+		val, err := c.nftConn.CounterValue(ctr)
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			return nil, err
+		}
+		pc.Packets = val.Packets
+		pc.Bytes = val.Bytes
+		out = append(out, pc)
+	}
+	return out, nil
+}
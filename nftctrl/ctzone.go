@@ -0,0 +1,94 @@
+package nftctrl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// CtZone assigns a conntrack zone to packets entering the node which match
+// either an input interface group or a packet mark.
+type CtZone struct {
+	// IfaceGroup matches the input interface group if non-zero.
+	IfaceGroup uint32
+	// Mark matches the packet mark if non-zero.
+	Mark uint32
+	Zone uint16
+}
+
+// ParseCtZones parses a comma-separated list of conntrack zone assignments
+// in the form iifgroup:<group>=<zone> or mark:<mark>=<zone>.
+func ParseCtZones(s string) ([]CtZone, error) {
+	var zones []CtZone
+	if s == "" {
+		return nil, nil
+	}
+	for _, a := range strings.Split(s, ",") {
+		match, zoneStr, ok := strings.Cut(a, "=")
+		if !ok {
+			return nil, fmt.Errorf("assignment %q: missing =<zone>", a)
+		}
+		kind, valStr, ok := strings.Cut(match, ":")
+		if !ok {
+			return nil, fmt.Errorf("assignment %q: expected iifgroup:<group> or mark:<mark>", a)
+		}
+		val, err := strconv.ParseUint(valStr, 0, 32)
+		if err != nil || val == 0 {
+			return nil, fmt.Errorf("assignment %q: invalid match value %q", a, valStr)
+		}
+		zone, err := strconv.ParseUint(zoneStr, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("assignment %q: invalid zone %q", a, zoneStr)
+		}
+		z := CtZone{Zone: uint16(zone)}
+		switch kind {
+		case "iifgroup":
+			z.IfaceGroup = uint32(val)
+		case "mark":
+			z.Mark = uint32(val)
+		default:
+			return nil, fmt.Errorf("assignment %q: unknown match %q", a, kind)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// addCtZoneChain adds a chain assigning conntrack zones before connection
+// tracking happens. The first matching assignment wins.
+func (c *Controller) addCtZoneChain() {
+	ch := c.nftConn.AddChain(&nfds.Chain{
+		Table:   c.table,
+		Name:    "ct_zone",
+		Type:    nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookPrerouting,
+		// Zones need to be assigned before conntrack looks up the connection
+		Priority: nftables.ChainPriorityRaw,
+	})
+	for _, z := range c.cfg.CtZones {
+		var match []expr.Any
+		if z.IfaceGroup != 0 {
+			match = append(match, &expr.Meta{Key: expr.MetaKeyIIFGROUP, Register: newRegOffset + 0},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: binaryutil.NativeEndian.PutUint32(z.IfaceGroup)})
+		}
+		if z.Mark != 0 {
+			match = append(match, &expr.Meta{Key: expr.MetaKeyMARK, Register: newRegOffset + 0},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: binaryutil.NativeEndian.PutUint32(z.Mark)})
+		}
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: ch,
+			Exprs: append(match,
+				&expr.Immediate{Register: newRegOffset + 0, Data: binaryutil.NativeEndian.PutUint16(z.Zone)},
+				&expr.Ct{Key: expr.CtKeyZONE, Register: newRegOffset + 0, SourceRegister: true},
+				// Stop evaluating further assignments
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			),
+		})
+	}
+}
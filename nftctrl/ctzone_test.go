@@ -0,0 +1,22 @@
+package nftctrl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCtZones(t *testing.T) {
+	zones, err := ParseCtZones("iifgroup:10=1,mark:0x20=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CtZone{{IfaceGroup: 10, Zone: 1}, {Mark: 0x20, Zone: 2}}
+	if !reflect.DeepEqual(zones, expected) {
+		t.Errorf("expected %+v, got %+v", expected, zones)
+	}
+	for _, bad := range []string{"iifgroup:10", "foo:1=1", "mark:0=1", "mark:1=70000"} {
+		if _, err := ParseCtZones(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package nftctrl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// testPacket describes a packet evaluated by evalPacket. Only the fields
+// needed by the generated ruleset are modeled.
+type testPacket struct {
+	src, dst     netip.Addr
+	proto        uint8
+	sport, dport uint16
+	tcpFlags     uint8
+	// icmpType is the ICMP(v6) type if proto is ICMP(v6).
+	icmpType uint8
+	ctState  uint32
+	iif, oif uint32
+	// iifGroup and oifGroup are the interface groups of the input and
+	// output interface.
+	iifGroup, oifGroup uint32
+	mark               uint32
+	// hopLimit is the IPv6 hop limit or IPv4 TTL. If zero, it is 64.
+	hopLimit uint8
+	// length is the total IP length of the packet including the IP header.
+	// If zero, it is the length of the headers.
+	length uint16
+	// overLimit is set if the packet exceeds all rate limits.
+	overLimit bool
+	// origSrc and origDst are the addresses of the original direction of
+	// the connection as seen by conntrack. If invalid, they are src and dst.
+	origSrc, origDst netip.Addr
+	// now is the time at which the packet is evaluated.
+	now time.Time
+	// srcMAC is the source address of the Ethernet header and vlan the ID
+	// of its VLAN tag if non-zero. Without srcMAC, the packet was received
+	// on an interface without link layer header.
+	srcMAC net.HardwareAddr
+	vlan   uint16
+}
+
+type testVerdict string
+
+const (
+	verdictAccept testVerdict = "accept"
+	verdictDrop   testVerdict = "drop"
+	verdictReject testVerdict = "reject"
+	// verdictReset is a reject with a TCP reset.
+	verdictReset testVerdict = "reset"
+)
+
+// newConn returns a packet of a new TCP connection between two addresses in
+// the forward hook.
+func newConn(src, dst string, dport uint16) testPacket {
+	return testPacket{
+		src:      netip.MustParseAddr(src),
+		dst:      netip.MustParseAddr(dst),
+		proto:    unix.IPPROTO_TCP,
+		sport:    40000,
+		dport:    dport,
+		tcpFlags: 0x02, // SYN
+		ctState:  expr.CtStateBitNEW,
+	}
+}
+
+// reply returns the reply packet to p of an established connection.
+func (p testPacket) reply() testPacket {
+	r := p
+	r.src, r.dst = p.dst, p.src
+	r.sport, r.dport = p.dport, p.sport
+	r.iif, r.oif = p.oif, p.iif
+	r.iifGroup, r.oifGroup = p.oifGroup, p.iifGroup
+	r.tcpFlags = 0x12 // SYN, ACK
+	r.ctState = expr.CtStateBitESTABLISHED
+	return r
+}
+
+// evalPacket evaluates the base chains of the given hook in the ruleset of
+// mem for a packet and returns the final verdict. It implements the subset of
+// nftables semantics used by the controller and fails the test on anything
+// else.
+func evalPacket(t testing.TB, mem *nfds.Memory, hook *nftables.ChainHook, pkt testPacket) testVerdict {
+	t.Helper()
+	family := nftables.TableFamilyIPv6
+	if pkt.src.Is4() {
+		family = nftables.TableFamilyIPv4
+	}
+	chains, err := mem.ListChainsOfTableFamily(family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var baseChains []*nftables.Chain
+	for _, ch := range chains {
+		if ch.Hooknum != nil && *ch.Hooknum == *hook {
+			baseChains = append(baseChains, ch)
+		}
+	}
+	sort.SliceStable(baseChains, func(i, j int) bool { return *baseChains[i].Priority < *baseChains[j].Priority })
+	e := evaluator{t: t, mem: mem, pkt: pkt, family: family}
+	for _, ch := range baseChains {
+		v := e.evalBaseChain(ch)
+		if v != verdictAccept {
+			return v
+		}
+	}
+	return verdictAccept
+}
+
+type evaluator struct {
+	t      testing.TB
+	mem    *nfds.Memory
+	pkt    testPacket
+	family nftables.TableFamily
+}
+
+func (e *evaluator) evalBaseChain(ch *nftables.Chain) testVerdict {
+	v, ok := e.evalChain(ch.Table, ch.Name, 0)
+	if ok {
+		return v
+	}
+	if ch.Policy != nil && *ch.Policy == nftables.ChainPolicyDrop {
+		return verdictDrop
+	}
+	return verdictAccept
+}
+
+// evalChain evaluates a chain and returns a terminal verdict and true, or
+// false if the end of the chain was reached or it returned.
+func (e *evaluator) evalChain(table *nftables.Table, name string, depth int) (testVerdict, bool) {
+	if depth > 16 {
+		e.t.Fatalf("chain %q: jump depth exceeded", name)
+	}
+	rules, err := e.mem.GetRules(table, &nftables.Chain{Name: name, Table: table})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	for _, r := range rules {
+		verdict := e.evalRule(table, r)
+		if verdict == nil {
+			continue
+		}
+		switch verdict.Kind {
+		case expr.VerdictAccept:
+			return verdictAccept, true
+		case expr.VerdictDrop:
+			return verdictDrop, true
+		case expr.VerdictReturn:
+			return "", false
+		case expr.VerdictJump, expr.VerdictGoto:
+			if v, ok := e.evalChain(table, verdict.Chain, depth+1); ok {
+				return v, true
+			}
+			if verdict.Kind == expr.VerdictGoto {
+				return "", false
+			}
+		case rejectVerdictKind:
+			return verdictReject, true
+		case resetVerdictKind:
+			return verdictReset, true
+		default:
+			e.t.Fatalf("chain %q: unsupported verdict %v", name, verdict.Kind)
+		}
+	}
+	return "", false
+}
+
+// rejectVerdictKind and resetVerdictKind are used internally to represent
+// reject expressions.
+const (
+	rejectVerdictKind expr.VerdictKind = -100
+	resetVerdictKind  expr.VerdictKind = -101
+)
+
+// evalRule evaluates a rule and returns its verdict, or nil if it did not
+// match or ended without a verdict.
+func (e *evaluator) evalRule(table *nftables.Table, r *nftables.Rule) *expr.Verdict {
+	var regs [4 * 20]byte
+	reg := func(n uint32, l uint32) []byte {
+		if n < newRegOffset {
+			e.t.Fatalf("rule in %q: legacy register %d not supported", r.Chain.Name, n)
+		}
+		off := (n - newRegOffset) * 4
+		return regs[off : off+l]
+	}
+	for _, ex := range r.Exprs {
+		switch ex := ex.(type) {
+		case *expr.Meta:
+			if ex.SourceRegister {
+				e.t.Fatalf("rule in %q: setting meta %v not supported", r.Chain.Name, ex.Key)
+			}
+			copy(reg(ex.Register, 4), e.meta(ex.Key))
+		case *expr.Payload:
+			var hdr []byte
+			switch ex.Base {
+			case expr.PayloadBaseLLHeader:
+				hdr = e.llHeader()
+			case expr.PayloadBaseNetworkHeader:
+				hdr = e.networkHeader()
+			case expr.PayloadBaseTransportHeader:
+				hdr = e.transportHeader()
+			default:
+				e.t.Fatalf("rule in %q: unsupported payload base %v", r.Chain.Name, ex.Base)
+			}
+			if int(ex.Offset+ex.Len) > len(hdr) {
+				// The kernel breaks out of the rule
+				return nil
+			}
+			copy(reg(ex.DestRegister, ex.Len), hdr[ex.Offset:ex.Offset+ex.Len])
+		case *expr.Cmp:
+			cmp := bytes.Compare(reg(ex.Register, uint32(len(ex.Data))), ex.Data)
+			var match bool
+			switch ex.Op {
+			case expr.CmpOpEq:
+				match = cmp == 0
+			case expr.CmpOpNeq:
+				match = cmp != 0
+			case expr.CmpOpLt:
+				match = cmp < 0
+			case expr.CmpOpLte:
+				match = cmp <= 0
+			case expr.CmpOpGt:
+				match = cmp > 0
+			case expr.CmpOpGte:
+				match = cmp >= 0
+			}
+			if !match {
+				return nil
+			}
+		case *expr.Range:
+			v := reg(ex.Register, uint32(len(ex.FromData)))
+			inRange := bytes.Compare(v, ex.FromData) >= 0 && bytes.Compare(v, ex.ToData) <= 0
+			if inRange != (ex.Op == expr.CmpOpEq) {
+				return nil
+			}
+		case *expr.Byteorder:
+			if ex.Op != expr.ByteorderHton || ex.Size != 4 {
+				e.t.Fatalf("rule in %q: unsupported byteorder %v of size %d", r.Chain.Name, ex.Op, ex.Size)
+			}
+			src := reg(ex.SourceRegister, ex.Len)
+			dst := reg(ex.DestRegister, ex.Len)
+			for i := 0; i < len(dst); i += 4 {
+				copy(dst[i:i+4], binaryutil.BigEndian.PutUint32(binaryutil.NativeEndian.Uint32(src[i:i+4])))
+			}
+		case *expr.Bitwise:
+			src := reg(ex.SourceRegister, ex.Len)
+			dst := reg(ex.DestRegister, ex.Len)
+			for i := range dst {
+				dst[i] = src[i]&ex.Mask[i] ^ ex.Xor[i]
+			}
+		case *expr.Ct:
+			if ex.SourceRegister {
+				// Setting conntrack fields does not affect the verdict
+				continue
+			}
+			switch ex.Key {
+			case expr.CtKeySTATE:
+				copy(reg(ex.Register, 4), binaryutil.NativeEndian.PutUint32(e.pkt.ctState))
+			case expr.CtKeySRC, expr.CtKeyDST:
+				if ex.Direction != 0 {
+					e.t.Fatalf("rule in %q: unsupported ct direction %d", r.Chain.Name, ex.Direction)
+				}
+				addr, fallback := e.pkt.origSrc, e.pkt.src
+				if ex.Key == expr.CtKeyDST {
+					addr, fallback = e.pkt.origDst, e.pkt.dst
+				}
+				if !addr.IsValid() {
+					addr = fallback
+				}
+				copy(reg(ex.Register, uint32(addr.BitLen()/8)), addr.AsSlice())
+			default:
+				e.t.Fatalf("rule in %q: unsupported ct key %v", r.Chain.Name, ex.Key)
+			}
+		case *expr.Immediate:
+			copy(reg(ex.Register, uint32(len(ex.Data))), ex.Data)
+		case *expr.Lookup:
+			set, elems := e.set(table, ex.SetName, ex.SetID)
+			key := reg(ex.SourceRegister, set.KeyType.Bytes)
+			elem, found := lookupElement(set, elems, key)
+			if found == ex.Invert {
+				return nil
+			}
+			if ex.IsDestRegSet {
+				if ex.DestRegister != 0 {
+					e.t.Fatalf("rule in %q: data maps not supported", r.Chain.Name)
+				}
+				return elem.VerdictData
+			}
+		case *expr.Limit:
+			if e.pkt.overLimit != ex.Over {
+				return nil
+			}
+		case *expr.Counter, *expr.Objref, *expr.Log:
+			// No effect on the verdict
+		case *expr.Reject:
+			if ex.Type == unix.NFT_REJECT_TCP_RST {
+				if e.pkt.proto != unix.IPPROTO_TCP {
+					e.t.Fatalf("rule in %q: TCP reset of non-TCP packet", r.Chain.Name)
+				}
+				return &expr.Verdict{Kind: resetVerdictKind}
+			}
+			return &expr.Verdict{Kind: rejectVerdictKind}
+		case *expr.Verdict:
+			return ex
+		default:
+			e.t.Fatalf("rule in %q: unsupported expression %T", r.Chain.Name, ex)
+		}
+	}
+	return nil
+}
+
+func (e *evaluator) meta(key expr.MetaKey) []byte {
+	switch key {
+	case expr.MetaKeyL4PROTO:
+		return []byte{e.pkt.proto, 0, 0, 0}
+	case expr.MetaKeyIIF:
+		return binaryutil.NativeEndian.PutUint32(e.pkt.iif)
+	case expr.MetaKeyOIF:
+		return binaryutil.NativeEndian.PutUint32(e.pkt.oif)
+	case expr.MetaKeyIIFGROUP:
+		return binaryutil.NativeEndian.PutUint32(e.pkt.iifGroup)
+	case expr.MetaKeyOIFGROUP:
+		return binaryutil.NativeEndian.PutUint32(e.pkt.oifGroup)
+	case expr.MetaKeyMARK:
+		return binaryutil.NativeEndian.PutUint32(e.pkt.mark)
+	case expr.MetaKeyNFPROTO:
+		return []byte{byte(e.family), 0, 0, 0}
+	case nfds.MetaKeyTimeDay:
+		return []byte{byte(e.pkt.now.UTC().Weekday()), 0, 0, 0}
+	case nfds.MetaKeyTimeHour:
+		h, m, s := e.pkt.now.UTC().Clock()
+		return binaryutil.NativeEndian.PutUint32(uint32(h*3600 + m*60 + s))
+	}
+	e.t.Fatalf("unsupported meta key %v", key)
+	return nil
+}
+
+func (e *evaluator) llHeader() []byte {
+	if e.pkt.srcMAC == nil {
+		return nil
+	}
+	hdr := make([]byte, 12, 18)
+	copy(hdr[6:12], e.pkt.srcMAC)
+	if e.pkt.vlan != 0 {
+		hdr = binary.BigEndian.AppendUint16(hdr, 0x8100)
+		hdr = binary.BigEndian.AppendUint16(hdr, e.pkt.vlan)
+	}
+	etherType := uint16(0x86dd)
+	if e.pkt.src.Is4() {
+		etherType = 0x0800
+	}
+	return binary.BigEndian.AppendUint16(hdr, etherType)
+}
+
+func (e *evaluator) networkHeader() []byte {
+	length := e.pkt.length
+	hopLimit := e.pkt.hopLimit
+	if hopLimit == 0 {
+		hopLimit = 64
+	}
+	if e.pkt.src.Is4() {
+		if length == 0 {
+			length = 40
+		}
+		hdr := make([]byte, 20)
+		hdr[0] = 0x45
+		copy(hdr[2:4], binaryutil.BigEndian.PutUint16(length))
+		hdr[8] = hopLimit
+		hdr[9] = e.pkt.proto
+		copy(hdr[12:16], e.pkt.src.AsSlice())
+		copy(hdr[16:20], e.pkt.dst.AsSlice())
+		return hdr
+	}
+	if length == 0 {
+		length = 60
+	}
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60
+	copy(hdr[4:6], binaryutil.BigEndian.PutUint16(length-40))
+	hdr[6] = e.pkt.proto
+	hdr[7] = hopLimit
+	copy(hdr[8:24], e.pkt.src.AsSlice())
+	copy(hdr[24:40], e.pkt.dst.AsSlice())
+	return hdr
+}
+
+func (e *evaluator) transportHeader() []byte {
+	hdr := make([]byte, 20)
+	switch e.pkt.proto {
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		hdr[0] = e.pkt.icmpType
+	default:
+		copy(hdr[0:2], binaryutil.BigEndian.PutUint16(e.pkt.sport))
+		copy(hdr[2:4], binaryutil.BigEndian.PutUint16(e.pkt.dport))
+		hdr[13] = e.pkt.tcpFlags
+	}
+	return hdr
+}
+
+func (e *evaluator) set(table *nftables.Table, name string, id uint32) (*nftables.Set, []nftables.SetElement) {
+	if strings.Contains(name, "%d") {
+		name = fmt.Sprintf(name, id)
+	}
+	sets, err := e.mem.GetSets(table)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	idx := slices.IndexFunc(sets, func(s *nftables.Set) bool { return s.Name == name })
+	if idx == -1 {
+		e.t.Fatalf("lookup of missing set %q", name)
+	}
+	elems, err := e.mem.GetSetElements(sets[idx])
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return sets[idx], elems
+}
+
+// lookupElement returns the element of the set matching key.
+func lookupElement(set *nftables.Set, elems []nftables.SetElement, key []byte) (nftables.SetElement, bool) {
+	if !set.Interval {
+		for _, el := range elems {
+			if bytes.Equal(el.Key, key) {
+				return el, true
+			}
+		}
+		return nftables.SetElement{}, false
+	}
+	if set.Concatenation {
+		// Ranges are given by Key and KeyEnd, both inclusive
+		for _, el := range elems {
+			if bytes.Compare(el.Key, key) <= 0 && bytes.Compare(key, el.KeyEnd) <= 0 {
+				return el, true
+			}
+		}
+		return nftables.SetElement{}, false
+	}
+	// Ranges are given by a start element and an end element with the
+	// exclusive upper bound. An end of zero wraps around the address space.
+	var best *nftables.SetElement
+	for i, el := range elems {
+		if el.IntervalEnd && isZero(el.Key) {
+			continue
+		}
+		if bytes.Compare(el.Key, key) <= 0 && (best == nil || bytes.Compare(best.Key, el.Key) < 0 || (bytes.Equal(best.Key, el.Key) && !el.IntervalEnd)) {
+			best = &elems[i]
+		}
+	}
+	if best == nil || best.IntervalEnd {
+		return nftables.SetElement{}, false
+	}
+	return *best, true
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
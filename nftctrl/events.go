@@ -0,0 +1,97 @@
+package nftctrl
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+type eventKey struct {
+	uid       types.UID
+	eventtype string
+	reason    string
+	message   string
+}
+
+// DedupRecorder is an EventRecorder which drops events identical to one
+// already emitted for the same object within the configured interval. As
+// policies are rebuilt on every update, the same diagnostics would otherwise
+// be emitted over and over again.
+type DedupRecorder struct {
+	rec record.EventRecorder
+	now func() time.Time
+
+	mu       sync.Mutex
+	interval time.Duration
+	lastSent map[eventKey]time.Time
+}
+
+// NewDedupRecorder wraps rec, suppressing events with the same object,
+// type, reason and message as one emitted less than interval ago. An interval
+// of 0 disables deduplication.
+func NewDedupRecorder(rec record.EventRecorder, interval time.Duration) *DedupRecorder {
+	return &DedupRecorder{
+		rec:      rec,
+		interval: interval,
+		now:      time.Now,
+		lastSent: make(map[eventKey]time.Time),
+	}
+}
+
+// allow returns true if the event should be emitted and records it as sent.
+func (r *DedupRecorder) allow(object runtime.Object, eventtype, reason, message string) bool {
+	obj, err := meta.Accessor(object)
+	if err != nil {
+		return true
+	}
+	k := eventKey{uid: obj.GetUID(), eventtype: eventtype, reason: reason, message: message}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.interval <= 0 {
+		return true
+	}
+	now := r.now()
+	if last, ok := r.lastSent[k]; ok && now.Sub(last) < r.interval {
+		return false
+	}
+	r.lastSent[k] = now
+	if len(r.lastSent) > 1024 {
+		// Prune expired entries to keep memory bounded
+		for ek, t := range r.lastSent {
+			if now.Sub(t) >= r.interval {
+				delete(r.lastSent, ek)
+			}
+		}
+	}
+	return true
+}
+
+// SetInterval changes the deduplication interval. It is safe for concurrent
+// use.
+func (r *DedupRecorder) SetInterval(interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interval = interval
+}
+
+func (r *DedupRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if r.allow(object, eventtype, reason, message) {
+		r.rec.Event(object, eventtype, reason, message)
+	}
+}
+
+func (r *DedupRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *DedupRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if r.allow(object, eventtype, reason, message) {
+		r.rec.AnnotatedEventf(object, annotations, eventtype, reason, "%s", message)
+	}
+}
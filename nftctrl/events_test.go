@@ -0,0 +1,41 @@
+package nftctrl
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDedupRecorder(t *testing.T) {
+	fake := record.NewFakeRecorder(100)
+	rec := NewDedupRecorder(fake, time.Minute)
+	now := time.Unix(0, 0)
+	rec.now = func() time.Time { return now }
+
+	nwp1 := &nwkv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "p1", UID: "1"}}
+	nwp2 := &nwkv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "p2", UID: "2"}}
+
+	rec.Eventf(nwp1, corev1.EventTypeWarning, "InvalidPort", "port %d bad", 1)
+	rec.Eventf(nwp1, corev1.EventTypeWarning, "InvalidPort", "port %d bad", 1) // Duplicate
+	rec.Eventf(nwp1, corev1.EventTypeWarning, "InvalidPort", "port %d bad", 2) // Different message
+	rec.Eventf(nwp2, corev1.EventTypeWarning, "InvalidPort", "port %d bad", 1) // Different object
+	if len(fake.Events) != 3 {
+		t.Errorf("expected 3 events, got %d", len(fake.Events))
+	}
+
+	now = now.Add(time.Minute)
+	rec.Eventf(nwp1, corev1.EventTypeWarning, "InvalidPort", "port %d bad", 1) // Interval passed
+	if len(fake.Events) != 4 {
+		t.Errorf("expected 4 events, got %d", len(fake.Events))
+	}
+
+	rec.SetInterval(0)
+	rec.Eventf(nwp1, corev1.EventTypeWarning, "InvalidPort", "port %d bad", 1) // Deduplication disabled
+	if len(fake.Events) != 5 {
+		t.Errorf("expected 5 events, got %d", len(fake.Events))
+	}
+}
@@ -8,6 +8,9 @@ import (
 
 const (
 	newRegOffset = 8
+	// ctDirOriginal selects the original direction of a connection in ct
+	// expressions.
+	ctDirOriginal = 0
 )
 
 type direction uint8
@@ -47,6 +50,13 @@ func loadIP(dir direction, dstReg uint32) *expr.Dynamic {
 	}
 }
 
+// loadOrigDstIP returns an expression loading the destination address of the
+// original direction of the connection into the given register (new register
+// numbers). Its length depends on the table family.
+func loadOrigDstIP(dstReg uint32) *expr.Ct {
+	return &expr.Ct{Key: expr.CtKeyDST, Direction: ctDirOriginal, Register: newRegOffset + dstReg}
+}
+
 func rejectAdministrative() *expr.Dynamic {
 	return &expr.Dynamic{
 		Expr: func(fam uint8) expr.Any {
@@ -65,6 +75,82 @@ func rejectAdministrative() *expr.Dynamic {
 	}
 }
 
+// addRejectRules adds rules rejecting all traffic reaching them to the end of
+// ch according to the configured reject mode and rate.
+func (c *Controller) addRejectRules(ch *nfds.Chain) []*nfds.Rule {
+	var rules []*nfds.Rule
+	if c.cfg.RejectRate != nil {
+		limit := *c.cfg.RejectRate
+		limit.Over = true
+		rules = append(rules, c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: ch,
+			Exprs: c.withCounter(
+				&limit,
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			),
+		}))
+	}
+	if c.cfg.RejectWith == RejectTCPReset {
+		rules = append(rules, c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: ch,
+			Exprs: c.withCounter(
+				// Load Layer 4 protocol into register 0
+				&expr.Meta{
+					Key:      expr.MetaKeyL4PROTO,
+					Register: newRegOffset + 0,
+				},
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: newRegOffset + 0,
+					Data:     []byte{unix.IPPROTO_TCP},
+				},
+				&expr.Reject{
+					Type: unix.NFT_REJECT_TCP_RST,
+				},
+			),
+		}))
+	}
+	return append(rules, c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: c.withCounter(
+			rejectAdministrative(),
+		),
+	}))
+}
+
+// withCounter returns the expressions of a rule with a counter inserted
+// before its final verdict expression if rule counters are enabled.
+func (c *Controller) withCounter(exprs ...expr.Any) []expr.Any {
+	if !c.cfg.RuleCounters {
+		return exprs
+	}
+	last := len(exprs) - 1
+	return append(exprs[:last:last], &expr.Counter{}, exprs[last])
+}
+
+// maxLogPrefixLen is the maximum length of a log prefix in bytes.
+const maxLogPrefixLen = 127
+
+// addAuditRule adds a rule logging and accepting all traffic reaching it to
+// the end of ch.
+func (c *Controller) addAuditRule(ch *nfds.Chain) *nfds.Rule {
+	prefix := "npc-audit " + ch.Name + ": "
+	if len(prefix) > maxLogPrefixLen {
+		prefix = prefix[:maxLogPrefixLen]
+	}
+	return c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: []expr.Any{
+			&expr.Log{Key: 1 << unix.NFTA_LOG_PREFIX, Data: []byte(prefix)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+}
+
 func loadDstPort(dstReg uint32) *expr.Payload {
 	return &expr.Payload{
 		Base:         expr.PayloadBaseTransportHeader,
@@ -74,6 +160,17 @@ func loadDstPort(dstReg uint32) *expr.Payload {
 	}
 }
 
+// loadSrcPort loads the source port of TCP, UDP or SCTP packets, which is
+// located at the start of the transport header for all of them.
+func loadSrcPort(dstReg uint32) *expr.Payload {
+	return &expr.Payload{
+		Base:         expr.PayloadBaseTransportHeader,
+		DestRegister: newRegOffset + dstReg,
+		Offset:       0,
+		Len:          2,
+	}
+}
+
 type Lookup struct {
 	SourceRegister uint32
 	DestRegister   uint32
@@ -0,0 +1,187 @@
+package nftctrl
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+// regState tracks the state of a 4 byte register while checking a rule.
+type regState struct {
+	// writer is the index of the expression which last wrote the register,
+	// or -1 if it has not been written.
+	writer int
+	read   bool
+}
+
+// checkRegisters verifies that every register read by an expression of r
+// has been written by an earlier one, and that no value is overwritten
+// before being read, which would indicate that an expression clobbered a
+// register still needed by a later one.
+func checkRegisters(t *testing.T, e *evaluator, table *nftables.Table, r *nftables.Rule) {
+	t.Helper()
+	var regs [16]regState
+	for i := range regs {
+		regs[i].writer = -1
+	}
+	span := func(i int, reg, l uint32) []regState {
+		if reg < newRegOffset || (reg-newRegOffset)*4+l > 16*4 {
+			t.Fatalf("chain %q expression %d: register %d with length %d out of range", r.Chain.Name, i, reg, l)
+		}
+		start := reg - newRegOffset
+		return regs[start : start+(l+3)/4]
+	}
+	write := func(i int, reg, l uint32) {
+		regs := span(i, reg, l)
+		for j, st := range regs {
+			if st.writer != -1 && !st.read {
+				t.Errorf("chain %q: register %d written by expression %d is overwritten by expression %d before being read: %v", r.Chain.Name, reg+uint32(j), st.writer, i, r.Exprs)
+			}
+			regs[j] = regState{writer: i}
+		}
+	}
+	read := func(i int, reg, l uint32) {
+		regs := span(i, reg, l)
+		for j := range regs {
+			st := &regs[j]
+			if st.writer == -1 {
+				t.Errorf("chain %q: register %d read by expression %d before being written: %v", r.Chain.Name, reg+uint32(j), i, r.Exprs)
+			}
+			st.read = true
+		}
+	}
+	for i, ex := range r.Exprs {
+		switch ex := ex.(type) {
+		case *expr.Meta:
+			if ex.SourceRegister {
+				read(i, ex.Register, 4)
+			} else {
+				write(i, ex.Register, 4)
+			}
+		case *expr.Ct:
+			l := uint32(4)
+			if (ex.Key == expr.CtKeySRC || ex.Key == expr.CtKeyDST) && table.Family == nftables.TableFamilyIPv6 {
+				l = 16
+			}
+			if ex.SourceRegister {
+				read(i, ex.Register, l)
+			} else {
+				write(i, ex.Register, l)
+			}
+		case *expr.Payload:
+			write(i, ex.DestRegister, ex.Len)
+		case *expr.Cmp:
+			read(i, ex.Register, uint32(len(ex.Data)))
+		case *expr.Range:
+			read(i, ex.Register, uint32(len(ex.FromData)))
+		case *expr.Byteorder:
+			read(i, ex.SourceRegister, ex.Len)
+			write(i, ex.DestRegister, ex.Len)
+		case *expr.Bitwise:
+			read(i, ex.SourceRegister, ex.Len)
+			write(i, ex.DestRegister, ex.Len)
+		case *expr.Immediate:
+			if ex.Register != 0 {
+				write(i, ex.Register, uint32(len(ex.Data)))
+			}
+		case *expr.Lookup:
+			set, _ := e.set(table, ex.SetName, ex.SetID)
+			read(i, ex.SourceRegister, set.KeyType.Bytes)
+			if ex.IsDestRegSet && ex.DestRegister != 0 {
+				write(i, ex.DestRegister, set.DataType.Bytes)
+			}
+		}
+	}
+}
+
+func TestRegisterUsage(t *testing.T) {
+	drop := nftables.ChainPolicyDrop
+	for _, cfg := range []Config{
+		{},
+		{
+			PodIfaceGroup:   1,
+			BaseChainPolicy: &drop,
+			IfaceResolver:   func(*corev1.Pod, netip.Addr) (uint32, error) { return 2, nil },
+			CtZones:         []CtZone{{IfaceGroup: 1, Zone: 1}, {Mark: 2, Zone: 2}},
+			RejectWith:      RejectTCPReset,
+		},
+		{AllowSelfTraffic: true, AllowICMPv6ND: true, PodIfaceGroup: 1},
+		{AllowSelfTraffic: true, IfaceResolver: func(*corev1.Pod, netip.Addr) (uint32, error) { return 2, nil }},
+		{BypassCIDRs: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("fd10::/64")}},
+		{SharedPortSetMin: 2, MaxSetElements: 1, RuleChains: true},
+		{L2AntiSpoofing: true, PodIfaceGroup: 1, IfaceResolver: func(*corev1.Pod, netip.Addr) (uint32, error) { return 2, nil }},
+		{Stateless: true, SharedPortSetMin: 2, MaxSetElements: 1, RuleChains: true},
+		{EgressOriginalSource: true, EgressOriginalDestination: true, IfaceResolver: func(*corev1.Pod, netip.Addr) (uint32, error) { return 2, nil }},
+	} {
+		c, mem, _ := newTestController(t, cfg)
+		port := intstr.FromInt32(80)
+		namedPort := intstr.FromString("http")
+		endPort := int32(90)
+		c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "all"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "all", Annotations: map[string]string{
+				annotationTCPFlags:                    "syn/syn,ack",
+				annotationActiveTime:                  "mon-fri 08:00-18:00",
+				annotationSourcePorts + "-egress-0":   "1024-65535",
+				annotationPacketLength + "-ingress-0": "64-1500",
+			}},
+			Spec: nwkv1.NetworkPolicySpec{
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From: []nwkv1.NetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{}},
+						{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}},
+						{IPBlock: &nwkv1.IPBlock{CIDR: "2001:db8::/32"}},
+					},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: &port, EndPort: &endPort}, {Port: &namedPort}, {Port: ptrIntStr(intstr.FromInt32(443))}},
+				}, {
+					Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+				}, {
+					From: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "198.51.100.0/24"}}},
+				}},
+				Egress: []nwkv1.NetworkPolicyEgressRule{{
+					To:    []nwkv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: &port}, {Port: ptrIntStr(intstr.FromInt32(443))}},
+				}, {
+					To:    []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}}, {IPBlock: &nwkv1.IPBlock{CIDR: "2001:db8::/32"}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+				}},
+			},
+		})
+		pod := testPod("default", "a", nil, "10.0.0.1", "fd00::1")
+		pod.Spec.Containers = []corev1.Container{{Name: "main", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}
+		pod.Annotations = map[string]string{annotationMAC: "02:00:00:00:00:01", annotationVLAN: "100"}
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, pod)
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", nil, "10.0.0.2", "fd00::2"))
+		mustFlush(t, c)
+
+		for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+			e := &evaluator{t: t, mem: mem, family: fam}
+			chains, err := mem.ListChainsOfTableFamily(fam)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var numRules int
+			for _, ch := range chains {
+				rules, err := mem.GetRules(ch.Table, ch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range rules {
+					checkRegisters(t, e, ch.Table, r)
+				}
+				numRules += len(rules)
+			}
+			if numRules < 10 {
+				t.Errorf("family %v: expected a non-trivial ruleset, got %d rules", fam, numRules)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package nftctrl
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+)
+
+// parseFQDNs parses a comma-separated list of domain names. Names are
+// lowercased and a trailing dot is removed. Wildcards are rejected, as only
+// names which can be resolved are supported.
+func parseFQDNs(s string) ([]string, error) {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(item)), ".")
+		if name == "" {
+			return nil, fmt.Errorf("empty name")
+		}
+		if len(name) > 253 {
+			return nil, fmt.Errorf("name %q is longer than 253 characters", name)
+		}
+		for _, label := range strings.Split(name, ".") {
+			if label == "*" {
+				return nil, fmt.Errorf("wildcard name %q is not supported", name)
+			}
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("name %q has an empty label or one longer than 63 characters", name)
+			}
+			for _, ch := range label {
+				if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '_') {
+					return nil, fmt.Errorf("name %q contains invalid character %q", name, ch)
+				}
+			}
+			if label[0] == '-' || label[len(label)-1] == '-' {
+				return nil, fmt.Errorf("name %q has a label starting or ending with a hyphen", name)
+			}
+		}
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// ruleFQDNs returns the domain names whose addresses are peers of the idx-th
+// rule in direction dir of policy, or nil if there are none.
+func (c *Controller) ruleFQDNs(policy *nwkv1.NetworkPolicy, dir direction, idx int) []string {
+	key := ruleAnnotationKey(annotationFQDNs, dir, idx)
+	spec, ok := policy.Annotations[key]
+	if !ok {
+		return nil
+	}
+	fqdns, err := parseFQDNs(spec)
+	if err == nil && dir == dirIngress {
+		// Sources cannot be attributed to names
+		err = fmt.Errorf("only supported on egress rules")
+	}
+	if err != nil {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s invalid, ignoring: %v", key, err)
+		return nil
+	}
+	if !c.cfg.FQDNPeers {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidAnnotation", "annotation %s requires FQDN peers to be enabled, ignoring", key)
+		return nil
+	}
+	return fqdns
+}
+
+// addFQDNRules adds the set of the addresses of fqdns to r and rules
+// accepting traffic to them on portProtos. The set is filled by
+// indexFQDNRule and SetFQDNAddrs.
+func (c *Controller) addFQDNRules(r *Rule, fqdns []string, prefix string, portProtos []RuleNumberedPortMeta) {
+	fqdnSet := nfds.Set{
+		Table:        c.table,
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		Name:         prefix + "_fqdn",
+		KeyByteOrder: binaryutil.BigEndian,
+	}
+	c.nftConn.AddSet(&fqdnSet, []nftables.SetElement{})
+	r.FQDNs = fqdns
+	r.FQDNSet = &fqdnSet
+	for _, s := range r.sides {
+		exprs := []expr.Any{loadIP(s.peer, 0)}
+		if c.cfg.EgressOriginalDestination {
+			// Names resolve to the addresses clients connect to, which
+			// might be translated, like with ipBlock peers.
+			exprs = []expr.Any{loadOrigDstIP(0)}
+		}
+		exprs = append(exprs, lookup(Lookup{
+			SourceRegister: newRegOffset + 0,
+			Set:            &fqdnSet,
+		}))
+		exprs = append(exprs, c.portProtoExprs(r, s, portProtos, 0)...)
+		exprs = append(exprs, c.extensionExprs(r, s, 0)...)
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: s.chain,
+			Exprs: append(exprs, &expr.Verdict{Kind: expr.VerdictAccept}),
+		})
+	}
+}
+
+// indexFQDNRule registers the FQDNs of r and adds their known addresses to
+// its set.
+func (c *Controller) indexFQDNRule(r *Rule) {
+	if r.FQDNSet == nil {
+		return
+	}
+	r.fqdnIPs = make(map[netip.Addr]int)
+	for _, name := range r.FQDNs {
+		rules := c.fqdnRules[name]
+		if rules == nil {
+			rules = make(map[*Rule]struct{})
+			c.fqdnRules[name] = rules
+		}
+		rules[r] = struct{}{}
+		c.updateRuleFQDNIPs(r, c.fqdnAddrs[name], nil)
+	}
+}
+
+// unindexFQDNRule removes the registration of the FQDNs of r. The addresses
+// of names no longer used are kept until the next flush, so a policy being
+// recreated on updates does not lose them.
+func (c *Controller) unindexFQDNRule(r *Rule) {
+	for _, name := range r.FQDNs {
+		delete(c.fqdnRules[name], r)
+		if len(c.fqdnRules[name]) == 0 {
+			delete(c.fqdnRules, name)
+		}
+	}
+}
+
+// pruneFQDNAddrs forgets the addresses of names no longer used by any rule.
+func (c *Controller) pruneFQDNAddrs() {
+	for name := range c.fqdnAddrs {
+		if _, ok := c.fqdnRules[name]; !ok {
+			delete(c.fqdnAddrs, name)
+		}
+	}
+}
+
+// updateRuleFQDNIPs adds the addresses in add and removes the ones in del
+// from the set of r. Addresses still used by another FQDN of r are kept.
+func (c *Controller) updateRuleFQDNIPs(r *Rule, add, del []netip.Addr) {
+	var addElems, delElems []nftables.SetElement
+	// Adding first keeps addresses in both lists in the set
+	for _, ip := range add {
+		r.fqdnIPs[ip]++
+		if r.fqdnIPs[ip] == 1 {
+			addElems = append(addElems, nftables.SetElement{Key: ip.AsSlice()})
+		}
+	}
+	for _, ip := range del {
+		r.fqdnIPs[ip]--
+		if r.fqdnIPs[ip] == 0 {
+			delete(r.fqdnIPs, ip)
+			delElems = append(delElems, nftables.SetElement{Key: ip.AsSlice()})
+		}
+	}
+	if len(addElems) > 0 {
+		c.nftConn.SetAddElements(r.FQDNSet, addElems)
+	}
+	if len(delElems) > 0 {
+		c.nftConn.SetDeleteElements(r.FQDNSet, delElems)
+	}
+}
+
+// fqdnElements returns the elements of the FQDN set of r.
+func (r *Rule) fqdnElements() []nftables.SetElement {
+	var elems []nftables.SetElement
+	for ip := range r.fqdnIPs {
+		elems = append(elems, nftables.SetElement{Key: ip.AsSlice()})
+	}
+	return elems
+}
+
+// FQDNs returns the sorted domain names used as peers by rules.
+func (c *Controller) FQDNs() []string {
+	var out []string
+	for name := range c.fqdnRules {
+		out = append(out, name)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// SetFQDNAddrs sets the addresses name resolves to and updates the sets of
+// all rules using it. Addresses missing from addrs are removed immediately,
+// so the caller needs to include dropped ones clients may still have cached,
+// like fqdn.Cache does. Names not used by any rule are ignored. It returns
+// true if the ruleset was changed.
+func (c *Controller) SetFQDNAddrs(name string, addrs []netip.Addr) bool {
+	rules, ok := c.fqdnRules[name]
+	if !ok {
+		return false
+	}
+	addrs = slices.Clone(addrs)
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	addrs = slices.Compact(addrs)
+	old := c.fqdnAddrs[name]
+	if slices.Equal(old, addrs) {
+		return false
+	}
+	c.fqdnAddrs[name] = addrs
+	if c.nftConn.Tracing() {
+		defer c.traceScope("FQDN " + name)()
+	}
+	for r := range rules {
+		c.updateRuleFQDNIPs(r, addrs, old)
+	}
+	return true
+}
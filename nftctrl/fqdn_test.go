@@ -0,0 +1,131 @@
+package nftctrl
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func fqdnPolicy(annotations map[string]string, ports ...int32) *nwkv1.NetworkPolicy {
+	var npPorts []nwkv1.NetworkPolicyPort
+	for _, p := range ports {
+		npPorts = append(npPorts, nwkv1.NetworkPolicyPort{Port: ptrIntStr(intstr.FromInt32(p))})
+	}
+	return &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test", Annotations: annotations},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+			Egress:      []nwkv1.NetworkPolicyEgressRule{{Ports: npPorts}},
+		},
+	}
+}
+
+func TestFQDNPeers(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{FQDNPeers: true})
+	name := cache.ObjectName{Namespace: "default", Name: "test"}
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(name, fqdnPolicy(map[string]string{
+		"npc.dolansoft.org/fqdns-egress-0": "Example.com., api.example.org",
+	}, 443))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2"))
+	mustFlush(t, c)
+	if events := drainEvents(rec); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+	if names := c.FQDNs(); !reflect.DeepEqual(names, []string{"api.example.org", "example.com"}) {
+		t.Fatalf("unexpected FQDNs %v", names)
+	}
+
+	check := func(dst string, port uint16, expected testVerdict) {
+		t.Helper()
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", dst, port)); v != expected {
+			t.Errorf("%s:%d: expected %v, got %v", dst, port, expected, v)
+		}
+	}
+	// Unresolved names do not permit anything, instead of all peers
+	check("192.0.2.1", 443, verdictReject)
+
+	if !c.SetFQDNAddrs("example.com", []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}) {
+		t.Error("expected setting new addresses to change the ruleset")
+	}
+	c.SetFQDNAddrs("api.example.org", []netip.Addr{netip.MustParseAddr("192.0.2.2")})
+	mustFlush(t, c)
+	check("192.0.2.1", 443, verdictAccept)
+	check("192.0.2.2", 443, verdictAccept)
+	check("192.0.2.1", 80, verdictReject)
+	check("192.0.2.3", 443, verdictReject)
+	if c.SetFQDNAddrs("example.com", []netip.Addr{netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.1")}) {
+		t.Error("expected setting the same addresses not to change the ruleset")
+	}
+
+	// Addresses shared with another name of the rule stay
+	c.SetFQDNAddrs("example.com", []netip.Addr{netip.MustParseAddr("192.0.2.3")})
+	mustFlush(t, c)
+	check("192.0.2.1", 443, verdictReject)
+	check("192.0.2.2", 443, verdictAccept)
+	check("192.0.2.3", 443, verdictAccept)
+
+	// Recreating the policy keeps the addresses
+	c.SetNetworkPolicy(name, fqdnPolicy(map[string]string{
+		"npc.dolansoft.org/fqdns-egress-0": "example.com,api.example.org",
+	}, 443, 8443))
+	mustFlush(t, c)
+	check("192.0.2.3", 8443, verdictAccept)
+	check("192.0.2.2", 443, verdictAccept)
+
+	c.SetNetworkPolicy(name, nil)
+	mustFlush(t, c)
+	if names := c.FQDNs(); len(names) != 0 {
+		t.Errorf("expected no FQDNs after deleting the policy, got %v", names)
+	}
+	if len(c.fqdnAddrs) != 0 {
+		t.Errorf("expected addresses of unused names to be pruned, got %v", c.fqdnAddrs)
+	}
+	if c.SetFQDNAddrs("example.com", []netip.Addr{netip.MustParseAddr("192.0.2.1")}) {
+		t.Error("expected addresses of unused names to be ignored")
+	}
+}
+
+func TestFQDNPeersInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		cfg         Config
+		annotations map[string]string
+		expected    string
+	}{
+		{"wildcard", Config{FQDNPeers: true}, map[string]string{"npc.dolansoft.org/fqdns-egress-0": "*.example.com"}, "wildcard"},
+		{"invalid character", Config{FQDNPeers: true}, map[string]string{"npc.dolansoft.org/fqdns-egress-0": "exa mple.com"}, "invalid character"},
+		{"ingress", Config{FQDNPeers: true}, map[string]string{"npc.dolansoft.org/fqdns-ingress-0": "example.com"}, "only supported on egress"},
+		{"disabled", Config{}, map[string]string{"npc.dolansoft.org/fqdns-egress-0": "example.com"}, "requires FQDN peers"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c, mem, rec := newTestController(t, tc.cfg)
+			policy := fqdnPolicy(tc.annotations, 443)
+			policy.Spec.PolicyTypes = append(policy.Spec.PolicyTypes, nwkv1.PolicyTypeIngress)
+			policy.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{}}
+			c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+			c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, policy)
+			c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2"))
+			mustFlush(t, c)
+			events := drainEvents(rec)
+			if len(events) != 1 || !strings.Contains(events[0], "InvalidAnnotation") || !strings.Contains(events[0], tc.expected) {
+				t.Errorf("expected an InvalidAnnotation event containing %q, got %v", tc.expected, events)
+			}
+			if names := c.FQDNs(); len(names) != 0 {
+				t.Errorf("expected no FQDNs, got %v", names)
+			}
+			// The rules are kept as if the annotation was not there
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "192.0.2.1", 443)); v != verdictAccept {
+				t.Errorf("expected egress rule without peers to permit all peers, got %v", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package nftctrl
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// MaxGraphPods limits the number of pods in a graph as computing it takes
+// time quadratic in the number of pods.
+const MaxGraphPods = 1000
+
+// GraphFilter selects the pods included in a graph.
+type GraphFilter struct {
+	// Namespaces contains the namespaces of the pods, must not be empty.
+	Namespaces []string
+	// Selector selects pods by labels if non-nil.
+	Selector labels.Selector
+}
+
+// Graph describes the effective connectivity between pods. Edges only exist
+// between pods in the graph, traffic to other pods or IPs is not included.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	ID string `json:"id"`
+	// Kind is either namespace or pod.
+	Kind string `json:"kind"`
+	// Parent is the ID of the namespace node of a pod.
+	Parent          string            `json:"parent,omitempty"`
+	Name            string            `json:"name"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	IngressIsolated bool              `json:"ingressIsolated,omitempty"`
+	EgressIsolated  bool              `json:"egressIsolated,omitempty"`
+}
+
+// GraphEdge describes permitted new connections from one pod to another.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Ports contains the permitted destination ports in the form
+	// <protocol>/<port>[-<endport>], <protocol> for all ports of a protocol,
+	// or any if all traffic is permitted.
+	Ports []string `json:"ports"`
+}
+
+// Graph computes the connectivity graph between all pods matching the filter
+// based on the same evaluation as CanConnect.
+func (c *Controller) Graph(filter GraphFilter) (*Graph, error) {
+	s, err := c.SnapshotGraph(filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.Graph(), nil
+}
+
+// GraphSnapshot contains copies of the pods of a graph and the policies
+// selecting them, so the graph can be computed without blocking updates of
+// the controller.
+type GraphSnapshot struct {
+	nodes []GraphNode
+	pods  []*Pod
+}
+
+// SnapshotGraph copies the state needed to compute the connectivity graph
+// between all pods matching the filter. Unlike computing the graph, it takes
+// time linear in the number of pods and their rules.
+func (c *Controller) SnapshotGraph(filter GraphFilter) (*GraphSnapshot, error) {
+	if len(filter.Namespaces) == 0 {
+		return nil, fmt.Errorf("at least one namespace is required")
+	}
+	var g GraphSnapshot
+	var pods []*Pod
+	for _, ns := range filter.Namespaces {
+		node := GraphNode{ID: "ns/" + ns, Kind: "namespace", Name: ns}
+		if n, ok := c.namespaces[ns]; ok {
+			node.Labels = n.Labels
+		}
+		g.nodes = append(g.nodes, node)
+	}
+	for _, p := range c.pods {
+		if !slices.Contains(filter.Namespaces, p.Namespace) || (filter.Selector != nil && !filter.Selector.Matches(p.Labels)) {
+			continue
+		}
+		pods = append(pods, p)
+	}
+	if len(pods) > MaxGraphPods {
+		return nil, fmt.Errorf("filter matches %d pods, more than the maximum of %d", len(pods), MaxGraphPods)
+	}
+	slices.SortFunc(pods, func(a, b *Pod) int {
+		return strings.Compare(graphPodID(a), graphPodID(b))
+	})
+	for _, p := range pods {
+		g.nodes = append(g.nodes, GraphNode{
+			ID:              graphPodID(p),
+			Kind:            "pod",
+			Parent:          "ns/" + p.Namespace,
+			Name:            p.Name,
+			Labels:          p.Labels,
+			IngressIsolated: p.ingressChain != nil,
+			EgressIsolated:  p.egressChain != nil,
+		})
+	}
+	g.pods = snapshotPods(pods)
+	return &g, nil
+}
+
+// snapshotPods copies the fields of pods evaluated by permittedPorts, the
+// policies referenced by them and their rules. Only pods out of pods are
+// kept as peers of the rules.
+func snapshotPods(pods []*Pod) []*Pod {
+	podCopies := make(map[*Pod]*Pod)
+	for _, p := range pods {
+		pc := *p
+		pc.IPs = slices.Clone(p.IPs)
+		pc.NamedPorts = maps.Clone(p.NamedPorts)
+		podCopies[p] = &pc
+	}
+	ruleCopies := make(map[*Rule]*Rule)
+	copyRules := func(rules []*Rule) []*Rule {
+		out := make([]*Rule, len(rules))
+		for i, r := range rules {
+			rc, ok := ruleCopies[r]
+			if !ok {
+				rule := *r
+				rc = &rule
+				rc.podRefs = make(map[*Pod]struct{})
+				for p, pc := range podCopies {
+					if _, ok := r.podRefs[p]; ok {
+						rc.podRefs[pc] = struct{}{}
+					}
+				}
+				rc.fqdnIPs = maps.Clone(r.fqdnIPs)
+				ruleCopies[r] = rc
+			}
+			out[i] = rc
+		}
+		return out
+	}
+	policyCopies := make(map[*Policy]*Policy)
+	copyRefs := func(refs map[*Policy]*nfds.Rule) map[*Policy]*nfds.Rule {
+		out := make(map[*Policy]*nfds.Rule, len(refs))
+		for nwp, r := range refs {
+			nc, ok := policyCopies[nwp]
+			if !ok {
+				policy := *nwp
+				nc = &policy
+				nc.IngressRuleMeta = copyRules(nwp.IngressRuleMeta)
+				nc.EgressRuleMeta = copyRules(nwp.EgressRuleMeta)
+				policyCopies[nwp] = nc
+			}
+			out[nc] = r
+		}
+		return out
+	}
+	out := make([]*Pod, len(pods))
+	for i, p := range pods {
+		pc := podCopies[p]
+		pc.ingressPolicyRefs = copyRefs(p.ingressPolicyRefs)
+		pc.egressPolicyRefs = copyRefs(p.egressPolicyRefs)
+		out[i] = pc
+	}
+	return out
+}
+
+// Graph computes the graph from the snapshot. It takes time quadratic in the
+// number of pods.
+func (s *GraphSnapshot) Graph() *Graph {
+	g := Graph{Nodes: s.nodes}
+	for _, src := range s.pods {
+		for _, dst := range s.pods {
+			if src == dst {
+				continue
+			}
+			ports := permittedPorts(src, dst)
+			if ports == nil || ports.Len() == 0 {
+				continue
+			}
+			g.Edges = append(g.Edges, GraphEdge{
+				From:  graphPodID(src),
+				To:    graphPodID(dst),
+				Ports: formatPorts(ports),
+			})
+		}
+	}
+	return &g
+}
+
+func graphPodID(p *Pod) string {
+	return "pod/" + p.Namespace + "/" + p.Name
+}
+
+// permittedPorts returns the protocol/port combinations permitted for new
+// connections from src to dst for all IP families both have addresses in.
+// It returns nil if they have no common family.
+func permittedPorts(src, dst *Pod) *ranges.Ranges[uint32] {
+	var out *ranges.Ranges[uint32]
+	for _, srcIP := range src.IPs {
+		for _, dstIP := range dst.IPs {
+			if srcIP.Is4() != dstIP.Is4() {
+				continue
+			}
+			ports := permittedPortsIP(src.egressChain != nil && !src.egressAudit, src.egressPolicyRefs, dirEgress, dst, dstIP)
+			ports = intersectPorts(ports, permittedPortsIP(dst.ingressChain != nil && !dst.ingressAudit, dst.ingressPolicyRefs, dirIngress, src, srcIP))
+			if out == nil {
+				out = ports
+			} else {
+				out = intersectPorts(out, ports)
+			}
+		}
+	}
+	return out
+}
+
+// permittedPortsIP returns the ports permitted in a direction for traffic
+// with the given peer. isolated needs to be false if the pod is not isolated
+// or its chain is only audited.
+func permittedPortsIP(isolated bool, policies map[*Policy]*nfds.Rule, dir direction, peer *Pod, peerIP netip.Addr) *ranges.Ranges[uint32] {
+	ports := ranges.New[uint32]()
+	if !isolated {
+		ports.Add(allPorts)
+		return ports
+	}
+	for nwp := range policies {
+		rules := nwp.IngressRuleMeta
+		if dir == dirEgress {
+			rules = nwp.EgressRuleMeta
+		}
+		for _, r := range rules {
+			r.addPermittedPorts(peer, peerIP, ports)
+		}
+	}
+	return ports
+}
+
+// intersectPorts returns the ranges contained in both a and b.
+func intersectPorts(a, b *ranges.Ranges[uint32]) *ranges.Ranges[uint32] {
+	notB := ranges.New[uint32]()
+	notB.Add(allPorts)
+	for it := b.Iterator(); it.Valid(); it.Next() {
+		notB.Subtract(it.Item())
+	}
+	out := ranges.New[uint32]()
+	for it := a.Iterator(); it.Valid(); it.Next() {
+		out.Add(it.Item())
+	}
+	for it := notB.Iterator(); it.Valid(); it.Next() {
+		out.Subtract(it.Item())
+	}
+	return out
+}
+
+func formatPorts(ports *ranges.Ranges[uint32]) []string {
+	var out []string
+	for it := ports.Iterator(); it.Valid(); it.Next() {
+		rng := it.Item()
+		if rng == allPorts {
+			return []string{"any"}
+		}
+		for proto := rng.Start >> 16; proto <= rng.End>>16; proto++ {
+			start, end := uint32(0), uint32(math.MaxUint16)
+			if proto == rng.Start>>16 {
+				start = rng.Start & math.MaxUint16
+			}
+			if proto == rng.End>>16 {
+				end = rng.End & math.MaxUint16
+			}
+			name := protocolName(uint8(proto))
+			switch {
+			case start == 0 && end == math.MaxUint16:
+				out = append(out, name)
+			case start == end:
+				out = append(out, fmt.Sprintf("%s/%d", name, start))
+			default:
+				out = append(out, fmt.Sprintf("%s/%d-%d", name, start, end))
+			}
+		}
+	}
+	return out
+}
+
+func protocolName(proto uint8) string {
+	switch proto {
+	case unix.IPPROTO_TCP:
+		return "TCP"
+	case unix.IPPROTO_UDP:
+		return "UDP"
+	case unix.IPPROTO_SCTP:
+		return "SCTP"
+	default:
+		return fmt.Sprint(proto)
+	}
+}
@@ -0,0 +1,71 @@
+package nftctrl
+
+import (
+	"reflect"
+	"testing"
+
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGraph(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", map[string]string{"app": "a"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", map[string]string{"app": "b"}, "10.0.0.2"))
+	c.SetPod(cache.ObjectName{Namespace: "other", Name: "c"}, testPod("other", "c", nil, "10.0.0.3"))
+	port := intstr.FromInt32(8000)
+	endPort := int32(8080)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "b"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "b"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "b"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "a"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &port, EndPort: &endPort}},
+			}},
+		},
+	})
+
+	if _, err := c.Graph(GraphFilter{}); err == nil {
+		t.Error("expected graph without namespace filter to be rejected")
+	}
+	g, err := c.Graph(GraphFilter{Namespaces: []string{"default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Nodes) != 3 {
+		t.Errorf("expected namespace and two pod nodes, got %v", g.Nodes)
+	}
+	expected := []GraphEdge{{From: "pod/default/a", To: "pod/default/b", Ports: []string{"TCP/8000-8080"}}}
+	if !reflect.DeepEqual(g.Edges, expected) {
+		t.Errorf("expected edges %v, got %v", expected, g.Edges)
+	}
+
+	g, err = c.Graph(GraphFilter{Namespaces: []string{"default", "other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []GraphEdge{
+		{From: "pod/default/a", To: "pod/default/b", Ports: []string{"TCP/8000-8080"}},
+		{From: "pod/default/a", To: "pod/other/c", Ports: []string{"any"}},
+		{From: "pod/other/c", To: "pod/default/a", Ports: []string{"any"}},
+	}
+	if !reflect.DeepEqual(g.Edges, expected) {
+		t.Errorf("expected edges %v, got %v", expected, g.Edges)
+	}
+
+	// Snapshots are not affected by later updates
+	s, err := c.SnapshotGraph(GraphFilter{Namespaces: []string{"default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", map[string]string{"app": "a"}, "10.0.0.4"))
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "b"}, nil)
+	expected = []GraphEdge{{From: "pod/default/a", To: "pod/default/b", Ports: []string{"TCP/8000-8080"}}}
+	if edges := s.Graph().Edges; !reflect.DeepEqual(edges, expected) {
+		t.Errorf("expected snapshot edges %v, got %v", expected, edges)
+	}
+}
@@ -0,0 +1,51 @@
+package nftctrl
+
+import (
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ndTypes are the ICMPv6 types of the Neighbor Discovery messages needed for
+// IPv6 connectivity: router solicitation and advertisement and neighbor
+// solicitation and advertisement.
+var ndTypes = []byte{133, 134, 135, 136}
+
+// addNDAcceptRule adds a rule to ch accepting ICMPv6 Neighbor Discovery
+// messages, which would otherwise be subject to the policies of isolated pods
+// like any other traffic. The rule only exists in the IPv6 family. As
+// required by RFC 4861, the messages must have a hop limit of 255, so they
+// cannot have been forwarded by a router.
+func (c *Controller) addNDAcceptRule(ch *nfds.Chain) {
+	ndSet := nfds.Set{
+		Table:        c.table,
+		Anonymous:    true,
+		Constant:     true,
+		KeyType:      nftables.TypeICMP6Type,
+		KeyByteOrder: binaryutil.BigEndian,
+		Family:       nftables.TableFamilyIPv6,
+	}
+	var elements []nftables.SetElement
+	for _, t := range ndTypes {
+		elements = append(elements, nftables.SetElement{Key: []byte{t}})
+	}
+	c.nftConn.AddSet(&ndSet, elements)
+	c.nftConn.AddRule(&nfds.Rule{
+		Table:  c.table,
+		Chain:  ch,
+		Family: nftables.TableFamilyIPv6,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: newRegOffset + 0},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: []byte{unix.IPPROTO_ICMPV6}},
+			// ip6 hoplimit 255
+			&expr.Payload{Base: expr.PayloadBaseNetworkHeader, DestRegister: newRegOffset + 0, Offset: 7, Len: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: []byte{255}},
+			// icmpv6 type
+			&expr.Payload{Base: expr.PayloadBaseTransportHeader, DestRegister: newRegOffset + 0, Offset: 0, Len: 1},
+			lookup(Lookup{Set: &ndSet, SourceRegister: newRegOffset + 0}),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+}
@@ -0,0 +1,67 @@
+package nftctrl
+
+import (
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// addIfaceGroupSet adds the set of the interface groups of pod-facing
+// interfaces if PodIfaceGroup is set. Besides PodIfaceGroup, it contains the
+// groups of all policies with the interface group annotation, so traffic
+// through interfaces in these groups reaches the pod chains as well.
+func (c *Controller) addIfaceGroupSet() {
+	c.ifaceGroupSet = &nfds.Set{
+		Table:        c.table,
+		Name:         "iface_groups",
+		KeyType:      nftables.TypeDevGroup,
+		KeyByteOrder: binaryutil.NativeEndian,
+	}
+	c.ifaceGroupRefs = map[uint32]int{c.cfg.PodIfaceGroup: 1}
+	c.nftConn.AddSet(c.ifaceGroupSet, c.ifaceGroupElements())
+}
+
+// ifaceGroupElements returns the elements of the interface group set.
+func (c *Controller) ifaceGroupElements() []nftables.SetElement {
+	var elements []nftables.SetElement
+	for group := range c.ifaceGroupRefs {
+		elements = append(elements, nftables.SetElement{Key: binaryutil.NativeEndian.PutUint32(group)})
+	}
+	return elements
+}
+
+// matchIfaceGroup returns expressions matching traffic whose interface
+// loaded by key is in one of the pod interface groups, or in none of them if
+// invert is set.
+func (c *Controller) matchIfaceGroup(key expr.MetaKey, invert bool) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: newRegOffset + 0},
+		lookup(Lookup{Set: c.ifaceGroupSet, SourceRegister: newRegOffset + 0, Invert: invert}),
+	}
+}
+
+// claimIfaceGroup adds the interface group of a policy to the interface
+// group set if it is the first policy using it.
+func (c *Controller) claimIfaceGroup(group uint32) {
+	if c.ifaceGroupSet == nil || group == 0 {
+		return
+	}
+	c.ifaceGroupRefs[group]++
+	if c.ifaceGroupRefs[group] == 1 {
+		c.nftConn.SetAddElements(c.ifaceGroupSet, []nftables.SetElement{{Key: binaryutil.NativeEndian.PutUint32(group)}})
+	}
+}
+
+// releaseIfaceGroup deletes the interface group of a policy from the
+// interface group set if it was the last policy using it.
+func (c *Controller) releaseIfaceGroup(group uint32) {
+	if c.ifaceGroupSet == nil || group == 0 {
+		return
+	}
+	c.ifaceGroupRefs[group]--
+	if c.ifaceGroupRefs[group] == 0 {
+		delete(c.ifaceGroupRefs, group)
+		c.nftConn.SetDeleteElements(c.ifaceGroupSet, []nftables.SetElement{{Key: binaryutil.NativeEndian.PutUint32(group)}})
+	}
+}
@@ -0,0 +1,176 @@
+package nftctrl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// etherTypeVLAN is the EtherType of 802.1Q VLAN-tagged frames.
+const etherTypeVLAN = 0x8100
+
+// addL2Vmap adds the verdict map jumping to the l2 chains of pods. It is
+// keyed like vmap_eg, so the elements of a pod are the same apart from the
+// verdict.
+func (c *Controller) addL2Vmap(keyType, keyType6 nftables.SetDatatype) {
+	c.vmapL2 = &nfds.Set{
+		Table:         c.table,
+		Name:          "vmap_l2",
+		IsMap:         true,
+		KeyByteOrder:  binaryutil.BigEndian,
+		KeyType:       keyType,
+		KeyType6:      keyType6,
+		Concatenation: c.cfg.IfaceResolver != nil,
+		DataType:      nftables.TypeVerdict,
+	}
+	c.nftConn.AddSet(c.vmapL2, []nftables.SetElement{})
+}
+
+// addL2Rule adds the rule to the egress base chain ch looking up the source
+// of pod traffic in vmapL2. Traffic of pods without pinned layer 2 addresses
+// does not match and continues with the next rule.
+func (c *Controller) addL2Rule(ch *nfds.Chain, prefilter []expr.Any) {
+	c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: slices.Concat(prefilter, c.vmapKey(expr.MetaKeyIIF, dirIngress), []expr.Any{
+			lookup(Lookup{DestRegister: 0, IsDestRegSet: true, SourceRegister: newRegOffset + 0, Set: c.vmapL2}),
+		}),
+	})
+}
+
+// setL2Addrs sets the MAC address and VLAN ID traffic from the IPs of p has
+// to originate from. They are nil and zero if pod does not pin them. Invalid
+// annotations are added to the warnings of p and ignored.
+func (p *Pod) setL2Addrs(pod *corev1.Pod) {
+	var mac net.HardwareAddr
+	if s, ok := pod.Annotations[annotationMAC]; ok {
+		var err error
+		mac, err = net.ParseMAC(s)
+		if err == nil && len(mac) != 6 {
+			err = fmt.Errorf("not an Ethernet address")
+		}
+		if err != nil {
+			p.warnf("InvalidAnnotation", "annotation %s invalid, ignoring: %v", annotationMAC, err)
+			mac = nil
+		}
+	} else if s, ok := pod.Annotations[annotationNetworkStatus]; ok {
+		mac = networkStatusMAC(s)
+	}
+	var vlan uint16
+	if s, ok := pod.Annotations[annotationVLAN]; ok {
+		// IDs 0 and 4095 are reserved
+		v, err := strconv.ParseUint(s, 10, 12)
+		if err == nil && (v == 0 || v == 4095) {
+			err = fmt.Errorf("reserved VLAN ID %d", v)
+		}
+		if err != nil {
+			p.warnf("InvalidAnnotation", "annotation %s invalid, ignoring: %v", annotationVLAN, err)
+		} else {
+			vlan = uint16(v)
+		}
+	}
+	p.mac, p.vlan = mac, vlan
+}
+
+// networkStatusMAC returns the MAC address of the default network in the
+// network status annotation s, or nil if it has none.
+func networkStatusMAC(s string) net.HardwareAddr {
+	var status []struct {
+		Mac     string `json:"mac"`
+		Default bool   `json:"default"`
+	}
+	if err := json.Unmarshal([]byte(s), &status); err != nil {
+		klog.V(2).Infof("Failed to parse network status %q: %v", s, err)
+		return nil
+	}
+	for _, st := range status {
+		if !st.Default || st.Mac == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(st.Mac)
+		if err != nil || len(mac) != 6 {
+			klog.V(2).Infof("Ignoring invalid MAC address %q in network status", st.Mac)
+			return nil
+		}
+		return mac
+	}
+	return nil
+}
+
+// equalL2Addrs returns true if p and p2 pin the same layer 2 addresses.
+func (p *Pod) equalL2Addrs(p2 *Pod) bool {
+	return bytes.Equal(p.mac, p2.mac) && p.vlan == p2.vlan
+}
+
+// addPodL2Chain creates the l2 chain of p dropping traffic from its IPs with
+// other layer 2 addresses than the pinned ones, if it pins any. The LL header
+// is only available for traffic received on Ethernet interfaces, the rules do
+// not match other traffic.
+func (c *Controller) addPodL2Chain(p *Pod) {
+	if c.vmapL2 == nil || (p.mac == nil && p.vlan == 0) {
+		return
+	}
+	p.l2Chain = c.nftConn.AddChain(&nfds.Chain{
+		Name:  fmt.Sprintf("l2_%s", p.ID),
+		Table: c.table,
+		Type:  nftables.ChainTypeFilter,
+	})
+	if p.mac != nil {
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: p.l2Chain,
+			Exprs: []expr.Any{
+				// ether saddr
+				&expr.Payload{DestRegister: newRegOffset + 0, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: newRegOffset + 0, Data: slices.Clone(p.mac)},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		})
+	}
+	if p.vlan != 0 {
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: p.l2Chain,
+			Exprs: []expr.Any{
+				// ether type
+				&expr.Payload{DestRegister: newRegOffset + 0, Base: expr.PayloadBaseLLHeader, Offset: 12, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: newRegOffset + 0, Data: binary.BigEndian.AppendUint16(nil, etherTypeVLAN)},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		})
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: p.l2Chain,
+			Exprs: []expr.Any{
+				// vlan id, the low 12 bits of the tag control information
+				&expr.Payload{DestRegister: newRegOffset + 0, Base: expr.PayloadBaseLLHeader, Offset: 14, Len: 2},
+				&expr.Bitwise{SourceRegister: newRegOffset + 0, DestRegister: newRegOffset + 0, Len: 2, Mask: []byte{0x0f, 0xff}, Xor: []byte{0, 0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: newRegOffset + 0, Data: binary.BigEndian.AppendUint16(nil, p.vlan)},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		})
+	}
+	c.nftConn.SetAddElements(c.vmapL2, p.vmapElements(p.l2Chain))
+}
+
+// deletePodL2Chain deletes the l2 chain of p and its verdict map elements.
+func (c *Controller) deletePodL2Chain(p *Pod) {
+	if p.l2Chain == nil {
+		return
+	}
+	c.nftConn.SetDeleteElements(c.vmapL2, p.vmapElements(p.l2Chain))
+	c.nftConn.DelChain(p.l2Chain)
+	p.l2Chain = nil
+}
@@ -0,0 +1,50 @@
+package nftctrl
+
+import (
+	"net/netip"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// multicastPrefixes are the destinations of multicast and limited broadcast
+// traffic.
+var multicastPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// addMulticastSet adds the set of multicast and broadcast destinations.
+func (c *Controller) addMulticastSet() {
+	c.multicastSet = &nfds.Set{
+		Table:        c.table,
+		Name:         "multicast",
+		Constant:     true,
+		Interval:     true,
+		KeyType:      nftables.TypeIPAddr,
+		KeyType6:     nftables.TypeIP6Addr,
+		KeyByteOrder: binaryutil.BigEndian,
+	}
+	var elements []nftables.SetElement
+	for _, p := range multicastPrefixes {
+		elements = append(elements, rangeToInterval(prefixToRange(p))...)
+	}
+	c.nftConn.AddSet(c.multicastSet, elements)
+}
+
+// addMulticastAcceptRule adds a rule to ch accepting traffic to multicast and
+// broadcast destinations.
+func (c *Controller) addMulticastAcceptRule(ch *nfds.Chain) {
+	c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: []expr.Any{
+			loadIP(dirEgress, 0),
+			lookup(Lookup{Set: c.multicastSet, SourceRegister: newRegOffset + 0}),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+}
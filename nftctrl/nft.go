@@ -1,17 +1,20 @@
 package nftctrl
 
 import (
+	"errors"
 	"fmt"
 	"net/netip"
+	"strings"
 
 	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
 	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
-	"github.com/mdlayher/netlink"
 	"go4.org/netipx"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 )
@@ -24,67 +27,447 @@ type Controller struct {
 	vmapEg  *nfds.Set
 	vmapIng *nfds.Set
 
+	// multicastSet contains multicast and broadcast destinations if they
+	// are allowed.
+	multicastSet *nfds.Set
+	// selfSet contains all pod IPs paired with themselves if traffic of pods
+	// to themselves is allowed.
+	selfSet *nfds.Set
+	// bypassSet contains BypassCIDRs if there are any.
+	bypassSet *nfds.Set
+	// ifaceGroupSet contains the interface groups of pod-facing interfaces
+	// if PodIfaceGroup is set, and ifaceGroupRefs the number of users of
+	// each, with PodIfaceGroup always being used.
+	ifaceGroupSet  *nfds.Set
+	ifaceGroupRefs map[uint32]int
+	// vmapL2 maps the source of traffic from pods with pinned layer 2
+	// addresses to their l2 chains if L2AntiSpoofing is set.
+	vmapL2 *nfds.Set
+
 	nwps       map[cache.ObjectName]*Policy
 	rules      map[*Rule]struct{}
 	pods       map[cache.ObjectName]*Pod
 	namespaces map[string]*Namespace
 
+	// nsPods indexes the pods by namespace and nsRules contains the rules
+	// selecting peers by namespace labels, so namespace label changes only
+	// reevaluate the affected pods and rules.
+	nsPods  map[string]map[*Pod]struct{}
+	nsRules map[*Rule]struct{}
+	// readyRules contains the rules only selecting Ready pods as peers, which
+	// are reevaluated when the readiness of a pod changes.
+	readyRules map[*Rule]struct{}
+
+	// fqdnRules contains the rules with FQDN peers by name and fqdnAddrs
+	// the addresses of the names last set by SetFQDNAddrs.
+	fqdnRules map[string]map[*Rule]struct{}
+	fqdnAddrs map[string][]netip.Addr
+
+	// vmapClaims contains all pods using a verdict map key in the order they
+	// were added. Only the first one gets an entry in the verdict maps.
+	vmapClaims map[vmapKey][]*Pod
+	// unresolvedIfaces contains the pods with IPs whose interface could not
+	// be resolved.
+	unresolvedIfaces map[cache.ObjectName]struct{}
+	// hostNetworkPeers contains the host-network pods matched by the peer
+	// selectors of each policy which have been reported, so this is only
+	// done once per policy and pod.
+	hostNetworkPeers map[cache.ObjectName]map[cache.ObjectName]struct{}
+
+	// portSets contains the shared port sets by their canonical port list.
+	portSets map[string]*sharedPortSet
+
+	// pendingNamedPortAudit contains the rules with named ports created
+	// since the last flush, which are checked by auditNamedPorts.
+	pendingNamedPortAudit map[*Rule]struct{}
+
+	// policyCounters contains the counters of the traffic accepted by each
+	// policy. They are kept when a policy is recreated on updates.
+	policyCounters map[cache.ObjectName]*nfds.Counter
+
+	// PreviousSchemaVersion is the schema version of the ruleset which was
+	// present in the table when the controller was created, or empty if
+	// there was none or it had no version marker.
+	PreviousSchemaVersion string
+	// PreviousIdentity is the identity of the controller instance which
+	// managed the table when the controller was created, or empty if there
+	// was none or it had no identity.
+	PreviousIdentity string
+
 	eventRecorder record.EventRecorder
+	// diagnostics collects the events emitted during a reconcile call if
+	// non-nil.
+	diagnostics *[]Diagnostic
+
+	cfg Config
+}
+
+// Config contains options affecting the generated ruleset as a whole.
+type Config struct {
+	// PodIfaceGroup is the interface group id of pod-facing interfaces. If
+	// non-zero, only traffic to/from interfaces in this group, or the group
+	// of a policy with the interface group annotation, is policed.
+	PodIfaceGroup uint32
+	// IfaceResolver, if set, scopes the pod verdict maps to interfaces. Pod
+	// IPs are mapped to the index of the interface they are reachable through
+	// and only traffic to/from a pod IP on that interface is policed. Pods
+	// can use the same IP on different interfaces. It is called when a pod
+	// is added or its IPs change. IPs it fails to resolve are not policed
+	// and reported by UnresolvedIfacePods.
+	IfaceResolver func(pod *corev1.Pod, ip netip.Addr) (ifindex uint32, err error)
+	// CtZones, if non-empty, adds a chain assigning conntrack zones to
+	// traffic entering the node. This changes conntrack behavior node-wide.
+	CtZones []CtZone
+	// Table is the name of the table to use. Defaults to k8s-nft-npc.
+	Table string
+	// AdoptTable makes the controller add its objects to an existing table
+	// managed by someone else instead of creating a dedicated one. Only
+	// objects owned by the controller are touched.
+	AdoptTable bool
+	// Identity identifies the controller instance, for example by its pod
+	// name. If set, it is recorded in the table to attribute the objects in
+	// it to this instance.
+	Identity string
+	// ElementComments attaches the namespace/name of the pod to all set
+	// elements derived from it. This makes the sets self-documenting at the
+	// cost of larger netlink messages.
+	ElementComments bool
+	// ReadableIDs appends as much of the namespace and name as fits to the
+	// UIDs identifying objects whose names are too long to be used in the
+	// names of their chains and sets, so they can still be found by name.
+	ReadableIDs bool
+	// BaseChainPolicy sets the policy of the base chains if non-nil. With
+	// drop, forwarded traffic to/from pod interfaces with an IP not known to
+	// belong to a pod is dropped instead of being let through, e.g. if the
+	// pod has not been programmed yet. Requires PodIfaceGroup so that
+	// other forwarded traffic is not affected.
+	BaseChainPolicy *nftables.ChainPolicy
+	// MaxSetElements limits the number of elements in the pod IP set of a
+	// rule if non-zero. Rules selecting pods with more IPs permit all peers
+	// on their ports instead, which avoids huge sets at the cost of being
+	// more permissive than the policy.
+	MaxSetElements int
+	// MaxIPBlockRanges limits the number of address ranges the ipBlock peers
+	// of a rule are split into by their excepts if non-zero. Each range
+	// becomes an interval in the rule's peer set. The ipBlock peers of rules
+	// exceeding it are ignored, which denies the traffic they would permit
+	// instead of building huge interval sets.
+	MaxIPBlockRanges int
+	// RejectWith selects how traffic not permitted by policies is rejected.
+	RejectWith RejectMode
+	// RejectRate, if non-nil, limits the rate at which traffic is rejected
+	// in each direction of each pod. Traffic exceeding it is dropped
+	// silently, so floods of denied packets do not cause as many ICMP
+	// errors or TCP resets.
+	RejectRate *expr.Limit
+	// EgressOriginalSource attributes egress traffic to pods by the source
+	// address of the original direction of its connection as recorded by
+	// conntrack instead of the current source of the packet. The base
+	// chains run in the forward hook before SNAT in postrouting, so this is
+	// only needed if the source is translated earlier, for example by a CNI
+	// rewriting it before the forward hook. Untracked traffic is not
+	// attributed to any pod.
+	EgressOriginalSource bool
+	// EgressOriginalDestination makes egress rules with ipBlock peers match
+	// the destination address of the original direction of the connection
+	// as recorded by conntrack instead of the current destination of the
+	// packet. As the base chains run after DNAT, this allows permitting
+	// traffic to Service IPs translated by kube-proxy. Ports are still
+	// matched against the translated destination port. Traffic to pods by
+	// their own IPs is unaffected as it is not translated.
+	EgressOriginalDestination bool
+	// Stateless matches traffic without relying on conntrack. Packets of
+	// established and related connections are not accepted by the base
+	// chains, instead every policy rule has a mirrored rule accepting the
+	// replies to the traffic it permits, with addresses and ports swapped.
+	// These rules are jumped to from the pod chains of the opposite
+	// direction, so replies are only accepted if the pod is isolated in that
+	// direction and a policy selecting it accepts them, or it is not
+	// isolated in that direction. Related traffic like ICMP errors is not
+	// accepted and the TCP flags annotation has no effect. The rate limit
+	// and policy counter of a rule only apply to the traffic it permits, not
+	// its replies, but see every packet of it instead of only the first of
+	// each connection. This cannot be combined with CtZones,
+	// EgressOriginalSource, EgressOriginalDestination and DisableEgress.
+	Stateless bool
+	// DefaultDenyIngress and DefaultDenyEgress, if non-nil, select pods by
+	// labels which are isolated in the respective direction even if no
+	// policy selects them, as if every namespace had a default deny policy.
+	DefaultDenyIngress labels.Selector
+	DefaultDenyEgress  labels.Selector
+	// DisableEgress ignores the Egress policy type of policies, so only
+	// ingress is enforced and pods are never isolated for egress. This
+	// allows enabling egress enforcement separately from ingress. It
+	// cannot be combined with DefaultDenyEgress.
+	DisableEgress bool
+	// SharedPortSetMin, if non-zero, makes rules with at least this many
+	// numbered ports or port ranges match them using named sets shared
+	// between all rules with the same ports. They can be inspected with nft
+	// and avoid duplicating large port lists.
+	SharedPortSetMin int
+	// AllowMulticast accepts traffic to multicast and broadcast destinations
+	// even if pods are isolated, so cluster discovery protocols keep working.
+	AllowMulticast bool
+	// AllowICMPv6ND accepts ICMPv6 Neighbor Discovery messages in the base
+	// chains, so isolating pods does not break IPv6 connectivity, for
+	// example with proxy NDP on routed pod networks. Only messages with a hop
+	// limit of 255 are accepted, which have not been forwarded by a router.
+	AllowICMPv6ND bool
+	// AllowSelfTraffic accepts traffic from a pod IP to the same IP, for
+	// example health checks of a pod reaching itself through a service,
+	// even if the pod is isolated. It requires PodIfaceGroup or
+	// IfaceResolver, as only traffic entering and leaving through pod
+	// interfaces is accepted.
+	AllowSelfTraffic bool
+	// BypassCIDRs are exempt from policy enforcement. Traffic between pods
+	// and them is accepted before pod chains are evaluated, for example to
+	// keep a management network reachable.
+	BypassCIDRs []netip.Prefix
+	// L2AntiSpoofing drops traffic from pod IPs which does not originate
+	// from the MAC address or VLAN of the pod, as given by its annotations.
+	// This prevents pods on a shared layer 2 network from spoofing the IPs
+	// of other pods, which would otherwise subject their traffic to the
+	// chains of the spoofed pod.
+	L2AntiSpoofing bool
+	// RuleCounters attaches counters to the rules rejecting traffic of
+	// isolated pods, which can be read using PodRejectCounters.
+	RuleCounters bool
+	// PolicyCounters attaches a named counter shared by all rules of a
+	// policy to the rules accepting traffic, which can be read using
+	// PolicyCounters. Unlike rule counters, it keeps its value if the
+	// policy is updated, and if the table is reconciled in place by New
+	// because it has the current schema version. In Stateless mode, it
+	// counts packets instead of connections.
+	PolicyCounters bool
+	// RuleChains adds the rules of each policy rule to a separate chain
+	// named after the policy chain and the index of the rule, e.g.
+	// pol_<id>_ing_0, which the policy chain jumps to. This makes the
+	// ruleset map directly to the rules of policies.
+	RuleChains bool
+	// AuditNamedPorts emits an event on policies with rules whose named
+	// ports do not resolve to any selected pod when they are first flushed.
+	AuditNamedPorts bool
+	// ExcludeHostNetworkPeers excludes host-network pods from the pods
+	// selected as peers by policies. As they share the IPs of their node,
+	// selecting them would permit all traffic of the node.
+	ExcludeHostNetworkPeers bool
+	// ExcludeInitContainerPorts leaves the ports of init containers out of
+	// the named ports of pods, as they do not serve traffic once the pod is
+	// running. Ports of sidecars, which are init containers with restart
+	// policy Always, are still included.
+	ExcludeInitContainerPorts bool
+	// ReadyPeers tracks the readiness of pods, so policies can restrict their
+	// peers to Ready pods with the ready-peers annotation. Readiness changes
+	// then cause pod updates, which only touch the peer sets of such
+	// policies.
+	ReadyPeers bool
+	// FQDNPeers enables the fqdns annotation on egress rules. The addresses
+	// of the names used by rules, which are returned by FQDNs, need to be
+	// supplied with SetFQDNAddrs.
+	FQDNPeers bool
+	// SelectorAnnotations are the keys of pod annotations which can be
+	// matched by selectors like labels. They are available as pseudo-labels
+	// with the key returned by AnnotationLabelKey.
+	SelectorAnnotations []string
 }
 
-const tableName = "k8s-nft-npc"
+// RejectMode selects how disallowed traffic is rejected.
+type RejectMode uint8
 
-func New(eventRecorder record.EventRecorder, podIfaceGroup uint32) (*Controller, error) {
-	nftc, err := nftables.New(nftables.AsLasting(), nftables.WithSockOptions(func(conn *netlink.Conn) error {
-		if err := conn.SetWriteBuffer(1 << 22); err != nil {
-			return err
-		}
-		if err := conn.SetReadBuffer(1 << 22); err != nil {
-			return err
+const (
+	// RejectICMPAdminProhibited rejects all traffic with an ICMP(v6)
+	// administratively prohibited error.
+	RejectICMPAdminProhibited RejectMode = iota
+	// RejectTCPReset rejects TCP traffic with a TCP reset, which makes
+	// clients fail immediately instead of potentially waiting for a timeout.
+	// Other traffic is rejected as with RejectICMPAdminProhibited.
+	RejectTCPReset
+)
+
+// ParseRejectMode parses a reject mode in the format used by nft.
+func ParseRejectMode(s string) (RejectMode, error) {
+	switch s {
+	case "icmp-admin-prohibited":
+		return RejectICMPAdminProhibited, nil
+	case "tcp-reset":
+		return RejectTCPReset, nil
+	default:
+		return 0, fmt.Errorf("unknown reject mode %q, expected icmp-admin-prohibited or tcp-reset", s)
+	}
+}
+
+// ParseRejectRate parses a rate/unit [burst n] limit for Config.RejectRate.
+// An empty string disables the limit.
+func ParseRejectRate(s string) (*expr.Limit, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return parseLimit(s)
+}
+
+// failClosed returns true if traffic not matching the verdict maps is
+// dropped. In that case, non-isolated pods get accept elements.
+func (c *Controller) failClosed() bool {
+	return c.cfg.BaseChainPolicy != nil && *c.cfg.BaseChainPolicy == nftables.ChainPolicyDrop
+}
+
+const defaultTableName = "k8s-nft-npc"
+
+// SchemaVersion identifies the layout of the ruleset generated by this
+// version of the controller. It needs to be incremented whenever chains, sets
+// or rules change in a way which is incompatible with reconciling a ruleset
+// created by an older version in place.
+const SchemaVersion = "1"
+
+// ownedNames contains the names of the chains, sets and counters the
+// controller creates at most once and ownedPrefixes the prefixes of the ones
+// created per object. In adopted tables, objects with other names belong to
+// the user and are never touched.
+var (
+	ownedNames = map[string]bool{
+		"filter_hook_ing":    true,
+		"filter_hook_eg":     true,
+		"vmap_ing":           true,
+		"vmap_eg":            true,
+		"vmap_l2":            true,
+		"ct_zone":            true,
+		"multicast":          true,
+		"self_ips":           true,
+		"bypass":             true,
+		"iface_groups":       true,
+		nfds.VersionSetName:  true,
+		nfds.IdentitySetName: true,
+	}
+	ownedPrefixes = []string{"pod_", "pol_", "portset_", "l2_"}
+)
+
+func ownsName(name string) bool {
+	if ownedNames[name] {
+		return true
+	}
+	for _, p := range ownedPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
 		}
-		return nil
-	}))
-	if err != nil {
-		return nil, fmt.Errorf("failed to open nftables netlink connection: %w", err)
 	}
+	return false
+}
+
+func New(eventRecorder record.EventRecorder, nftConn *nfds.Conn, cfg Config) (*Controller, error) {
 	c := &Controller{
 		rules:      make(map[*Rule]struct{}),
 		nwps:       make(map[cache.ObjectName]*Policy),
 		namespaces: make(map[string]*Namespace),
 		pods:       make(map[cache.ObjectName]*Pod),
+		nsPods:     make(map[string]map[*Pod]struct{}),
+		nsRules:    make(map[*Rule]struct{}),
+		readyRules: make(map[*Rule]struct{}),
+		fqdnRules:  make(map[string]map[*Rule]struct{}),
+		fqdnAddrs:  make(map[string][]netip.Addr),
+		vmapClaims: make(map[vmapKey][]*Pod),
+		portSets:   make(map[string]*sharedPortSet),
+
+		unresolvedIfaces:      make(map[cache.ObjectName]struct{}),
+		hostNetworkPeers:      make(map[cache.ObjectName]map[cache.ObjectName]struct{}),
+		pendingNamedPortAudit: make(map[*Rule]struct{}),
+		policyCounters:        make(map[cache.ObjectName]*nfds.Counter),
 
-		nftConn: nfds.WrapConn(nftc),
+		nftConn: nftConn,
 
-		eventRecorder: eventRecorder,
+		cfg: cfg,
 	}
 
-	// Add delete operations to any tables already present to make sure we start fresh.
-	// Do not flush to atomically activate the new tables.
-	tables, err := nftc.ListTables()
+	c.eventRecorder = &diagRecorder{rec: eventRecorder, c: c}
+
+	if c.failClosed() && c.cfg.PodIfaceGroup == 0 {
+		return nil, errors.New("a drop base chain policy requires a pod interface group")
+	}
+	if err := c.checkStateless(); err != nil {
+		return nil, err
+	}
+	if c.cfg.AllowSelfTraffic && c.cfg.PodIfaceGroup == 0 && c.cfg.IfaceResolver == nil {
+		return nil, errors.New("allowing self traffic requires a pod interface group or interface-scoped verdict maps")
+	}
+	if c.cfg.DisableEgress && c.cfg.DefaultDenyEgress != nil {
+		return nil, errors.New("default deny egress cannot be used with egress disabled")
+	}
+	if c.cfg.Table == "" {
+		c.cfg.Table = defaultTableName
+	}
+	c.table = &nfds.Table{
+		Name:  c.cfg.Table,
+		Adopt: c.cfg.AdoptTable,
+	}
+	prevVersion, err := c.nftConn.ReadVersion(c.cfg.Table)
 	if err != nil {
-		return nil, fmt.Errorf("unable to list nftables tables: %w", err)
-	}
-	var hasV4, hasV6 bool
-	for _, t := range tables {
-		if t.Name == tableName {
-			if t.Family == nftables.TableFamilyIPv4 {
-				hasV4 = true
-			} else if t.Family == nftables.TableFamilyIPv6 {
-				hasV6 = true
-			}
+		return nil, fmt.Errorf("unable to read schema version of table %q: %w", c.cfg.Table, err)
+	}
+	c.PreviousSchemaVersion = prevVersion
+	prevIdentity, err := c.nftConn.ReadIdentity(c.cfg.Table)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read identity of table %q: %w", c.cfg.Table, err)
+	}
+	c.PreviousIdentity = prevIdentity
+	// Add delete operations to any objects already present to make sure we
+	// start fresh. Do not flush to atomically activate the new objects.
+	// If the existing ruleset has the current schema version, it is
+	// reconciled in place: the table and the counters are kept, so counters
+	// keep their values, while chains and sets are replaced. Otherwise the
+	// whole table is recreated, or all owned objects of an adopted one.
+	owned := ownsName
+	if !c.cfg.AdoptTable {
+		owned = func(string) bool { return true }
+	}
+	switch {
+	case prevVersion == SchemaVersion:
+		c.nftConn.AddTable(c.table)
+		if err := c.nftConn.DelOwnedKeepCounters(c.table, owned); err != nil {
+			return nil, fmt.Errorf("unable to clean up table %q: %w", c.cfg.Table, err)
 		}
+	case c.cfg.AdoptTable:
+		c.nftConn.AddTable(c.table)
+		if err := c.nftConn.DelOwned(c.table, owned); err != nil {
+			return nil, fmt.Errorf("unable to clean up table %q: %w", c.cfg.Table, err)
+		}
+	default:
+		if err := c.nftConn.DelTableIfExists(c.cfg.Table); err != nil {
+			return nil, fmt.Errorf("unable to list nftables tables: %w", err)
+		}
+		c.nftConn.AddTable(c.table)
 	}
-	if hasV4 {
-		nftc.DelTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "k8s-nft-npc"})
+	if err := c.nftConn.WriteVersion(c.table, SchemaVersion); err != nil {
+		return nil, fmt.Errorf("unable to write schema version: %w", err)
 	}
-	if hasV6 {
-		nftc.DelTable(&nftables.Table{Family: nftables.TableFamilyIPv6, Name: "k8s-nft-npc"})
+	if c.cfg.Identity != "" {
+		if err := c.nftConn.WriteIdentity(c.table, c.cfg.Identity); err != nil {
+			return nil, fmt.Errorf("unable to write identity: %w", err)
+		}
 	}
 
-	c.table = &nfds.Table{
-		Name: "k8s-nft-npc",
+	if len(c.cfg.CtZones) > 0 {
+		c.addCtZoneChain()
+	}
+	if c.cfg.AllowMulticast {
+		c.addMulticastSet()
+	}
+	if c.cfg.AllowSelfTraffic {
+		c.addSelfSet()
+	}
+	if len(c.cfg.BypassCIDRs) > 0 {
+		c.addBypassSet()
+	}
+	if c.cfg.PodIfaceGroup != 0 {
+		c.addIfaceGroupSet()
+	}
+
+	vmapKeyType, vmapKeyType6 := nftables.TypeIPAddr, nftables.TypeIP6Addr
+	if c.cfg.IfaceResolver != nil {
+		vmapKeyType = nftables.MustConcatSetType(nftables.TypeIFIndex, nftables.TypeIPAddr)
+		vmapKeyType6 = nftables.MustConcatSetType(nftables.TypeIFIndex, nftables.TypeIP6Addr)
+	}
+	if c.cfg.L2AntiSpoofing {
+		c.addL2Vmap(vmapKeyType, vmapKeyType6)
 	}
-	c.nftConn.AddTable(c.table)
 
 	podTrafficChainIng := c.nftConn.AddChain(&nfds.Chain{
 		Table:   c.table,
@@ -93,38 +476,54 @@ func New(eventRecorder record.EventRecorder, podIfaceGroup uint32) (*Controller,
 		Hooknum: nftables.ChainHookForward,
 		// Hook traffic after IPVS and other shenanigans
 		Priority: nftables.ChainPrioritySELinuxLast,
+		Policy:   c.cfg.BaseChainPolicy,
 	})
-	c.nftConn.AddRule(&nfds.Rule{
-		Table: c.table,
-		Chain: podTrafficChainIng,
-		Exprs: []expr.Any{
-			// Accept packets for established or related connections
-			&expr.Ct{Key: expr.CtKeySTATE, Register: newRegOffset + 1},
-			&expr.Bitwise{SourceRegister: newRegOffset + 1, DestRegister: newRegOffset + 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED), Xor: binaryutil.NativeEndian.PutUint32(0)},
-			&expr.Cmp{Op: expr.CmpOpNeq, Register: newRegOffset + 1, Data: binaryutil.NativeEndian.PutUint32(0)},
-			&expr.Verdict{Kind: expr.VerdictAccept},
-		},
-	})
+	if !c.cfg.Stateless {
+		c.addEstablishedRule(podTrafficChainIng)
+	}
+	if c.cfg.AllowICMPv6ND {
+		c.addNDAcceptRule(podTrafficChainIng)
+	}
 	c.vmapIng = &nfds.Set{
-		Table:        c.table,
-		Name:         "vmap_ing",
-		IsMap:        true,
-		KeyByteOrder: binaryutil.BigEndian,
-		KeyType:      nftables.TypeIPAddr,
-		KeyType6:     nftables.TypeIP6Addr,
-		DataType:     nftables.TypeVerdict,
+		Table:         c.table,
+		Name:          "vmap_ing",
+		IsMap:         true,
+		KeyByteOrder:  binaryutil.BigEndian,
+		KeyType:       vmapKeyType,
+		KeyType6:      vmapKeyType6,
+		Concatenation: c.cfg.IfaceResolver != nil,
+		DataType:      nftables.TypeVerdict,
 	}
 	c.nftConn.AddSet(c.vmapIng, []nftables.SetElement{})
 	var ingPrefilter []expr.Any
-	if podIfaceGroup != 0 {
-		ingPrefilter = append(ingPrefilter, &expr.Meta{Key: expr.MetaKeyOIFGROUP, Register: newRegOffset + 0},
-			&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: binaryutil.NativeEndian.PutUint32(podIfaceGroup)})
+	if c.cfg.PodIfaceGroup != 0 {
+		ingPrefilter = c.matchIfaceGroup(expr.MetaKeyOIFGROUP, false)
+	}
+	if c.failClosed() {
+		// Accept traffic not involving pod interfaces, the policy only
+		// applies to pod traffic.
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: podTrafficChainIng,
+			Exprs: append(c.matchIfaceGroup(expr.MetaKeyOIFGROUP, true), &expr.Verdict{Kind: expr.VerdictAccept}),
+		})
+		if c.cfg.AllowMulticast {
+			// Multicast destinations are not pod IPs and would otherwise
+			// be dropped by the chain policy.
+			c.addMulticastAcceptRule(podTrafficChainIng)
+		}
+	}
+	if c.bypassSet != nil {
+		// The peer of ingress traffic is its source
+		c.addBypassAcceptRule(podTrafficChainIng, dirIngress)
+	}
+	if c.cfg.AllowSelfTraffic {
+		c.addSelfAcceptRule(podTrafficChainIng)
 	}
 	c.nftConn.AddRule(&nfds.Rule{
 		Table: c.table,
 		Chain: podTrafficChainIng,
-		Exprs: append(ingPrefilter,
-			loadIP(dirEgress, 0),
+		Exprs: append(append(ingPrefilter, c.vmapKey(expr.MetaKeyOIF, dirEgress)...),
 			lookup(Lookup{DestRegister: 0, IsDestRegSet: true, SourceRegister: newRegOffset + 0, Set: c.vmapIng}),
 		),
 	})
@@ -134,54 +533,150 @@ func New(eventRecorder record.EventRecorder, podIfaceGroup uint32) (*Controller,
 		Name:    "filter_hook_eg",
 		Type:    nftables.ChainTypeFilter,
 		Hooknum: nftables.ChainHookForward,
-		// Hook traffic after IPVS and other shenanigans
+		// Hook traffic after IPVS and other shenanigans. Forwarded traffic
+		// is masqueraded only later in postrouting, so the source is still
+		// the pod IP.
 		Priority: nftables.ChainPrioritySELinuxLast,
+		Policy:   c.cfg.BaseChainPolicy,
 	})
+	var egPrefilter []expr.Any
+	if c.cfg.PodIfaceGroup != 0 {
+		egPrefilter = c.matchIfaceGroup(expr.MetaKeyIIFGROUP, false)
+	}
+	if c.vmapL2 != nil {
+		// Spoofed packets must not be accepted as part of an established
+		// connection either.
+		c.addL2Rule(podTrafficChainEg, egPrefilter)
+	}
+	if !c.cfg.Stateless {
+		c.addEstablishedRule(podTrafficChainEg)
+	}
+	if c.cfg.AllowICMPv6ND {
+		// After the l2 rule, so spoofed messages are still dropped
+		c.addNDAcceptRule(podTrafficChainEg)
+	}
+	c.vmapEg = &nfds.Set{
+		Table:         c.table,
+		Name:          "vmap_eg",
+		IsMap:         true,
+		KeyByteOrder:  binaryutil.BigEndian,
+		KeyType:       vmapKeyType,
+		KeyType6:      vmapKeyType6,
+		Concatenation: c.cfg.IfaceResolver != nil,
+		DataType:      nftables.TypeVerdict,
+	}
+	c.nftConn.AddSet(c.vmapEg, []nftables.SetElement{})
+	if c.failClosed() {
+		// Accept traffic not involving pod interfaces, the policy only
+		// applies to pod traffic.
+		c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: podTrafficChainEg,
+			Exprs: append(c.matchIfaceGroup(expr.MetaKeyIIFGROUP, true), &expr.Verdict{Kind: expr.VerdictAccept}),
+		})
+	}
+	if c.bypassSet != nil {
+		c.addBypassAcceptRule(podTrafficChainEg, dirEgress)
+	}
+	if c.cfg.AllowSelfTraffic {
+		c.addSelfAcceptRule(podTrafficChainEg)
+	}
 	c.nftConn.AddRule(&nfds.Rule{
 		Table: c.table,
 		Chain: podTrafficChainEg,
+		Exprs: append(append(egPrefilter, c.vmapKey(expr.MetaKeyIIF, dirIngress)...),
+			lookup(Lookup{DestRegister: 0, IsDestRegSet: true, SourceRegister: newRegOffset + 0, Set: c.vmapEg}),
+		),
+	})
+	return c, nil
+}
+
+// addEstablishedRule adds a rule accepting packets of established or related
+// connections to ch.
+func (c *Controller) addEstablishedRule(ch *nfds.Chain) {
+	c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
 		Exprs: []expr.Any{
-			// Accept packets for established or related connections
 			&expr.Ct{Key: expr.CtKeySTATE, Register: newRegOffset + 1},
 			&expr.Bitwise{SourceRegister: newRegOffset + 1, DestRegister: newRegOffset + 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED), Xor: binaryutil.NativeEndian.PutUint32(0)},
 			&expr.Cmp{Op: expr.CmpOpNeq, Register: newRegOffset + 1, Data: binaryutil.NativeEndian.PutUint32(0)},
 			&expr.Verdict{Kind: expr.VerdictAccept},
 		},
 	})
-	c.vmapEg = &nfds.Set{
-		Table:        c.table,
-		Name:         "vmap_eg",
-		IsMap:        true,
-		KeyByteOrder: binaryutil.BigEndian,
-		KeyType:      nftables.TypeIPAddr,
-		KeyType6:     nftables.TypeIP6Addr,
-		DataType:     nftables.TypeVerdict,
+}
+
+// vmapKey returns expressions loading the key of the pod verdict maps into
+// register 0 (new register numbers). This is the pod IP, prefixed by the
+// interface index in ifaceKey if the maps are interface-scoped.
+func (c *Controller) vmapKey(ifaceKey expr.MetaKey, dir direction) []expr.Any {
+	load := func(dstReg uint32) expr.Any {
+		if dir == dirIngress && c.cfg.EgressOriginalSource {
+			// The length of the address depends on the table family
+			return &expr.Ct{Key: expr.CtKeySRC, Direction: ctDirOriginal, Register: newRegOffset + dstReg}
+		}
+		return loadIP(dir, dstReg)
 	}
-	c.nftConn.AddSet(c.vmapEg, []nftables.SetElement{})
-	var egPrefilter []expr.Any
-	if podIfaceGroup != 0 {
-		egPrefilter = append(egPrefilter, &expr.Meta{Key: expr.MetaKeyIIFGROUP, Register: newRegOffset + 0},
-			&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: binaryutil.NativeEndian.PutUint32(podIfaceGroup)})
+	if c.cfg.IfaceResolver == nil {
+		return []expr.Any{load(0)}
+	}
+	return []expr.Any{
+		&expr.Meta{Key: ifaceKey, Register: newRegOffset + 0},
+		load(1),
 	}
-	c.nftConn.AddRule(&nfds.Rule{
-		Table: c.table,
-		Chain: podTrafficChainEg,
-		Exprs: append(egPrefilter,
-			loadIP(dirIngress, 0),
-			lookup(Lookup{DestRegister: 0, IsDestRegSet: true, SourceRegister: newRegOffset + 0, Set: c.vmapEg}),
-		),
-	})
-	return c, nil
 }
 
 func (c *Controller) Flush() error {
+	c.auditNamedPorts()
+	c.pruneFQDNAddrs()
 	return c.nftConn.Flush()
 }
 
+// noTrace is returned instead of the result of traceScope while tracing is
+// disabled.
+func noTrace() {}
+
+// traceScope makes the changes traced from now on belong to context until
+// the returned function is called, which restores the previous context. As
+// formatting the context is not free, callers only call it if
+// c.nftConn.Tracing() returns true.
+func (c *Controller) traceScope(context string) func() {
+	prev := c.nftConn.SetTraceContext(context)
+	return func() { c.nftConn.SetTraceContext(prev) }
+}
+
 func (c *Controller) Close() error {
 	return c.nftConn.CloseLasting()
 }
 
+// Verify compares the ruleset built by this controller with the one present
+// in the given connection without modifying either. It returns a
+// human-readable list of differences, which is empty if both are consistent.
+func (c *Controller) Verify(actual *nfds.Conn) ([]string, error) {
+	var diffs []string
+	for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		want, err := c.nftConn.TakeSnapshot(c.cfg.Table, fam, ownsName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read expected ruleset: %w", err)
+		}
+		got, err := actual.TakeSnapshot(c.cfg.Table, fam, ownsName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read actual ruleset: %w", err)
+		}
+		for _, d := range nfds.Diff(want, got) {
+			diffs = append(diffs, fmt.Sprintf("%s: %s", familyName(fam), d))
+		}
+	}
+	return diffs, nil
+}
+
+func familyName(fam nftables.TableFamily) string {
+	if fam == nftables.TableFamilyIPv4 {
+		return "ip"
+	}
+	return "ip6"
+}
+
 func prefixToRange(net netip.Prefix) ranges.Range[netip.Addr] {
 	return ranges.Range[netip.Addr]{
 		Start: net.Masked().Addr(),
@@ -232,14 +727,28 @@ func closest(a netip.Addr, before bool) netip.Addr {
 	return out
 }
 
+// maxIDLen is the maximum length of object identifiers.
+const maxIDLen = 128
+
 // objectID returns an identifier for a Kubernetes object which can be used as
 // part of the name of an nftables chain or set.
-func objectID(obj *metav1.ObjectMeta) string {
-	if len(obj.Namespace)+1+len(obj.Name) > 128 {
+// Identifiers of short names are reused when an object is deleted and
+// recreated. This is safe as objects are processed by name with their current
+// state and never concurrently, so a stale delete cannot be applied after the
+// recreated object has been added.
+// If readable, identifiers falling back to the UID are followed by as much of
+// the namespace and name as fits.
+func objectID(obj *metav1.ObjectMeta, readable bool) string {
+	id := fmt.Sprintf("%s_%s", obj.Namespace, obj.Name)
+	if len(id) > maxIDLen {
 		// If the combined length of namespace and name is longer than 128 bytes,
 		// use the object UID instead. nftables names are limited to 256 characters,
 		// and this limit could otherwise be exceeded.
-		return string(obj.UID)
+		if !readable {
+			return string(obj.UID)
+		}
+		uid := string(obj.UID) + "_"
+		return uid + id[:max(maxIDLen-len(uid), 0)]
 	}
-	return fmt.Sprintf("%s_%s", obj.Namespace, obj.Name)
+	return id
 }
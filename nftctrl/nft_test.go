@@ -0,0 +1,1221 @@
+package nftctrl
+
+import (
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go4.org/netipx"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestController(t testing.TB, cfg Config) (*Controller, *nfds.Memory, *record.FakeRecorder) {
+	t.Helper()
+	mem := nfds.NewMemory()
+	rec := record.NewFakeRecorder(1000)
+	conn := nfds.WrapConn(mem)
+	conn.ValidateSetKeys(true)
+	c, err := New(rec, conn, cfg)
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("failed initial flush: %v", err)
+	}
+	return c, mem, rec
+}
+
+// mustFlush flushes the controller and fails the test if the backend
+// reports an error or set elements were skipped as invalid.
+func mustFlush(t testing.TB, c *Controller) {
+	t.Helper()
+	if err := c.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if n := c.nftConn.InvalidElements(); n != 0 {
+		t.Fatalf("%d invalid set elements were skipped", n)
+	}
+}
+
+// drainEvents returns all events recorded so far.
+func drainEvents(rec *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-rec.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestObjectID(t *testing.T) {
+	const uid = "6f1d3c2a-8b4e-4f5a-9c7d-0e1f2a3b4c5d"
+	ns := strings.Repeat("n", 63)
+	for _, tc := range []struct {
+		name     string
+		readable bool
+		expected string
+	}{
+		// Exactly the maximum length
+		{strings.Repeat("a", 64), false, ns + "_" + strings.Repeat("a", 64)},
+		{strings.Repeat("a", 64), true, ns + "_" + strings.Repeat("a", 64)},
+		{strings.Repeat("a", 65), false, uid},
+		{strings.Repeat("a", 65), true, uid + "_" + ns + "_" + strings.Repeat("a", 27)},
+	} {
+		id := objectID(&metav1.ObjectMeta{Namespace: ns, Name: tc.name, UID: uid}, tc.readable)
+		if id != tc.expected {
+			t.Errorf("name of length %d, readable %v: expected %q, got %q", len(tc.name), tc.readable, tc.expected, id)
+		}
+		if len(id) > maxIDLen {
+			t.Errorf("name of length %d, readable %v: ID %q exceeds maximum length", len(tc.name), tc.readable, id)
+		}
+	}
+}
+
+func TestNoIPv6(t *testing.T) {
+	mem := nfds.NewMemory()
+	mem.DisableFamily(nftables.TableFamilyIPv6)
+	conn := nfds.WrapConn(mem)
+	conn.ValidateSetKeys(true)
+	if err := conn.DetectIPv6("probe"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(record.NewFakeRecorder(100), conn, Config{PolicyCounters: true, RuleCounters: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.IPv6() {
+		t.Error("expected IPv6 to be detected as unsupported")
+	}
+	deny := denyAllPolicy("default", "deny")
+	deny.Spec.PodSelector = metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, deny)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}},
+					{IPBlock: &nwkv1.IPBlock{CIDR: "2001:db8::/32"}},
+				},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1", "fd00::1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+
+	if tables, _ := mem.ListTables(); len(tables) != 1 || tables[0].Family != nftables.TableFamilyIPv4 {
+		t.Errorf("expected only an IPv4 table, got %v", tables)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictAccept {
+		t.Errorf("expected permitted traffic to be accepted, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected other traffic to be rejected, got %v", v)
+	}
+	if _, err := c.PodRejectCounters(); err != nil {
+		t.Errorf("failed to read reject counters: %v", err)
+	}
+	if _, err := c.PolicyCounters(); err != nil {
+		t.Errorf("failed to read policy counters: %v", err)
+	}
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v (%v)", orphans, err)
+	}
+
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, nil)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, nil)
+	mustFlush(t, c)
+}
+
+func TestAdoptTable(t *testing.T) {
+	mem := nfds.NewMemory()
+	for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		tbl := mem.AddTable(&nftables.Table{Name: "filter", Family: fam})
+		mem.AddChain(&nftables.Chain{Name: "user", Table: tbl})
+		// Only exact names and prefixes followed by an underscore are owned
+		mem.AddChain(&nftables.Chain{Name: "bypass_mgmt", Table: tbl})
+		mem.AddChain(&nftables.Chain{Name: "multicast_routes", Table: tbl})
+		mem.AddChain(&nftables.Chain{Name: "podman", Table: tbl})
+	}
+	cfg := Config{Table: "filter", AdoptTable: true}
+	for i := 0; i < 2; i++ {
+		// The second controller cleans up the objects of the first one
+		c, err := New(record.NewFakeRecorder(100), nfds.WrapConn(mem), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "test"}, testPod("default", "test", nil, "10.0.0.1"))
+		mustFlush(t, c)
+	}
+	chains, err := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ch := range chains {
+		names = append(names, ch.Name)
+	}
+	expected := []string{"bypass_mgmt", "filter_hook_eg", "filter_hook_ing", "multicast_routes", "pod_default_test_eg", "pod_default_test_ing", "podman", "pol_default_deny_eg", "pol_default_deny_ing", "user"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected chains %v, got %v", expected, names)
+	}
+}
+
+func TestDisableEgress(t *testing.T) {
+	if _, err := New(record.NewFakeRecorder(10), nfds.WrapConn(nfds.NewMemory()), Config{DisableEgress: true, DefaultDenyEgress: labels.Everything()}); err == nil {
+		t.Error("expected default deny egress with egress disabled to be rejected")
+	}
+
+	mem := nfds.NewMemory()
+	for _, disable := range []bool{false, true} {
+		// The second controller removes the egress chains of the first one,
+		// like on a restart with the flag added
+		rec := record.NewFakeRecorder(100)
+		c, err := New(rec, nfds.WrapConn(mem), Config{DisableEgress: disable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "test"}, testPod("default", "test", nil, "10.0.0.1"))
+		mustFlush(t, c)
+		events := drainEvents(rec)
+		if disable != (len(events) == 1 && strings.Contains(events[0], "EgressDisabled")) {
+			t.Errorf("disable %v: unexpected events %v", disable, events)
+		}
+	}
+	chains, err := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ch := range chains {
+		if strings.HasPrefix(ch.Name, "pod_") || strings.HasPrefix(ch.Name, "pol_") {
+			names = append(names, ch.Name)
+		}
+	}
+	expected := []string{"pod_default_test_ing", "pol_default_deny_ing"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected chains %v, got %v", expected, names)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "192.0.2.1", 80)); v != verdictAccept {
+		t.Errorf("expected egress to be accepted, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected ingress to be rejected, got %v", v)
+	}
+}
+
+func TestBaseChainPolicyDrop(t *testing.T) {
+	drop := nftables.ChainPolicyDrop
+	if _, err := New(record.NewFakeRecorder(10), nfds.WrapConn(nfds.NewMemory()), Config{BaseChainPolicy: &drop}); err == nil {
+		t.Error("expected drop policy without pod interface group to be rejected")
+	}
+
+	c, mem, _ := newTestController(t, Config{BaseChainPolicy: &drop, PodIfaceGroup: 1})
+	vmapIng := &nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, Name: "vmap_ing"}
+	expectVerdict := func(kind expr.VerdictKind, chain string) {
+		t.Helper()
+		elems, err := mem.GetSetElements(vmapIng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elems) != 1 || elems[0].VerdictData.Kind != kind || elems[0].VerdictData.Chain != chain {
+			t.Fatalf("expected a single element with verdict %v %q, got %v", kind, chain, elems)
+		}
+	}
+
+	podName := cache.ObjectName{Namespace: "default", Name: "test"}
+	c.SetPod(podName, testPod("default", "test", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	expectVerdict(expr.VerdictAccept, "")
+
+	policyName := cache.ObjectName{Namespace: "default", Name: "deny"}
+	c.SetNetworkPolicy(policyName, denyAllPolicy("default", "deny"))
+	mustFlush(t, c)
+	expectVerdict(expr.VerdictJump, "pod_default_test_ing")
+
+	c.SetNetworkPolicy(policyName, nil)
+	mustFlush(t, c)
+	expectVerdict(expr.VerdictAccept, "")
+
+	c.SetPod(podName, nil)
+	mustFlush(t, c)
+	if elems, _ := mem.GetSetElements(vmapIng); len(elems) != 0 {
+		t.Errorf("expected no elements after pod deletion, got %v", elems)
+	}
+}
+
+func TestEgressOnlyReplyTraffic(t *testing.T) {
+	drop := nftables.ChainPolicyDrop
+	for _, cfg := range []Config{{}, {BaseChainPolicy: &drop, PodIfaceGroup: 1}} {
+		c, mem, _ := newTestController(t, cfg)
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.1", "fd00::1"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.2", "fd00::2"))
+		port := intstr.FromInt32(80)
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "egress"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}},
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+				Egress: []nwkv1.NetworkPolicyEgressRule{{
+					To:    []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+				}},
+			},
+		})
+		mustFlush(t, c)
+
+		for _, ips := range [][2]string{{"10.0.0.1", "10.0.0.2"}, {"fd00::1", "fd00::2"}} {
+			req := newConn(ips[0], ips[1], 80)
+			req.iifGroup, req.oifGroup = cfg.PodIfaceGroup, cfg.PodIfaceGroup
+			if v := evalPacket(t, mem, nftables.ChainHookForward, req); v != verdictAccept {
+				t.Errorf("%v: expected permitted connection to be accepted, got %v", cfg, v)
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, req.reply()); v != verdictAccept {
+				t.Errorf("%v: expected reply traffic to be accepted, got %v", cfg, v)
+			}
+			// The client is not isolated for ingress
+			inbound := newConn(ips[1], ips[0], 8080)
+			inbound.iifGroup, inbound.oifGroup = cfg.PodIfaceGroup, cfg.PodIfaceGroup
+			if v := evalPacket(t, mem, nftables.ChainHookForward, inbound); v != verdictAccept {
+				t.Errorf("%v: expected inbound connection to be accepted, got %v", cfg, v)
+			}
+			req.dport = 81
+			if v := evalPacket(t, mem, nftables.ChainHookForward, req); v != verdictReject {
+				t.Errorf("%v: expected connection to other port to be rejected, got %v", cfg, v)
+			}
+		}
+	}
+}
+
+func TestEgressOriginalSource(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		c, mem, _ := newTestController(t, Config{EgressOriginalSource: enabled})
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.1", "fd00::1"))
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "egress"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+				Egress: []nwkv1.NetworkPolicyEgressRule{{
+					To: []nwkv1.NetworkPolicyPeer{
+						{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}},
+						{IPBlock: &nwkv1.IPBlock{CIDR: "2001:db8::/32"}},
+					},
+				}},
+			},
+		})
+		mustFlush(t, c)
+
+		// The source of the packets has already been translated to the node
+		// address, the original source is the pod.
+		for _, ips := range [][4]string{
+			{"10.0.0.1", "100.64.0.1", "192.0.2.1", "198.51.100.1"},
+			{"fd00::1", "fd00:64::1", "2001:db8::1", "2001:db9::1"},
+		} {
+			allowed := newConn(ips[1], ips[2], 80)
+			allowed.origSrc = netip.MustParseAddr(ips[0])
+			if v := evalPacket(t, mem, nftables.ChainHookForward, allowed); v != verdictAccept {
+				t.Errorf("enabled=%v: expected traffic to allowed block to be accepted, got %v", enabled, v)
+			}
+			other := newConn(ips[1], ips[3], 80)
+			other.origSrc = netip.MustParseAddr(ips[0])
+			expected := verdictAccept
+			if enabled {
+				expected = verdictReject
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, other); v != expected {
+				t.Errorf("enabled=%v: expected traffic to other address %s to be %v, got %v", enabled, ips[3], expected, v)
+			}
+		}
+	}
+}
+
+func TestEgressOriginalDestination(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		c, mem, _ := newTestController(t, Config{EgressOriginalDestination: enabled})
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.1", "fd00::1"))
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "egress"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+				Egress: []nwkv1.NetworkPolicyEgressRule{{
+					// The Service CIDRs
+					To: []nwkv1.NetworkPolicyPeer{
+						{IPBlock: &nwkv1.IPBlock{CIDR: "10.96.0.0/12"}},
+						{IPBlock: &nwkv1.IPBlock{CIDR: "fd00:96::/108"}},
+					},
+				}},
+			},
+		})
+		mustFlush(t, c)
+
+		// Connections to a Service IP translated to the IP of a backend
+		for _, ips := range [][3]string{{"10.0.0.1", "10.96.0.10", "10.0.1.1"}, {"fd00::1", "fd00:96::a", "fd00:1::1"}} {
+			pkt := newConn(ips[0], ips[2], 80)
+			pkt.origDst = netip.MustParseAddr(ips[1])
+			expected := verdictReject
+			if enabled {
+				expected = verdictAccept
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != expected {
+				t.Errorf("enabled=%v: expected connection to Service IP %s to be %v, got %v", enabled, ips[1], expected, v)
+			}
+			// Untranslated traffic to the backend directly
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(ips[0], ips[2], 80)); v != verdictReject {
+				t.Errorf("enabled=%v: expected direct connection to %s to be rejected, got %v", enabled, ips[2], v)
+			}
+		}
+	}
+}
+
+func TestRejectWithTCPReset(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{RejectWith: RejectTCPReset})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1", "fd00::1"))
+	mustFlush(t, c)
+
+	for _, ips := range [][2]string{{"10.0.1.1", "10.0.0.1"}, {"fd00:1::1", "fd00::1"}} {
+		tcp := newConn(ips[0], ips[1], 80)
+		if v := evalPacket(t, mem, nftables.ChainHookForward, tcp); v != verdictReset {
+			t.Errorf("expected TCP connection %v to be reset, got %v", ips, v)
+		}
+		udp := tcp
+		udp.proto, udp.tcpFlags = unix.IPPROTO_UDP, 0
+		if v := evalPacket(t, mem, nftables.ChainHookForward, udp); v != verdictReject {
+			t.Errorf("expected UDP traffic %v to be rejected with ICMP, got %v", ips, v)
+		}
+	}
+}
+
+func TestAllowMulticast(t *testing.T) {
+	drop := nftables.ChainPolicyDrop
+	for _, cfg := range []Config{{AllowMulticast: true}, {AllowMulticast: true, BaseChainPolicy: &drop, PodIfaceGroup: 1}} {
+		c, mem, _ := newTestController(t, cfg)
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deny"},
+			Spec:       nwkv1.NetworkPolicySpec{PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress}},
+		})
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", nil, "10.0.0.1", "fd00::1"))
+		mustFlush(t, c)
+
+		for _, ips := range [][3]string{{"10.0.0.1", "224.0.0.251", "10.0.0.2"}, {"10.0.0.1", "255.255.255.255", "10.0.0.2"}, {"fd00::1", "ff02::fb", "fd00::2"}} {
+			pkt := newConn(ips[0], ips[1], 5353)
+			pkt.proto, pkt.tcpFlags = unix.IPPROTO_UDP, 0
+			pkt.iifGroup, pkt.oifGroup = cfg.PodIfaceGroup, cfg.PodIfaceGroup
+			if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != verdictAccept {
+				t.Errorf("%v: expected traffic to %v to be accepted, got %v", cfg, ips[1], v)
+			}
+			pkt.dst = netip.MustParseAddr(ips[2])
+			if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != verdictReject {
+				t.Errorf("%v: expected unicast traffic to %v to be rejected, got %v", cfg, ips[2], v)
+			}
+		}
+	}
+}
+
+func TestICMPv6ND(t *testing.T) {
+	drop := nftables.ChainPolicyDrop
+	for _, cfg := range []Config{{AllowICMPv6ND: true}, {AllowICMPv6ND: true, BaseChainPolicy: &drop, PodIfaceGroup: 1}, {}} {
+		c, mem, _ := newTestController(t, cfg)
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", nil, "10.0.0.1", "fd00::1"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", nil, "10.0.0.2", "fd00::2"))
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+		mustFlush(t, c)
+
+		icmp := func(src, dst string, proto, typ uint8) testPacket {
+			return testPacket{
+				src:      netip.MustParseAddr(src),
+				dst:      netip.MustParseAddr(dst),
+				proto:    proto,
+				icmpType: typ,
+				hopLimit: 255,
+				ctState:  expr.CtStateBitNEW,
+				iifGroup: cfg.PodIfaceGroup,
+				oifGroup: cfg.PodIfaceGroup,
+			}
+		}
+		ndVerdict := verdictReject
+		if cfg.AllowICMPv6ND {
+			ndVerdict = verdictAccept
+		}
+		for _, typ := range []uint8{135, 136} {
+			if v := evalPacket(t, mem, nftables.ChainHookForward, icmp("fd00::1", "fd00::2", unix.IPPROTO_ICMPV6, typ)); v != ndVerdict {
+				t.Errorf("%+v: expected ICMPv6 type %d between isolated pods to be %v, got %v", cfg, typ, ndVerdict, v)
+			}
+		}
+		// Forwarded messages, other ICMPv6 messages and other traffic are
+		// still subject to policies.
+		routed := icmp("fd00::1", "fd00::2", unix.IPPROTO_ICMPV6, 135)
+		routed.hopLimit = 254
+		if v := evalPacket(t, mem, nftables.ChainHookForward, routed); v != verdictReject {
+			t.Errorf("%+v: expected neighbor solicitation with a hop limit below 255 to be rejected, got %v", cfg, v)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, icmp("fd00::1", "fd00::2", unix.IPPROTO_ICMPV6, 128)); v != verdictReject {
+			t.Errorf("%+v: expected ICMPv6 echo request to be rejected, got %v", cfg, v)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, icmp("10.0.0.1", "10.0.0.2", unix.IPPROTO_ICMP, 135)); v != verdictReject {
+			t.Errorf("%+v: expected ICMP with the type of a neighbor solicitation to be rejected, got %v", cfg, v)
+		}
+		conn := newConn("fd00::1", "fd00::2", 80)
+		conn.iifGroup, conn.oifGroup = cfg.PodIfaceGroup, cfg.PodIfaceGroup
+		if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != verdictReject {
+			t.Errorf("%+v: expected TCP connection to be rejected, got %v", cfg, v)
+		}
+	}
+}
+
+func TestBypassCIDRs(t *testing.T) {
+	drop := nftables.ChainPolicyDrop
+	bypass := []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("fd10::/64")}
+	for _, cfg := range []Config{{BypassCIDRs: bypass}, {BypassCIDRs: bypass, BaseChainPolicy: &drop, PodIfaceGroup: 1}} {
+		c, mem, _ := newTestController(t, cfg)
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", nil, "10.0.0.1", "fd00::1"))
+		mustFlush(t, c)
+
+		for _, ips := range [][3]string{{"10.0.0.1", "192.168.1.1", "192.169.0.1"}, {"fd00::1", "fd10::1", "fd10:0:0:1::1"}} {
+			for _, ingress := range []bool{false, true} {
+				// The peer is reached through a non-pod interface
+				pkt := newConn(ips[0], ips[1], 22)
+				pkt.iifGroup = cfg.PodIfaceGroup
+				if ingress {
+					pkt.src, pkt.dst = pkt.dst, pkt.src
+					pkt.iifGroup, pkt.oifGroup = 0, cfg.PodIfaceGroup
+				}
+				if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != verdictAccept {
+					t.Errorf("%v: expected traffic %v -> %v to be accepted, got %v", cfg, pkt.src, pkt.dst, v)
+				}
+				other := netip.MustParseAddr(ips[2])
+				if ingress {
+					pkt.src = other
+				} else {
+					pkt.dst = other
+				}
+				if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != verdictReject {
+					t.Errorf("%v: expected traffic %v -> %v to be rejected, got %v", cfg, pkt.src, pkt.dst, v)
+				}
+			}
+		}
+		if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+			t.Errorf("expected no orphans, got %v, %v", orphans, err)
+		}
+	}
+}
+
+func TestPodRejectCounters(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{RuleCounters: true, RejectWith: RejectTCPReset})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "isolated"}, testPod("default", "isolated", nil, "10.0.0.1", "fd00::1"))
+	c.SetPod(cache.ObjectName{Namespace: "other", Name: "open"}, testPod("other", "open", nil, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+
+	// Simulate the kernel counting rejected IPv4 packets
+	var numCounters int
+	chains, _ := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	for _, ch := range chains {
+		rules, _ := mem.GetRules(ch.Table, ch)
+		for _, r := range rules {
+			for _, e := range r.Exprs {
+				if ctr, ok := e.(*expr.Counter); ok {
+					ctr.Packets, ctr.Bytes = 1, 100
+					numCounters++
+				}
+			}
+		}
+	}
+	// Two reject rules for TCP and other traffic in each direction
+	if numCounters != 4 {
+		t.Errorf("expected counters on the four reject rules, got %d", numCounters)
+	}
+
+	counters, err := c.PodRejectCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 1 || counters[0].Pod != (cache.ObjectName{Namespace: "default", Name: "isolated"}) || counters[0].Packets != 4 || counters[0].Bytes != 400 {
+		t.Errorf("expected 4 packets and 400 bytes for default/isolated, got %v", counters)
+	}
+}
+
+func TestNamespaceRejectTotals(t *testing.T) {
+	a := cache.ObjectName{Namespace: "a", Name: "a"}
+	b := cache.ObjectName{Namespace: "a", Name: "b"}
+	c := cache.ObjectName{Namespace: "c", Name: "c"}
+	chA, chB, chC := &nfds.Chain{Name: "a"}, &nfds.Chain{Name: "b"}, &nfds.Chain{Name: "c"}
+	// Recreated chains of pods b and c
+	chB2, chC2 := &nfds.Chain{Name: "b"}, &nfds.Chain{Name: "c"}
+	counter := func(pod cache.ObjectName, ch *nfds.Chain, packets uint64) PodCounter {
+		return PodCounter{Pod: pod, Packets: packets, Bytes: packets * 100, chains: map[*nfds.Chain]expr.Counter{ch: {Packets: packets, Bytes: packets * 100}}}
+	}
+	totals := NewNamespaceRejectTotals()
+	for _, step := range []struct {
+		counters []PodCounter
+		expected []NamespaceCounter
+	}{
+		{
+			[]PodCounter{counter(a, chA, 1), counter(c, chC, 0)},
+			[]NamespaceCounter{{"a", 1, 100}, {"c", 0, 0}},
+		},
+		{
+			[]PodCounter{counter(a, chA, 3), counter(b, chB, 1), counter(c, chC, 2)},
+			[]NamespaceCounter{{"a", 4, 400}, {"c", 2, 200}},
+		},
+		// Pod b was deleted and c recreated, resetting its counter
+		{
+			[]PodCounter{counter(a, chA, 3), counter(c, chC2, 1)},
+			[]NamespaceCounter{{"a", 4, 400}, {"c", 3, 300}},
+		},
+		// Pod b is recreated with the same name and already counted more
+		// than its predecessor
+		{
+			[]PodCounter{counter(a, chA, 3), counter(b, chB2, 5), counter(c, chC2, 1)},
+			[]NamespaceCounter{{"a", 9, 900}, {"c", 3, 300}},
+		},
+	} {
+		totals.Update(step.counters)
+		if got := totals.Counters(); !reflect.DeepEqual(got, step.expected) {
+			t.Errorf("after %v: expected %v, got %v", step.counters, step.expected, got)
+		}
+	}
+
+	// Deleted namespaces are forgotten
+	totals.Prune(func(ns string) bool { return ns == "a" })
+	if got, expected := totals.Counters(), []NamespaceCounter{{"a", 9, 900}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("after pruning: expected %v, got %v", expected, got)
+	}
+}
+
+func TestPolicyCounters(t *testing.T) {
+	var b strings.Builder
+	mem := nfds.NewMemory()
+	conn := nfds.WrapConn(mem)
+	conn.RecordScript(&b)
+	c, err := New(record.NewFakeRecorder(100), conn, Config{PolicyCounters: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := cache.ObjectName{Namespace: "default", Name: "allow"}
+	policy := func(port int32) *nwkv1.NetworkPolicy {
+		return &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+			Spec: nwkv1.NetworkPolicySpec{
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}, {IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(port))}},
+				}},
+			},
+		}
+	}
+	c.SetNetworkPolicy(name, policy(80))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1", "fd00::1"))
+	mustFlush(t, c)
+
+	ctrName := "pol_" + c.nwps[name].ID + "_cnt"
+	chains, _ := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	var accepting int
+	for _, ch := range chains {
+		if !strings.HasPrefix(ch.Name, "pol_") {
+			continue
+		}
+		rules, _ := mem.GetRules(ch.Table, ch)
+		for _, r := range rules {
+			if v, ok := r.Exprs[len(r.Exprs)-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictAccept {
+				continue
+			}
+			accepting++
+			if ref, ok := r.Exprs[len(r.Exprs)-2].(*expr.Objref); !ok || ref.Name != ctrName {
+				t.Errorf("chain %q: expected accepting rule to reference %q: %v", ch.Name, ctrName, r.Exprs)
+			}
+		}
+	}
+	if accepting == 0 {
+		t.Error("expected accepting policy rules")
+	}
+	counters, err := c.PolicyCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []PolicyCounter{{Policy: name}}; !reflect.DeepEqual(counters, expected) {
+		t.Errorf("expected counters %v, got %v", expected, counters)
+	}
+
+	// Updating the policy keeps the counter
+	b.Reset()
+	c.SetNetworkPolicy(name, policy(443))
+	mustFlush(t, c)
+	if strings.Contains(b.String(), " counter ip") {
+		t.Errorf("expected counter to be kept on update, got script\n%s", b.String())
+	}
+
+	b.Reset()
+	c.SetNetworkPolicy(name, nil)
+	mustFlush(t, c)
+	if !strings.Contains(b.String(), "delete counter ip "+defaultTableName+" "+ctrName) {
+		t.Errorf("expected counter to be deleted with the policy, got script\n%s", b.String())
+	}
+	if counters, err := c.PolicyCounters(); err != nil || len(counters) != 0 {
+		t.Errorf("expected no counters, got %v, %v", counters, err)
+	}
+}
+
+func TestRejectRate(t *testing.T) {
+	limit, err := ParseRejectRate("10/second burst 20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []RejectMode{RejectICMPAdminProhibited, RejectTCPReset} {
+		c, mem, _ := newTestController(t, Config{RejectWith: mode, RejectRate: limit, RuleCounters: true})
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "isolated"}, testPod("default", "isolated", nil, "10.0.0.1", "fd00::1"))
+		mustFlush(t, c)
+
+		want := verdictReject
+		if mode == RejectTCPReset {
+			want = verdictReset
+		}
+		for _, pkt := range []testPacket{newConn("10.0.0.2", "10.0.0.1", 80), newConn("10.0.0.1", "10.0.0.2", 80), newConn("fd00::2", "fd00::1", 80)} {
+			if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != want {
+				t.Errorf("mode %v: expected %v below the reject rate, got %v", mode, want, v)
+			}
+			pkt.overLimit = true
+			if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != verdictDrop {
+				t.Errorf("mode %v: expected drop above the reject rate, got %v", mode, v)
+			}
+		}
+	}
+	if limit, err := ParseRejectRate(""); limit != nil || err != nil {
+		t.Errorf("expected no limit for empty rate, got %v, %v", limit, err)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	var b strings.Builder
+	mem := nfds.NewMemory()
+	conn := nfds.WrapConn(mem)
+	conn.RecordScript(&b)
+	policy := &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec:       nwkv1.NetworkPolicySpec{Ingress: []nwkv1.NetworkPolicyIngressRule{{}}},
+	}
+	newController := func() *Controller {
+		t.Helper()
+		b.Reset()
+		c, err := New(record.NewFakeRecorder(10), conn, Config{PolicyCounters: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, policy)
+		mustFlush(t, c)
+		return c
+	}
+	c := newController()
+	if c.PreviousSchemaVersion != "" {
+		t.Errorf("expected no previous version for new table, got %q", c.PreviousSchemaVersion)
+	}
+
+	// The same version is reconciled in place, keeping the table and the
+	// counters
+	c = newController()
+	if c.PreviousSchemaVersion != SchemaVersion {
+		t.Errorf("expected previous version %q, got %q", SchemaVersion, c.PreviousSchemaVersion)
+	}
+	if strings.Contains(b.String(), "delete table") || strings.Contains(b.String(), "delete counter") {
+		t.Errorf("expected table and counters to be kept, got script\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), "delete chain") {
+		t.Errorf("expected chains to be replaced, got script\n%s", b.String())
+	}
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v (%v)", orphans, err)
+	}
+
+	// Other versions cause the table to be recreated
+	for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		mem.DelSet(&nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: fam}, Name: nfds.VersionSetName})
+	}
+	if err := conn.WriteVersion(c.table, "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	c = newController()
+	if c.PreviousSchemaVersion != "0" {
+		t.Errorf("expected previous version 0, got %q", c.PreviousSchemaVersion)
+	}
+	if !strings.Contains(b.String(), "delete table") {
+		t.Errorf("expected table to be recreated, got script\n%s", b.String())
+	}
+	if v, err := conn.ReadVersion(defaultTableName); err != nil || v != SchemaVersion {
+		t.Errorf("expected version %q after recreating the table, got %q, %v", SchemaVersion, v, err)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	mem := nfds.NewMemory()
+	conn := nfds.WrapConn(mem)
+	c, err := New(record.NewFakeRecorder(10), conn, Config{Identity: "node-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustFlush(t, c)
+	if id, err := conn.ReadIdentity(defaultTableName); err != nil || id != "node-a" {
+		t.Errorf("expected identity node-a, got %q, %v", id, err)
+	}
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected identity marker not to be an orphan, got %v, %v", orphans, err)
+	}
+	c, err = New(record.NewFakeRecorder(10), conn, Config{Identity: "node-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PreviousIdentity != "node-a" {
+		t.Errorf("expected previous identity node-a, got %q", c.PreviousIdentity)
+	}
+	mustFlush(t, c)
+	if id, err := conn.ReadIdentity(defaultTableName); err != nil || id != "node-b" {
+		t.Errorf("expected identity node-b after taking over the table, got %q, %v", id, err)
+	}
+	c, err = New(record.NewFakeRecorder(10), conn, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustFlush(t, c)
+	if id, err := conn.ReadIdentity(defaultTableName); err != nil || id != "" {
+		t.Errorf("expected no identity if unset, got %q, %v", id, err)
+	}
+}
+
+func TestStateless(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{Stateless: true})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.1", "fd00::1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.2", "fd00::2"))
+	port, dns := intstr.FromInt32(80), intstr.FromInt32(53)
+	udp := corev1.ProtocolUDP
+	// Both pods are isolated in both directions
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "client"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "client"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To:    []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+			}, {
+				To:    []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.168.0.0/24"}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}},
+			}},
+		},
+	})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "server"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "server"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+			}},
+		},
+	})
+	mustFlush(t, c)
+
+	for _, ips := range [][2]string{{"10.0.0.1", "10.0.0.2"}, {"fd00::1", "fd00::2"}} {
+		req := newConn(ips[0], ips[1], 80)
+		if v := evalPacket(t, mem, nftables.ChainHookForward, req); v != verdictAccept {
+			t.Errorf("expected permitted connection to be accepted, got %v", v)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, req.reply()); v != verdictAccept {
+			t.Errorf("expected reply traffic to be accepted by the reply rules, got %v", v)
+		}
+		// Conntrack is not consulted, so this is rejected even though it
+		// claims to belong to an established connection.
+		other := req.reply()
+		other.sport = 8080
+		if v := evalPacket(t, mem, nftables.ChainHookForward, other); v != verdictReject {
+			t.Errorf("expected traffic from another port to be rejected, got %v", v)
+		}
+		req.dport = 81
+		if v := evalPacket(t, mem, nftables.ChainHookForward, req.reply()); v != verdictReject {
+			t.Errorf("expected reply to a connection to another port to be rejected, got %v", v)
+		}
+	}
+	query := newConn("10.0.0.1", "192.168.0.1", 53)
+	query.proto = unix.IPPROTO_UDP
+	if v := evalPacket(t, mem, nftables.ChainHookForward, query.reply()); v != verdictAccept {
+		t.Errorf("expected reply from ipBlock peer to be accepted, got %v", v)
+	}
+	query.dst = netip.MustParseAddr("192.168.1.1")
+	if v := evalPacket(t, mem, nftables.ChainHookForward, query.reply()); v != verdictReject {
+		t.Errorf("expected reply from outside the ipBlock to be rejected, got %v", v)
+	}
+
+	// The reply jumps are removed with the policies and chains
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "server"}, nil)
+	mustFlush(t, c)
+	checkRefs(t, c)
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "10.0.0.2", 80).reply()); v != verdictAccept {
+		t.Errorf("expected reply from non-isolated server to be accepted, got %v", v)
+	}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "client"}, nil)
+	mustFlush(t, c)
+	checkRefs(t, c)
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v, %v", orphans, err)
+	}
+
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "flags"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "flags", Annotations: map[string]string{annotationTCPFlags: "syn"}},
+	})
+	mustFlush(t, c)
+	if events := drainEvents(rec); !slices.ContainsFunc(events, func(e string) bool { return strings.Contains(e, "not supported in stateless mode") }) {
+		t.Errorf("expected the TCP flags annotation to be rejected, got events %v", events)
+	}
+
+	if _, err := New(rec, nfds.WrapConn(nfds.NewMemory()), Config{Stateless: true, EgressOriginalSource: true}); err == nil {
+		t.Error("expected stateless mode to be incompatible with matching the original source")
+	}
+	if _, err := New(rec, nfds.WrapConn(nfds.NewMemory()), Config{Stateless: true, DisableEgress: true}); err == nil {
+		t.Error("expected stateless mode to be incompatible with disabling egress")
+	}
+}
+
+func TestStatelessRepliesNotLimited(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{Stateless: true, PolicyCounters: true})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1", "fd00::1"))
+	port := intstr.FromInt32(80)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow", Annotations: map[string]string{annotationLimit: "10/minute"}},
+		Spec: nwkv1.NetworkPolicySpec{
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{Ports: []nwkv1.NetworkPolicyPort{{Port: &port}}}},
+		},
+	})
+	mustFlush(t, c)
+
+	chains, _ := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	var limited, replies int
+	for _, ch := range chains {
+		if !strings.HasPrefix(ch.Name, "pol_") {
+			continue
+		}
+		rules, _ := mem.GetRules(ch.Table, ch)
+		for _, r := range rules {
+			hasLimit := slices.ContainsFunc(r.Exprs, func(e expr.Any) bool { _, ok := e.(*expr.Limit); return ok })
+			hasRef := slices.ContainsFunc(r.Exprs, func(e expr.Any) bool { _, ok := e.(*expr.Objref); return ok })
+			if strings.HasSuffix(ch.Name, "_reply") {
+				replies++
+				if hasLimit || hasRef {
+					t.Errorf("chain %q: expected reply rule not to be limited or counted: %v", ch.Name, r.Exprs)
+				}
+			} else if hasLimit && hasRef {
+				limited++
+			}
+		}
+	}
+	if limited == 0 || replies == 0 {
+		t.Errorf("expected limited and counted rules as well as reply rules, got %d and %d", limited, replies)
+	}
+}
+
+func TestPolicyStats(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+			}},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "db"}, testPod("default", "db", map[string]string{"app": "db"}, "10.0.0.2"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.3"))
+	mustFlush(t, c)
+
+	expected := []PolicyStats{{
+		Policy:       cache.ObjectName{Namespace: "default", Name: "allow"},
+		Rules:        2,
+		SelectedPods: 1,
+		PeerPods:     4,
+	}}
+	if stats := c.PolicyStats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestPodIsolation(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "ingress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ingress"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+		},
+	})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "db", Name: "deny"}, denyAllPolicy("db", "deny"))
+	// Audited policies do not isolate pods
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "audit"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "audit", Annotations: map[string]string{annotationMode: "audit"}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "audited"}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2"))
+	c.SetPod(cache.ObjectName{Namespace: "db", Name: "db"}, testPod("db", "db", nil, "10.0.0.3"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "audited"}, testPod("default", "audited", map[string]string{"app": "audited"}, "10.0.0.4"))
+	mustFlush(t, c)
+
+	expected := []PodIsolation{
+		{Pod: cache.ObjectName{Namespace: "db", Name: "db"}, Ingress: true, Egress: true},
+		{Pod: cache.ObjectName{Namespace: "default", Name: "audited"}},
+		{Pod: cache.ObjectName{Namespace: "default", Name: "client"}},
+		{Pod: cache.ObjectName{Namespace: "default", Name: "server"}, Ingress: true},
+	}
+	if iso := c.PodIsolation(); !reflect.DeepEqual(iso, expected) {
+		t.Errorf("expected isolation %+v, got %+v", expected, iso)
+	}
+}
+
+func TestFootprint(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	if f := c.Footprint(); f != (Footprint{}) {
+		t.Errorf("expected empty footprint, got %+v", f)
+	}
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", map[string]string{"app": "a"}, "10.0.0.1"))
+	mustFlush(t, c)
+	small := c.Footprint()
+	if small.Pods.Count != 1 || small.Policies.Count != 1 || small.Rules.Count != 1 {
+		t.Errorf("expected one object of every kind, got %+v", small)
+	}
+	if small.Pods.EstimatedBytes <= 0 || small.Policies.EstimatedBytes <= 0 || small.Rules.EstimatedBytes <= 0 {
+		t.Errorf("expected positive size estimates, got %+v", small)
+	}
+
+	// A pod with more labels and IPs, which also becomes a peer of the rule,
+	// grows the estimates.
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", map[string]string{"app": "b", "tier": "backend"}, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+	large := c.Footprint()
+	if large.Pods.Count != 2 || large.Pods.EstimatedBytes <= 2*small.Pods.EstimatedBytes {
+		t.Errorf("expected the second pod to more than double the pod estimate, got %+v after %+v", large.Pods, small.Pods)
+	}
+	if large.Rules.EstimatedBytes <= small.Rules.EstimatedBytes {
+		t.Errorf("expected the rule estimate to grow with its peers, got %+v after %+v", large.Rules, small.Rules)
+	}
+
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, nil)
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, nil)
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, nil)
+	mustFlush(t, c)
+	if f := c.Footprint(); f != (Footprint{}) {
+		t.Errorf("expected empty footprint after deleting everything, got %+v", f)
+	}
+}
+
+func TestScriptRendersRuleset(t *testing.T) {
+	drop := nftables.ChainPolicyDrop
+	var b strings.Builder
+	mem := nfds.NewMemory()
+	conn := nfds.WrapConn(mem)
+	conn.RecordScript(&b)
+	c, err := New(record.NewFakeRecorder(100), conn, Config{
+		PodIfaceGroup:    1,
+		BaseChainPolicy:  &drop,
+		IfaceResolver:    func(*corev1.Pod, netip.Addr) (uint32, error) { return 2, nil },
+		CtZones:          []CtZone{{IfaceGroup: 1, Zone: 1}},
+		RejectWith:       RejectTCPReset,
+		RejectRate:       &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond},
+		RuleCounters:     true,
+		PolicyCounters:   true,
+		AllowMulticast:   true,
+		AllowSelfTraffic: true,
+		AllowICMPv6ND:    true,
+		BypassCIDRs:      []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+		L2AntiSpoofing:   true,
+		SharedPortSetMin: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test", Annotations: map[string]string{
+			annotationTCPFlags:                    "syn/syn,ack",
+			annotationActiveTime:                  "sat-sun 22:00-06:00",
+			annotationLimit:                       "10/minute",
+			annotationPacketLength + "-ingress-0": "64-1500",
+		}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{}},
+					{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24", Except: []string{"192.0.2.128/25"}}},
+				},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(80))}, {Port: ptrIntStr(intstr.FromString("http"))}},
+			}},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(53))}, {Port: ptrIntStr(intstr.FromInt32(443))}, {Port: ptrIntStr(intstr.FromInt32(8000)), EndPort: ptr(int32(8080))}},
+			}},
+		},
+	})
+	pod := testPod("default", "a", nil, "10.0.0.1", "fd00::1")
+	pod.Annotations = map[string]string{annotationMAC: "02:00:00:00:00:01", annotationVLAN: "100"}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, pod)
+	mustFlush(t, c)
+
+	script := b.String()
+	if strings.Contains(script, "<") {
+		t.Errorf("script contains unsupported expressions:\n%s", script)
+	}
+	for _, line := range []string{
+		"add chain ip k8s-nft-npc filter_hook_ing { type filter hook forward priority 225; policy drop; }",
+		"add rule ip k8s-nft-npc filter_hook_ing ct state established,related accept",
+		"add rule ip6 k8s-nft-npc filter_hook_ing meta l4proto ipv6-icmp ip6 hoplimit 255 icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept",
+		"add rule ip k8s-nft-npc l2_" + c.pods[cache.ObjectName{Namespace: "default", Name: "a"}].ID + " ether saddr != 02:00:00:00:00:01 drop",
+	} {
+		if !strings.Contains(script, line+"\n") {
+			t.Errorf("expected script to contain %q, got\n%s", line, script)
+		}
+	}
+}
+
+// advanceAddr returns the address n addresses after a, saturating at the last
+// address of its family.
+func advanceAddr(a netip.Addr, n int) netip.Addr {
+	for range n {
+		next := a.Next()
+		if !next.IsValid() {
+			break
+		}
+		a = next
+	}
+	return a
+}
+
+// FuzzRangesAddrs applies the same sequence of additions and subtractions of
+// address ranges to ranges.Ranges with the comparator used for ipBlocks and to
+// a netipx.IPSet and checks that both cover the same addresses. Ranges start
+// close to the boundaries of bytes and families, which the integer fuzz test
+// of the ranges package does not reach.
+func FuzzRangesAddrs(f *testing.F) {
+	f.Add([]byte{0x00, 0x00, 0x1f, 0x01, 0x04, 0x02})
+	f.Add([]byte{0x02, 0x03, 0x10, 0x04, 0x08, 0x1f, 0x05, 0x00, 0x00})
+	f.Add([]byte{0x06, 0x00, 0x1f, 0x0d, 0x00, 0x02, 0x10, 0x0f, 0x1f, 0x11, 0x0f, 0x00})
+	// Ranges ending at 10.0.0.255 and starting at 10.0.1.0, which need a
+	// carry or borrow to be recognized as adjacent
+	f.Add([]byte{0x02, 0x00, 0x05, 0x02, 0x06, 0x04, 0x03, 0x06, 0x01, 0x02, 0x00, 0x14, 0x03, 0x00, 0x05})
+	anchors := []netip.Addr{
+		netip.MustParseAddr("0.0.0.0"),
+		netip.MustParseAddr("10.0.0.250"),
+		netip.MustParseAddr("10.0.255.250"),
+		netip.MustParseAddr("10.255.255.255"),
+		netip.MustParseAddr("255.255.255.240"),
+		netip.MustParseAddr("::"),
+		netip.MustParseAddr("fd00::fff0"),
+		netip.MustParseAddr("fd00::ffff:ffff:fff8"),
+		netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff0"),
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		in := fuzzInput(data)
+		dut := ranges.NewWithCompare(lessAddrs, closest)
+		var ref netipx.IPSetBuilder
+		for len(in) > 0 {
+			op := in.byte()
+			start := advanceAddr(anchors[int(op>>1)%len(anchors)], int(in.byte()%16))
+			end := advanceAddr(start, int(in.byte()%32))
+			r := ranges.Range[netip.Addr]{Start: start, End: end}
+			if op%2 == 0 {
+				t.Logf("Adding [%v, %v]", start, end)
+				dut.Add(r)
+				ref.AddRange(netipx.IPRangeFrom(start, end))
+			} else {
+				t.Logf("Subtracting [%v, %v]", start, end)
+				dut.Subtract(r)
+				ref.RemoveRange(netipx.IPRangeFrom(start, end))
+			}
+			refSet, err := ref.IPSet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []netipx.IPRange
+			for it := dut.Iterator(); it.Valid(); it.Next() {
+				got = append(got, netipx.IPRangeFrom(it.Item().Start, it.Item().End))
+			}
+			// Adjacent ranges are merged by both, so the ranges are equal
+			// if the covered addresses are.
+			if expected := refSet.Ranges(); !slices.Equal(got, expected) {
+				t.Fatalf("expected ranges %v, got %v", expected, got)
+			}
+		}
+	})
+}
+
+func TestTraceContext(t *testing.T) {
+	var lines []string
+	conn := nfds.WrapConn(nfds.NewMemory())
+	conn.Trace(func() bool { return true }, func(line string) { lines = append(lines, line) })
+	c, err := New(record.NewFakeRecorder(100), conn, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec: nwkv1.NetworkPolicySpec{
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1"))
+	mustFlush(t, c)
+
+	for _, prefix := range []string{
+		"policy default/test: add chain ip k8s-nft-npc pol_",
+		"policy default/test ingress rule 0: add set ip k8s-nft-npc pol_",
+		"pod default/server: add element ip k8s-nft-npc pol_",
+		"pod default/server selected by policy default/test: insert rule ip k8s-nft-npc pod_",
+	} {
+		if !slices.ContainsFunc(lines, func(l string) bool { return strings.HasPrefix(l, prefix) }) {
+			t.Errorf("expected a line starting with %q, got\n%s", prefix, strings.Join(lines, "\n"))
+		}
+	}
+	if conn.SetTraceContext("") != "" {
+		t.Error("expected the trace context to be restored")
+	}
+}
@@ -22,9 +22,42 @@ func (ns *Namespace) SemanticallyEqual(ns2 *Namespace) bool {
 	return true
 }
 
+// indexRule adds r to nsRules if it selects peers by namespace labels and to
+// readyRules if it only selects Ready pods.
+func (c *Controller) indexRule(r *Rule) {
+	if r.readyPeers {
+		c.readyRules[r] = struct{}{}
+	}
+	for _, sel := range r.PodSelectors {
+		if sel.NamespaceSelector != labels.Nothing() {
+			c.nsRules[r] = struct{}{}
+			return
+		}
+	}
+}
+
+func (c *Controller) indexPod(p *Pod) {
+	pods := c.nsPods[p.Namespace]
+	if pods == nil {
+		pods = make(map[*Pod]struct{})
+		c.nsPods[p.Namespace] = pods
+	}
+	pods[p] = struct{}{}
+}
+
+func (c *Controller) unindexPod(p *Pod) {
+	delete(c.nsPods[p.Namespace], p)
+	if len(c.nsPods[p.Namespace]) == 0 {
+		delete(c.nsPods, p.Namespace)
+	}
+}
+
 func (c *Controller) updateNS(old, new *Namespace) {
-	for r := range c.rules {
-		reevalPods := make(map[*Pod]struct{})
+	pods := c.nsPods[new.Name]
+	if len(pods) == 0 {
+		return // No pods to reevaluate
+	}
+	for r := range c.nsRules {
 		for _, sel := range r.PodSelectors {
 			if sel.NamespaceSelector == labels.Nothing() {
 				continue // Selector unaffected
@@ -37,45 +70,33 @@ func (c *Controller) updateNS(old, new *Namespace) {
 			if oldMatches == newMatches {
 				continue // Selector unaffected by change
 			}
-			// Relevant change happened, compute pods changed
-			if oldMatches {
-				for pod := range r.podRefs {
-					if pod.Namespace == new.Name {
-						reevalPods[pod] = struct{}{}
-					}
-				}
-			} else {
-				for _, pod := range c.pods {
-					if pod.Namespace == new.Name {
-						reevalPods[pod] = struct{}{}
-					}
-				}
+			// Relevant change happened, reevaluate the pods of the
+			// namespace against all selectors of the rule.
+			for p := range pods {
+				c.reevalPodInRule(p, r)
 			}
-		}
-		for p := range reevalPods {
-			c.reevalPodInRule(p, r)
+			break
 		}
 	}
 }
 
+// reevalPodInRule updates whether p is selected as a peer by r. Peers are
+// sources of ingress and destinations of egress rules, both are matched
+// through the same pod IP and named port sets.
 func (c *Controller) reevalPodInRule(p *Pod, r *Rule) {
 	isSelected := c.ruleSelectsPod(r, p)
 	_, wasSelected := r.podRefs[p]
 	if isSelected && !wasSelected {
 		p.ruleRefs[r] = struct{}{}
 		r.podRefs[p] = struct{}{}
-		if r.PodIPSet != nil {
-			c.nftConn.SetAddElements(r.PodIPSet, p.ipElements())
-		}
+		c.addRulePodIPs(r, p)
 		if r.NamedPortSet != nil {
 			c.nftConn.SetAddElements(r.NamedPortSet, p.namedPortElements(r.NamedPortMeta))
 		}
 	} else if !isSelected && wasSelected {
 		delete(r.podRefs, p)
 		delete(p.ruleRefs, r)
-		if r.PodIPSet != nil {
-			c.nftConn.SetDeleteElements(r.PodIPSet, p.ipElements())
-		}
+		c.delRulePodIPs(r, p)
 		if r.NamedPortSet != nil {
 			c.nftConn.SetDeleteElements(r.NamedPortSet, p.namedPortElements(r.NamedPortMeta))
 		}
@@ -83,6 +104,9 @@ func (c *Controller) reevalPodInRule(p *Pod, r *Rule) {
 }
 
 func (c *Controller) SetNamespace(name string, ns *corev1.Namespace) {
+	if c.nftConn.Tracing() {
+		defer c.traceScope("namespace " + name)()
+	}
 	syncedNS := c.namespaces[name]
 	switch {
 	case syncedNS == nil && ns != nil:
@@ -93,6 +117,9 @@ func (c *Controller) SetNamespace(name string, ns *corev1.Namespace) {
 		c.updateNS(nil, c.namespaces[name])
 	case syncedNS != nil && ns == nil:
 		delete(c.namespaces, name)
+		// Pods of a deleted namespace are not selected by any namespace
+		// selector anymore.
+		c.updateNS(syncedNS, &Namespace{Name: name})
 	case syncedNS != nil && ns != nil:
 		newNS := &Namespace{
 			Name:   name,
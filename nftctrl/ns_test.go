@@ -0,0 +1,142 @@
+package nftctrl
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNamespaceLabelFlip(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	podIPSet := &nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, Name: "pol_server_allow_ing_0_podips"}
+	expectPeer := func(selected bool) {
+		t.Helper()
+		elems, err := mem.GetSetElements(podIPSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selected != (len(elems) == 1) {
+			t.Fatalf("expected client selected as peer: %v, got elements %v", selected, elems)
+		}
+	}
+	setNS := func(labels map[string]string) {
+		c.SetNamespace("client", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "client", Labels: labels}})
+		mustFlush(t, c)
+	}
+
+	setNS(nil)
+	c.SetPod(cache.ObjectName{Namespace: "client", Name: "client"}, testPod("client", "client", nil, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "server", Name: "server"}, testPod("server", "server", nil, "10.0.0.2"))
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "server", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "server", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}}},
+			}},
+		},
+	})
+	mustFlush(t, c)
+	expectPeer(false)
+
+	setNS(map[string]string{"team": "a"})
+	expectPeer(true)
+
+	setNS(map[string]string{"team": "b"})
+	expectPeer(false)
+
+	setNS(map[string]string{"team": "a"})
+	expectPeer(true)
+
+	c.SetNamespace("client", nil)
+	mustFlush(t, c)
+	expectPeer(false)
+
+	// Namespace labels only affect peers, never which pods a policy applies to
+	client := c.pods[cache.ObjectName{Namespace: "client", Name: "client"}]
+	if client.ingressChain != nil || client.egressChain != nil {
+		t.Error("expected client pod to not be isolated by a policy in another namespace")
+	}
+	if c.pods[cache.ObjectName{Namespace: "server", Name: "server"}].ingressChain == nil {
+		t.Error("expected server pod to be isolated")
+	}
+
+	// The namespace index follows pods being recreated and deleted
+	setNS(map[string]string{"team": "a"})
+	c.SetPod(cache.ObjectName{Namespace: "client", Name: "client"}, testPod("client", "client", map[string]string{"version": "2"}, "10.0.0.3"))
+	mustFlush(t, c)
+	setNS(map[string]string{"team": "b"})
+	expectPeer(false)
+	setNS(map[string]string{"team": "a"})
+	expectPeer(true)
+	c.SetPod(cache.ObjectName{Namespace: "client", Name: "client"}, nil)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "server", Name: "allow"}, nil)
+	mustFlush(t, c)
+	if len(c.nsPods["client"]) != 0 || len(c.nsRules) != 0 {
+		t.Errorf("expected deleted objects to be removed from the namespace index, got pods %v and rules %v", c.nsPods["client"], c.nsRules)
+	}
+}
+
+func TestEgressNamespaceLabelFlip(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	setNS := func(labels map[string]string) {
+		c.SetNamespace("db", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "db", Labels: labels}})
+		mustFlush(t, c)
+	}
+	expectAllowed := func(allowed bool) {
+		t.Helper()
+		expected := verdictReject
+		if allowed {
+			expected = verdictAccept
+		}
+		for _, ips := range [][2]string{{"10.0.0.1", "10.0.0.2"}, {"fd00::1", "fd00::2"}} {
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(ips[0], ips[1], 5432)); v != expected {
+				t.Fatalf("expected connection %v to be %v, got %v", ips, expected, v)
+			}
+		}
+	}
+
+	setNS(nil)
+	db := testPod("db", "db", map[string]string{"app": "db"}, "10.0.0.2", "fd00::2")
+	db.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "db", ContainerPort: 5432, Protocol: corev1.ProtocolTCP}}}}
+	c.SetPod(cache.ObjectName{Namespace: "client", Name: "client"}, testPod("client", "client", nil, "10.0.0.1", "fd00::1"))
+	c.SetPod(cache.ObjectName{Namespace: "db", Name: "db"}, db)
+	dbPort := intstr.FromString("db")
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "client", Name: "egress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "client", Name: "egress"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To: []nwkv1.NetworkPolicyPeer{{
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+					PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+				}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &dbPort}},
+			}},
+		},
+	})
+	mustFlush(t, c)
+	expectAllowed(false)
+
+	setNS(map[string]string{"team": "a"})
+	expectAllowed(true)
+
+	setNS(map[string]string{"team": "b"})
+	expectAllowed(false)
+
+	setNS(map[string]string{"team": "a"})
+	expectAllowed(true)
+
+	c.SetNamespace("db", nil)
+	mustFlush(t, c)
+	expectAllowed(false)
+
+	// Only the peer is affected, the destination pod stays unisolated
+	if p := c.pods[cache.ObjectName{Namespace: "db", Name: "db"}]; p.ingressChain != nil || p.egressChain != nil {
+		t.Error("expected destination pod to not be isolated by a policy in another namespace")
+	}
+}
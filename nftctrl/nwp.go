@@ -5,16 +5,18 @@ import (
 	"fmt"
 	"math"
 	"net/netip"
+	"slices"
+	"strings"
 
 	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
 	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
-	"go4.org/netipx"
 	"golang.org/x/sys/unix"
 	corev1 "k8s.io/api/core/v1"
 	nwkv1 "k8s.io/api/networking/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -23,6 +25,7 @@ import (
 
 type Policy struct {
 	Namespace       string
+	Name            string
 	ID              string
 	PodSelector     labels.Selector
 	IngressRuleMeta []*Rule
@@ -30,7 +33,32 @@ type Policy struct {
 
 	ingressChain *nfds.Chain
 	egressChain  *nfds.Chain
-	podRefs      map[*Pod]struct{}
+	// ingressReplyChain and egressReplyChain accept the replies to the
+	// traffic permitted by ingressChain and egressChain if Config.Stateless
+	// is set. They are jumped to from the pod chains of the opposite
+	// direction.
+	ingressReplyChain *nfds.Chain
+	egressReplyChain  *nfds.Chain
+	// ruleChains are the chains of the individual rules if
+	// Config.RuleChains is set.
+	ruleChains []*nfds.Chain
+	podRefs    map[*Pod]struct{}
+	// audit is set if the policy is in audit mode.
+	audit bool
+	// ifaceGroup restricts the policy to traffic through pod interfaces in
+	// this group if non-zero.
+	ifaceGroup uint32
+
+	// spec and annotations are the ones the policy was created from. Only
+	// annotations affecting the ruleset are kept.
+	spec        *nwkv1.NetworkPolicySpec
+	annotations map[string]string
+}
+
+// SemanticallyEqual returns true if the policy was created from a
+// NetworkPolicy equivalent to nwp.
+func (p *Policy) SemanticallyEqual(nwp *nwkv1.NetworkPolicy) bool {
+	return apiequality.Semantic.DeepEqual(p.spec, &nwp.Spec) && apiequality.Semantic.DeepEqual(p.annotations, extensionAnnotations(nwp.Annotations))
 }
 
 type Rule struct {
@@ -39,8 +67,229 @@ type Rule struct {
 	PodIPSet      *nfds.Set
 	NamedPortMeta []RuleNamedPortMeta
 	NamedPortSet  *nfds.Set
+	// FQDNs are the domain names whose addresses are peers of the rule and
+	// FQDNSet contains their addresses.
+	FQDNs   []string
+	FQDNSet *nfds.Set
+
+	// The following fields describe the rule for simulation purposes, the
+	// ruleset is generated directly from the policy.
+	NumberedPortMeta []RuleNumberedPortMeta
+	IPBlocks         *ranges.Ranges[netip.Addr]
+	// AllPeers is set if the rule has no peers and thus permits any peer.
+	AllPeers bool
+	// AllPorts is set if the rule has no ports and thus permits any port.
+	AllPorts bool
+	// SourcePortMeta restricts the source ports per protocol if set by the
+	// source ports annotation. It is not taken into account by simulations.
+	SourcePortMeta []RuleNumberedPortMeta
+	// PacketLength restricts the total IP length of packets if set by the
+	// packet length annotation. It only applies to the first packet of a
+	// connection and is not taken into account by simulations.
+	PacketLength *ranges.Range[uint16]
+
+	// limit rate-limits the packets accepted by the rule if set by the limit
+	// annotation.
+	limit *expr.Limit
+	// counter counts the packets accepted by the rule if policy counters
+	// are enabled.
+	counter *nfds.Counter
 
 	podRefs map[*Pod]struct{}
+
+	policy *nwkv1.NetworkPolicy
+	chain  *nfds.Chain
+	// sides are the sides of the traffic matched by the rules of the rule,
+	// starting with the forward side in chain.
+	sides []ruleSide
+	// podIPs is the pod IP set of the rule, which is PodIPSet and can be
+	// shared with other rules of the policy.
+	podIPs *podIPSet
+	// readyPeers is set if only Ready pods are selected as peers.
+	readyPeers bool
+	// overflowed is set if PodIPSet exceeded the maximum number of elements.
+	// The set is empty and the rule permits all peers on its ports instead,
+	// using overflowRules.
+	overflowed    bool
+	overflowRules []*nfds.Rule
+	// portSets contains a reference for every use of a shared port set by
+	// the ruleset of the rule.
+	portSets []*sharedPortSet
+	// fqdnIPs counts the FQDNs of the rule resolving to each address in
+	// FQDNSet.
+	fqdnIPs map[netip.Addr]int
+}
+
+// podIPSet is a named set of the IPs of the pods selected as peers by rules
+// of a policy. Rules with identical peer selectors, like the ingress and
+// egress rules of symmetric policies, select the same pods and thus share a
+// single set.
+type podIPSet struct {
+	set *nfds.Set
+	// rules are the rules using the set. Only the first one updates the
+	// elements, the others select the same pods.
+	rules []*Rule
+	// elems is the number of elements in set, or the number it would have if
+	// it is overflowed.
+	elems int
+	// overflowed is set if set exceeded the maximum number of elements.
+	overflowed bool
+}
+
+// podSelectorsKey returns a representation of sels which is equal for
+// selectors matching the same pods of a namespace.
+func podSelectorsKey(sels []PodSelector) string {
+	var b strings.Builder
+	for _, sel := range sels {
+		fmt.Fprintf(&b, "%t %q %q;", sel.NamespaceSelector == labels.Nothing(), sel.NamespaceSelector.String(), sel.PodSelector.String())
+	}
+	return b.String()
+}
+
+// acquirePodIPSet makes r use the pod IP set of the rules in shared with the
+// same peer selectors, creating it if necessary. Every call needs to be
+// paired with a call to releasePodIPSet.
+func (c *Controller) acquirePodIPSet(r *Rule, shared map[string]*podIPSet, prefix string) {
+	key := podSelectorsKey(r.PodSelectors)
+	ps, ok := shared[key]
+	if !ok {
+		ps = &podIPSet{
+			set: &nfds.Set{
+				Table:        c.table,
+				KeyType:      nftables.TypeIPAddr,
+				KeyType6:     nftables.TypeIP6Addr,
+				Name:         prefix + "_podips",
+				KeyByteOrder: binaryutil.BigEndian,
+			},
+		}
+		c.nftConn.AddSet(ps.set, []nftables.SetElement{})
+		shared[key] = ps
+	}
+	ps.rules = append(ps.rules, r)
+	r.podIPs = ps
+	r.PodIPSet = ps.set
+	if ps.overflowed {
+		// The other rules already selected too many pods
+		c.addOverflowRules(r)
+	}
+}
+
+// releasePodIPSet stops r from using its pod IP set, deleting it if it was
+// the last rule using it. The rules of r need to be deleted beforehand.
+func (c *Controller) releasePodIPSet(r *Rule) {
+	ps := r.podIPs
+	ps.rules = slices.DeleteFunc(ps.rules, func(o *Rule) bool { return o == r })
+	if len(ps.rules) == 0 {
+		c.nftConn.DelSet(ps.set)
+	}
+}
+
+// ownsPodIPs returns true if r updates the elements of its pod IP set.
+func (r *Rule) ownsPodIPs() bool {
+	return r.podIPs != nil && r.podIPs.rules[0] == r
+}
+
+// addRulePodIPs adds the IPs of p to the pod IP set of r. If this would
+// exceed the configured maximum number of set elements, the rules using the
+// set fall back to permitting all peers on their ports.
+func (c *Controller) addRulePodIPs(r *Rule, p *Pod) {
+	if !r.ownsPodIPs() {
+		return
+	}
+	ps := r.podIPs
+	elems := p.ipElements()
+	if ps.overflowed {
+		ps.elems += len(elems)
+		return
+	}
+	if c.cfg.MaxSetElements > 0 && ps.elems+len(elems) > c.cfg.MaxSetElements {
+		c.overflowPodIPSet(r, p)
+		return
+	}
+	ps.elems += len(elems)
+	c.nftConn.SetAddElements(ps.set, elems)
+}
+
+// delRulePodIPs deletes the IPs of p from the pod IP set of r. If the set is
+// overflowed and the remaining IPs fit into it again, it is refilled.
+func (c *Controller) delRulePodIPs(r *Rule, p *Pod) {
+	if !r.ownsPodIPs() {
+		return
+	}
+	ps := r.podIPs
+	elems := p.ipElements()
+	ps.elems -= len(elems)
+	if ps.overflowed {
+		if ps.elems <= c.cfg.MaxSetElements {
+			c.refillPodIPSet(r, p)
+		}
+		return
+	}
+	c.nftConn.SetDeleteElements(r.PodIPSet, elems)
+}
+
+// overflowPodIPSet empties the pod IP set of r and adds rules permitting all
+// peers on their ports to every rule using it. The IPs of the pod being added
+// are not in the set yet. The rules stay in this state until the selected
+// pods fit into the set again.
+func (c *Controller) overflowPodIPSet(r *Rule, adding *Pod) {
+	ps := r.podIPs
+	for p := range r.podRefs {
+		if p != adding {
+			c.nftConn.SetDeleteElements(ps.set, p.ipElements())
+		}
+	}
+	ps.overflowed = true
+	ps.elems += len(adding.ipElements())
+	for _, o := range ps.rules {
+		c.addOverflowRules(o)
+	}
+	c.eventRecorder.Eventf(r.policy, corev1.EventTypeWarning, "SetOverflow", "a rule selects pods with more than %d IPs, permitting all peers on its ports instead", c.cfg.MaxSetElements)
+}
+
+// refillPodIPSet adds the IPs of the pods selected by r to its overflowed pod
+// IP set and deletes the rules permitting all peers from every rule using it.
+// The pod being removed, identified by its ID as its IPs might be updated in
+// place, is skipped even if r still references it.
+func (c *Controller) refillPodIPSet(r *Rule, removing *Pod) {
+	ps := r.podIPs
+	ps.overflowed = false
+	var elems []nftables.SetElement
+	for p := range r.podRefs {
+		if p.ID != removing.ID {
+			elems = append(elems, p.ipElements()...)
+		}
+	}
+	ps.elems = len(elems)
+	if len(elems) > 0 {
+		c.nftConn.SetAddElements(ps.set, elems)
+	}
+	for _, o := range ps.rules {
+		c.delOverflowRules(o)
+	}
+	c.eventRecorder.Eventf(r.policy, corev1.EventTypeNormal, "SetOverflowResolved", "a rule selects pods with at most %d IPs again, no longer permitting all peers on its ports", c.cfg.MaxSetElements)
+}
+
+// addOverflowRules marks r as overflowed and adds a rule permitting all peers
+// on the ports of r.
+func (c *Controller) addOverflowRules(r *Rule) {
+	r.overflowed = true
+	for _, s := range r.sides {
+		r.overflowRules = append(r.overflowRules, c.nftConn.AddRule(&nfds.Rule{
+			Table: c.table,
+			Chain: s.chain,
+			Exprs: append(append(c.portProtoExprs(r, s, r.NumberedPortMeta, 0), c.extensionExprs(r, s, 0)...), &expr.Verdict{Kind: expr.VerdictAccept}),
+		}))
+	}
+}
+
+// delOverflowRules deletes the rules added by addOverflowRules.
+func (c *Controller) delOverflowRules(r *Rule) {
+	r.overflowed = false
+	for _, or := range r.overflowRules {
+		c.nftConn.DelRule(or)
+	}
+	r.overflowRules = nil
 }
 
 type RuleNamedPortMeta struct {
@@ -80,13 +329,46 @@ func (sel PodSelector) Matches(p *Pod, selNs string, namespaces map[string]*Name
 	return true
 }
 
-func (c *Controller) createPeers(ch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer, ports []nwkv1.NetworkPolicyPort, prefix string, dir direction, nwp *nwkv1.NetworkPolicy) *Rule {
+// ruleChain returns the chain the rule of a policy with the given name is
+// added to. This is the policy chain ch, unless rule chains are enabled, in
+// which case a new chain jumped to from ch is added to nwp. As the filters at
+// the head of ch return from it, they still apply to all rules.
+func (c *Controller) ruleChain(nwp *Policy, ch *nfds.Chain, name string) *nfds.Chain {
+	if !c.cfg.RuleChains {
+		return ch
+	}
+	rch := &nfds.Chain{
+		Table: c.table,
+		Type:  nftables.ChainTypeFilter,
+		Name:  name,
+	}
+	c.nftConn.AddChain(rch)
+	c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: rch.Name}},
+	})
+	nwp.ruleChains = append(nwp.ruleChains, rch)
+	return rch
+}
+
+func (c *Controller) createPeers(ch, rch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer, ports []nwkv1.NetworkPolicyPort, ext ruleExtensions, prefix string, dir direction, nwp *nwkv1.NetworkPolicy) *Rule {
 	var meta Rule
 
 	meta.podRefs = make(map[*Pod]struct{})
 	meta.Namespace = nwp.Namespace
+	meta.policy = nwp
+	meta.chain = ch
+	meta.sides = ruleSides(ch, rch, dir)
+	meta.AllPeers = len(peers) == 0 && len(ext.fqdns) == 0
+	meta.AllPorts = len(ports) == 0
+	meta.SourcePortMeta = ext.srcPorts
+	meta.PacketLength = ext.packetLength
+	meta.limit = ext.limit
+	meta.counter = ext.counter
 
-	ipRangesPermitted := ranges.NewWithCompare(lessAddrs, closest)
+	// The ranges of all ipBlocks, which are merged after sorting them.
+	var blockRanges []ranges.Range[netip.Addr]
 
 	for _, src := range peers {
 		if src.IPBlock != nil {
@@ -104,20 +386,22 @@ func (c *Controller) createPeers(ch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer
 				continue
 			}
 			thisBlock := ranges.NewWithCompare(lessAddrs, closest)
-			thisBlock.Add(prefixToRange(p))
+			parent := prefixToRange(p)
+			thisBlock.Add(parent)
 			for _, excl := range src.IPBlock.Except {
 				pExcl, err := netip.ParsePrefix(excl)
 				if err != nil {
 					c.eventRecorder.Eventf(nwp, corev1.EventTypeWarning, "InvalidPeer", "ipBlock except value %q invalid: %v", excl, err)
 					continue
 				}
-				if !p.Contains(pExcl.Masked().Addr()) || !p.Contains(netipx.PrefixLastIP(pExcl)) {
-					c.eventRecorder.Eventf(nwp, corev1.EventTypeNormal, "SuspiciousIPBlock", "ipBlock except value %q is not contained in parent", excl, err)
+				exclRange := prefixToRange(pExcl)
+				if !thisBlock.Contains(parent, exclRange.Start) || !thisBlock.Contains(parent, exclRange.End) {
+					c.eventRecorder.Eventf(nwp, corev1.EventTypeNormal, "SuspiciousIPBlock", "ipBlock except value %q is not contained in parent", excl)
 				}
-				thisBlock.Subtract(prefixToRange(pExcl))
+				thisBlock.Subtract(exclRange)
 			}
 			for it := thisBlock.Iterator(); it.Valid(); it.Next() {
-				ipRangesPermitted.Add(it.Item())
+				blockRanges = append(blockRanges, it.Item())
 			}
 		}
 		nsSel, err := metav1.LabelSelectorAsSelector(src.NamespaceSelector)
@@ -157,6 +441,16 @@ func (c *Controller) createPeers(ch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer
 				continue
 			}
 		}
+		// Only numeric ports may be ranges. Validation rejects an end port
+		// in other entries, but objects created without it can still have
+		// one, which is ignored instead of guessing what was meant.
+		if port.EndPort != nil && (port.Port == nil || port.Port.Type == intstr.String) {
+			if port.Port == nil {
+				c.eventRecorder.Eventf(nwp, corev1.EventTypeWarning, "InvalidPort", "end port %d without a start port, ignoring end port", *port.EndPort)
+			} else {
+				c.eventRecorder.Eventf(nwp, corev1.EventTypeWarning, "InvalidPort", "end port %d cannot be combined with named port %q, ignoring end port", *port.EndPort, port.Port.StrVal)
+			}
+		}
 		if port.Port == nil {
 			portProtos = append(portProtos, RuleNumberedPortMeta{
 				Protocol: proto,
@@ -170,6 +464,13 @@ func (c *Controller) createPeers(ch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer
 				Protocol: proto,
 			})
 		} else if port.Port.Type == intstr.Int {
+			if port.Port.IntVal <= 0 {
+				// Port 0 is never used by legitimate traffic. Validation
+				// rejects it, but objects predating it or created without
+				// validation can still contain it.
+				c.eventRecorder.Eventf(nwp, corev1.EventTypeWarning, "InvalidPort", "port number %d is invalid, ignoring port", port.Port.IntVal)
+				continue
+			}
 			if port.Port.IntVal > math.MaxUint16 {
 				c.eventRecorder.Eventf(nwp, corev1.EventTypeWarning, "InvalidPort", "port number %d is out of range, ignoring port", port.Port.IntVal)
 				continue
@@ -196,9 +497,25 @@ func (c *Controller) createPeers(ch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer
 		}
 	}
 
+	slices.SortFunc(blockRanges, func(a, b ranges.Range[netip.Addr]) int {
+		return a.Start.Compare(b.Start)
+	})
+	ipRangesPermitted := ranges.NewWithCompare(lessAddrs, closest)
+	ipRangesPermitted.AddSorted(blockRanges)
+
+	if c.cfg.MaxIPBlockRanges > 0 && ipRangesPermitted.Len() > c.cfg.MaxIPBlockRanges {
+		// Ignoring the excepts instead would permit exactly the addresses
+		// the policy meant to exclude.
+		c.eventRecorder.Eventf(nwp, corev1.EventTypeWarning, "IPBlockOverflow", "ipBlock peers of a rule are split into %d ranges by their excepts, more than the maximum of %d, ignoring them", ipRangesPermitted.Len(), c.cfg.MaxIPBlockRanges)
+		ipRangesPermitted = ranges.NewWithCompare(lessAddrs, closest)
+	}
+
+	meta.NumberedPortMeta = portProtos
+	meta.IPBlocks = ipRangesPermitted
+
 	// Handle special named ports first as they work differently from the
 	// rest of the system.
-	if len(dynPorts) > 0 && (len(meta.PodSelectors) > 0 || len(peers) == 0) {
+	if len(dynPorts) > 0 && (len(meta.PodSelectors) > 0 || meta.AllPeers) {
 		namedPortSet := nfds.Set{
 			Table:         c.table,
 			Name:          prefix + "_namedports",
@@ -210,30 +527,32 @@ func (c *Controller) createPeers(ch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer
 		c.nftConn.AddSet(&namedPortSet, []nftables.SetElement{})
 		meta.NamedPortSet = &namedPortSet
 		meta.NamedPortMeta = dynPorts
-		c.nftConn.AddRule(&nfds.Rule{
-			Table: c.table,
-			Chain: ch,
-			Exprs: []expr.Any{
+		for _, s := range meta.sides {
+			exprs := []expr.Any{
 				// Load Layer 4 protocol into register 0
 				&expr.Meta{
 					Key:      expr.MetaKeyL4PROTO,
 					Register: newRegOffset + 0,
 				},
 				// Load Port into register 1
-				loadDstPort(1),
+				s.loadDstPort(1),
 				// Load IP address into register 2 (IPv4) or 2-5 (IPv6)
-				loadIP(dir, 2),
+				loadIP(s.peer, 2),
 				// Abort if IP/port/L4 protocol is not in permitted set
 				lookup(Lookup{
 					Set:            &namedPortSet,
 					SourceRegister: newRegOffset + 0,
 				}),
-				// Accept packet
-				&expr.Verdict{
+			}
+			exprs = append(exprs, c.extensionExprs(&meta, s, 0)...)
+			c.nftConn.AddRule(&nfds.Rule{
+				Table: c.table,
+				Chain: s.chain,
+				Exprs: append(exprs, &expr.Verdict{ // Accept packet
 					Kind: expr.VerdictAccept,
-				},
-			},
-		})
+				}),
+			})
+		}
 	}
 
 	if len(portProtos) == 0 && len(ports) > 0 {
@@ -242,147 +561,210 @@ func (c *Controller) createPeers(ch *nfds.Chain, peers []nwkv1.NetworkPolicyPeer
 		return &meta
 	}
 
-	var portProtoExprs []expr.Any
-	if len(portProtos) > 0 {
-		// Shortcut for simple port restrictions
-		if len(portProtos) == 1 && !portProtos[0].NeedsInterval() {
-			p := portProtos[0]
-			// Load L4 protocol into register 0
-			portProtoExprs = append(portProtoExprs, &expr.Meta{
-				Key:      expr.MetaKeyL4PROTO,
-				Register: newRegOffset + 0,
-			}, &expr.Cmp{ // Compare register 0 with expected protocol
-				Op:       expr.CmpOpEq,
-				Register: newRegOffset + 0,
-				Data:     []byte{p.Protocol},
-			})
-			if p.Port != 0 || p.EndPort != math.MaxUint16 {
-				portProtoExprs = append(portProtoExprs, loadDstPort(1), &expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: newRegOffset + 1,
-					Data:     binary.BigEndian.AppendUint16(nil, p.Port),
-				})
+	if ipRangesPermitted.Len() > 0 {
+		var rangeElements []nftables.SetElement
+		var has4, has6 bool
+		for it := ipRangesPermitted.Iterator(); it.Valid(); it.Next() {
+			rangeElements = append(rangeElements, rangeToInterval(it.Item())...)
+			if it.Item().Start.Is4() {
+				has4 = true
+			} else {
+				has6 = true
+			}
+		}
+		// Skip the set and rule of a family without any ranges as the rule
+		// could never match in it.
+		var family nftables.TableFamily
+		if !has6 {
+			family = nftables.TableFamilyIPv4
+		} else if !has4 {
+			family = nftables.TableFamilyIPv6
+		}
+		for _, s := range meta.sides {
+			exprs := []expr.Any{
+				loadIP(s.peer, 0),
 			}
-		} else if ipRangesPermitted.Len() > 0 || len(meta.PodSelectors) > 0 || len(peers) == 0 {
-			// Set-based for complex port restrictions
-			protoPortSet := nfds.Set{
-				Table:         c.table,
-				Anonymous:     true,
-				Constant:      true,
-				Concatenation: true,
-				Interval:      true,
-				KeyType:       nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService),
-				KeyByteOrder:  binaryutil.BigEndian,
+			if dir == dirEgress && c.cfg.EgressOriginalDestination {
+				// Not combined with Stateless, so this is the forward side
+				exprs = []expr.Any{loadOrigDstIP(0)}
 			}
-			var setElems []nftables.SetElement
-			for _, p := range portProtos {
-				// uint8 protocol, uint16 port, both padded to 4 bytes, big endian
-				startKey := make([]byte, 8)
-				endKey := make([]byte, 8)
-				startKey[0] = uint8(p.Protocol)
-				endKey[0] = uint8(p.Protocol)
-				binary.BigEndian.PutUint16(startKey[4:6], p.Port)
-				binary.BigEndian.PutUint16(endKey[4:6], p.EndPort)
-				setElems = append(setElems, nftables.SetElement{
-					Key:    startKey,
-					KeyEnd: endKey,
-				})
+			// Anonymous sets can only be referenced by a single rule
+			ipBlocksPermittedSet := nfds.Set{
+				Table:        c.table,
+				Anonymous:    true,
+				Constant:     true,
+				Interval:     true,
+				KeyType:      nftables.TypeIPAddr,
+				KeyType6:     nftables.TypeIP6Addr,
+				KeyByteOrder: binaryutil.BigEndian,
+				Family:       family,
 			}
+			c.nftConn.AddSet(&ipBlocksPermittedSet, rangeElements)
+			// Abort if address in register 0 is not in the permitted set
+			exprs = append(exprs, lookup(Lookup{
+				Set:            &ipBlocksPermittedSet,
+				SourceRegister: newRegOffset + 0,
+			}))
 
-			c.nftConn.AddSet(&protoPortSet, setElems)
-			portProtoExprs = []expr.Any{
-				// Load L4 protocol into register 0
-				&expr.Meta{
-					Key:      expr.MetaKeyL4PROTO,
-					Register: newRegOffset + 0,
-				},
-				// Load Port into register 1
-				loadDstPort(1),
-				// Abort if port/L4 protocol is not in permitted set
+			exprs = append(exprs, c.portProtoExprs(&meta, s, portProtos, family)...)
+			exprs = append(exprs, c.extensionExprs(&meta, s, family)...)
+
+			c.nftConn.AddRule(&nfds.Rule{
+				Table:  c.table,
+				Chain:  s.chain,
+				Family: family,
+				Exprs: append(exprs, &expr.Verdict{ // Accept packet
+					Kind: expr.VerdictAccept,
+				}),
+			})
+		}
+	}
+	if len(meta.PodSelectors) > 0 {
+		c.acquirePodIPSet(&meta, ext.podIPSets, prefix)
+		for _, s := range meta.sides {
+			exprs := []expr.Any{
+				// Load IP address into register 0
+				loadIP(s.peer, 0),
+				// Check if IP is in pod IP set set
 				lookup(Lookup{
-					Set:            &protoPortSet,
 					SourceRegister: newRegOffset + 0,
+					Set:            meta.PodIPSet,
 				}),
 			}
+			exprs = append(exprs, c.portProtoExprs(&meta, s, portProtos, 0)...)
+			exprs = append(exprs, c.extensionExprs(&meta, s, 0)...)
+			c.nftConn.AddRule(&nfds.Rule{
+				Table: c.table,
+				Chain: s.chain,
+				Exprs: append(exprs, &expr.Verdict{Kind: expr.VerdictAccept}),
+			})
 		}
 	}
-
-	if ipRangesPermitted.Len() > 0 {
-		exprs := []expr.Any{
-			loadIP(dir, 0),
-		}
-		ipBlocksPermittedSet := nfds.Set{
-			Table:        c.table,
-			Anonymous:    true,
-			Constant:     true,
-			Interval:     true,
-			KeyType:      nftables.TypeIPAddr,
-			KeyType6:     nftables.TypeIP6Addr,
-			KeyByteOrder: binaryutil.BigEndian,
-		}
-		var rangeElements []nftables.SetElement
-		for it := ipRangesPermitted.Iterator(); it.Valid(); it.Next() {
-			rangeElements = append(rangeElements, rangeToInterval(it.Item())...)
+	if len(ext.fqdns) > 0 {
+		c.addFQDNRules(&meta, ext.fqdns, prefix, portProtos)
+	}
+	if meta.AllPeers {
+		for _, s := range meta.sides {
+			exprs := append(c.portProtoExprs(&meta, s, portProtos, 0), c.extensionExprs(&meta, s, 0)...)
+			c.nftConn.AddRule(&nfds.Rule{
+				Table: c.table,
+				Chain: s.chain,
+				Exprs: append(exprs, &expr.Verdict{Kind: expr.VerdictAccept}),
+			})
 		}
-		c.nftConn.AddSet(&ipBlocksPermittedSet, rangeElements)
-		// Abort if address in register 0 is not in the permitted set
-		exprs = append(exprs, lookup(Lookup{
-			Set:            &ipBlocksPermittedSet,
-			SourceRegister: newRegOffset + 0,
-		}))
+	}
+	return &meta
+}
 
-		exprs = append(exprs, portProtoExprs...)
+// portProtoExprs returns expressions matching the given numbered ports of r
+// as destination ports of the traffic permitted on side s, or none if no
+// ports are given. Anonymous sets can only be referenced by a
+// single rule, so the expressions must not be shared between rules. If family
+// is set, the expressions are only valid in rules restricted to it.
+func (c *Controller) portProtoExprs(r *Rule, s ruleSide, portProtos []RuleNumberedPortMeta, family nftables.TableFamily) []expr.Any {
+	if c.cfg.SharedPortSetMin > 0 && len(portProtos) >= c.cfg.SharedPortSetMin {
+		ps := c.acquirePortSet(portProtos)
+		r.portSets = append(r.portSets, ps)
+		return lookupPortProtos(ps.set, s.loadDstPort)
+	}
+	return c.matchPortProtos(portProtos, s.loadDstPort, family)
+}
 
-		c.nftConn.AddRule(&nfds.Rule{
-			Table: c.table,
-			Chain: ch,
-			Exprs: append(exprs, &expr.Verdict{ // Accept packet
-				Kind: expr.VerdictAccept,
-			}),
-		})
+// matchPortProtos is like portProtoExprs, but matches the port loaded by
+// loadPort.
+func (c *Controller) matchPortProtos(portProtos []RuleNumberedPortMeta, loadPort func(dstReg uint32) *expr.Payload, family nftables.TableFamily) []expr.Any {
+	if len(portProtos) == 0 {
+		return nil
 	}
-	if len(meta.PodSelectors) > 0 {
-		podIPSet := nfds.Set{
-			Table:        c.table,
-			KeyType:      nftables.TypeIPAddr,
-			KeyType6:     nftables.TypeIP6Addr,
-			Name:         prefix + "_podips",
-			KeyByteOrder: binaryutil.BigEndian,
-		}
-		c.nftConn.AddSet(&podIPSet, []nftables.SetElement{})
-		meta.PodIPSet = &podIPSet
+	// Shortcut for simple port restrictions
+	if len(portProtos) == 1 && !portProtos[0].NeedsInterval() {
+		p := portProtos[0]
 		exprs := []expr.Any{
-			// Load IP address into register 0
-			loadIP(dir, 0),
-			// Check if IP is in pod IP set set
-			lookup(Lookup{
-				SourceRegister: newRegOffset + 0,
-				Set:            &podIPSet,
-			}),
+			// Load L4 protocol into register 0
+			&expr.Meta{
+				Key:      expr.MetaKeyL4PROTO,
+				Register: newRegOffset + 0,
+			},
+			// Compare register 0 with expected protocol
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: newRegOffset + 0,
+				Data:     []byte{p.Protocol},
+			},
 		}
-		exprs = append(exprs, portProtoExprs...)
-		c.nftConn.AddRule(&nfds.Rule{
-			Table: c.table,
-			Chain: ch,
-			Exprs: append(exprs, &expr.Verdict{Kind: expr.VerdictAccept}),
-		})
+		if p.Port != 0 || p.EndPort != math.MaxUint16 {
+			exprs = append(exprs, loadPort(1), &expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: newRegOffset + 1,
+				Data:     binary.BigEndian.AppendUint16(nil, p.Port),
+			})
+		}
+		return exprs
 	}
-	if len(peers) == 0 {
-		exprs := append([]expr.Any{}, portProtoExprs...)
-		c.nftConn.AddRule(&nfds.Rule{
-			Table: c.table,
-			Chain: ch,
-			Exprs: append(exprs, &expr.Verdict{Kind: expr.VerdictAccept}),
+	// Set-based for complex port restrictions
+	protoPortSet := nfds.Set{
+		Table:         c.table,
+		Anonymous:     true,
+		Constant:      true,
+		Concatenation: true,
+		Interval:      true,
+		KeyType:       nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService),
+		KeyByteOrder:  binaryutil.BigEndian,
+		Family:        family,
+	}
+	c.nftConn.AddSet(&protoPortSet, portProtoElements(portProtos))
+	return lookupPortProtos(&protoPortSet, loadPort)
+}
+
+// portProtoElements returns the elements of a concatenated interval set of
+// L4 protocols and ports.
+func portProtoElements(portProtos []RuleNumberedPortMeta) []nftables.SetElement {
+	var setElems []nftables.SetElement
+	for _, p := range portProtos {
+		// uint8 protocol, uint16 port, both padded to 4 bytes, big endian
+		startKey := make([]byte, 8)
+		endKey := make([]byte, 8)
+		startKey[0] = uint8(p.Protocol)
+		endKey[0] = uint8(p.Protocol)
+		binary.BigEndian.PutUint16(startKey[4:6], p.Port)
+		binary.BigEndian.PutUint16(endKey[4:6], p.EndPort)
+		setElems = append(setElems, nftables.SetElement{
+			Key:    startKey,
+			KeyEnd: endKey,
 		})
 	}
-	return &meta
+	return setElems
+}
+
+// lookupPortProtos returns expressions looking up the L4 protocol and the
+// port loaded by loadPort in a set with elements from portProtoElements.
+func lookupPortProtos(protoPortSet *nfds.Set, loadPort func(dstReg uint32) *expr.Payload) []expr.Any {
+	return []expr.Any{
+		// Load L4 protocol into register 0
+		&expr.Meta{
+			Key:      expr.MetaKeyL4PROTO,
+			Register: newRegOffset + 0,
+		},
+		// Load Port into register 1
+		loadPort(1),
+		// Abort if port/L4 protocol is not in permitted set
+		lookup(Lookup{
+			Set:            protoPortSet,
+			SourceRegister: newRegOffset + 0,
+		}),
+	}
 }
 
 func (c *Controller) createNWP(name cache.ObjectName, policy *nwkv1.NetworkPolicy) {
 	var nwp Policy
 	var err error
 	nwp.Namespace = policy.Namespace
-	nwp.ID = objectID(&policy.ObjectMeta)
+	nwp.Name = policy.Name
+	nwp.spec = policy.Spec.DeepCopy()
+	nwp.annotations = extensionAnnotations(policy.Annotations)
+	nwp.audit = c.policyAudited(policy)
+	nwp.ifaceGroup = c.policyIfaceGroup(policy)
+	nwp.ID = objectID(&policy.ObjectMeta, c.cfg.ReadableIDs)
 	nwp.PodSelector, err = metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
 	if err != nil {
 		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "InvalidPolicy", "podSelector invalid: %v", err)
@@ -404,7 +786,21 @@ func (c *Controller) createNWP(name cache.ObjectName, policy *nwkv1.NetworkPolic
 			isIngress = true
 		}
 	}
+	if !isIngress && len(policy.Spec.Ingress) != 0 {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "IgnoredRules", "policy has ingress rules, but policyTypes does not contain Ingress, ignoring them")
+	}
+	if !isEgress && len(policy.Spec.Egress) != 0 {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeWarning, "IgnoredRules", "policy has egress rules, but policyTypes does not contain Egress, ignoring them")
+	}
+	if isEgress && c.cfg.DisableEgress {
+		c.eventRecorder.Eventf(policy, corev1.EventTypeNormal, "EgressDisabled", "egress enforcement is disabled, ignoring the Egress policy type")
+		isEgress = false
+	}
 
+	limit := c.policyLimit(policy)
+	counter := c.policyCounter(name, &nwp)
+	readyPeers := c.policyReadyPeers(policy)
+	podIPSets := make(map[string]*podIPSet)
 	if isIngress {
 		ingChain := nfds.Chain{
 			Table: c.table,
@@ -412,15 +808,39 @@ func (c *Controller) createNWP(name cache.ObjectName, policy *nwkv1.NetworkPolic
 			Name:  fmt.Sprintf("pol_%s_ing", nwp.ID),
 		}
 		c.nftConn.AddChain(&ingChain)
+		c.addTCPFlagsFilter(&ingChain, policy)
+		c.addActiveTimeFilter(&ingChain, policy)
+		ingReplyChain := c.addReplyChain(&ingChain)
+		if ingReplyChain != nil {
+			c.addActiveTimeFilter(ingReplyChain, policy)
+		}
 		for i, ingRule := range policy.Spec.Ingress {
-			meta := c.createPeers(&ingChain, ingRule.From, ingRule.Ports, fmt.Sprintf("%s_%d", ingChain.Name, i), dirIngress, policy)
+			restore := noTrace
+			if c.nftConn.Tracing() {
+				restore = c.traceScope(fmt.Sprintf("policy %v ingress rule %d", name, i))
+			}
+			ext := ruleExtensions{
+				srcPorts:     c.ruleSourcePorts(policy, dirIngress, i),
+				packetLength: c.rulePacketLength(policy, dirIngress, i),
+				fqdns:        c.ruleFQDNs(policy, dirIngress, i),
+				limit:        limit,
+				counter:      counter,
+				podIPSets:    podIPSets,
+			}
+			prefix := fmt.Sprintf("%s_%d", ingChain.Name, i)
+			meta := c.createPeers(c.ruleChain(&nwp, &ingChain, prefix), ingReplyChain, ingRule.From, ingRule.Ports, ext, prefix, dirIngress, policy)
+			meta.readyPeers = readyPeers
 			for _, pod := range c.pods {
 				c.addPodRule(meta, pod)
 			}
 			nwp.IngressRuleMeta = append(nwp.IngressRuleMeta, meta)
 			c.rules[meta] = struct{}{}
+			c.indexRule(meta)
+			c.queueNamedPortAudit(meta)
+			restore()
 		}
 		nwp.ingressChain = &ingChain
+		nwp.ingressReplyChain = ingReplyChain
 	}
 	if isEgress {
 		egChain := nfds.Chain{
@@ -429,24 +849,102 @@ func (c *Controller) createNWP(name cache.ObjectName, policy *nwkv1.NetworkPolic
 			Name:  fmt.Sprintf("pol_%s_eg", nwp.ID),
 		}
 		c.nftConn.AddChain(&egChain)
+		c.addTCPFlagsFilter(&egChain, policy)
+		c.addActiveTimeFilter(&egChain, policy)
+		egReplyChain := c.addReplyChain(&egChain)
+		if egReplyChain != nil {
+			c.addActiveTimeFilter(egReplyChain, policy)
+		}
 		for i, egRule := range policy.Spec.Egress {
-			meta := c.createPeers(&egChain, egRule.To, egRule.Ports, fmt.Sprintf("%s_%d", egChain.Name, i), dirEgress, policy)
+			restore := noTrace
+			if c.nftConn.Tracing() {
+				restore = c.traceScope(fmt.Sprintf("policy %v egress rule %d", name, i))
+			}
+			ext := ruleExtensions{
+				srcPorts:     c.ruleSourcePorts(policy, dirEgress, i),
+				packetLength: c.rulePacketLength(policy, dirEgress, i),
+				fqdns:        c.ruleFQDNs(policy, dirEgress, i),
+				limit:        limit,
+				counter:      counter,
+				podIPSets:    podIPSets,
+			}
+			prefix := fmt.Sprintf("%s_%d", egChain.Name, i)
+			meta := c.createPeers(c.ruleChain(&nwp, &egChain, prefix), egReplyChain, egRule.To, egRule.Ports, ext, prefix, dirEgress, policy)
+			meta.readyPeers = readyPeers
 			for _, pod := range c.pods {
 				c.addPodRule(meta, pod)
 			}
 			nwp.EgressRuleMeta = append(nwp.EgressRuleMeta, meta)
 			c.rules[meta] = struct{}{}
+			c.indexRule(meta)
+			c.indexFQDNRule(meta)
+			c.queueNamedPortAudit(meta)
+			restore()
 		}
 		nwp.egressChain = &egChain
+		nwp.egressReplyChain = egReplyChain
 	}
 
 	nwp.podRefs = make(map[*Pod]struct{})
 	for _, pod := range c.pods {
 		c.addPodNWP(pod, &nwp)
 	}
+	c.claimIfaceGroup(nwp.ifaceGroup)
 	c.nwps[name] = &nwp
 }
 
+// policyCounter returns the counter of the policy, creating it if needed, or
+// nil if policy counters are disabled.
+func (c *Controller) policyCounter(name cache.ObjectName, nwp *Policy) *nfds.Counter {
+	if !c.cfg.PolicyCounters {
+		return nil
+	}
+	if ctr, ok := c.policyCounters[name]; ok {
+		return ctr
+	}
+	ctr := c.nftConn.AddCounter(&nfds.Counter{
+		Table: c.table,
+		Name:  fmt.Sprintf("pol_%s_cnt", nwp.ID),
+	})
+	c.policyCounters[name] = ctr
+	return ctr
+}
+
+func (c *Controller) queueNamedPortAudit(r *Rule) {
+	if c.cfg.AuditNamedPorts && r.NamedPortSet != nil {
+		c.pendingNamedPortAudit[r] = struct{}{}
+	}
+}
+
+// auditNamedPorts emits an event for every rule created since the last call
+// whose named ports are not exposed with the right protocol by any pod it
+// selects. This is usually caused by a typo in the port name or protocol.
+// The check is deferred until the flush so pods processed after the policy
+// during the initial sync are taken into account.
+func (c *Controller) auditNamedPorts() {
+	for r := range c.pendingNamedPortAudit {
+		delete(c.pendingNamedPortAudit, r)
+		if _, ok := c.rules[r]; !ok {
+			continue
+		}
+		resolved := false
+		for p := range r.podRefs {
+			if len(p.namedPortElements(r.NamedPortMeta)) > 0 {
+				resolved = true
+				break
+			}
+		}
+		if resolved {
+			continue
+		}
+		var ports []string
+		for _, nm := range r.NamedPortMeta {
+			ports = append(ports, fmt.Sprintf("%s/%s", nm.PortName, protocolName(nm.Protocol)))
+		}
+		c.eventRecorder.Eventf(r.policy, corev1.EventTypeNormal, "NamedPortUnresolved", "named ports %s resolved to no selected pods", strings.Join(ports, ", "))
+	}
+}
+
 func (c *Controller) deleteRules(rm []*Rule) {
 	for _, r := range rm {
 		for p := range r.podRefs {
@@ -455,13 +953,25 @@ func (c *Controller) deleteRules(rm []*Rule) {
 		if r.NamedPortSet != nil {
 			c.nftConn.DelSet(r.NamedPortSet)
 		}
-		if r.PodIPSet != nil {
-			c.nftConn.DelSet(r.PodIPSet)
+		if r.podIPs != nil {
+			c.releasePodIPSet(r)
+		}
+		if r.FQDNSet != nil {
+			c.unindexFQDNRule(r)
+			c.nftConn.DelSet(r.FQDNSet)
+		}
+		for _, ps := range r.portSets {
+			c.releasePortSet(ps)
 		}
 		delete(c.rules, r)
+		delete(c.nsRules, r)
+		delete(c.readyRules, r)
 	}
 }
 
+// deleteNWP removes nwp and all references to it and its rules from the pods
+// still known. Pods it selected or selected as peers may have been deleted
+// before, for example when its namespace is deleted.
 func (c *Controller) deleteNWP(name cache.ObjectName, nwp *Policy) {
 	for p := range nwp.podRefs {
 		c.removePodNWP(p, nwp)
@@ -472,12 +982,25 @@ func (c *Controller) deleteNWP(name cache.ObjectName, nwp *Policy) {
 	if nwp.egressChain != nil {
 		c.nftConn.DelChain(nwp.egressChain)
 	}
+	for _, ch := range []*nfds.Chain{nwp.ingressReplyChain, nwp.egressReplyChain} {
+		if ch != nil {
+			c.nftConn.DelChain(ch)
+		}
+	}
+	// The jumps to rule chains are gone with the policy chains
+	for _, ch := range nwp.ruleChains {
+		c.nftConn.DelChain(ch)
+	}
 	c.deleteRules(nwp.IngressRuleMeta)
 	c.deleteRules(nwp.EgressRuleMeta)
+	c.releaseIfaceGroup(nwp.ifaceGroup)
 	delete(c.nwps, name)
 }
 
 func (c *Controller) SetNetworkPolicy(name cache.ObjectName, nwp *nwkv1.NetworkPolicy) {
+	if c.nftConn.Tracing() {
+		defer c.traceScope(fmt.Sprintf("policy %v", name))()
+	}
 	syncedNWP := c.nwps[name]
 	switch {
 	case syncedNWP == nil && nwp != nil:
@@ -485,9 +1008,17 @@ func (c *Controller) SetNetworkPolicy(name cache.ObjectName, nwp *nwkv1.NetworkP
 	case syncedNWP != nil && nwp == nil:
 		// Delete NWP
 		c.deleteNWP(name, syncedNWP)
+		delete(c.hostNetworkPeers, name)
+		if ctr, ok := c.policyCounters[name]; ok {
+			// The rules referencing the counter are deleted with the chains
+			c.nftConn.DelCounter(ctr)
+			delete(c.policyCounters, name)
+		}
 	case syncedNWP != nil && nwp != nil:
 		// Update NWP
-		// TODO: Figure out if update is meaningful
+		if syncedNWP.SemanticallyEqual(nwp) {
+			return // Nothing to do
+		}
 		c.deleteNWP(name, syncedNWP)
 		c.createNWP(name, nwp)
 	case syncedNWP == nil && nwp == nil:
@@ -0,0 +1,1491 @@
+package nftctrl
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestPolicyTypeMismatchWarning(t *testing.T) {
+	c, _, rec := newTestController(t, Config{})
+	nwp := &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+			Egress:      []nwkv1.NetworkPolicyEgressRule{{}},
+		},
+	}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, nwp)
+	mustFlush(t, c)
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "IgnoredRules") || !strings.Contains(events[0], "egress") {
+		t.Errorf("expected single IgnoredRules event for egress, got %v", events)
+	}
+	if c.nwps[cache.ObjectName{Namespace: "default", Name: "test"}].egressChain != nil {
+		t.Errorf("expected no egress chain for ingress-only policy")
+	}
+}
+
+func denyAllPolicy(ns, name string) *nwkv1.NetworkPolicy {
+	return &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, UID: types.UID("uid-" + ns + "-" + name)},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+		},
+	}
+}
+
+func TestParseTCPFlags(t *testing.T) {
+	value, mask, err := parseTCPFlags("syn/syn,ack")
+	if err != nil || value != 0x02 || mask != 0x12 {
+		t.Errorf("expected 0x02/0x12, got %#x/%#x (%v)", value, mask, err)
+	}
+	value, mask, err = parseTCPFlags("syn")
+	if err != nil || value != 0x02 || mask != 0x02 {
+		t.Errorf("expected 0x02/0x02, got %#x/%#x (%v)", value, mask, err)
+	}
+	for _, bad := range []string{"foo", "syn,ack/syn", "syn/"} {
+		if _, _, err := parseTCPFlags(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestUnchangedPolicyUpdate(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	name := cache.ObjectName{Namespace: "default", Name: "deny"}
+	nwp := denyAllPolicy("default", "deny")
+	c.SetNetworkPolicy(name, nwp)
+	mustFlush(t, c)
+	synced := c.nwps[name]
+
+	nwp = nwp.DeepCopy()
+	nwp.ResourceVersion = "2"
+	nwp.Annotations = map[string]string{"unrelated": "true"}
+	c.SetNetworkPolicy(name, nwp)
+	if c.nwps[name] != synced {
+		t.Error("expected policy with unrelated changes to not be recreated")
+	}
+
+	nwp = nwp.DeepCopy()
+	nwp.Annotations[annotationTCPFlags] = "syn/syn,ack"
+	c.SetNetworkPolicy(name, nwp)
+	if c.nwps[name] == synced {
+		t.Error("expected policy with changed extension annotation to be recreated")
+	}
+	mustFlush(t, c)
+}
+
+func TestMaxSetElements(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{MaxSetElements: 2})
+	port := intstr.FromInt32(80)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+			}},
+		},
+	})
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1", "fd00::1"))
+	mustFlush(t, c)
+	if events := drainEvents(rec); len(events) != 0 {
+		t.Errorf("expected no events below the limit, got %v", events)
+	}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2"))
+	mustFlush(t, c)
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "SetOverflow") {
+		t.Errorf("expected a single SetOverflow event, got %v", events)
+	}
+	podIPSet := &nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, Name: "pol_default_allow_ing_0_podips"}
+	if elems, _ := mem.GetSetElements(podIPSet); len(elems) != 0 {
+		t.Errorf("expected overflowed set to be empty, got %v", elems)
+	}
+	// All peers are permitted on the rule's port now, but not other ports
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("192.0.2.1", "10.0.0.1", 80)); v != verdictAccept {
+		t.Errorf("expected connection from any peer to be accepted, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 81)); v != verdictReject {
+		t.Errorf("expected connection to other port to be rejected, got %v", v)
+	}
+
+	// Once the pods fit again, the set is refilled and only they are
+	// permitted
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, nil)
+	mustFlush(t, c)
+	events = drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "SetOverflowResolved") {
+		t.Errorf("expected a single SetOverflowResolved event, got %v", events)
+	}
+	if elems, _ := mem.GetSetElements(podIPSet); len(elems) != 1 {
+		t.Errorf("expected refilled set to contain the server IP, got %v", elems)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("192.0.2.1", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected connection from other peers to be rejected, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "10.0.0.1", 80)); v != verdictAccept {
+		t.Errorf("expected connection from the selected pod to be accepted, got %v", v)
+	}
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v, %v", orphans, err)
+	}
+}
+
+func symmetricPolicy(ns, name string) *nwkv1.NetworkPolicy {
+	client := []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}}}
+	return &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress:     []nwkv1.NetworkPolicyIngressRule{{From: client}},
+			Egress:      []nwkv1.NetworkPolicyEgressRule{{To: client}},
+		},
+	}
+}
+
+func TestSharedPodIPSet(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	name := cache.ObjectName{Namespace: "default", Name: "sym"}
+	c.SetNetworkPolicy(name, symmetricPolicy("default", "sym"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"role": "client"}, "10.0.0.2"))
+	mustFlush(t, c)
+
+	table := &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}
+	sets, err := mem.GetSets(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var podIPSets []string
+	for _, s := range sets {
+		if strings.HasSuffix(s.Name, "_podips") {
+			podIPSets = append(podIPSets, s.Name)
+		}
+	}
+	if !reflect.DeepEqual(podIPSets, []string{"pol_default_sym_ing_0_podips"}) {
+		t.Errorf("expected a single pod IP set shared by both directions, got %v", podIPSets)
+	}
+	check := func(src, dst string, expected testVerdict) {
+		t.Helper()
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(src, dst, 80)); v != expected {
+			t.Errorf("%s -> %s: expected %v, got %v", src, dst, expected, v)
+		}
+	}
+	check("10.0.0.2", "10.0.0.1", verdictAccept)
+	check("10.0.0.1", "10.0.0.2", verdictAccept)
+	check("10.0.0.1", "10.0.0.3", verdictReject)
+
+	// Releasing the set of one direction keeps it for the other one, which
+	// takes over updating it
+	nwp := c.nwps[name]
+	c.deleteRules(nwp.IngressRuleMeta)
+	nwp.IngressRuleMeta = nil
+	if !nwp.EgressRuleMeta[0].ownsPodIPs() {
+		t.Fatal("expected egress rule to own the pod IP set")
+	}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client2"}, testPod("default", "client2", map[string]string{"role": "client"}, "10.0.0.3"))
+	mustFlush(t, c)
+	check("10.0.0.1", "10.0.0.3", verdictAccept)
+	checkRefs(t, c)
+
+	c.SetNetworkPolicy(name, nil)
+	mustFlush(t, c)
+	if _, err := mem.GetSetElements(&nftables.Set{Table: table, Name: "pol_default_sym_ing_0_podips"}); err == nil {
+		t.Error("expected pod IP set to be deleted with the last rule using it")
+	}
+}
+
+func TestSharedPodIPSetOverflow(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{MaxSetElements: 1})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "sym"}, symmetricPolicy("default", "sym"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"role": "client"}, "10.0.0.2", "10.0.0.3"))
+	mustFlush(t, c)
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "SetOverflow") {
+		t.Errorf("expected a single SetOverflow event, got %v", events)
+	}
+	// Both directions permit all peers
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("192.0.2.1", "10.0.0.1", 80)); v != verdictAccept {
+		t.Errorf("expected ingress from any peer to be accepted, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "192.0.2.1", 80)); v != verdictAccept {
+		t.Errorf("expected egress to any peer to be accepted, got %v", v)
+	}
+
+	// With the pods already known, the ingress rule overflows the set before
+	// the egress rule is created, which permits all peers as well
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "sym"}, nil)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "sym"}, symmetricPolicy("default", "sym"))
+	mustFlush(t, c)
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "192.0.2.1", 80)); v != verdictAccept {
+		t.Errorf("expected egress to any peer to be accepted after recreating the policy, got %v", v)
+	}
+}
+
+func TestMaxIPBlockRanges(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{MaxIPBlockRanges: 8})
+	var excepts []string
+	for i := range 10 {
+		excepts = append(excepts, fmt.Sprintf("192.0.2.%d/32", i*16))
+	}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				// Splits into 11 ranges
+				From: []nwkv1.NetworkPolicyPeer{
+					{IPBlock: &nwkv1.IPBlock{CIDR: "0.0.0.0/0", Except: excepts}},
+					{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}},
+				},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(80))}},
+			}, {
+				From:  []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "0.0.0.0/0", Except: excepts[:3]}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(443))}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"role": "client"}, "10.0.0.2"))
+	mustFlush(t, c)
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "IPBlockOverflow") || !strings.Contains(events[0], "11 ranges") {
+		t.Errorf("expected a single IPBlockOverflow event, got %v", events)
+	}
+
+	for _, tc := range []struct {
+		src  string
+		port uint16
+		want testVerdict
+	}{
+		// The ipBlock of the first rule is ignored, its pod selector not
+		{"198.51.100.1", 80, verdictReject},
+		{"192.0.2.0", 80, verdictReject},
+		{"10.0.0.2", 80, verdictAccept},
+		// The second rule is within the limit
+		{"198.51.100.1", 443, verdictAccept},
+		{"192.0.2.0", 443, verdictReject},
+		{"192.0.2.48", 443, verdictAccept},
+	} {
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(tc.src, "10.0.0.1", tc.port)); v != tc.want {
+			t.Errorf("connection from %v to port %d: expected %v, got %v", tc.src, tc.port, tc.want, v)
+		}
+	}
+}
+
+func TestSingleFamilyIPBlock(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "egress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}}},
+				Ports: []nwkv1.NetworkPolicyPort{
+					{Port: ptrIntStr(intstr.FromInt32(80))},
+					{Port: ptrIntStr(intstr.FromInt32(443))},
+				},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.1", "fd00::1"))
+	mustFlush(t, c)
+
+	for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		table := &nftables.Table{Name: defaultTableName, Family: fam}
+		sets, err := mem.GetSets(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var anonSets int
+		for _, s := range sets {
+			if s.Anonymous {
+				anonSets++
+			}
+		}
+		rules, err := mem.GetRules(table, &nftables.Chain{Name: "pol_default_egress_eg", Table: table})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The IPv4 ruleset contains the ipBlock and the port set
+		wantSets, wantRules := 2, 1
+		if fam == nftables.TableFamilyIPv6 {
+			wantSets, wantRules = 0, 0
+		}
+		if anonSets != wantSets || len(rules) != wantRules {
+			t.Errorf("family %v: expected %d anonymous sets and %d rules, got %d and %d", fam, wantSets, wantRules, anonSets, len(rules))
+		}
+	}
+
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "192.0.2.1", 443)); v != verdictAccept {
+		t.Errorf("expected IPv4 connection to ipBlock to be accepted, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("fd00::1", "2001:db8::1", 443)); v != verdictReject {
+		t.Errorf("expected IPv6 connection to be rejected, got %v", v)
+	}
+}
+
+// An ingress rule combining ipBlocks with a port range only gets a rule in
+// the families of its ipBlocks. Traffic of the other family is rejected even
+// though the port set exists in both.
+func TestIPBlockPortRangeFamilies(t *testing.T) {
+	for _, cidrs := range [][]string{
+		{"192.0.2.0/24"},
+		{"2001:db8::/64"},
+		{"192.0.2.0/24", "2001:db8::/64"},
+	} {
+		c, mem, _ := newTestController(t, Config{})
+		var peers []nwkv1.NetworkPolicyPeer
+		for _, cidr := range cidrs {
+			peers = append(peers, nwkv1.NetworkPolicyPeer{IPBlock: &nwkv1.IPBlock{CIDR: cidr}})
+		}
+		name := cache.ObjectName{Namespace: "default", Name: "ingress"}
+		c.SetNetworkPolicy(name, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ingress"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From:  peers,
+					Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(8000)), EndPort: ptr[int32](8100)}},
+				}},
+			},
+		})
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1", "fd00::1"))
+		mustFlush(t, c)
+
+		for _, fam := range []struct {
+			family         nftables.TableFamily
+			prefix         netip.Prefix
+			inBlock, other string
+			server         string
+		}{
+			{nftables.TableFamilyIPv4, netip.MustParsePrefix("192.0.2.0/24"), "192.0.2.1", "198.51.100.1", "10.0.0.1"},
+			{nftables.TableFamilyIPv6, netip.MustParsePrefix("2001:db8::/64"), "2001:db8::1", "2001:db8:1::1", "fd00::1"},
+		} {
+			var hasBlock bool
+			for _, cidr := range cidrs {
+				hasBlock = hasBlock || cidr == fam.prefix.String()
+			}
+			table := &nftables.Table{Name: defaultTableName, Family: fam.family}
+			rules, err := mem.GetRules(table, &nftables.Chain{Name: c.nwps[name].ingressChain.Name, Table: table})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRules := 0
+			if hasBlock {
+				wantRules = 1
+			}
+			if len(rules) != wantRules {
+				t.Errorf("%v, family %v: expected %d rules, got %d", cidrs, fam.family, wantRules, len(rules))
+			}
+			e := &evaluator{t: t, mem: mem, family: fam.family}
+			for _, r := range rules {
+				checkRegisters(t, e, table, r)
+			}
+
+			want := verdictReject
+			if hasBlock {
+				want = verdictAccept
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(fam.inBlock, fam.server, 8050)); v != want {
+				t.Errorf("%v: expected connection from %v on port in range to be %v, got %v", cidrs, fam.inBlock, want, v)
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(fam.inBlock, fam.server, 8101)); v != verdictReject {
+				t.Errorf("%v: expected connection from %v on port outside range to be rejected, got %v", cidrs, fam.inBlock, v)
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(fam.other, fam.server, 8050)); v != verdictReject {
+				t.Errorf("%v: expected connection from %v outside ipBlock to be rejected, got %v", cidrs, fam.other, v)
+			}
+		}
+	}
+}
+
+func TestSuspiciousIPBlockExcept(t *testing.T) {
+	for _, c := range []struct {
+		except     string
+		suspicious bool
+	}{
+		{"192.0.2.128/25", false},
+		{"192.0.2.0/24", false},
+		{"192.0.0.0/16", true},
+		{"198.51.100.0/24", true},
+		{"2001:db8::/64", true},
+	} {
+		ctrl, _, rec := newTestController(t, Config{})
+		ctrl.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+			Spec: nwkv1.NetworkPolicySpec{
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24", Except: []string{c.except}}}},
+				}},
+			},
+		})
+		var suspicious bool
+		for _, e := range drainEvents(rec) {
+			suspicious = suspicious || strings.Contains(e, "SuspiciousIPBlock")
+		}
+		if suspicious != c.suspicious {
+			t.Errorf("except %v: expected suspicious %v, got %v", c.except, c.suspicious, suspicious)
+		}
+	}
+}
+
+func ptrIntStr(v intstr.IntOrString) *intstr.IntOrString {
+	return &v
+}
+
+// The named port rule loads the L4 protocol, port and IP address into
+// consecutive registers and looks them up as a single concatenated key. Each
+// component is padded to a multiple of 4 bytes.
+func TestNamedPortKeyLayout(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	namedPort := intstr.FromString("http")
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &namedPort}},
+			}},
+		},
+	})
+	client := testPod("default", "client", nil, "10.0.0.2", "fd00::2")
+	client.Spec.Containers = []corev1.Container{{Name: "main", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP}}}}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, client)
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1", "fd00::1"))
+	mustFlush(t, c)
+
+	cases := []struct {
+		family  nftables.TableFamily
+		key     []byte
+		src     string
+		dst     string
+		keySize uint32
+	}{{
+		family:  nftables.TableFamilyIPv4,
+		key:     []byte{unix.IPPROTO_TCP, 0, 0, 0, 0x1f, 0x90, 0, 0, 10, 0, 0, 2},
+		src:     "10.0.0.2",
+		dst:     "10.0.0.1",
+		keySize: 12,
+	}, {
+		family:  nftables.TableFamilyIPv6,
+		key:     append([]byte{unix.IPPROTO_TCP, 0, 0, 0, 0x1f, 0x90, 0, 0}, netip.MustParseAddr("fd00::2").AsSlice()...),
+		src:     "fd00::2",
+		dst:     "fd00::1",
+		keySize: 24,
+	}}
+	for _, tc := range cases {
+		table := &nftables.Table{Name: defaultTableName, Family: tc.family}
+		sets, err := mem.GetSets(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx := slices.IndexFunc(sets, func(s *nftables.Set) bool { return s.Name == "pol_default_allow_ing_0_namedports" })
+		if idx == -1 {
+			t.Fatalf("family %v: named port set missing", tc.family)
+		}
+		if sets[idx].KeyType.Bytes != tc.keySize {
+			t.Errorf("family %v: expected key size %d, got %d", tc.family, tc.keySize, sets[idx].KeyType.Bytes)
+		}
+		elems, err := mem.GetSetElements(sets[idx])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elems) != 1 || !bytes.Equal(elems[0].Key, tc.key) {
+			t.Errorf("family %v: expected single element with key %x, got %v", tc.family, tc.key, elems)
+		}
+		// The evaluator assembles the key from the registers loaded by the rule
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(tc.src, tc.dst, 8080)); v != verdictAccept {
+			t.Errorf("family %v: expected connection to named port to be accepted, got %v", tc.family, v)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(tc.src, tc.dst, 8081)); v != verdictReject {
+			t.Errorf("family %v: expected connection to other port to be rejected, got %v", tc.family, v)
+		}
+	}
+}
+
+func TestSourcePortsAnnotation(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "egress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress", Annotations: map[string]string{
+			annotationSourcePorts + "-egress-0": "1024-65535",
+			annotationSourcePorts + "-egress-1": "80-",
+		}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}}},
+			}, {
+				To:    []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "198.51.100.0/24"}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(443))}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.1"))
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "InvalidAnnotation") || !strings.Contains(events[0], "source-ports-egress-1") {
+		t.Errorf("expected a single InvalidAnnotation event for the second rule, got %v", events)
+	}
+
+	conn := newConn("10.0.0.1", "192.0.2.1", 53)
+	if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != verdictAccept {
+		t.Errorf("expected connection from unprivileged source port to be accepted, got %v", v)
+	}
+	conn.proto = unix.IPPROTO_UDP
+	if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != verdictAccept {
+		t.Errorf("expected UDP traffic from unprivileged source port to be accepted, got %v", v)
+	}
+	conn.sport = 53
+	if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != verdictReject {
+		t.Errorf("expected traffic from privileged source port to be rejected, got %v", v)
+	}
+	icmp := testPacket{src: conn.src, dst: conn.dst, proto: unix.IPPROTO_ICMP, icmpType: 8, ctState: conn.ctState}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, icmp); v != verdictReject {
+		t.Errorf("expected ICMP traffic to be rejected, got %v", v)
+	}
+	// The invalid annotation is ignored
+	conn = newConn("10.0.0.1", "198.51.100.1", 443)
+	conn.sport = 53
+	if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != verdictAccept {
+		t.Errorf("expected connection permitted by rule with invalid annotation to be accepted, got %v", v)
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	r, err := parsePortRanges("53, 1024-65535,80-80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ranges.Range[uint16]
+	for it := r.Iterator(); it.Valid(); it.Next() {
+		got = append(got, it.Item())
+	}
+	want := []ranges.Range[uint16]{{Start: 53, End: 53}, {Start: 80, End: 80}, {Start: 1024, End: 65535}}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	for _, bad := range []string{"", "foo", "80-", "90-80", "65536"} {
+		if _, err := parsePortRanges(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestPacketLengthAnnotation(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "ingress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ingress", Annotations: map[string]string{
+			annotationPacketLength + "-ingress-0": "100-1500",
+			annotationPacketLength + "-ingress-1": "1500-100",
+		}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{}},
+					{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}},
+				},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(80))}},
+			}, {
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(443))}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1", "fd00::1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "InvalidAnnotation") || !strings.Contains(events[0], "packet-length-ingress-1") {
+		t.Errorf("expected a single InvalidAnnotation event for the second rule, got %v", events)
+	}
+
+	for _, tc := range []struct {
+		src, dst string
+		dport    uint16
+		length   uint16
+		want     testVerdict
+	}{
+		{"10.0.0.2", "10.0.0.1", 80, 100, verdictAccept},
+		{"10.0.0.2", "10.0.0.1", 80, 1500, verdictAccept},
+		{"10.0.0.2", "10.0.0.1", 80, 99, verdictReject},
+		{"10.0.0.2", "10.0.0.1", 80, 1501, verdictReject},
+		{"192.0.2.1", "10.0.0.1", 80, 1000, verdictAccept},
+		{"192.0.2.1", "10.0.0.1", 80, 9000, verdictReject},
+		// The total length of IPv6 packets includes the fixed header
+		{"fd00::2", "fd00::1", 80, 100, verdictAccept},
+		{"fd00::2", "fd00::1", 80, 1500, verdictAccept},
+		{"fd00::2", "fd00::1", 80, 99, verdictReject},
+		{"fd00::2", "fd00::1", 80, 1501, verdictReject},
+		// Other ports are still not permitted
+		{"10.0.0.2", "10.0.0.1", 81, 1000, verdictReject},
+		// The invalid annotation is ignored
+		{"10.0.0.2", "10.0.0.1", 443, 9000, verdictAccept},
+	} {
+		conn := newConn(tc.src, tc.dst, tc.dport)
+		conn.length = tc.length
+		if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != tc.want {
+			t.Errorf("%s -> %s:%d with length %d: expected %v, got %v", tc.src, tc.dst, tc.dport, tc.length, tc.want, v)
+		}
+	}
+}
+
+func TestParsePacketLength(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want ranges.Range[uint16]
+	}{
+		{"64-1500", ranges.Range[uint16]{Start: 64, End: 1500}},
+		{"-1500", ranges.Range[uint16]{Start: 0, End: 1500}},
+		{"1500-", ranges.Range[uint16]{Start: 1500, End: 65535}},
+	} {
+		got, err := parsePacketLength(tc.spec)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: expected %v, got %v, %v", tc.spec, tc.want, got, err)
+		}
+	}
+	for _, spec := range []string{"", "1500", "1500-64", "a-b", "0-70000", "-39"} {
+		if _, err := parsePacketLength(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}
+
+func TestLimitAnnotation(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	for i, nwp := range []struct{ name, limit string }{{"limited", "10/second burst 5"}, {"invalid", "10/fortnight"}} {
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: nwp.name, Name: nwp.name}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: nwp.name, Name: nwp.name, Annotations: map[string]string{annotationLimit: nwp.limit}},
+			Spec: nwkv1.NetworkPolicySpec{
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}, {IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(80))}},
+				}},
+			},
+		})
+		c.SetPod(cache.ObjectName{Namespace: nwp.name, Name: "client"}, testPod(nwp.name, "client", nil, fmt.Sprintf("10.0.%d.1", i)))
+		c.SetPod(cache.ObjectName{Namespace: nwp.name, Name: "server"}, testPod(nwp.name, "server", nil, fmt.Sprintf("10.0.%d.2", i)))
+	}
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "InvalidAnnotation") || !strings.Contains(events[0], "fortnight") {
+		t.Errorf("expected a single InvalidAnnotation event, got %v", events)
+	}
+
+	for _, tc := range []struct {
+		src, dst  string
+		overLimit bool
+		want      testVerdict
+	}{
+		{"10.0.0.1", "10.0.0.2", false, verdictAccept},
+		{"10.0.0.1", "10.0.0.2", true, verdictReject},
+		{"192.0.2.1", "10.0.0.2", false, verdictAccept},
+		{"192.0.2.1", "10.0.0.2", true, verdictReject},
+		// The invalid annotation is ignored
+		{"10.0.1.1", "10.0.1.2", true, verdictAccept},
+		{"192.0.2.1", "10.0.1.2", true, verdictAccept},
+	} {
+		conn := newConn(tc.src, tc.dst, 80)
+		conn.overLimit = tc.overLimit
+		if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != tc.want {
+			t.Errorf("%v -> %v (over limit: %v): expected %v, got %v", tc.src, tc.dst, tc.overLimit, tc.want, v)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	l, err := parseLimit("100/minute burst 20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := expr.Limit{Type: expr.LimitTypePkts, Rate: 100, Unit: expr.LimitTimeMinute, Burst: 20}
+	if *l != want {
+		t.Errorf("expected %+v, got %+v", want, *l)
+	}
+	for _, bad := range []string{"", "10", "0/second", "10/fortnight", "10/second burst", "10/second burst -1", "10/second foo 1"} {
+		if _, err := parseLimit(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestActiveTimeAnnotation(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	for i, nwp := range []struct{ name, window string }{{"business", "mon-fri 08:00-18:00"}, {"night", "22:00-06:00"}, {"weekend", "sat-sun"}, {"invalid", "mon-fri 08:00"}} {
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: nwp.name, Name: nwp.name}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: nwp.name, Name: nwp.name, Annotations: map[string]string{annotationActiveTime: nwp.window}},
+			Spec: nwkv1.NetworkPolicySpec{
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(80))}},
+				}},
+			},
+		})
+		c.SetPod(cache.ObjectName{Namespace: nwp.name, Name: "client"}, testPod(nwp.name, "client", nil, fmt.Sprintf("10.0.%d.1", i)))
+		c.SetPod(cache.ObjectName{Namespace: nwp.name, Name: "server"}, testPod(nwp.name, "server", nil, fmt.Sprintf("10.0.%d.2", i)))
+	}
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "InvalidAnnotation") {
+		t.Errorf("expected a single InvalidAnnotation event, got %v", events)
+	}
+
+	friday := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	saturday := friday.AddDate(0, 0, 1)
+	for _, tc := range []struct {
+		dst  string
+		now  time.Time
+		want testVerdict
+	}{
+		{"10.0.0.2", friday.Add(8 * time.Hour), verdictAccept},
+		{"10.0.0.2", friday.Add(18*time.Hour - time.Second), verdictAccept},
+		{"10.0.0.2", friday.Add(18 * time.Hour), verdictReject},
+		{"10.0.0.2", friday.Add(7 * time.Hour), verdictReject},
+		{"10.0.0.2", saturday.Add(12 * time.Hour), verdictReject},
+		// The window is in UTC
+		{"10.0.0.2", friday.Add(12 * time.Hour).In(time.FixedZone("UTC+10", 10*3600)), verdictAccept},
+		{"10.0.1.2", friday.Add(23 * time.Hour), verdictAccept},
+		{"10.0.1.2", friday.Add(5 * time.Hour), verdictAccept},
+		{"10.0.1.2", friday.Add(6 * time.Hour), verdictReject},
+		{"10.0.1.2", friday.Add(12 * time.Hour), verdictReject},
+		{"10.0.2.2", saturday, verdictAccept},
+		{"10.0.2.2", saturday.AddDate(0, 0, 1).Add(12 * time.Hour), verdictAccept},
+		{"10.0.2.2", friday.Add(12 * time.Hour), verdictReject},
+		// The invalid annotation is ignored
+		{"10.0.3.2", saturday, verdictAccept},
+	} {
+		src := netip.MustParseAddr(tc.dst).Prev().String()
+		conn := newConn(src, tc.dst, 80)
+		conn.now = tc.now
+		if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != tc.want {
+			t.Errorf("%v -> %v at %v: expected %v, got %v", src, tc.dst, tc.now, tc.want, v)
+		}
+	}
+}
+
+func TestParseActiveTime(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want activeTime
+	}{
+		{"Mon-Fri 08:00-18:00", activeTime{firstDay: 1, lastDay: 5, start: 8 * 3600, end: 18 * 3600}},
+		{"sat", activeTime{firstDay: 6, lastDay: 6, allHours: true}},
+		{"mon-sun", activeTime{firstDay: 1, lastDay: 0, allDays: true, allHours: true}},
+		{"22:00-00:00", activeTime{allDays: true, start: 22 * 3600}},
+		{"00:00-24:00", activeTime{allDays: true, end: 24 * 3600, allHours: true}},
+	} {
+		at, err := parseActiveTime(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+		} else if at != tc.want {
+			t.Errorf("%q: expected %+v, got %+v", tc.spec, tc.want, at)
+		}
+	}
+	for _, bad := range []string{"", "mon-fri 08:00", "08:00-18:00 mon", "mon tue", "someday", "08:00-08:00", "24:00-01:00", "08:60-09:00", "25:00-26:00", "mon-fri 08:00-18:00 extra"} {
+		if _, err := parseActiveTime(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestAuditMode(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	web := cache.ObjectName{Namespace: "default", Name: "web"}
+	c.SetPod(web, testPod("default", "web", map[string]string{"app": "web"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2"))
+	expect := func(port uint16, want testVerdict) {
+		t.Helper()
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", port)); v != want {
+			t.Errorf("connection to port %d: expected %v, got %v", port, want, v)
+		}
+	}
+	policy := func(name, mode string, port int32) *nwkv1.NetworkPolicy {
+		p := intstr.FromInt32(port)
+		return &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: map[string]string{annotationMode: mode}},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Ingress:     []nwkv1.NetworkPolicyIngressRule{{Ports: []nwkv1.NetworkPolicyPort{{Port: &p}}}},
+			},
+		}
+	}
+	audit := cache.ObjectName{Namespace: "default", Name: "audit"}
+	c.SetNetworkPolicy(audit, policy("audit", "audit", 80))
+	mustFlush(t, c)
+	expect(80, verdictAccept)
+	expect(81, verdictAccept)
+	rules, err := mem.GetRules(&nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, &nftables.Chain{Name: "pod_default_web_ing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log, ok := rules[len(rules)-1].Exprs[0].(*expr.Log); !ok || !strings.HasPrefix(string(log.Data), "npc-audit pod_default_web_ing") {
+		t.Errorf("expected audit rule to log with prefix, got %v", rules[len(rules)-1].Exprs)
+	}
+	if ok, reason := c.CanConnect(cache.ObjectName{Namespace: "default", Name: "client"}, web, unix.IPPROTO_TCP, 81); !ok || !strings.Contains(reason, "audited") {
+		t.Errorf("expected audited connection to be possible, got %v (%s)", ok, reason)
+	}
+
+	// An enforced policy selecting the same pod enforces all policies
+	enforce := cache.ObjectName{Namespace: "default", Name: "enforce"}
+	c.SetNetworkPolicy(enforce, policy("enforce", "enforce", 443))
+	mustFlush(t, c)
+	expect(80, verdictAccept)
+	expect(443, verdictAccept)
+	expect(81, verdictReject)
+
+	c.SetNetworkPolicy(enforce, nil)
+	mustFlush(t, c)
+	expect(81, verdictAccept)
+
+	// Switching the policy to enforcing mode
+	c.SetNetworkPolicy(audit, policy("audit", "bogus", 80))
+	mustFlush(t, c)
+	expect(80, verdictAccept)
+	expect(81, verdictReject)
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "InvalidAnnotation") {
+		t.Errorf("expected a single InvalidAnnotation event, got %v", events)
+	}
+}
+
+func TestAuditNamedPorts(t *testing.T) {
+	c, _, rec := newTestController(t, Config{AuditNamedPorts: true})
+	udp := corev1.ProtocolUDP
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	// The policy is processed before the pods, as can happen during the
+	// initial sync, which must not cause spurious events.
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromString("http"))}},
+			}, {
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromString("dns")), Protocol: &udp}},
+			}},
+		},
+	})
+	pod := testPod("default", "server", nil, "10.0.0.1")
+	pod.Spec.Containers = []corev1.Container{{Name: "main", Ports: []corev1.ContainerPort{
+		{Name: "http", ContainerPort: 8080},
+		{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolTCP},
+	}}}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, pod)
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "Normal NamedPortUnresolved") || !strings.Contains(events[0], "dns/UDP") {
+		t.Errorf("expected a single NamedPortUnresolved event for dns/UDP, got %v", events)
+	}
+	mustFlush(t, c)
+	if events := drainEvents(rec); len(events) != 0 {
+		t.Errorf("expected audit to run only once per rule, got %v", events)
+	}
+}
+
+// fuzzInput consumes bytes of fuzzer input, returning zero once exhausted.
+type fuzzInput []byte
+
+func (in *fuzzInput) byte() byte {
+	if len(*in) == 0 {
+		return 0
+	}
+	b := (*in)[0]
+	*in = (*in)[1:]
+	return b
+}
+
+func (in *fuzzInput) uint16() uint16 {
+	return uint16(in.byte())<<8 | uint16(in.byte())
+}
+
+func (in *fuzzInput) peers() []nwkv1.NetworkPolicyPeer {
+	var peers []nwkv1.NetworkPolicyPeer
+	for range in.byte() % 4 {
+		switch in.byte() % 6 {
+		case 0:
+			peers = append(peers, nwkv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{}})
+		case 1:
+			peers = append(peers, nwkv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}}})
+		case 2:
+			peers = append(peers, nwkv1.NetworkPolicyPeer{NamespaceSelector: &metav1.LabelSelector{}})
+		case 3:
+			peers = append(peers, nwkv1.NetworkPolicyPeer{
+				NamespaceSelector: &metav1.LabelSelector{},
+				PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}},
+			})
+		case 4:
+			addr := netip.AddrFrom4([4]byte{10, in.byte(), in.byte(), in.byte()})
+			prefix := netip.PrefixFrom(addr, int(in.byte()%33)).Masked()
+			ipBlock := &nwkv1.IPBlock{CIDR: prefix.String()}
+			if exceptBits := int(in.byte() % 33); exceptBits > prefix.Bits() {
+				ipBlock.Except = []string{netip.PrefixFrom(addr, exceptBits).Masked().String()}
+			}
+			peers = append(peers, nwkv1.NetworkPolicyPeer{IPBlock: ipBlock})
+		case 5:
+			addr := netip.AddrFrom16([16]byte{0xfd, 0, 14: in.byte(), 15: in.byte()})
+			prefix := netip.PrefixFrom(addr, int(in.byte()%129)).Masked()
+			peers = append(peers, nwkv1.NetworkPolicyPeer{IPBlock: &nwkv1.IPBlock{CIDR: prefix.String()}})
+		}
+	}
+	return peers
+}
+
+func (in *fuzzInput) ports() []nwkv1.NetworkPolicyPort {
+	protocols := []*corev1.Protocol{nil, ptr(corev1.ProtocolTCP), ptr(corev1.ProtocolUDP), ptr(corev1.ProtocolSCTP)}
+	var ports []nwkv1.NetworkPolicyPort
+	for range in.byte() % 5 {
+		port := nwkv1.NetworkPolicyPort{Protocol: protocols[in.byte()%4]}
+		switch in.byte() % 4 {
+		case 0:
+			port.Port = ptrIntStr(intstr.FromInt32(int32(in.uint16())))
+		case 1:
+			start := in.uint16()
+			port.Port = ptrIntStr(intstr.FromInt32(int32(start)))
+			port.EndPort = ptr(int32(start) + int32(in.byte()))
+		case 2:
+			port.Port = ptrIntStr(intstr.FromString([]string{"http", "dns"}[in.byte()%2]))
+		}
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// FuzzCreatePeers builds policies with random peers and ports and checks
+// invariants of the generated ruleset.
+func FuzzCreatePeers(f *testing.F) {
+	f.Add([]byte{0x01, 0x02, 0x00, 0x04, 0x01, 0x01, 0x00, 0x00, 0x50})
+	f.Add([]byte{0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x08, 0x10, 0x02, 0x01, 0x01, 0x00, 0x50, 0x10, 0x02, 0x02, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		in := fuzzInput(data)
+		cfg := Config{
+			SharedPortSetMin: int(in.byte() % 4),
+			MaxSetElements:   int(in.byte() % 4),
+		}
+		c, mem, _ := newTestController(t, cfg)
+		annotations := make(map[string]string)
+		if in.byte()%2 == 1 {
+			annotations[annotationLimit] = "10/second burst 5"
+		}
+		if in.byte()%2 == 1 {
+			annotations[annotationSourcePorts+"-ingress-0"] = "1024-65535"
+		}
+		policy := &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fuzz", Annotations: annotations},
+			Spec: nwkv1.NetworkPolicySpec{
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			},
+		}
+		for range in.byte() % 3 {
+			policy.Spec.Ingress = append(policy.Spec.Ingress, nwkv1.NetworkPolicyIngressRule{From: in.peers(), Ports: in.ports()})
+		}
+		for range in.byte() % 3 {
+			policy.Spec.Egress = append(policy.Spec.Egress, nwkv1.NetworkPolicyEgressRule{To: in.peers(), Ports: in.ports()})
+		}
+
+		c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "fuzz"}, policy)
+		server := testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1", "fd00::1")
+		server.Spec.Containers = []corev1.Container{{Name: "main", Ports: []corev1.ContainerPort{
+			{Name: "http", ContainerPort: 8080},
+			{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+		}}}
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, server)
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.2", "fd00::2"))
+		mustFlush(t, c)
+
+		for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+			e := &evaluator{t: t, mem: mem, family: fam}
+			table := &nftables.Table{Name: defaultTableName, Family: fam}
+			sets, err := mem.GetSets(table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, set := range sets {
+				elems, err := mem.GetSetElements(set)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, el := range elems {
+					if len(el.Key) != int(set.KeyType.Bytes) {
+						t.Errorf("set %q: element key %x has length %d, expected %d", set.Name, el.Key, len(el.Key), set.KeyType.Bytes)
+					}
+					if set.Interval && el.KeyEnd != nil && len(el.KeyEnd) != int(set.KeyType.Bytes) {
+						t.Errorf("set %q: element key end %x has length %d, expected %d", set.Name, el.KeyEnd, len(el.KeyEnd), set.KeyType.Bytes)
+					}
+				}
+			}
+			chains, err := mem.ListChainsOfTableFamily(fam)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ch := range chains {
+				rules, err := mem.GetRules(ch.Table, ch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range rules {
+					checkRegisters(t, e, ch.Table, r)
+					if !strings.HasPrefix(ch.Name, "pol_") {
+						continue
+					}
+					switch last := r.Exprs[len(r.Exprs)-1].(type) {
+					case *expr.Verdict:
+					case *expr.Lookup:
+						if !last.IsDestRegSet || last.DestRegister != 0 {
+							t.Errorf("chain %q: rule ends in non-verdict lookup: %v", ch.Name, r.Exprs)
+						}
+					default:
+						t.Errorf("chain %q: rule does not end in a verdict: %v", ch.Name, r.Exprs)
+					}
+				}
+			}
+		}
+
+		// The evaluator fails the test on malformed rules
+		for _, pkt := range []testPacket{
+			newConn("10.0.0.2", "10.0.0.1", 8080),
+			newConn("10.0.0.1", "10.0.0.2", 53),
+			newConn("fd00::2", "fd00::1", 80),
+			newConn("10.0.0.1", "10.1.2.3", 443),
+		} {
+			evalPacket(t, mem, nftables.ChainHookForward, pkt)
+			evalPacket(t, mem, nftables.ChainHookForward, pkt.reply())
+		}
+	})
+}
+
+func TestNamedPortWithEndPort(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromString("http")), EndPort: ptr(int32(9000))}},
+			}},
+		},
+	})
+	server := testPod("default", "server", nil, "10.0.0.1")
+	server.Spec.Containers = []corev1.Container{{Name: "main", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP}}}}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, server)
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2"))
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "InvalidPort") || !strings.Contains(events[0], `named port "http"`) {
+		t.Errorf("expected an InvalidPort event for the end port, got %v", events)
+	}
+	// The entry is treated as the named port alone
+	for _, tc := range []struct {
+		port     uint16
+		expected testVerdict
+	}{{8080, verdictAccept}, {8081, verdictReject}, {9000, verdictReject}} {
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", tc.port)); v != tc.expected {
+			t.Errorf("port %d: expected %v, got %v", tc.port, tc.expected, v)
+		}
+	}
+}
+
+func TestPortZero(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "test"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(0))}, {Port: ptrIntStr(intstr.FromInt32(80))}},
+			}, {
+				// A rule with only invalid ports must not permit all ports
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(-1))}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1"))
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 2 || !strings.Contains(events[0], "InvalidPort") || !strings.Contains(events[0], "port number 0") || !strings.Contains(events[1], "port number -1") {
+		t.Errorf("expected InvalidPort events for ports 0 and -1, got %v", events)
+	}
+	for _, tc := range []struct {
+		port     uint16
+		expected testVerdict
+	}{{0, verdictReject}, {80, verdictAccept}, {443, verdictReject}, {65535, verdictReject}} {
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", tc.port)); v != tc.expected {
+			t.Errorf("port %d: expected %v, got %v", tc.port, tc.expected, v)
+		}
+	}
+}
+
+func TestInterfaceGroupAnnotation(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "tenant-a"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tenant-a", Annotations: map[string]string{annotationInterfaceGroup: "5"}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress:     []nwkv1.NetworkPolicyIngressRule{{}},
+			Egress:      []nwkv1.NetworkPolicyEgressRule{{}},
+		},
+	})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "invalid"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "invalid", Annotations: map[string]string{annotationInterfaceGroup: "0"}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "none"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1"))
+	mustFlush(t, c)
+
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "InvalidAnnotation") || !strings.Contains(events[0], "interface-group") {
+		t.Errorf("expected a single InvalidAnnotation event, got %v", events)
+	}
+	for _, group := range []uint32{5, 6} {
+		expected := verdictReject
+		if group == 5 {
+			expected = verdictAccept
+		}
+		in := newConn("192.0.2.1", "10.0.0.1", 80)
+		in.oifGroup = group
+		if v := evalPacket(t, mem, nftables.ChainHookForward, in); v != expected {
+			t.Errorf("ingress through interface group %d: expected %v, got %v", group, expected, v)
+		}
+		out := newConn("10.0.0.1", "192.0.2.1", 80)
+		out.iifGroup = group
+		if v := evalPacket(t, mem, nftables.ChainHookForward, out); v != expected {
+			t.Errorf("egress through interface group %d: expected %v, got %v", group, expected, v)
+		}
+	}
+}
+
+func TestInterfaceGroupAnnotationWithPodIfaceGroup(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{PodIfaceGroup: 1})
+	c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "tenant-a"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tenant-a", Annotations: map[string]string{annotationInterfaceGroup: "5"}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", nil, "10.0.0.1"))
+	mustFlush(t, c)
+
+	check := func(step, src string, expected map[uint32]testVerdict) {
+		t.Helper()
+		for group, verdict := range expected {
+			in := newConn(src, "10.0.0.1", 80)
+			in.oifGroup = group
+			if v := evalPacket(t, mem, nftables.ChainHookForward, in); v != verdict {
+				t.Errorf("%s: ingress from %s through interface group %d: expected %v, got %v", step, src, group, verdict, v)
+			}
+		}
+	}
+	// The group of the policy is policed in addition to the global one,
+	// where the policy does not apply. Other groups are not policed.
+	check("with policy", "192.0.2.1", map[uint32]testVerdict{1: verdictReject, 5: verdictAccept, 6: verdictAccept})
+	check("with policy", "198.51.100.1", map[uint32]testVerdict{1: verdictReject, 5: verdictReject, 6: verdictAccept})
+
+	// Once no policy uses it, the group is no longer policed
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "tenant-a"}, nil)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+	mustFlush(t, c)
+	check("after deleting policy", "198.51.100.1", map[uint32]testVerdict{1: verdictReject, 5: verdictAccept})
+	if res, err := c.ReconcileSets(); err != nil || res.Changed() {
+		t.Errorf("expected interface group set to be in sync, got %+v, %v", res, err)
+	}
+}
+
+// checkRefs verifies that the references between pods, policies and rules
+// only point to objects still known to c.
+func checkRefs(t *testing.T, c *Controller) {
+	t.Helper()
+	pods := make(map[*Pod]bool)
+	for _, p := range c.pods {
+		pods[p] = true
+	}
+	nwps := make(map[*Policy]bool)
+	rules := make(map[*Rule]bool)
+	for _, nwp := range c.nwps {
+		nwps[nwp] = true
+		for p := range nwp.podRefs {
+			if !pods[p] {
+				t.Errorf("policy %s/%s references deleted pod %s/%s", nwp.Namespace, nwp.Name, p.Namespace, p.Name)
+			}
+		}
+		for _, r := range slices.Concat(nwp.IngressRuleMeta, nwp.EgressRuleMeta) {
+			rules[r] = true
+		}
+	}
+	for r := range c.rules {
+		if !rules[r] {
+			t.Errorf("rule of deleted policy %s/%s is still known", r.policy.Namespace, r.policy.Name)
+		}
+		for p := range r.podRefs {
+			if !pods[p] {
+				t.Errorf("rule of policy %s/%s references deleted pod %s/%s", r.policy.Namespace, r.policy.Name, p.Namespace, p.Name)
+			}
+		}
+		if r.podIPs != nil {
+			for _, o := range r.podIPs.rules {
+				if _, ok := c.rules[o]; !ok {
+					t.Errorf("pod IP set %s is shared with a deleted rule of policy %s/%s", r.PodIPSet.Name, o.policy.Namespace, o.policy.Name)
+				}
+			}
+		}
+	}
+	for r := range c.nsRules {
+		if _, ok := c.rules[r]; !ok {
+			t.Errorf("namespace index contains deleted rule of policy %s/%s", r.policy.Namespace, r.policy.Name)
+		}
+	}
+	for _, p := range c.pods {
+		for r := range p.ruleRefs {
+			if _, ok := c.rules[r]; !ok {
+				t.Errorf("pod %s/%s references deleted rule of policy %s/%s", p.Namespace, p.Name, r.policy.Namespace, r.policy.Name)
+			}
+		}
+		for _, refs := range []map[*Policy]*nfds.Rule{p.ingressPolicyRefs, p.egressPolicyRefs, p.ingressReplyRefs, p.egressReplyRefs} {
+			for nwp := range refs {
+				if !nwps[nwp] {
+					t.Errorf("pod %s/%s references deleted policy %s/%s", p.Namespace, p.Name, nwp.Namespace, nwp.Name)
+				}
+			}
+		}
+	}
+	for ns, nsPods := range c.nsPods {
+		for p := range nsPods {
+			if !pods[p] {
+				t.Errorf("namespace index of %s contains deleted pod %s/%s", ns, p.Namespace, p.Name)
+			}
+		}
+	}
+}
+
+func TestDeleteOrdering(t *testing.T) {
+	doomedNS := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "doomed", Labels: map[string]string{"env": "test"}}}
+	otherNS := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}}
+	doomedPolicy := &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "doomed", Name: "pol", UID: "uid-doomed-pol"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromString("http"))}},
+			}},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To: []nwkv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}}},
+			}},
+		},
+	}
+	// Survives the namespace, but selects its pods as peers
+	otherPolicy := &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "pol", UID: "uid-other-pol"},
+		Spec: nwkv1.NetworkPolicySpec{
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "test"}}}},
+			}},
+		},
+	}
+	doomedPods := []*corev1.Pod{
+		testPod("doomed", "a", nil, "10.0.1.1", "fd00:1::1"),
+		testPod("doomed", "b", nil, "10.0.1.2", "fd00:1::2"),
+	}
+	for _, p := range doomedPods {
+		p.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP}}}}
+	}
+	server := testPod("other", "server", nil, "10.0.0.1", "fd00::1")
+
+	setup := func(c *Controller) {
+		c.SetNamespace("doomed", doomedNS)
+		c.SetNamespace("other", otherNS)
+		c.SetNetworkPolicy(cache.MetaObjectToName(doomedPolicy), doomedPolicy)
+		c.SetNetworkPolicy(cache.MetaObjectToName(otherPolicy), otherPolicy)
+		for _, p := range doomedPods {
+			c.SetPod(cache.MetaObjectToName(p), p)
+		}
+		c.SetPod(cache.MetaObjectToName(server), server)
+	}
+	deletePolicy := func(c *Controller) {
+		c.SetNetworkPolicy(cache.MetaObjectToName(doomedPolicy), nil)
+	}
+	deletePods := func(c *Controller) {
+		for _, p := range doomedPods {
+			c.SetPod(cache.MetaObjectToName(p), nil)
+		}
+	}
+	deleteNS := func(c *Controller) {
+		c.SetNamespace("doomed", nil)
+	}
+
+	// The ruleset after deleting the namespace must not differ from one
+	// created without it.
+	expected, expectedMem, _ := newTestController(t, Config{})
+	expected.SetNamespace("other", otherNS)
+	expected.SetNetworkPolicy(cache.MetaObjectToName(otherPolicy), otherPolicy)
+	expected.SetPod(cache.MetaObjectToName(server), server)
+	mustFlush(t, expected)
+
+	for _, tc := range []struct {
+		name  string
+		steps []func(*Controller)
+	}{
+		{"policy first", []func(*Controller){deletePolicy, deletePods, deleteNS}},
+		{"pods first", []func(*Controller){deletePods, deletePolicy, deleteNS}},
+		{"namespace first", []func(*Controller){deleteNS, deletePods, deletePolicy}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, mem, _ := newTestController(t, Config{})
+			setup(c)
+			mustFlush(t, c)
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", "10.0.0.1", 80)); v != verdictAccept {
+				t.Fatalf("expected traffic from the namespace to be accepted before deletion, got %v", v)
+			}
+			for _, step := range tc.steps {
+				step(c)
+				mustFlush(t, c)
+				checkRefs(t, c)
+			}
+
+			if len(c.rules) != len(expected.rules) {
+				t.Errorf("expected %d rules, got %d", len(expected.rules), len(c.rules))
+			}
+			if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+				t.Errorf("expected no orphans, got %v (%v)", orphans, err)
+			}
+			for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+				chains, _ := mem.ListChainsOfTableFamily(fam)
+				expectedChains, _ := expectedMem.ListChainsOfTableFamily(fam)
+				if len(chains) != len(expectedChains) {
+					t.Errorf("family %d: expected %d chains, got %d", fam, len(expectedChains), len(chains))
+				}
+				table := &nftables.Table{Name: defaultTableName, Family: fam}
+				sets, _ := mem.GetSets(table)
+				expectedSets, _ := expectedMem.GetSets(table)
+				if len(sets) != len(expectedSets) {
+					t.Errorf("family %d: expected %d sets, got %d", fam, len(expectedSets), len(sets))
+				}
+				for _, s := range sets {
+					elems, _ := mem.GetSetElements(s)
+					expectedElems, _ := expectedMem.GetSetElements(s)
+					if len(elems) != len(expectedElems) {
+						t.Errorf("family %d: expected %d elements in set %s, got %d", fam, len(expectedElems), s.Name, len(elems))
+					}
+				}
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", "10.0.0.1", 80)); v != verdictReject {
+				t.Errorf("expected traffic from the deleted namespace's addresses to be rejected, got %v", v)
+			}
+		})
+	}
+}
+
+func TestRuleChains(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{RuleChains: true})
+	name := cache.ObjectName{Namespace: "default", Name: "allow"}
+	c.SetNetworkPolicy(name, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow", Annotations: map[string]string{annotationTCPFlags: "syn/syn,ack"}},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(80))}},
+			}, {
+				From: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "192.0.2.0/24"}}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2"))
+	mustFlush(t, c)
+
+	chains, err := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, ch := range chains {
+		names[ch.Name] = true
+	}
+	for _, ch := range []string{"pol_default_allow_ing", "pol_default_allow_ing_0", "pol_default_allow_ing_1"} {
+		if !names[ch] {
+			t.Errorf("expected chain %q, got %v", ch, names)
+		}
+	}
+
+	for _, tc := range []struct {
+		src   string
+		dport uint16
+		want  testVerdict
+	}{
+		{"10.0.0.2", 80, verdictAccept},
+		{"10.0.0.2", 443, verdictReject},
+		{"192.0.2.1", 443, verdictAccept},
+		{"198.51.100.1", 80, verdictReject},
+	} {
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(tc.src, "10.0.0.1", tc.dport)); v != tc.want {
+			t.Errorf("%v -> 10.0.0.1:%d: expected %v, got %v", tc.src, tc.dport, tc.want, v)
+		}
+	}
+	// The TCP flags filter of the policy chain applies to all rule chains
+	conn := newConn("192.0.2.1", "10.0.0.1", 443)
+	conn.tcpFlags = 0x12 // SYN, ACK
+	if v := evalPacket(t, mem, nftables.ChainHookForward, conn); v != verdictReject {
+		t.Errorf("expected packet not matching the TCP flags to be rejected, got %v", v)
+	}
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v (%v)", orphans, err)
+	}
+
+	c.SetNetworkPolicy(name, nil)
+	mustFlush(t, c)
+	checkRefs(t, c)
+	chains, err = mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range chains {
+		if strings.HasPrefix(ch.Name, "pol_") {
+			t.Errorf("expected chain %q to be deleted with the policy", ch.Name)
+		}
+	}
+}
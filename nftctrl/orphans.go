@@ -0,0 +1,103 @@
+package nftctrl
+
+import "git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+
+// expectedNames returns the names of all chains, named sets and counters which
+// are part of the current ruleset.
+func (c *Controller) expectedNames() map[string]bool {
+	names := map[string]bool{
+		"filter_hook_ing": true,
+		"filter_hook_eg":  true,
+		c.vmapIng.Name:    true,
+		c.vmapEg.Name:     true,
+
+		nfds.VersionSetName: true,
+	}
+	if c.cfg.Identity != "" {
+		names[nfds.IdentitySetName] = true
+	}
+	if len(c.cfg.CtZones) > 0 {
+		names["ct_zone"] = true
+	}
+	if c.multicastSet != nil {
+		names[c.multicastSet.Name] = true
+	}
+	if c.selfSet != nil {
+		names[c.selfSet.Name] = true
+	}
+	if c.bypassSet != nil {
+		names[c.bypassSet.Name] = true
+	}
+	if c.ifaceGroupSet != nil {
+		names[c.ifaceGroupSet.Name] = true
+	}
+	if c.vmapL2 != nil {
+		names[c.vmapL2.Name] = true
+	}
+	for _, p := range c.pods {
+		if p.ingressChain != nil {
+			names[p.ingressChain.Name] = true
+		}
+		if p.egressChain != nil {
+			names[p.egressChain.Name] = true
+		}
+		if p.l2Chain != nil {
+			names[p.l2Chain.Name] = true
+		}
+	}
+	for _, nwp := range c.nwps {
+		if nwp.ingressChain != nil {
+			names[nwp.ingressChain.Name] = true
+		}
+		if nwp.egressChain != nil {
+			names[nwp.egressChain.Name] = true
+		}
+		if nwp.ingressReplyChain != nil {
+			names[nwp.ingressReplyChain.Name] = true
+		}
+		if nwp.egressReplyChain != nil {
+			names[nwp.egressReplyChain.Name] = true
+		}
+	}
+	for r := range c.rules {
+		names[r.chain.Name] = true
+		if r.PodIPSet != nil {
+			names[r.PodIPSet.Name] = true
+		}
+		if r.NamedPortSet != nil {
+			names[r.NamedPortSet.Name] = true
+		}
+		if r.FQDNSet != nil {
+			names[r.FQDNSet.Name] = true
+		}
+	}
+	for _, ps := range c.portSets {
+		names[ps.set.Name] = true
+	}
+	for _, ctr := range c.policyCounters {
+		names[ctr.Name] = true
+	}
+	return names
+}
+
+// isOrphan returns a function returning true for names of objects owned by
+// the controller which are not part of the current ruleset.
+func (c *Controller) isOrphan() func(name string) bool {
+	expected := c.expectedNames()
+	return func(name string) bool {
+		return ownsName(name) && !expected[name]
+	}
+}
+
+// Orphans returns descriptions of all chains and named sets in the table
+// which look like they are owned by the controller, but are not part of the
+// current ruleset. These can be left behind by crashes or bugs. The ruleset
+// needs to be flushed for the result to be accurate.
+func (c *Controller) Orphans() ([]string, error) {
+	return c.nftConn.ListOwned(c.table, c.isOrphan())
+}
+
+// DelOrphans deletes all objects returned by Orphans with the next flush.
+func (c *Controller) DelOrphans() error {
+	return c.nftConn.DelOwned(c.table, c.isOrphan())
+}
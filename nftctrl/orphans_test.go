@@ -0,0 +1,71 @@
+package nftctrl
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/nftables"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestOrphans(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{SharedPortSetMin: 1, AllowMulticast: true})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+	// Uses pod IP, named port and shared port sets
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "peers"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "peers"},
+		Spec: nwkv1.NetworkPolicySpec{
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(443))}, {Port: ptrIntStr(intstr.FromString("http"))}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "test"}, testPod("default", "test", nil, "10.0.0.1", "fd00::1"))
+	mustFlush(t, c)
+
+	orphans, err := c.Orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("expected no orphans in a consistent ruleset, got %v", orphans)
+	}
+
+	// Leave behind objects of a previous generation, only in some families
+	v4 := &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}
+	v6 := &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv6}
+	mem.AddChain(&nftables.Chain{Name: "pod_old_ing", Table: v4})
+	mem.AddChain(&nftables.Chain{Name: "user", Table: v4})
+	if err := mem.AddSet(&nftables.Set{Name: "pol_old_ing_0_podips", Table: v6, KeyType: nftables.TypeIP6Addr}, nil); err != nil {
+		t.Fatal(err)
+	}
+	mustFlush(t, c)
+
+	orphans, err = c.Orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ip chain pod_old_ing", "ip6 set pol_old_ing_0_podips"}
+	if !slices.Equal(orphans, expected) {
+		t.Errorf("expected orphans %v, got %v", expected, orphans)
+	}
+
+	if err := c.DelOrphans(); err != nil {
+		t.Fatal(err)
+	}
+	mustFlush(t, c)
+	if orphans, _ := c.Orphans(); len(orphans) != 0 {
+		t.Errorf("expected no orphans after deleting them, got %v", orphans)
+	}
+	chains, _ := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if !slices.ContainsFunc(chains, func(ch *nftables.Chain) bool { return ch.Name == "user" }) {
+		t.Error("expected chain not owned by the controller to be kept")
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected ruleset to still reject traffic, got %v", v)
+	}
+}
@@ -1,13 +1,18 @@
 package nftctrl
 
 import (
+	"cmp"
 	"encoding/binary"
 	"fmt"
+	"maps"
 	"math"
+	"net"
 	"net/netip"
+	"slices"
 
 	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 	"golang.org/x/sys/unix"
 	corev1 "k8s.io/api/core/v1"
@@ -18,16 +23,117 @@ import (
 
 type Pod struct {
 	Namespace  string
+	Name       string
 	ID         string
 	Labels     labels.Set
 	IPs        []netip.Addr
 	NamedPorts map[string]NamedPort
 
+	// ifIndexes contains the interface index each IP is reachable through if
+	// the verdict maps are interface-scoped, otherwise it is nil.
+	ifIndexes map[netip.Addr]uint32
+
+	// shadowedKeys contains the verdict map keys of IPs which are also used
+	// by another pod added earlier. They are left out of the verdict maps.
+	shadowedKeys map[vmapKey]struct{}
+
+	// comment is attached to all set elements of this pod if non-empty.
+	comment string
+
+	// hostNetwork is set if the pod runs in the network namespace of its
+	// node and thus has the node's IPs.
+	hostNetwork bool
+	// ready is set if the pod is Ready or readiness is not tracked.
+	ready bool
+
+	// mac and vlan are the layer 2 addresses traffic from the IPs of the
+	// pod is pinned to if L2AntiSpoofing is set, nil and zero otherwise.
+	mac  net.HardwareAddr
+	vlan uint16
+
 	ingressChain, egressChain *nfds.Chain
+	// l2Chain drops traffic from the IPs of the pod with other layer 2
+	// addresses if the pod pins any.
+	l2Chain *nfds.Chain
+
+	// defaultDenyIngress and defaultDenyEgress are set if the pod is isolated
+	// in the respective direction by the global default deny selectors, even
+	// if no policy selects it.
+	defaultDenyIngress, defaultDenyEgress bool
+
+	// ingressTerminal and egressTerminal are the rules at the end of the
+	// respective chain handling traffic not permitted by any policy.
+	ingressTerminal, egressTerminal []*nfds.Rule
+	// ingressAudit and egressAudit are set if the terminal rules of the
+	// respective chain accept instead of rejecting.
+	ingressAudit, egressAudit bool
 
 	ruleRefs map[*Rule]struct{}
 
 	ingressPolicyRefs, egressPolicyRefs map[*Policy]*nfds.Rule
+	// ingressReplyRefs and egressReplyRefs contain the jumps from the
+	// respective chain to the reply chains of the policies selecting the pod
+	// for the opposite direction if Config.Stateless is set.
+	ingressReplyRefs, egressReplyRefs map[*Policy]*nfds.Rule
+
+	// warnings are the problems found while normalizing the pod. They are
+	// emitted as events when they first occur instead of on every update.
+	warnings []podWarning
+}
+
+// podWarning is a Warning event on a pod.
+type podWarning struct {
+	reason, message string
+}
+
+func (p *Pod) warnf(reason, messageFmt string, args ...interface{}) {
+	p.warnings = append(p.warnings, podWarning{reason: reason, message: fmt.Sprintf(messageFmt, args...)})
+}
+
+// reportWarnings emits the warnings of p which prev, the previous state of
+// the same pod or nil, did not have.
+func (c *Controller) reportWarnings(pod *corev1.Pod, p, prev *Pod) {
+	for _, w := range p.warnings {
+		if prev == nil || !slices.Contains(prev.warnings, w) {
+			c.eventRecorder.Event(pod, corev1.EventTypeWarning, w.reason, w.message)
+		}
+	}
+}
+
+// vmapKey identifies the verdict map elements of a pod IP. ifIndex is zero
+// unless the verdict maps are interface-scoped.
+type vmapKey struct {
+	ifIndex uint32
+	ip      netip.Addr
+}
+
+func (k vmapKey) String() string {
+	if k.ifIndex == 0 {
+		return k.ip.String()
+	}
+	return fmt.Sprintf("%v on interface %d", k.ip, k.ifIndex)
+}
+
+// vmapKey returns the verdict map key of ip, or false if the verdict maps are
+// interface-scoped and the interface of ip is not known.
+func (p *Pod) vmapKey(ip netip.Addr) (vmapKey, bool) {
+	if p.ifIndexes == nil {
+		return vmapKey{ip: ip}, true
+	}
+	ifIndex, ok := p.ifIndexes[ip]
+	return vmapKey{ifIndex: ifIndex, ip: ip}, ok
+}
+
+// vmapKeys returns the verdict map keys of all IPs of p with a known
+// interface.
+func (p *Pod) vmapKeys() []vmapKey {
+	var keys []vmapKey
+	for _, ip := range p.IPs {
+		if k, ok := p.vmapKey(ip); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
 }
 
 type NamedPort struct {
@@ -38,22 +144,44 @@ type NamedPort struct {
 func (p *Pod) vmapElements(chain *nfds.Chain) []nftables.SetElement {
 	var elems []nftables.SetElement
 	for _, ip := range p.IPs {
-		elems = append(elems, nftables.SetElement{
-			Key: ip.AsSlice(),
-			VerdictData: &expr.Verdict{
-				Kind:  expr.VerdictJump,
-				Chain: chain.Name,
-			},
-		})
+		if e, ok := p.vmapElement(ip, chain); ok {
+			elems = append(elems, e)
+		}
 	}
 	return elems
 }
 
+// vmapElement returns the verdict map element of the given IP of the pod,
+// jumping to chain. If chain is nil, the element accepts the traffic.
+func (p *Pod) vmapElement(ip netip.Addr, chain *nfds.Chain) (nftables.SetElement, bool) {
+	k, ok := p.vmapKey(ip)
+	if !ok {
+		return nftables.SetElement{}, false
+	}
+	if _, ok := p.shadowedKeys[k]; ok {
+		return nftables.SetElement{}, false
+	}
+	key := ip.AsSlice()
+	if p.ifIndexes != nil {
+		key = append(binaryutil.NativeEndian.PutUint32(k.ifIndex), key...)
+	}
+	verdict := &expr.Verdict{Kind: expr.VerdictAccept}
+	if chain != nil {
+		verdict = &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name}
+	}
+	return nftables.SetElement{
+		Key:         key,
+		VerdictData: verdict,
+		Comment:     p.comment,
+	}, true
+}
+
 func (p *Pod) ipElements() []nftables.SetElement {
 	var elems []nftables.SetElement
 	for _, ip := range p.IPs {
 		elems = append(elems, nftables.SetElement{
-			Key: ip.AsSlice(),
+			Key:     ip.AsSlice(),
+			Comment: p.comment,
 		})
 	}
 	return elems
@@ -68,7 +196,8 @@ func (p *Pod) namedPortElements(nms []RuleNamedPortMeta) []nftables.SetElement {
 				continue
 			}
 			elems = append(elems, nftables.SetElement{
-				Key: append(append(binary.BigEndian.AppendUint16([]byte{nm.Protocol, 0, 0, 0}, port.Port), 0, 0), ip.AsSlice()...),
+				Key:     append(append(binary.BigEndian.AppendUint16([]byte{nm.Protocol, 0, 0, 0}, port.Port), 0, 0), ip.AsSlice()...),
+				Comment: p.comment,
 			})
 		}
 	}
@@ -76,7 +205,37 @@ func (p *Pod) namedPortElements(nms []RuleNamedPortMeta) []nftables.SetElement {
 }
 
 func (p *Pod) SemanticallyEqual(p2 *Pod) bool {
-	if p.Namespace != p2.Namespace || p.ID != p2.ID || len(p.Labels) != len(p2.Labels) || len(p.IPs) != len(p2.IPs) || len(p.NamedPorts) != len(p2.NamedPorts) {
+	return p.ready == p2.ready && p.equalIgnoringNamedPorts(p2) && equalNamedPorts(p.NamedPorts, p2.NamedPorts)
+}
+
+func (p *Pod) equalIgnoringNamedPorts(p2 *Pod) bool {
+	if !p.equalIgnoringAddrs(p2) || len(p.IPs) != len(p2.IPs) {
+		return false
+	}
+	ipSet := make(map[netip.Addr]struct{})
+	for _, ip := range p2.IPs {
+		ipSet[ip] = struct{}{}
+	}
+	for _, ip := range p.IPs {
+		if _, ok := ipSet[ip]; !ok {
+			return false
+		}
+	}
+	if len(p.ifIndexes) != len(p2.ifIndexes) {
+		return false
+	}
+	for ip, idx := range p.ifIndexes {
+		if idx2, ok := p2.ifIndexes[ip]; !ok || idx2 != idx {
+			return false
+		}
+	}
+	return true
+}
+
+// equalIgnoringAddrs is like equalIgnoringNamedPorts, but also ignores the
+// IPs and interface indexes.
+func (p *Pod) equalIgnoringAddrs(p2 *Pod) bool {
+	if p.Namespace != p2.Namespace || p.ID != p2.ID || len(p.Labels) != len(p2.Labels) || !p.equalL2Addrs(p2) {
 		return false
 	}
 	for k, v1 := range p.Labels {
@@ -84,86 +243,428 @@ func (p *Pod) SemanticallyEqual(p2 *Pod) bool {
 			return false
 		}
 	}
-	for n, p := range p.NamedPorts {
-		if p2, ok := p2.NamedPorts[n]; !ok || p2 != p {
+	return true
+}
+
+func equalNamedPorts(a, b map[string]NamedPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n, p := range a {
+		if p2, ok := b[n]; !ok || p2 != p {
 			return false
 		}
 	}
-	ipSet := make(map[netip.Addr]struct{})
-	for _, ip := range p2.IPs {
-		ipSet[ip] = struct{}{}
+	return true
+}
+
+// diffElements returns the elements only present in new and the ones only
+// present in old.
+func diffElements(old, new []nftables.SetElement) (added, removed []nftables.SetElement) {
+	oldKeys := make(map[string]struct{})
+	for _, e := range old {
+		oldKeys[string(e.Key)] = struct{}{}
 	}
-	for _, ip := range p.IPs {
-		if _, ok := ipSet[ip]; !ok {
+	newKeys := make(map[string]struct{})
+	for _, e := range new {
+		newKeys[string(e.Key)] = struct{}{}
+		if _, ok := oldKeys[string(e.Key)]; !ok {
+			added = append(added, e)
+		}
+	}
+	for _, e := range old {
+		if _, ok := newKeys[string(e.Key)]; !ok {
+			removed = append(removed, e)
+		}
+	}
+	return
+}
+
+// updatePodNamedPorts replaces the named ports of an already-synced pod,
+// updating only the named port sets of rules selecting it. The pod's chains
+// and vmap entries do not depend on named ports and are left untouched.
+func (c *Controller) updatePodNamedPorts(p *Pod, namedPorts map[string]NamedPort) {
+	oldElems := make(map[*Rule][]nftables.SetElement)
+	for r := range p.ruleRefs {
+		if r.NamedPortSet != nil {
+			oldElems[r] = p.namedPortElements(r.NamedPortMeta)
+		}
+	}
+	p.NamedPorts = namedPorts
+	for r, old := range oldElems {
+		added, removed := diffElements(old, p.namedPortElements(r.NamedPortMeta))
+		if len(removed) > 0 {
+			c.nftConn.SetDeleteElements(r.NamedPortSet, removed)
+		}
+		if len(added) > 0 {
+			c.nftConn.SetAddElements(r.NamedPortSet, added)
+		}
+	}
+}
+
+// updatePodReady changes the readiness of an already-synced pod, updating
+// only the rules restricted to Ready peers.
+func (c *Controller) updatePodReady(p *Pod, ready bool) {
+	p.ready = ready
+	for r := range c.readyRules {
+		c.reevalPodInRule(p, r)
+	}
+}
+
+// addPodVmap adds the elements of p to the given verdict map. chain is the
+// pod's chain for the direction of the map. If it is nil, the pod is not
+// isolated in that direction and only gets accept elements if the base
+// chains would otherwise drop its traffic.
+func (c *Controller) addPodVmap(vmap *nfds.Set, p *Pod, chain *nfds.Chain) {
+	if chain == nil && !c.failClosed() {
+		return
+	}
+	if err := c.nftConn.SetAddElements(vmap, p.vmapElements(chain)); err != nil {
+		panic(err)
+	}
+}
+
+// delPodVmap deletes the elements added by addPodVmap.
+func (c *Controller) delPodVmap(vmap *nfds.Set, p *Pod, chain *nfds.Chain) {
+	if chain == nil && !c.failClosed() {
+		return
+	}
+	c.nftConn.SetDeleteElements(vmap, p.vmapElements(chain))
+}
+
+// claimVmapIPs registers p as a user of the verdict map keys of its IPs. If
+// another pod already uses one of them, a warning is emitted and the key is
+// shadowed for p, as conflicting verdict map elements would fail the whole
+// transaction. With interface-scoped verdict maps, pods can use the same IP
+// on different interfaces.
+func (c *Controller) claimVmapIPs(p *Pod, pod *corev1.Pod) {
+	for _, k := range p.vmapKeys() {
+		claims := c.vmapClaims[k]
+		if slices.Contains(claims, p) {
+			continue
+		}
+		if len(claims) == 0 && c.selfSet != nil {
+			c.nftConn.SetAddElements(c.selfSet, []nftables.SetElement{selfElement(k, c.cfg.IfaceResolver != nil)})
+		}
+		if len(claims) > 0 {
+			if p.shadowedKeys == nil {
+				p.shadowedKeys = make(map[vmapKey]struct{})
+			}
+			p.shadowedKeys[k] = struct{}{}
+			c.eventRecorder.Eventf(pod, corev1.EventTypeWarning, "DuplicateIP", "IP %v is also used by pod %s/%s, not policing it for this pod", k, claims[0].Namespace, claims[0].Name)
+		}
+		c.vmapClaims[k] = append(claims, p)
+	}
+}
+
+// releaseVmapIPs unregisters p as a user of the given verdict map keys. The
+// verdict map entries of keys owned by p are handed over to the next pod
+// using them, if any. The entries of p itself need to be deleted beforehand.
+func (c *Controller) releaseVmapIPs(p *Pod, keys []vmapKey) {
+	for _, k := range keys {
+		claims := c.vmapClaims[k]
+		i := slices.Index(claims, p)
+		if i == -1 {
+			continue
+		}
+		claims = slices.Delete(claims, i, i+1)
+		if len(claims) == 0 {
+			delete(c.vmapClaims, k)
+			if c.selfSet != nil {
+				c.nftConn.SetDeleteElements(c.selfSet, []nftables.SetElement{selfElement(k, c.cfg.IfaceResolver != nil)})
+			}
+			continue
+		}
+		c.vmapClaims[k] = claims
+		if i != 0 {
+			continue
+		}
+		next := claims[0]
+		delete(next.shadowedKeys, k)
+		klog.Infof("Pod %s/%s now owns IP %v", next.Namespace, next.Name, k)
+		if next.ingressChain != nil || c.failClosed() {
+			if e, ok := next.vmapElement(k.ip, next.ingressChain); ok {
+				c.nftConn.SetAddElements(c.vmapIng, []nftables.SetElement{e})
+			}
+		}
+		if next.egressChain != nil || c.failClosed() {
+			if e, ok := next.vmapElement(k.ip, next.egressChain); ok {
+				c.nftConn.SetAddElements(c.vmapEg, []nftables.SetElement{e})
+			}
+		}
+		if next.l2Chain != nil {
+			if e, ok := next.vmapElement(k.ip, next.l2Chain); ok {
+				c.nftConn.SetAddElements(c.vmapL2, []nftables.SetElement{e})
+			}
+		}
+	}
+}
+
+// PodIPs returns the IPs of all pods known to the controller in ascending
+// order. IPs of host-network pods are the ones of their node and excluded.
+func (c *Controller) PodIPs() []netip.Addr {
+	var ips []netip.Addr
+	for _, p := range c.pods {
+		if !p.hostNetwork {
+			ips = append(ips, p.IPs...)
+		}
+	}
+	slices.SortFunc(ips, netip.Addr.Compare)
+	return slices.Compact(ips)
+}
+
+// replaceVmapIPs transfers the claims of old to new for all verdict map keys
+// used by both, keeping their position.
+func (c *Controller) replaceVmapIPs(old, new *Pod) {
+	for _, k := range new.vmapKeys() {
+		claims := c.vmapClaims[k]
+		i := slices.Index(claims, old)
+		if i == -1 {
+			continue
+		}
+		claims[i] = new
+		if i != 0 {
+			if new.shadowedKeys == nil {
+				new.shadowedKeys = make(map[vmapKey]struct{})
+			}
+			new.shadowedKeys[k] = struct{}{}
+		}
+	}
+}
+
+// updatePodAddrs replaces the IPs, interface indexes and named ports of an
+// already-synced pod with the ones of updated. The pod's chains are kept, only
+// the set elements derived from its addresses are updated. This also covers
+// pods gaining their IPs after being isolated, as pending pods often do.
+func (c *Controller) updatePodAddrs(p, updated *Pod, pod *corev1.Pod) {
+	old := *p
+	var oldIng, oldEg []nftables.SetElement
+	if p.ingressChain != nil || c.failClosed() {
+		oldIng = old.vmapElements(p.ingressChain)
+	}
+	if p.egressChain != nil || c.failClosed() {
+		oldEg = old.vmapElements(p.egressChain)
+	}
+	var oldL2 []nftables.SetElement
+	if p.l2Chain != nil {
+		oldL2 = old.vmapElements(p.l2Chain)
+	}
+	for r := range p.ruleRefs {
+		c.delRulePodIPs(r, &old)
+	}
+	oldNamedPorts := make(map[*Rule][]nftables.SetElement)
+	for r := range p.ruleRefs {
+		if r.NamedPortSet != nil {
+			oldNamedPorts[r] = old.namedPortElements(r.NamedPortMeta)
+		}
+	}
+
+	var removedKeys []vmapKey
+	updatedKeys := updated.vmapKeys()
+	for _, k := range old.vmapKeys() {
+		if !slices.Contains(updatedKeys, k) {
+			removedKeys = append(removedKeys, k)
+			delete(p.shadowedKeys, k)
+		}
+	}
+	p.IPs, p.ifIndexes, p.NamedPorts = updated.IPs, updated.ifIndexes, updated.NamedPorts
+	c.claimVmapIPs(p, pod)
+
+	// Delete the entries of p before handing its IPs over to other pods
+	// using them, which reuse the same keys.
+	updateVmap := func(vmap *nfds.Set, old []nftables.SetElement, chain *nfds.Chain) []nftables.SetElement {
+		if chain == nil && !c.failClosed() {
+			return nil
+		}
+		added, removed := diffElements(old, p.vmapElements(chain))
+		if len(removed) > 0 {
+			c.nftConn.SetDeleteElements(vmap, removed)
+		}
+		return added
+	}
+	addedIng := updateVmap(c.vmapIng, oldIng, p.ingressChain)
+	addedEg := updateVmap(c.vmapEg, oldEg, p.egressChain)
+	var addedL2 []nftables.SetElement
+	if p.l2Chain != nil {
+		addedL2 = updateVmap(c.vmapL2, oldL2, p.l2Chain)
+	}
+	c.releaseVmapIPs(p, removedKeys)
+	if len(addedIng) > 0 {
+		c.nftConn.SetAddElements(c.vmapIng, addedIng)
+	}
+	if len(addedEg) > 0 {
+		c.nftConn.SetAddElements(c.vmapEg, addedEg)
+	}
+	if len(addedL2) > 0 {
+		c.nftConn.SetAddElements(c.vmapL2, addedL2)
+	}
+
+	for r := range p.ruleRefs {
+		c.addRulePodIPs(r, p)
+	}
+	for r, old := range oldNamedPorts {
+		added, removed := diffElements(old, p.namedPortElements(r.NamedPortMeta))
+		if len(removed) > 0 {
+			c.nftConn.SetDeleteElements(r.NamedPortSet, removed)
+		}
+		if len(added) > 0 {
+			c.nftConn.SetAddElements(r.NamedPortSet, added)
+		}
+	}
+}
+
+// addPodIngressChain creates the ingress chain of p, isolating it for
+// ingress, if it does not exist yet.
+func (c *Controller) addPodIngressChain(p *Pod) {
+	if p.ingressChain != nil {
+		return
+	}
+	p.ingressChain = c.nftConn.AddChain(&nfds.Chain{
+		Name:  fmt.Sprintf("pod_%s_ing", p.ID),
+		Table: c.table,
+		Type:  nftables.ChainTypeFilter,
+	})
+	// Reject everything not permitted directly by a network policy or
+	// related to a connection permitted by it.
+	p.ingressTerminal = c.addRejectRules(p.ingressChain)
+	p.ingressAudit = false
+	for nwp := range p.egressPolicyRefs {
+		c.addPodReplyJump(p.ingressChain, p.ingressReplyRefs, dirIngress, nwp)
+	}
+	c.delPodVmap(c.vmapIng, p, nil)
+	c.addPodVmap(c.vmapIng, p, p.ingressChain)
+}
+
+// addPodEgressChain creates the egress chain of p, isolating it for egress,
+// if it does not exist yet.
+func (c *Controller) addPodEgressChain(p *Pod) {
+	if p.egressChain != nil {
+		return
+	}
+	p.egressChain = c.nftConn.AddChain(&nfds.Chain{
+		Name:  fmt.Sprintf("pod_%s_eg", p.ID),
+		Table: c.table,
+		Type:  nftables.ChainTypeFilter,
+	})
+	if c.cfg.AllowMulticast {
+		// Ingress chains do not need this rule as the verdict map entries
+		// pointing to them only match unicast pod IPs.
+		c.addMulticastAcceptRule(p.egressChain)
+	}
+	// Reject everything not permitted directly by a network policy or
+	// related to a connection permitted by it.
+	p.egressTerminal = c.addRejectRules(p.egressChain)
+	p.egressAudit = false
+	for nwp := range p.ingressPolicyRefs {
+		c.addPodReplyJump(p.egressChain, p.egressReplyRefs, dirEgress, nwp)
+	}
+	c.delPodVmap(c.vmapEg, p, nil)
+	c.addPodVmap(c.vmapEg, p, p.egressChain)
+}
+
+// podAudited returns true if the chain of p for the direction with the given
+// policy references is only audited. This is the case if all policies
+// isolating p in that direction are audited.
+func podAudited(policyRefs map[*Policy]*nfds.Rule, defaultDeny bool) bool {
+	if defaultDeny || len(policyRefs) == 0 {
+		return false
+	}
+	for nwp := range policyRefs {
+		if !nwp.audit {
 			return false
 		}
 	}
 	return true
 }
 
+// updatePodTerminal replaces the terminal rules of ch if the audit mode
+// changed.
+func (c *Controller) updatePodTerminal(ch *nfds.Chain, terminal *[]*nfds.Rule, audit *bool, wantAudit bool) {
+	if ch == nil || *audit == wantAudit {
+		return
+	}
+	for _, r := range *terminal {
+		c.nftConn.DelRule(r)
+	}
+	if wantAudit {
+		*terminal = []*nfds.Rule{c.addAuditRule(ch)}
+	} else {
+		*terminal = c.addRejectRules(ch)
+	}
+	*audit = wantAudit
+}
+
+// updatePodModes updates the terminal rules of the chains of p according to
+// the modes of the policies selecting it.
+func (c *Controller) updatePodModes(p *Pod) {
+	c.updatePodTerminal(p.ingressChain, &p.ingressTerminal, &p.ingressAudit, podAudited(p.ingressPolicyRefs, p.defaultDenyIngress))
+	c.updatePodTerminal(p.egressChain, &p.egressTerminal, &p.egressAudit, podAudited(p.egressPolicyRefs, p.defaultDenyEgress))
+}
+
+// addPodDefaultDeny isolates p in the directions it is default denied in.
+func (c *Controller) addPodDefaultDeny(p *Pod) {
+	if p.defaultDenyIngress {
+		c.addPodIngressChain(p)
+	}
+	if p.defaultDenyEgress {
+		c.addPodEgressChain(p)
+	}
+}
+
+// jumpExprs returns the expressions of the rule jumping from the pod chain of
+// the given direction to the policy chain chainName.
+func (nwp *Policy) jumpExprs(dir direction, chainName string) []expr.Any {
+	var exprs []expr.Any
+	if nwp.ifaceGroup != 0 {
+		// The pod interface is the output interface for ingress
+		key := expr.MetaKeyOIFGROUP
+		if dir == dirEgress {
+			key = expr.MetaKeyIIFGROUP
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: key, Register: newRegOffset + 0},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: binaryutil.NativeEndian.PutUint32(nwp.ifaceGroup)},
+		)
+	}
+	return append(exprs, &expr.Verdict{Kind: expr.VerdictJump, Chain: chainName})
+}
+
+// addPodNWP adds jumps to the chains of nwp to the chains of p if nwp selects
+// p. They are inserted at the head of the chains to stay in front of the
+// terminal rules, which is a constant-time operation independent of the
+// number of policies selecting p. Their order does not matter, as policies
+// are additive: a policy chain either accepts or returns to the pod chain.
+// All of them have to be evaluated in the worst case, so they cannot be
+// replaced by a single verdict map lookup, but only the first packet of a
+// connection traverses them.
 func (c *Controller) addPodNWP(p *Pod, nwp *Policy) {
 	if nwp.Namespace != p.Namespace || !nwp.PodSelector.Matches(p.Labels) {
 		return
 	}
+	if c.nftConn.Tracing() {
+		defer c.traceScope(fmt.Sprintf("pod %s/%s selected by policy %s/%s", p.Namespace, p.Name, nwp.Namespace, nwp.Name))()
+	}
 	if nwp.ingressChain != nil {
-		if p.ingressChain == nil {
-			p.ingressChain = c.nftConn.AddChain(&nfds.Chain{
-				Name:  fmt.Sprintf("pod_%s_ing", p.ID),
-				Table: c.table,
-				Type:  nftables.ChainTypeFilter,
-			})
-			c.nftConn.AddRule(&nfds.Rule{
-				Table: c.table,
-				Chain: p.ingressChain,
-				Exprs: []expr.Any{
-					// Reject everything not permitted directly by a network policy or
-					// related to a connection permitted by it.
-					rejectAdministrative(),
-				},
-			})
-			if err := c.nftConn.SetAddElements(c.vmapIng, p.vmapElements(p.ingressChain)); err != nil {
-				panic(err)
-			}
-		}
+		c.addPodIngressChain(p)
 		p.ingressPolicyRefs[nwp] = c.nftConn.InsertRule(&nfds.Rule{
 			Table: c.table,
 			Chain: p.ingressChain,
-			Exprs: []expr.Any{
-				&expr.Verdict{Kind: expr.VerdictJump, Chain: nwp.ingressChain.Name},
-			},
+			Exprs: nwp.jumpExprs(dirIngress, nwp.ingressChain.Name),
 		})
+		c.addPodReplyJump(p.egressChain, p.egressReplyRefs, dirEgress, nwp)
 		nwp.podRefs[p] = struct{}{}
 	}
 	if nwp.egressChain != nil {
-		if p.egressChain == nil {
-			p.egressChain = c.nftConn.AddChain(&nfds.Chain{
-				Name:  fmt.Sprintf("pod_%s_eg", p.ID),
-				Table: c.table,
-				Type:  nftables.ChainTypeFilter,
-			})
-			c.nftConn.AddRule(&nfds.Rule{
-				Table: c.table,
-				Chain: p.egressChain,
-				Exprs: []expr.Any{
-					// Reject everything not permitted directly by a network policy or
-					// related to a connection permitted by it.
-					rejectAdministrative(),
-				},
-			})
-
-			if err := c.nftConn.SetAddElements(c.vmapEg, p.vmapElements(p.egressChain)); err != nil {
-				panic(err)
-			}
-		}
+		c.addPodEgressChain(p)
 		p.egressPolicyRefs[nwp] = c.nftConn.InsertRule(&nfds.Rule{
 			Table: c.table,
 			Chain: p.egressChain,
-			Exprs: []expr.Any{
-				&expr.Verdict{Kind: expr.VerdictJump, Chain: nwp.egressChain.Name},
-			},
+			Exprs: nwp.jumpExprs(dirEgress, nwp.egressChain.Name),
 		})
+		c.addPodReplyJump(p.ingressChain, p.ingressReplyRefs, dirIngress, nwp)
 		nwp.podRefs[p] = struct{}{}
 	}
+	c.updatePodModes(p)
 }
 
 func (c *Controller) removePodNWP(p *Pod, nwp *Policy) {
@@ -174,10 +675,14 @@ func (c *Controller) removePodNWP(p *Pod, nwp *Policy) {
 	if ok {
 		delete(p.ingressPolicyRefs, nwp)
 	}
-	if len(p.ingressPolicyRefs) == 0 && p.ingressChain != nil {
-		c.nftConn.SetDeleteElements(c.vmapIng, p.vmapElements(p.ingressChain))
+	c.delPodReplyJump(p.egressReplyRefs, nwp)
+	if len(p.ingressPolicyRefs) == 0 && p.ingressChain != nil && !p.defaultDenyIngress {
+		c.delPodVmap(c.vmapIng, p, p.ingressChain)
 		c.nftConn.DelChain(p.ingressChain)
 		p.ingressChain = nil
+		// The reply jumps are gone with the chain
+		clear(p.ingressReplyRefs)
+		c.addPodVmap(c.vmapIng, p, nil)
 	}
 
 	r, ok = p.egressPolicyRefs[nwp]
@@ -187,16 +692,26 @@ func (c *Controller) removePodNWP(p *Pod, nwp *Policy) {
 	if ok {
 		delete(p.egressPolicyRefs, nwp)
 	}
-	if len(p.egressPolicyRefs) == 0 && p.egressChain != nil {
-		c.nftConn.SetDeleteElements(c.vmapEg, p.vmapElements(p.egressChain))
+	c.delPodReplyJump(p.ingressReplyRefs, nwp)
+	if len(p.egressPolicyRefs) == 0 && p.egressChain != nil && !p.defaultDenyEgress {
+		c.delPodVmap(c.vmapEg, p, p.egressChain)
 		c.nftConn.DelChain(p.egressChain)
 		p.egressChain = nil
+		clear(p.egressReplyRefs)
+		c.addPodVmap(c.vmapEg, p, nil)
 	}
+	c.updatePodModes(p)
 }
 
 func (c *Controller) ruleSelectsPod(r *Rule, p *Pod) bool {
+	if r.readyPeers && !p.ready {
+		return false
+	}
 	for _, sel := range r.PodSelectors {
 		if sel.Matches(p, r.Namespace, c.namespaces) {
+			if p.hostNetwork {
+				return c.selectHostNetworkPeer(r, p)
+			}
 			return true
 		}
 	}
@@ -204,13 +719,40 @@ func (c *Controller) ruleSelectsPod(r *Rule, p *Pod) bool {
 	return len(r.PodSelectors) == 0 && r.NamedPortSet != nil
 }
 
+// selectHostNetworkPeer is called if a peer selector of r matches a
+// host-network pod. As the pod has the IPs of its node, selecting it permits
+// all traffic of the node and every other host-network pod on it, so this is
+// reported the first time the policy matches the pod. It returns whether the
+// pod is selected.
+func (c *Controller) selectHostNetworkPeer(r *Rule, p *Pod) bool {
+	policyName := cache.MetaObjectToName(r.policy)
+	podName := cache.ObjectName{Namespace: p.Namespace, Name: p.Name}
+	reported := c.hostNetworkPeers[policyName]
+	_, wasReported := reported[podName]
+	if !wasReported {
+		if reported == nil {
+			reported = make(map[cache.ObjectName]struct{})
+			c.hostNetworkPeers[policyName] = reported
+		}
+		reported[podName] = struct{}{}
+	}
+	if c.cfg.ExcludeHostNetworkPeers {
+		if !wasReported {
+			c.eventRecorder.Eventf(r.policy, corev1.EventTypeNormal, "HostNetworkPeerExcluded", "peer selector matches host-network pod %s/%s, which is excluded from peers", p.Namespace, p.Name)
+		}
+		return false
+	}
+	if !wasReported {
+		c.eventRecorder.Eventf(r.policy, corev1.EventTypeWarning, "HostNetworkPeer", "peer selector matches host-network pod %s/%s, permitting all traffic from its node IPs %v", p.Namespace, p.Name, p.IPs)
+	}
+	return true
+}
+
 func (c *Controller) addPodRule(r *Rule, p *Pod) {
 	if c.ruleSelectsPod(r, p) {
 		p.ruleRefs[r] = struct{}{}
 		r.podRefs[p] = struct{}{}
-		if r.PodIPSet != nil {
-			c.nftConn.SetAddElements(r.PodIPSet, p.ipElements())
-		}
+		c.addRulePodIPs(r, p)
 		if r.NamedPortSet != nil {
 			c.nftConn.SetAddElements(r.NamedPortSet, p.namedPortElements(r.NamedPortMeta))
 		}
@@ -218,16 +760,16 @@ func (c *Controller) addPodRule(r *Rule, p *Pod) {
 }
 
 func (c *Controller) deletePod(p *Pod) {
+	c.delPodVmap(c.vmapIng, p, p.ingressChain)
 	if p.ingressChain != nil {
-		c.nftConn.SetDeleteElements(c.vmapIng, p.vmapElements(p.ingressChain))
 		c.nftConn.DelChain(p.ingressChain)
 	}
 	for nwp := range p.ingressPolicyRefs {
 		delete(nwp.podRefs, p)
 	}
 
+	c.delPodVmap(c.vmapEg, p, p.egressChain)
 	if p.egressChain != nil {
-		c.nftConn.SetDeleteElements(c.vmapEg, p.vmapElements(p.egressChain))
 		c.nftConn.DelChain(p.egressChain)
 	}
 	for nwp := range p.egressPolicyRefs {
@@ -235,20 +777,33 @@ func (c *Controller) deletePod(p *Pod) {
 	}
 	for r := range p.ruleRefs {
 		delete(r.podRefs, p)
-		if r.PodIPSet != nil {
-			c.nftConn.SetDeleteElements(r.PodIPSet, p.ipElements())
-		}
+		c.delRulePodIPs(r, p)
 		if r.NamedPortSet != nil {
 			c.nftConn.SetDeleteElements(r.NamedPortSet, p.namedPortElements(r.NamedPortMeta))
 		}
 	}
+	c.deletePodL2Chain(p)
+	c.releaseVmapIPs(p, p.vmapKeys())
 }
 
 func (c *Controller) SetPod(name cache.ObjectName, pod *corev1.Pod) {
+	if c.nftConn.Tracing() {
+		defer c.traceScope(fmt.Sprintf("pod %v", name))()
+	}
 	syncedPod := c.pods[name]
+	if pod == nil {
+		delete(c.unresolvedIfaces, name)
+	}
 	switch {
 	case syncedPod == nil && pod != nil:
 		p := c.normalizePod(pod)
+		c.reportWarnings(pod, p, nil)
+		c.resolvePodIfaces(name, p, pod, nil)
+		c.claimVmapIPs(p, pod)
+		c.addPodVmap(c.vmapIng, p, nil)
+		c.addPodVmap(c.vmapEg, p, nil)
+		c.addPodL2Chain(p)
+		c.addPodDefaultDeny(p)
 		for _, nwp := range c.nwps {
 			c.addPodNWP(p, nwp)
 		}
@@ -256,18 +811,50 @@ func (c *Controller) SetPod(name cache.ObjectName, pod *corev1.Pod) {
 			c.addPodRule(r, p)
 		}
 		c.pods[name] = p
+		c.indexPod(p)
 	case syncedPod != nil && pod == nil:
 		c.deletePod(syncedPod)
 		delete(c.pods, name)
+		c.unindexPod(syncedPod)
+		if syncedPod.hostNetwork {
+			for _, reported := range c.hostNetworkPeers {
+				delete(reported, name)
+			}
+		}
 	case syncedPod != nil && pod != nil:
 		// Update Pod
 		p := c.normalizePod(pod)
+		c.reportWarnings(pod, p, syncedPod)
+		// The synced pod is kept if nothing else changed
+		syncedPod.warnings = p.warnings
+		c.resolvePodIfaces(name, p, pod, syncedPod)
 		if p.SemanticallyEqual(syncedPod) {
 			return // Nothing to do
 		}
+		if p.ready != syncedPod.ready {
+			c.updatePodReady(syncedPod, p.ready)
+			if p.SemanticallyEqual(syncedPod) {
+				return
+			}
+		}
+		if p.equalIgnoringNamedPorts(syncedPod) {
+			c.updatePodNamedPorts(syncedPod, p.NamedPorts)
+			return
+		}
+		if p.equalIgnoringAddrs(syncedPod) {
+			c.updatePodAddrs(syncedPod, p, pod)
+			return
+		}
 		// Recreate, we curently cannot intelligently update
+		c.replaceVmapIPs(syncedPod, p)
 		c.deletePod(syncedPod)
 		delete(c.pods, name)
+		c.unindexPod(syncedPod)
+		c.claimVmapIPs(p, pod)
+		c.addPodVmap(c.vmapIng, p, nil)
+		c.addPodVmap(c.vmapEg, p, nil)
+		c.addPodL2Chain(p)
+		c.addPodDefaultDeny(p)
 		for _, nwp := range c.nwps {
 			c.addPodNWP(p, nwp)
 		}
@@ -275,17 +862,142 @@ func (c *Controller) SetPod(name cache.ObjectName, pod *corev1.Pod) {
 			c.addPodRule(r, p)
 		}
 		c.pods[name] = p
+		c.indexPod(p)
 	case syncedPod == nil && pod == nil:
 		// Nothing to do
 	}
 }
 
+// resolvePodIfaces sets the interface indexes of the IPs of p if the verdict
+// maps are interface-scoped. The indexes of IPs of prev, the previous state
+// of the same pod, are kept, so only new IPs and ones which failed to resolve
+// before are resolved. Failures are reported, the pod is retried when it is
+// set again.
+func (c *Controller) resolvePodIfaces(name cache.ObjectName, p *Pod, pod *corev1.Pod, prev *Pod) {
+	if c.cfg.IfaceResolver == nil {
+		return
+	}
+	if prev != nil && prev.ID != p.ID {
+		prev = nil
+	}
+	p.ifIndexes = make(map[netip.Addr]uint32)
+	for _, ip := range p.IPs {
+		if prev != nil {
+			if ifIndex, ok := prev.ifIndexes[ip]; ok {
+				p.ifIndexes[ip] = ifIndex
+				continue
+			}
+		}
+		ifIndex, err := c.cfg.IfaceResolver(pod, ip)
+		if err != nil {
+			c.eventRecorder.Eventf(pod, corev1.EventTypeWarning, "InterfaceUnresolved", "interface of IP %v cannot be resolved, not policing it: %v", ip, err)
+			continue
+		}
+		p.ifIndexes[ip] = ifIndex
+	}
+	if len(p.ifIndexes) < len(p.IPs) {
+		c.unresolvedIfaces[name] = struct{}{}
+	} else {
+		delete(c.unresolvedIfaces, name)
+	}
+}
+
+// IfacesUnresolved returns true if the pod with the given name has IPs whose
+// interface could not be resolved.
+func (c *Controller) IfacesUnresolved(name cache.ObjectName) bool {
+	_, ok := c.unresolvedIfaces[name]
+	return ok
+}
+
+// UnresolvedIfacePods returns the pods with IPs whose interface could not be
+// resolved, sorted by name. They need to be set again to retry resolving
+// them.
+func (c *Controller) UnresolvedIfacePods() []cache.ObjectName {
+	var out []cache.ObjectName
+	for name := range c.unresolvedIfaces {
+		out = append(out, name)
+	}
+	slices.SortFunc(out, func(a, b cache.ObjectName) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+	return out
+}
+
+// podLabels returns the labels of pod matched by selectors, which include
+// pseudo-labels for the annotations in SelectorAnnotations. Labels of the pod
+// using the keys of pseudo-labels are dropped, so they cannot be used to
+// impersonate an annotation which can only be set by trusted parties.
+func (c *Controller) podLabels(pod *corev1.Pod) labels.Set {
+	out := pod.Labels
+	copied := false
+	copyLabels := func() {
+		if !copied {
+			// Do not modify the labels in the informer cache
+			out = make(labels.Set, len(pod.Labels)+len(c.cfg.SelectorAnnotations))
+			maps.Copy(out, pod.Labels)
+			copied = true
+		}
+	}
+	for key := range pod.Labels {
+		if isAnnotationLabelKey(key) {
+			copyLabels()
+			delete(out, key)
+		}
+	}
+	for _, key := range c.cfg.SelectorAnnotations {
+		value, ok := pod.Annotations[key]
+		if !ok {
+			continue
+		}
+		copyLabels()
+		out[AnnotationLabelKey(key)] = value
+	}
+	return out
+}
+
+// podReady returns true if pod has the Ready condition.
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podIPs returns the IPs of pod. Some components only set the legacy PodIP
+// field, which is used if PodIPs is empty. Otherwise, PodIPs takes precedence
+// as its first entry should be identical to PodIP.
+func podIPs(pod *corev1.Pod) []corev1.PodIP {
+	if len(pod.Status.PodIPs) == 0 {
+		if pod.Status.PodIP == "" {
+			return nil
+		}
+		return []corev1.PodIP{{IP: pod.Status.PodIP}}
+	}
+	if pod.Status.PodIP != "" && pod.Status.PodIPs[0].IP != pod.Status.PodIP {
+		klog.V(2).Infof("PodIP %q of pod %s/%s differs from first PodIPs entry %q, using PodIPs", pod.Status.PodIP, pod.Namespace, pod.Name, pod.Status.PodIPs[0].IP)
+	}
+	return pod.Status.PodIPs
+}
+
 func (c *Controller) normalizePod(pod *corev1.Pod) *Pod {
 	var p Pod
 	p.Namespace = pod.Namespace
-	p.ID = objectID(&pod.ObjectMeta)
-	p.Labels = pod.Labels
-	for _, ip := range pod.Status.PodIPs {
+	p.Name = pod.Name
+	p.ID = objectID(&pod.ObjectMeta, c.cfg.ReadableIDs)
+	p.Labels = c.podLabels(pod)
+	p.hostNetwork = pod.Spec.HostNetwork
+	p.ready = !c.cfg.ReadyPeers || podReady(pod)
+	p.defaultDenyIngress = c.cfg.DefaultDenyIngress != nil && c.cfg.DefaultDenyIngress.Matches(p.Labels)
+	p.defaultDenyEgress = c.cfg.DefaultDenyEgress != nil && c.cfg.DefaultDenyEgress.Matches(p.Labels)
+	if c.cfg.ElementComments {
+		p.comment = pod.Namespace + "/" + pod.Name
+	}
+	if c.cfg.L2AntiSpoofing {
+		p.setL2Addrs(pod)
+	}
+	for _, ip := range podIPs(pod) {
 		if pod.Status.Phase != corev1.PodRunning && pod.Status.Phase != corev1.PodPending {
 			continue
 		}
@@ -294,18 +1006,47 @@ func (c *Controller) normalizePod(pod *corev1.Pod) *Pod {
 			klog.Warningf("Failed to parse IP %q of pod %q: %v", ip.IP, p.ID, err)
 			continue
 		}
+		// Zones are meaningless in the forward hook and v4-mapped addresses
+		// are not used on the wire.
+		pIP = pIP.WithZone("").Unmap()
+		if pIP.IsLinkLocalUnicast() {
+			klog.V(4).Infof("Ignoring link-local IP %q of pod %q", ip.IP, p.ID)
+			continue
+		}
 		p.IPs = append(p.IPs, pIP)
 	}
 	p.NamedPorts = make(map[string]NamedPort)
 	p.ruleRefs = make(map[*Rule]struct{})
 	p.egressPolicyRefs = make(map[*Policy]*nfds.Rule)
 	p.ingressPolicyRefs = make(map[*Policy]*nfds.Rule)
-	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+	p.egressReplyRefs = make(map[*Policy]*nfds.Rule)
+	p.ingressReplyRefs = make(map[*Policy]*nfds.Rule)
+	// Ephemeral containers have their own type, but share the fields needed
+	// for named ports.
+	var ephemeralContainers []corev1.Container
+	for _, ec := range pod.Spec.EphemeralContainers {
+		ephemeralContainers = append(ephemeralContainers, corev1.Container{Name: ec.Name, Ports: ec.Ports})
+	}
+	initContainers := pod.Spec.InitContainers
+	if c.cfg.ExcludeInitContainerPorts {
+		initContainers = nil
+		for _, ic := range pod.Spec.InitContainers {
+			// Sidecars keep running alongside the regular containers
+			if ic.RestartPolicy != nil && *ic.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+				initContainers = append(initContainers, ic)
+			}
+		}
+	}
+	for i, containers := range [][]corev1.Container{pod.Spec.Containers, initContainers, ephemeralContainers} {
+		kind := "Container"
+		if i == 1 {
+			kind = "Init container"
+		}
 		for _, container := range containers {
 			for _, port := range container.Ports {
 				if port.Name != "" {
 					if port.ContainerPort > math.MaxUint16 {
-						c.eventRecorder.Eventf(pod, corev1.EventTypeWarning, "InvalidPort", "Container %v port %v is out of range, ignore", container.Name, port.ContainerPort)
+						p.warnf("InvalidPort", "Container %v port %v is out of range, ignore", container.Name, port.ContainerPort)
 						continue
 					}
 					var proto uint8 = unix.IPPROTO_TCP
@@ -319,10 +1060,20 @@ func (c *Controller) normalizePod(pod *corev1.Pod) *Pod {
 							continue
 						}
 					}
-					p.NamedPorts[port.Name] = NamedPort{
+					np := NamedPort{
 						Protocol: proto,
 						Port:     uint16(port.ContainerPort),
 					}
+					// Port names are only unique per container. Resolve
+					// conflicts deterministically by using the first port in
+					// the order of the pod spec.
+					if existing, ok := p.NamedPorts[port.Name]; ok {
+						if existing != np {
+							p.warnf("DuplicatePort", "%s %v port %v conflicts with another port of the same name, ignoring it", kind, container.Name, port.Name)
+						}
+						continue
+					}
+					p.NamedPorts[port.Name] = np
 				}
 			}
 		}
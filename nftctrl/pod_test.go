@@ -0,0 +1,1417 @@
+package nftctrl
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func testPod(ns, name string, labels map[string]string, ips ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: labels, UID: types.UID("uid-" + ns + "-" + name)},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+	}
+	return pod
+}
+
+func TestLegacyPodIP(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+	pod := testPod("default", "legacy", nil)
+	pod.Status.PodIP = "10.0.0.1"
+	c.SetPod(cache.MetaObjectToName(pod), pod)
+	mustFlush(t, c)
+
+	p := c.pods[cache.MetaObjectToName(pod)]
+	if len(p.IPs) != 1 || p.IPs[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("expected IP from PodIP, got %v", p.IPs)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected pod with only PodIP to be isolated, got %v", v)
+	}
+
+	// PodIPs takes precedence if both are set
+	pod.Status.PodIPs = []corev1.PodIP{{IP: "10.0.0.2"}, {IP: "fd00::2"}}
+	if ips := c.normalizePod(pod).IPs; len(ips) != 2 || ips[0] != netip.MustParseAddr("10.0.0.2") {
+		t.Errorf("expected IPs from PodIPs, got %v", ips)
+	}
+}
+
+func TestNormalizePodZonedAndLinkLocalIPs(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	pod := testPod("default", "test", nil, "10.0.0.1", "fd00::1%eth0", "fe80::1%eth0", "169.254.1.1")
+	p := c.normalizePod(pod)
+	expected := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}
+	if len(p.IPs) != len(expected) {
+		t.Fatalf("expected IPs %v, got %v", expected, p.IPs)
+	}
+	for i := range expected {
+		if p.IPs[i] != expected[i] {
+			t.Errorf("expected IP %v, got %v", expected[i], p.IPs[i])
+		}
+	}
+
+	// Make sure the elements are accepted by the (length-checking) backend
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "test"}, pod)
+	mustFlush(t, c)
+}
+
+func TestDuplicatePodIP(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{})
+	vmapIng := &nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, Name: "vmap_ing"}
+	expectJump := func(chain string) {
+		t.Helper()
+		elems, err := mem.GetSetElements(vmapIng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elems) != 1 || elems[0].VerdictData.Chain != chain {
+			t.Fatalf("expected a single element jumping to %q, got %v", chain, elems)
+		}
+	}
+
+	for _, ns := range []string{"a", "b"} {
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: ns, Name: "deny"}, denyAllPolicy(ns, "deny"))
+	}
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "first"}, testPod("a", "first", nil, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "b", Name: "second"}, testPod("b", "second", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	expectJump("pod_a_first_ing")
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "DuplicateIP") || !strings.Contains(events[0], "a/first") {
+		t.Errorf("expected a single DuplicateIP warning naming a/first, got %v", events)
+	}
+
+	// Updating the first pod must not hand over the IP
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "first"}, testPod("a", "first", map[string]string{"foo": "bar"}, "10.0.0.1"))
+	mustFlush(t, c)
+	expectJump("pod_a_first_ing")
+
+	// Deleting it must
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "first"}, nil)
+	mustFlush(t, c)
+	expectJump("pod_b_second_ing")
+
+	// So must changing the IP of the owner
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "first"}, testPod("a", "first", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	expectJump("pod_b_second_ing")
+	drainEvents(rec)
+	c.SetPod(cache.ObjectName{Namespace: "b", Name: "second"}, testPod("b", "second", nil, "10.0.0.2"))
+	mustFlush(t, c)
+	elems, err := mem.GetSetElements(vmapIng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chains := make(map[netip.Addr]string)
+	for _, e := range elems {
+		chains[netip.AddrFrom4([4]byte(e.Key))] = e.VerdictData.Chain
+	}
+	if len(chains) != 2 || chains[netip.MustParseAddr("10.0.0.1")] != "pod_a_first_ing" || chains[netip.MustParseAddr("10.0.0.2")] != "pod_b_second_ing" {
+		t.Errorf("expected 10.0.0.1 to be handed over to a/first, got %v", chains)
+	}
+}
+
+func TestInterfaceScopedDuplicateIP(t *testing.T) {
+	ifaces := map[string]uint32{"first": 2, "second": 3}
+	var resolved []string
+	c, mem, rec := newTestController(t, Config{
+		AllowSelfTraffic: true,
+		IfaceResolver: func(pod *corev1.Pod, ip netip.Addr) (uint32, error) {
+			resolved = append(resolved, pod.Name)
+			return ifaces[pod.Name], nil
+		},
+	})
+	table := &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}
+	expectJumps := func(expected map[uint32]string) {
+		t.Helper()
+		elems, err := mem.GetSetElements(&nftables.Set{Table: table, Name: "vmap_ing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[uint32]string)
+		for _, e := range elems {
+			if netip.AddrFrom4([4]byte(e.Key[4:])) != netip.MustParseAddr("10.0.0.1") {
+				t.Errorf("unexpected element %v", e)
+			}
+			got[binaryutil.NativeEndian.Uint32(e.Key[:4])] = e.VerdictData.Chain
+		}
+		if !maps.Equal(got, expected) {
+			t.Errorf("expected jumps %v by interface, got %v", expected, got)
+		}
+	}
+
+	for _, ns := range []string{"a", "b"} {
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: ns, Name: "deny"}, denyAllPolicy(ns, "deny"))
+	}
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "first"}, testPod("a", "first", nil, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "b", Name: "second"}, testPod("b", "second", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	if events := drainEvents(rec); len(events) != 0 {
+		t.Errorf("expected no events for the same IP on different interfaces, got %v", events)
+	}
+	expectJumps(map[uint32]string{2: "pod_a_first_ing", 3: "pod_b_second_ing"})
+
+	// Updates not changing the IPs do not resolve them again
+	resolved = nil
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "first"}, testPod("a", "first", map[string]string{"foo": "bar"}, "10.0.0.1"))
+	if len(resolved) != 0 {
+		t.Errorf("expected no interfaces to be resolved, got %v", resolved)
+	}
+
+	// The IP is still used by the second pod
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "first"}, nil)
+	mustFlush(t, c)
+	expectJumps(map[uint32]string{3: "pod_b_second_ing"})
+	if elems, err := mem.GetSetElements(&nftables.Set{Table: table, Name: "self_ips"}); err != nil || len(elems) != 1 {
+		t.Errorf("expected the self element of the IP to be kept, got %v (%v)", elems, err)
+	}
+
+	// The same IP on the same interface is a duplicate
+	ifaces["third"] = 3
+	c.SetPod(cache.ObjectName{Namespace: "a", Name: "third"}, testPod("a", "third", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	if events := drainEvents(rec); len(events) != 1 || !strings.Contains(events[0], "DuplicateIP") {
+		t.Errorf("expected a single DuplicateIP warning, got %v", events)
+	}
+	expectJumps(map[uint32]string{3: "pod_b_second_ing"})
+}
+
+func TestInterfaceScopedUnresolved(t *testing.T) {
+	var fail bool
+	c, mem, rec := newTestController(t, Config{
+		IfaceResolver: func(pod *corev1.Pod, ip netip.Addr) (uint32, error) {
+			if fail {
+				return 0, fmt.Errorf("no route to %v", ip)
+			}
+			return 2, nil
+		},
+	})
+	vmapIng := &nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, Name: "vmap_ing"}
+	name := cache.ObjectName{Namespace: "default", Name: "test"}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+
+	fail = true
+	c.SetPod(name, testPod("default", "test", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	if events := drainEvents(rec); len(events) != 1 || !strings.Contains(events[0], "Warning InterfaceUnresolved") {
+		t.Errorf("expected a single InterfaceUnresolved warning, got %v", events)
+	}
+	if pods := c.UnresolvedIfacePods(); !slices.Equal(pods, []cache.ObjectName{name}) || !c.IfacesUnresolved(name) {
+		t.Errorf("expected the pod to be unresolved, got %v", pods)
+	}
+	if elems, _ := mem.GetSetElements(vmapIng); len(elems) != 0 {
+		t.Errorf("expected no elements for unresolved IPs, got %v", elems)
+	}
+
+	// Setting the unchanged pod again retries resolving it
+	fail = false
+	c.SetPod(name, testPod("default", "test", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	if pods := c.UnresolvedIfacePods(); len(pods) != 0 || c.IfacesUnresolved(name) {
+		t.Errorf("expected no unresolved pods, got %v", pods)
+	}
+	if elems, _ := mem.GetSetElements(vmapIng); len(elems) != 1 || elems[0].VerdictData.Chain != "pod_default_test_ing" {
+		t.Errorf("expected an element jumping to the pod chain, got %v", elems)
+	}
+
+	fail = true
+	c.SetPod(name, testPod("default", "test", nil, "10.0.0.1", "10.0.0.2"))
+	mustFlush(t, c)
+	c.SetPod(name, nil)
+	mustFlush(t, c)
+	if pods := c.UnresolvedIfacePods(); len(pods) != 0 {
+		t.Errorf("expected deleted pods to be forgotten, got %v", pods)
+	}
+}
+
+// Pods are tracked by name and the workqueue never processes the same name
+// concurrently or out of order. Deleting and recreating a pod with the same
+// name thus results either in a delete followed by an add or, if both happen
+// before the name is processed, in a single update with the new pod.
+func TestPodRecreateSameName(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	vmapIng := &nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, Name: "vmap_ing"}
+	expectPodIP := func(ip string) {
+		t.Helper()
+		elems, err := mem.GetSetElements(vmapIng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(elems) != 1 || netip.AddrFrom4([4]byte(elems[0].Key)) != netip.MustParseAddr(ip) || elems[0].VerdictData.Chain != "pod_default_test_ing" {
+			t.Fatalf("expected a single element for %v, got %v", ip, elems)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", ip, 80)); v != verdictReject {
+			t.Errorf("expected traffic to %v to be rejected, got %v", ip, v)
+		}
+	}
+	name := cache.ObjectName{Namespace: "default", Name: "test"}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+	c.SetPod(name, testPod("default", "test", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	expectPodIP("10.0.0.1")
+
+	// Delete and recreate collapsed into an update
+	pod := testPod("default", "test", nil, "10.0.0.2")
+	pod.UID = "uid-2"
+	c.SetPod(name, pod)
+	mustFlush(t, c)
+	expectPodIP("10.0.0.2")
+
+	// Delete and recreate within a single transaction
+	c.SetPod(name, nil)
+	pod = testPod("default", "test", nil, "10.0.0.3")
+	pod.UID = "uid-3"
+	c.SetPod(name, pod)
+	mustFlush(t, c)
+	expectPodIP("10.0.0.3")
+
+	// Delete and recreate in separate transactions
+	c.SetPod(name, nil)
+	mustFlush(t, c)
+	pod = testPod("default", "test", nil, "10.0.0.4")
+	pod.UID = "uid-4"
+	c.SetPod(name, pod)
+	mustFlush(t, c)
+	expectPodIP("10.0.0.4")
+}
+
+// Pods are often isolated by a policy before they get their IPs. Address
+// changes are applied without recreating the pod's chains.
+func TestPodIPAddedAfterChainExists(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(80))}},
+			}},
+		},
+	})
+	server := cache.ObjectName{Namespace: "default", Name: "server"}
+	client := cache.ObjectName{Namespace: "default", Name: "client"}
+	pending := testPod("default", "server", map[string]string{"role": "server"})
+	pending.Status.Phase = corev1.PodPending
+	c.SetPod(server, pending)
+	c.SetPod(client, testPod("default", "client", map[string]string{"role": "client"}))
+	mustFlush(t, c)
+	chain := &nftables.Chain{Table: &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}, Name: "pod_default_server_ing"}
+	before, err := mem.GetRules(chain.Table, chain)
+	if err != nil {
+		t.Fatalf("expected chain of pending pod to exist: %v", err)
+	}
+
+	expect := func(src, dst string, port uint16, want testVerdict) {
+		t.Helper()
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(src, dst, port)); v != want {
+			t.Errorf("connection %v -> %v:%d: expected %v, got %v", src, dst, port, want, v)
+		}
+	}
+	c.SetPod(server, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1", "fd00::1"))
+	c.SetPod(client, testPod("default", "client", map[string]string{"role": "client"}, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+	expect("10.0.0.2", "10.0.0.1", 80, verdictAccept)
+	expect("fd00::2", "fd00::1", 80, verdictAccept)
+	expect("10.0.0.2", "10.0.0.1", 81, verdictReject)
+	expect("10.0.0.3", "10.0.0.1", 80, verdictReject)
+	after, err := mem.GetRules(chain.Table, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != len(after) || before[0].Handle != after[0].Handle {
+		t.Errorf("expected chain to be kept, rules changed from %v to %v", before, after)
+	}
+
+	// Changing IPs removes the old ones
+	c.SetPod(server, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.4"))
+	c.SetPod(client, testPod("default", "client", map[string]string{"role": "client"}, "10.0.0.5"))
+	mustFlush(t, c)
+	expect("10.0.0.5", "10.0.0.4", 80, verdictAccept)
+	expect("10.0.0.5", "10.0.0.4", 81, verdictReject)
+	expect("10.0.0.2", "10.0.0.4", 80, verdictReject)
+	expect("10.0.0.5", "10.0.0.1", 81, verdictAccept)
+	expect("fd00::2", "fd00::1", 81, verdictAccept)
+}
+
+// Completed pods keep their IPs in the status until they are deleted, but the
+// IPs may already be reused by new pods.
+func TestCompletedPodReleasesIPs(t *testing.T) {
+	for _, phase := range []corev1.PodPhase{corev1.PodSucceeded, corev1.PodFailed} {
+		c, mem, _ := newTestController(t, Config{})
+		deny := denyAllPolicy("default", "deny")
+		deny.Spec.PolicyTypes = []nwkv1.PolicyType{nwkv1.PolicyTypeIngress}
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, deny)
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "job"}}}},
+				}},
+			},
+		})
+		job := cache.ObjectName{Namespace: "default", Name: "job"}
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1", "fd00::1"))
+		c.SetPod(job, testPod("default", "job", map[string]string{"role": "job"}, "10.0.0.2", "fd00::2"))
+		mustFlush(t, c)
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictAccept {
+			t.Fatalf("%v: expected running job to reach server, got %v", phase, v)
+		}
+
+		completed := testPod("default", "job", map[string]string{"role": "job"}, "10.0.0.2", "fd00::2")
+		completed.Status.Phase = phase
+		c.SetPod(job, completed)
+		mustFlush(t, c)
+		for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+			for _, vmap := range []string{"vmap_ing", "vmap_eg"} {
+				elems, err := mem.GetSetElements(&nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: fam}, Name: vmap})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, e := range elems {
+					if e.VerdictData.Chain == "pod_default_job_ing" || e.VerdictData.Chain == "pod_default_job_eg" {
+						t.Errorf("%v: expected no %s elements of completed pod, got %v", phase, vmap, e)
+					}
+				}
+			}
+		}
+		for _, src := range []string{"10.0.0.2", "fd00::2"} {
+			dst := "10.0.0.1"
+			if src == "fd00::2" {
+				dst = "fd00::1"
+			}
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(src, dst, 80)); v != verdictReject {
+				t.Errorf("%v: expected IP %v of completed job to be removed from peers, got %v", phase, src, v)
+			}
+		}
+
+		// A new pod reusing the IP gets it immediately
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "next"}, testPod("default", "next", map[string]string{"role": "job"}, "10.0.0.2"))
+		mustFlush(t, c)
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictAccept {
+			t.Errorf("%v: expected new pod reusing the IP to reach server, got %v", phase, v)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "10.0.0.2", 80)); v != verdictReject {
+			t.Errorf("%v: expected new pod reusing the IP to be isolated, got %v", phase, v)
+		}
+	}
+}
+
+// Pods are only isolated in the directions of the policies selecting them.
+// Non-isolated directions have no per-pod chain and no verdict map element,
+// so their traffic falls through the base chains and is accepted.
+func TestDefaultOpen(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "ingress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ingress"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1", "fd00::1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", nil, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+
+	for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		chains, err := mem.ListChainsOfTableFamily(fam)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var podChains []string
+		for _, ch := range chains {
+			if strings.HasPrefix(ch.Name, "pod_") {
+				podChains = append(podChains, ch.Name)
+			}
+		}
+		if len(podChains) != 1 || podChains[0] != "pod_default_server_ing" {
+			t.Errorf("family %v: expected only the ingress chain of the server, got %v", fam, podChains)
+		}
+		for vmap, want := range map[string]int{"vmap_ing": 1, "vmap_eg": 0} {
+			elems, err := mem.GetSetElements(&nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: fam}, Name: vmap})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(elems) != want {
+				t.Errorf("family %v: expected %d elements in %s, got %v", fam, want, vmap, elems)
+			}
+		}
+	}
+
+	for _, conn := range []struct {
+		src, dst string
+		want     testVerdict
+	}{
+		{"10.0.0.2", "10.0.0.1", verdictReject},
+		{"fd00::2", "fd00::1", verdictReject},
+		// Egress of the server is not isolated
+		{"10.0.0.1", "10.0.0.2", verdictAccept},
+		{"10.0.0.1", "192.0.2.1", verdictAccept},
+		{"fd00::1", "2001:db8::1", verdictAccept},
+		// Neither direction of the client is isolated
+		{"192.0.2.1", "10.0.0.2", verdictAccept},
+		{"10.0.0.2", "192.0.2.1", verdictAccept},
+		{"2001:db8::1", "fd00::2", verdictAccept},
+	} {
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(conn.src, conn.dst, 80)); v != conn.want {
+			t.Errorf("connection %v -> %v: expected %v, got %v", conn.src, conn.dst, conn.want, v)
+		}
+	}
+}
+
+func TestDuplicateNamedPorts(t *testing.T) {
+	c, _, rec := newTestController(t, Config{})
+	pod := testPod("default", "test", nil, "10.0.0.1")
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "a", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+		{Name: "b", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 9090}, {Name: "metrics", ContainerPort: 9100}}},
+	}
+	// Identical ports are not a conflict
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "init", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP}}},
+	}
+	name := cache.ObjectName{Namespace: "default", Name: "test"}
+	for range 2 {
+		c.SetPod(name, pod)
+		p := c.pods[name]
+		if np := p.NamedPorts["http"]; np.Port != 8080 {
+			t.Errorf("expected first port 8080 to win, got %d", np.Port)
+		}
+		if np := p.NamedPorts["metrics"]; np.Port != 9100 {
+			t.Errorf("expected metrics port 9100, got %d", np.Port)
+		}
+	}
+	events := drainEvents(rec)
+	if len(events) != 1 || !strings.Contains(events[0], "DuplicatePort") || !strings.Contains(events[0], "Container b port http") {
+		t.Errorf("expected a single DuplicatePort event for container b, got %v", events)
+	}
+
+	// The conflict is reported again once it reappears
+	resolved := pod.DeepCopy()
+	resolved.Spec.Containers[1].Ports[0].Name = "alt"
+	c.SetPod(name, resolved)
+	c.SetPod(name, pod)
+	if events := drainEvents(rec); len(events) != 1 || !strings.Contains(events[0], "DuplicatePort") {
+		t.Errorf("expected a DuplicatePort event for the reappearing conflict, got %v", events)
+	}
+}
+
+func TestInitContainerNamedPorts(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	pod := testPod("default", "test", nil, "10.0.0.1")
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+	}
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "setup", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 9090}, {Name: "setup", ContainerPort: 9000}}},
+		{Name: "proxy", RestartPolicy: &always, Ports: []corev1.ContainerPort{{Name: "proxy", ContainerPort: 15001}}},
+	}
+	for _, exclude := range []bool{false, true} {
+		c, _, _ := newTestController(t, Config{ExcludeInitContainerPorts: exclude})
+		p := c.normalizePod(pod)
+		if np := p.NamedPorts["http"]; np.Port != 8080 {
+			t.Errorf("exclude %v: expected regular container port http to win, got %d", exclude, np.Port)
+		}
+		if np := p.NamedPorts["proxy"]; np.Port != 15001 {
+			t.Errorf("exclude %v: expected sidecar port proxy to be included, got %d", exclude, np.Port)
+		}
+		_, hasSetup := p.NamedPorts["setup"]
+		if hasSetup == exclude {
+			t.Errorf("exclude %v: expected init container port setup to be included %v, got %v", exclude, !exclude, hasSetup)
+		}
+		switch w := p.warnings; {
+		case exclude && len(w) != 0:
+			t.Errorf("expected no warnings for excluded init container ports, got %v", w)
+		case !exclude && (len(w) != 1 || w[0].reason != "DuplicatePort" || !strings.Contains(w[0].message, "Init container setup port http")):
+			t.Errorf("expected a DuplicatePort warning for the init container, got %v", w)
+		}
+	}
+}
+
+func TestEphemeralContainerNamedPorts(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	pod := testPod("default", "test", nil, "10.0.0.1")
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+	}
+	// Injecting an ephemeral container changes the pod
+	before := c.normalizePod(pod)
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:  "debugger",
+			Ports: []corev1.ContainerPort{{Name: "debug", ContainerPort: 2345}, {Name: "http", ContainerPort: 9090}},
+		},
+	}}
+	p := c.normalizePod(pod)
+	if np := p.NamedPorts["debug"]; np != (NamedPort{Protocol: unix.IPPROTO_TCP, Port: 2345}) {
+		t.Errorf("expected ephemeral container port debug to be 2345/TCP, got %+v", np)
+	}
+	if np := p.NamedPorts["http"]; np.Port != 8080 {
+		t.Errorf("expected regular container port http to win, got %d", np.Port)
+	}
+	if before.SemanticallyEqual(p) {
+		t.Error("expected pod with additional ephemeral container port to differ")
+	}
+}
+
+func TestUpdatePodNamedPorts(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "egress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To:    []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromString("http"))}},
+			}},
+		},
+	})
+	name := cache.ObjectName{Namespace: "default", Name: "server"}
+	server := func(port int32) *corev1.Pod {
+		pod := testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1")
+		pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: port}}}}
+		return pod
+	}
+	c.SetPod(name, server(8080))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"role": "client"}, "10.0.0.2"))
+	mustFlush(t, c)
+	expect := func(port uint16, want testVerdict) {
+		t.Helper()
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", port)); v != want {
+			t.Errorf("connection to port %d: expected %v, got %v", port, want, v)
+		}
+	}
+	expect(8080, verdictAccept)
+	expect(9090, verdictReject)
+
+	// Only the named port elements are updated, the pod is not recreated
+	synced := c.pods[name]
+	c.SetPod(name, server(9090))
+	mustFlush(t, c)
+	if c.pods[name] != synced {
+		t.Error("expected pod with changed named ports to be updated in place")
+	}
+	if np := synced.NamedPorts["http"]; np.Port != 9090 {
+		t.Errorf("expected named port http to be updated to 9090, got %d", np.Port)
+	}
+	expect(8080, verdictReject)
+	expect(9090, verdictAccept)
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v, %v", orphans, err)
+	}
+}
+
+func TestDefaultDeny(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{DefaultDenyIngress: labels.SelectorFromSet(labels.Set{"app": "web"})})
+	web := cache.ObjectName{Namespace: "default", Name: "web"}
+	expect := func(dst string, port uint16, want testVerdict) {
+		t.Helper()
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", dst, port)); v != want {
+			t.Errorf("connection to %v:%d: expected %v, got %v", dst, port, want, v)
+		}
+	}
+	c.SetPod(web, testPod("default", "web", map[string]string{"app": "web"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "other"}, testPod("default", "other", nil, "10.0.0.2"))
+	mustFlush(t, c)
+	expect("10.0.0.1", 80, verdictReject)
+	expect("10.0.0.2", 80, verdictAccept)
+	// Egress is not default denied
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.1", "10.0.1.1", 80)); v != verdictAccept {
+		t.Errorf("expected egress to be accepted, got %v", v)
+	}
+
+	// Policies permit traffic as usual
+	port := intstr.FromInt32(80)
+	allow := cache.ObjectName{Namespace: "default", Name: "allow"}
+	c.SetNetworkPolicy(allow, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Ingress:     []nwkv1.NetworkPolicyIngressRule{{Ports: []nwkv1.NetworkPolicyPort{{Port: &port}}}},
+		},
+	})
+	mustFlush(t, c)
+	expect("10.0.0.1", 80, verdictAccept)
+	expect("10.0.0.1", 81, verdictReject)
+
+	// Removing the last policy keeps the pod isolated
+	c.SetNetworkPolicy(allow, nil)
+	mustFlush(t, c)
+	expect("10.0.0.1", 80, verdictReject)
+
+	// Relabeling the pod lifts the isolation
+	c.SetPod(web, testPod("default", "web", map[string]string{"app": "api"}, "10.0.0.1"))
+	mustFlush(t, c)
+	expect("10.0.0.1", 80, verdictAccept)
+}
+
+// chainJumps returns the chains jumped to by the rules of the IPv4 chain with
+// the given name in the ruleset of mem, or nil if it does not exist.
+func chainJumps(t *testing.T, mem *nfds.Memory, name string) []string {
+	t.Helper()
+	chains, err := mem.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(chains, func(ch *nftables.Chain) bool { return ch.Name == name })
+	if i == -1 {
+		return nil
+	}
+	rules, err := mem.GetRules(chains[i].Table, chains[i])
+	if err != nil {
+		t.Fatal(err)
+	}
+	jumps := []string{}
+	for _, r := range rules {
+		for _, e := range r.Exprs {
+			if v, ok := e.(*expr.Verdict); ok && v.Kind == expr.VerdictJump {
+				jumps = append(jumps, v.Chain)
+			}
+		}
+	}
+	slices.Sort(jumps)
+	return jumps
+}
+
+func TestPodRelabeledOutOfPolicy(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	port := intstr.FromInt32(80)
+	for _, sel := range []string{"web", "api"} {
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: sel}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: sel},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{sel: "true"}},
+				Ingress:     []nwkv1.NetworkPolicyIngressRule{{Ports: []nwkv1.NetworkPolicyPort{{Port: &port}}}},
+			},
+		})
+	}
+	name := cache.ObjectName{Namespace: "default", Name: "test"}
+	c.SetPod(name, testPod("default", "test", map[string]string{"web": "true", "api": "true"}, "10.0.0.1"))
+	mustFlush(t, c)
+	if jumps := chainJumps(t, mem, "pod_default_test_ing"); !slices.Equal(jumps, []string{"pol_default_api_ing", "pol_default_web_ing"}) {
+		t.Fatalf("expected jumps to both policies, got %v", jumps)
+	}
+	old := c.pods[name]
+
+	c.SetPod(name, testPod("default", "test", map[string]string{"api": "true"}, "10.0.0.1"))
+	mustFlush(t, c)
+	if jumps := chainJumps(t, mem, "pod_default_test_ing"); !slices.Equal(jumps, []string{"pol_default_api_ing"}) {
+		t.Errorf("expected only the jump to the still matching policy, got %v", jumps)
+	}
+	p := c.pods[name]
+	web, api := c.nwps[cache.ObjectName{Namespace: "default", Name: "web"}], c.nwps[cache.ObjectName{Namespace: "default", Name: "api"}]
+	if _, ok := web.podRefs[p]; ok {
+		t.Error("expected the policy no longer selecting the pod not to reference it")
+	}
+	if _, ok := api.podRefs[p]; !ok {
+		t.Error("expected the policy still selecting the pod to reference it")
+	}
+	for _, nwp := range []*Policy{web, api} {
+		if _, ok := nwp.podRefs[old]; ok {
+			t.Errorf("expected policy %s not to reference the pod before the update", nwp.Name)
+		}
+	}
+	if _, ok := p.ingressPolicyRefs[web]; ok {
+		t.Error("expected the pod not to reference the policy no longer selecting it")
+	}
+	checkRefs(t, c)
+
+	// Without any selecting policy, the pod is no longer isolated
+	c.SetPod(name, testPod("default", "test", nil, "10.0.0.1"))
+	mustFlush(t, c)
+	if jumps := chainJumps(t, mem, "pod_default_test_ing"); jumps != nil {
+		t.Errorf("expected the pod chain to be deleted, got jumps %v", jumps)
+	}
+	for _, nwp := range []*Policy{web, api} {
+		if len(nwp.podRefs) != 0 {
+			t.Errorf("expected policy %s to reference no pods, got %d", nwp.Name, len(nwp.podRefs))
+		}
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", "10.0.0.1", 81)); v != verdictAccept {
+		t.Errorf("expected traffic to the unselected pod to be accepted, got %v", v)
+	}
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v, %v", orphans, err)
+	}
+}
+
+func TestPodDualStackToIPv4Only(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	port := intstr.FromInt32(80)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "server"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "server"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress, nwkv1.PolicyTypeEgress},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &port}},
+			}},
+		},
+	})
+	clientName := cache.ObjectName{Namespace: "default", Name: "client"}
+	serverName := cache.ObjectName{Namespace: "default", Name: "server"}
+	c.SetPod(clientName, testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.1", "fd00::1"))
+	c.SetPod(serverName, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+
+	expectVerdict := func(src, dst string, expected testVerdict) {
+		t.Helper()
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(src, dst, 80)); v != expected {
+			t.Errorf("expected traffic from %v to %v to be %v, got %v", src, dst, expected, v)
+		}
+	}
+	// expectNoElements checks that no v6 set contains ip in its key.
+	expectNoElements := func(ip string) {
+		t.Helper()
+		sets, err := mem.GetSets(&nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := netip.MustParseAddr(ip).AsSlice()
+		for _, s := range sets {
+			elems, err := mem.GetSetElements(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range elems {
+				if bytes.Contains(e.Key, addr) {
+					t.Errorf("expected no element for %v, found one in set %q", ip, s.Name)
+				}
+			}
+		}
+	}
+	expectVerdict("10.0.0.1", "10.0.0.2", verdictAccept)
+	expectVerdict("fd00::1", "fd00::2", verdictAccept)
+	expectVerdict("fd00::3", "fd00::2", verdictReject)
+
+	// The client loses its IPv6 address
+	c.SetPod(clientName, testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.1"))
+	mustFlush(t, c)
+	expectNoElements("fd00::1")
+	expectVerdict("10.0.0.1", "10.0.0.2", verdictAccept)
+	expectVerdict("10.0.0.3", "10.0.0.2", verdictReject)
+	expectVerdict("fd00::1", "fd00::2", verdictReject)
+
+	// The server loses its IPv6 address, so it is no longer policed there
+	c.SetPod(serverName, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.2"))
+	mustFlush(t, c)
+	expectNoElements("fd00::2")
+	expectVerdict("10.0.0.1", "10.0.0.2", verdictAccept)
+	expectVerdict("10.0.0.3", "10.0.0.2", verdictReject)
+	expectVerdict("fd00::3", "fd00::2", verdictAccept)
+}
+
+func TestHostNetworkPeer(t *testing.T) {
+	for _, exclude := range []bool{false, true} {
+		c, mem, rec := newTestController(t, Config{ExcludeHostNetworkPeers: exclude})
+		c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow-client"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow-client"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+				}},
+			},
+		})
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.2"))
+		hostPod := testPod("default", "agent", map[string]string{"app": "client"}, "192.168.0.10")
+		hostPod.Spec.HostNetwork = true
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "agent"}, hostPod)
+		mustFlush(t, c)
+
+		events := drainEvents(rec)
+		expectedEvent := "Warning HostNetworkPeer"
+		expectedVerdict := verdictAccept
+		if exclude {
+			expectedEvent = "Normal HostNetworkPeerExcluded"
+			expectedVerdict = verdictReject
+		}
+		if len(events) != 1 || !strings.Contains(events[0], expectedEvent) || !strings.Contains(events[0], "default/agent") {
+			t.Errorf("exclude=%v: expected a single %s event, got %v", exclude, expectedEvent, events)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("192.168.0.10", "10.0.0.1", 80)); v != expectedVerdict {
+			t.Errorf("exclude=%v: expected connection from node IP to be %v, got %v", exclude, expectedVerdict, v)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictAccept {
+			t.Errorf("exclude=%v: expected connection from regular client pod to be accepted, got %v", exclude, v)
+		}
+
+		// Changing the pod or the policy does not report it again
+		hostPod = hostPod.DeepCopy()
+		hostPod.Labels["version"] = "2"
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "agent"}, hostPod)
+		c.SetNamespace("default", &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"env": "test"}}})
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow-client"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow-client"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+				PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+				}, {
+					From: []nwkv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}, PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+				}},
+			},
+		})
+		mustFlush(t, c)
+		if events := drainEvents(rec); len(events) != 0 {
+			t.Errorf("exclude=%v: expected no further events, got %v", exclude, events)
+		}
+		// A new pod of the same name is reported again
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "agent"}, nil)
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "agent"}, hostPod)
+		mustFlush(t, c)
+		if events := drainEvents(rec); len(events) != 1 || !strings.Contains(events[0], expectedEvent) {
+			t.Errorf("exclude=%v: expected a single %s event for the recreated pod, got %v", exclude, expectedEvent, events)
+		}
+	}
+}
+
+func TestSelectorAnnotations(t *testing.T) {
+	for _, key := range []string{"team", "example.com/team"} {
+		if errs := validation.IsQualifiedName(AnnotationLabelKey(key)); len(errs) > 0 {
+			t.Errorf("pseudo-label key for %q is not a valid label key: %v", key, errs)
+		}
+	}
+
+	c, mem, _ := newTestController(t, Config{SelectorAnnotations: []string{"example.com/team", "tier"}})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{
+					"example.com.annotation.npc.dolansoft.org/team": "a",
+					"annotation.npc.dolansoft.org/tier":             "frontend",
+				}}}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+	client := testPod("default", "client", map[string]string{"app": "client"}, "10.0.0.2")
+	client.Annotations = map[string]string{"example.com/team": "a", "tier": "frontend"}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, client)
+	// Annotations not listed in the config are not available
+	other := testPod("default", "other", nil, "10.0.0.3")
+	other.Annotations = map[string]string{"example.com/team": "a", "tier": "frontend", "example.com/other": "x"}
+	other.Labels = map[string]string{"annotation.npc.dolansoft.org/tier": "backend"}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "other"}, other)
+	mustFlush(t, c)
+
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictAccept {
+		t.Errorf("expected pod selected by annotations to be permitted, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.3", "10.0.0.1", 80)); v != verdictAccept {
+		t.Errorf("expected annotation to override pseudo-label, got %v", v)
+	}
+	if len(other.Labels) != 1 {
+		t.Errorf("expected labels of the pod object to be unchanged, got %v", other.Labels)
+	}
+	// Labels cannot impersonate annotations which are not set
+	spoofer := testPod("default", "spoofer", map[string]string{
+		"example.com.annotation.npc.dolansoft.org/team": "a",
+		"annotation.npc.dolansoft.org/tier":             "frontend",
+	}, "10.0.0.4")
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "spoofer"}, spoofer)
+	mustFlush(t, c)
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.4", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected pod with pseudo-labels but without annotations to be rejected, got %v", v)
+	}
+	if len(spoofer.Labels) != 2 {
+		t.Errorf("expected labels of the pod object to be unchanged, got %v", spoofer.Labels)
+	}
+
+	// Changing the annotation deselects the pod
+	client = client.DeepCopy()
+	client.Annotations["example.com/team"] = "b"
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, client)
+	mustFlush(t, c)
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected pod with changed annotation to be rejected, got %v", v)
+	}
+
+	// Without configuration, annotations are not matched
+	c, mem, _ = newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{
+					"annotation.npc.dolansoft.org/tier": "frontend",
+				}}}},
+			}},
+		},
+	})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"app": "server"}, "10.0.0.1"))
+	client = testPod("default", "client", nil, "10.0.0.2")
+	client.Annotations = map[string]string{"tier": "frontend"}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, client)
+	mustFlush(t, c)
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictReject {
+		t.Errorf("expected annotations to be ignored by default, got %v", v)
+	}
+}
+
+func TestAllowSelfTraffic(t *testing.T) {
+	ifaces := map[string]uint32{"a": 2, "b": 3}
+	resolver := func(pod *corev1.Pod, ip netip.Addr) (uint32, error) { return ifaces[pod.Name], nil }
+	ping := func(src, dst string, iface uint32) testPacket {
+		pkt := testPacket{src: netip.MustParseAddr(src), dst: netip.MustParseAddr(dst), proto: unix.IPPROTO_ICMP, icmpType: 8, ctState: expr.CtStateBitNEW}
+		if pkt.src.Is6() {
+			pkt.proto, pkt.icmpType = unix.IPPROTO_ICMPV6, 128
+		}
+		pkt.iif, pkt.oif = iface, iface
+		pkt.iifGroup, pkt.oifGroup = 1, 1
+		return pkt
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"disabled", Config{PodIfaceGroup: 1}},
+		{"interface group", Config{AllowSelfTraffic: true, PodIfaceGroup: 1}},
+		{"interface-scoped", Config{AllowSelfTraffic: true, IfaceResolver: resolver}},
+	} {
+		allow := tc.cfg.AllowSelfTraffic
+		c, mem, _ := newTestController(t, tc.cfg)
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+		name := cache.ObjectName{Namespace: "default", Name: "a"}
+		c.SetPod(name, testPod("default", "a", nil, "10.0.0.1", "fd00::1"))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", nil, "10.0.0.2", "fd00::2"))
+		mustFlush(t, c)
+
+		want := verdictReject
+		if allow {
+			want = verdictAccept
+		}
+		for _, ip := range []string{"10.0.0.1", "fd00::1"} {
+			if v := evalPacket(t, mem, nftables.ChainHookForward, ping(ip, ip, 2)); v != want {
+				t.Errorf("%s: %v -> itself: expected %v, got %v", tc.name, ip, want, v)
+			}
+			// Spoofed packets from other interfaces are not self traffic
+			spoofed := ping(ip, ip, 2)
+			spoofed.iif, spoofed.iifGroup = 5, 0
+			if v := evalPacket(t, mem, nftables.ChainHookForward, spoofed); v != verdictReject {
+				t.Errorf("%s: spoofed %v -> itself from another interface: expected reject, got %v", tc.name, ip, v)
+			}
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, ping("10.0.0.2", "10.0.0.1", 2)); v != verdictReject {
+			t.Errorf("%s: expected traffic between pods to be rejected, got %v", tc.name, v)
+		}
+		if !allow {
+			continue
+		}
+
+		// The set follows IP changes and deletions
+		c.SetPod(name, testPod("default", "a", nil, "10.0.0.3", "fd00::1"))
+		mustFlush(t, c)
+		for _, ip := range []string{"10.0.0.3", "fd00::1"} {
+			if v := evalPacket(t, mem, nftables.ChainHookForward, ping(ip, ip, 2)); v != verdictAccept {
+				t.Errorf("%s: %v -> itself after IP change: expected accept, got %v", tc.name, ip, v)
+			}
+		}
+		c.SetPod(name, nil)
+		mustFlush(t, c)
+		for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+			set := &nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: fam}, Name: "self_ips"}
+			if elems, err := mem.GetSetElements(set); err != nil || len(elems) != 1 {
+				t.Errorf("%s: expected only the element of the remaining pod in %v, got %v (%v)", tc.name, fam, elems, err)
+			}
+		}
+		if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+			t.Errorf("%s: expected no orphans, got %v (%v)", tc.name, orphans, err)
+		}
+	}
+
+	if _, err := New(record.NewFakeRecorder(10), nfds.WrapConn(nfds.NewMemory()), Config{AllowSelfTraffic: true}); err == nil {
+		t.Error("expected self traffic without pod interfaces to be rejected")
+	}
+}
+
+// rulesetSummary returns the chains with their number of rules and the sets
+// with their elements of the controller's tables, independent of handles and
+// the order in which they were created.
+func rulesetSummary(t *testing.T, mem *nfds.Memory) []string {
+	t.Helper()
+	var summary []string
+	for _, fam := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		table := &nftables.Table{Name: defaultTableName, Family: fam}
+		chains, err := mem.ListChainsOfTableFamily(fam)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ch := range chains {
+			rules, err := mem.GetRules(table, ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			summary = append(summary, fmt.Sprintf("%v chain %s: %d rules", fam, ch.Name, len(rules)))
+		}
+		sets, err := mem.GetSets(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range sets {
+			if s.Anonymous {
+				continue
+			}
+			elems, err := mem.GetSetElements(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range elems {
+				elem := fmt.Sprintf("%v set %s: %x-%x", fam, s.Name, e.Key, e.KeyEnd)
+				if e.VerdictData != nil {
+					elem += " " + e.VerdictData.Chain
+				}
+				summary = append(summary, elem)
+			}
+		}
+	}
+	slices.Sort(summary)
+	return summary
+}
+
+// The workqueue coalesces events by name, so the controller may only see the
+// final state of a pod after an arbitrary number of events. The resulting
+// ruleset must be the same as if the pod had been in that state from the
+// beginning.
+func TestCoalescedPodEvents(t *testing.T) {
+	name := cache.ObjectName{Namespace: "default", Name: "client"}
+	client := func(uid, role string, ips ...string) *corev1.Pod {
+		pod := testPod("default", "client", map[string]string{"role": role}, ips...)
+		pod.UID = types.UID(uid)
+		pod.Spec.Containers = []corev1.Container{{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}
+		return pod
+	}
+	setup := func() (*Controller, *nfds.Memory) {
+		c, mem, _ := newTestController(t, Config{})
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, denyAllPolicy("default", "deny"))
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}},
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromString("http"))}},
+				}},
+				Egress: []nwkv1.NetworkPolicyEgressRule{{
+					To: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}}}},
+				}},
+			},
+		})
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1", "fd00::1"))
+		mustFlush(t, c)
+		return c, mem
+	}
+
+	tests := []struct {
+		name string
+		// steps are applied in order, each one in its own transaction
+		steps [][]*corev1.Pod
+		final *corev1.Pod
+	}{
+		{"delete of an unknown pod", [][]*corev1.Pod{{nil}}, nil},
+		{"add and delete in one transaction", [][]*corev1.Pod{{client("uid-1", "client", "10.0.0.2", "fd00::2"), nil}}, nil},
+		{"add and delete in separate transactions", [][]*corev1.Pod{{client("uid-1", "client", "10.0.0.2", "fd00::2")}, {nil}}, nil},
+		{"add in the final state", [][]*corev1.Pod{{client("uid-1", "client", "10.0.0.2", "fd00::2")}}, client("uid-1", "client", "10.0.0.2", "fd00::2")},
+		{"add and update labels and IPs", [][]*corev1.Pod{{client("uid-1", "client", "10.0.0.2", "fd00::2")}, {client("uid-1", "other", "10.0.0.3")}}, client("uid-1", "other", "10.0.0.3")},
+		{"replace by a new pod with the same name", [][]*corev1.Pod{{client("uid-1", "client", "10.0.0.2", "fd00::2")}, {client("uid-2", "client", "10.0.0.3", "fd00::3")}}, client("uid-2", "client", "10.0.0.3", "fd00::3")},
+		{"replace by a new pending pod without IPs", [][]*corev1.Pod{{client("uid-1", "client", "10.0.0.2", "fd00::2")}, {client("uid-2", "client")}}, client("uid-2", "client")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, mem := setup()
+			for _, step := range tt.steps {
+				for _, pod := range step {
+					c.SetPod(name, pod)
+				}
+				mustFlush(t, c)
+			}
+			checkRefs(t, c)
+			if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+				t.Errorf("expected no orphans, got %v, %v", orphans, err)
+			}
+
+			ref, refMem := setup()
+			if tt.final != nil {
+				ref.SetPod(name, tt.final)
+				mustFlush(t, ref)
+			}
+			if got, expected := rulesetSummary(t, mem), rulesetSummary(t, refMem); !slices.Equal(got, expected) {
+				t.Errorf("expected ruleset\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestL2AntiSpoofing(t *testing.T) {
+	c, mem, rec := newTestController(t, Config{L2AntiSpoofing: true})
+	deny := denyAllPolicy("default", "deny")
+	deny.Spec.PolicyTypes = []nwkv1.PolicyType{nwkv1.PolicyTypeIngress}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, deny)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}}},
+			}},
+		},
+	})
+	name := cache.ObjectName{Namespace: "default", Name: "client"}
+	client := func(annotations map[string]string, ips ...string) *corev1.Pod {
+		pod := testPod("default", "client", map[string]string{"role": "client"}, ips...)
+		pod.Annotations = annotations
+		return pod
+	}
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	other := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1", "fd00::1"))
+	c.SetPod(name, client(map[string]string{annotationMAC: mac.String(), annotationVLAN: "100"}, "10.0.0.2", "fd00::2"))
+	mustFlush(t, c)
+
+	expect := func(src, dst string, srcMAC net.HardwareAddr, vlan uint16, ctState uint32, want testVerdict) {
+		t.Helper()
+		pkt := newConn(src, dst, 80)
+		pkt.srcMAC, pkt.vlan, pkt.ctState = srcMAC, vlan, ctState
+		if v := evalPacket(t, mem, nftables.ChainHookForward, pkt); v != want {
+			t.Errorf("%v (%v, VLAN %d) -> %v: expected %v, got %v", src, srcMAC, vlan, dst, want, v)
+		}
+	}
+	expect("10.0.0.2", "10.0.0.1", mac, 100, expr.CtStateBitNEW, verdictAccept)
+	expect("fd00::2", "fd00::1", mac, 100, expr.CtStateBitNEW, verdictAccept)
+	expect("10.0.0.2", "10.0.0.1", other, 100, expr.CtStateBitNEW, verdictDrop)
+	expect("fd00::2", "fd00::1", other, 100, expr.CtStateBitNEW, verdictDrop)
+	expect("10.0.0.2", "10.0.0.1", mac, 0, expr.CtStateBitNEW, verdictDrop)
+	expect("10.0.0.2", "10.0.0.1", mac, 200, expr.CtStateBitNEW, verdictDrop)
+	// Spoofed packets are dropped before established connections are
+	// accepted.
+	expect("10.0.0.2", "10.0.0.1", other, 100, expr.CtStateBitESTABLISHED, verdictDrop)
+	// Traffic of pods without pinned addresses and without LL header is
+	// not checked
+	expect("10.0.0.3", "10.0.0.1", other, 0, expr.CtStateBitNEW, verdictReject)
+	expect("10.0.0.2", "10.0.0.1", nil, 0, expr.CtStateBitNEW, verdictAccept)
+
+	// Changed IPs are pinned instead of the old ones
+	c.SetPod(name, client(map[string]string{annotationMAC: mac.String(), annotationVLAN: "100"}, "10.0.0.3"))
+	mustFlush(t, c)
+	expect("10.0.0.3", "10.0.0.1", other, 100, expr.CtStateBitNEW, verdictDrop)
+	expect("10.0.0.2", "10.0.0.1", other, 100, expr.CtStateBitNEW, verdictReject)
+
+	// The MAC address of the default network is used from the network
+	// status
+	status := `[{"name":"cbr0","interface":"eth0","mac":"02:00:00:00:00:02","default":true},{"name":"macvlan","interface":"net1","mac":"02:00:00:00:00:03"}]`
+	c.SetPod(name, client(map[string]string{annotationNetworkStatus: status}, "10.0.0.3"))
+	mustFlush(t, c)
+	expect("10.0.0.3", "10.0.0.1", other, 0, expr.CtStateBitNEW, verdictAccept)
+	expect("10.0.0.3", "10.0.0.1", mac, 0, expr.CtStateBitNEW, verdictDrop)
+
+	// Invalid annotations are reported and do not pin anything
+	drainEvents(rec)
+	c.SetPod(name, client(map[string]string{annotationMAC: "02:00:00:00:00", annotationVLAN: "4095"}, "10.0.0.3"))
+	mustFlush(t, c)
+	expect("10.0.0.3", "10.0.0.1", mac, 0, expr.CtStateBitNEW, verdictAccept)
+	if events := drainEvents(rec); len(events) != 2 || !strings.Contains(events[0], "InvalidAnnotation") || !strings.Contains(events[1], "InvalidAnnotation") {
+		t.Errorf("expected two InvalidAnnotation warnings, got %v", events)
+	}
+	// They are not reported again on unrelated updates
+	c.SetPod(name, client(map[string]string{annotationMAC: "02:00:00:00:00", annotationVLAN: "4095"}, "10.0.0.4"))
+	mustFlush(t, c)
+	if events := drainEvents(rec); len(events) != 0 {
+		t.Errorf("expected no repeated warnings, got %v", events)
+	}
+
+	c.SetPod(name, client(map[string]string{annotationMAC: mac.String()}, "10.0.0.3"))
+	mustFlush(t, c)
+	c.SetPod(name, nil)
+	mustFlush(t, c)
+	expect("10.0.0.3", "10.0.0.1", other, 0, expr.CtStateBitNEW, verdictReject)
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v, %v", orphans, err)
+	}
+
+	// Annotations are ignored unless enabled
+	c, mem, _ = newTestController(t, Config{})
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, deny)
+	c.SetPod(name, client(map[string]string{annotationMAC: mac.String()}, "10.0.0.2"))
+	mustFlush(t, c)
+	expect("10.0.0.2", "10.0.0.1", other, 0, expr.CtStateBitNEW, verdictAccept)
+}
+
+func TestReadyPeers(t *testing.T) {
+	allow := func(name string, port int32, annotations map[string]string) *nwkv1.NetworkPolicy {
+		return &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+				Ingress: []nwkv1.NetworkPolicyIngressRule{{
+					From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}}},
+					Ports: []nwkv1.NetworkPolicyPort{{Port: ptrIntStr(intstr.FromInt32(port))}},
+				}},
+			},
+		}
+	}
+	name := cache.ObjectName{Namespace: "default", Name: "client"}
+	client := func(ready bool, ips ...string) *corev1.Pod {
+		pod := testPod("default", "client", map[string]string{"role": "client"}, ips...)
+		status := corev1.ConditionFalse
+		if ready {
+			status = corev1.ConditionTrue
+		}
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}
+		return pod
+	}
+	setup := func(cfg Config) (*Controller, *nfds.Memory, func(src string, port uint16, want testVerdict)) {
+		c, mem, _ := newTestController(t, cfg)
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "ready"}, allow("ready", 80, map[string]string{annotationReadyPeers: "true"}))
+		c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "any"}, allow("any", 81, nil))
+		c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.1"))
+		return c, mem, func(src string, port uint16, want testVerdict) {
+			t.Helper()
+			if v := evalPacket(t, mem, nftables.ChainHookForward, newConn(src, "10.0.0.1", port)); v != want {
+				t.Errorf("connection from %v to port %d: expected %v, got %v", src, port, want, v)
+			}
+		}
+	}
+
+	c, _, expect := setup(Config{ReadyPeers: true})
+	c.SetPod(name, client(false, "10.0.0.2"))
+	mustFlush(t, c)
+	expect("10.0.0.2", 80, verdictReject)
+	expect("10.0.0.2", 81, verdictAccept)
+
+	c.SetPod(name, client(true, "10.0.0.2"))
+	mustFlush(t, c)
+	expect("10.0.0.2", 80, verdictAccept)
+	expect("10.0.0.2", 81, verdictAccept)
+
+	// Readiness and IPs changing at once
+	c.SetPod(name, client(false, "10.0.0.3"))
+	mustFlush(t, c)
+	expect("10.0.0.2", 80, verdictReject)
+	expect("10.0.0.3", 80, verdictReject)
+	expect("10.0.0.2", 81, verdictReject)
+	expect("10.0.0.3", 81, verdictAccept)
+
+	c.SetPod(name, client(true, "10.0.0.4"))
+	mustFlush(t, c)
+	expect("10.0.0.3", 80, verdictReject)
+	expect("10.0.0.4", 80, verdictAccept)
+	checkRefs(t, c)
+
+	// Deleting a pod while it is not Ready
+	c.SetPod(name, client(false, "10.0.0.4"))
+	mustFlush(t, c)
+	c.SetPod(name, nil)
+	mustFlush(t, c)
+	checkRefs(t, c)
+	if orphans, err := c.Orphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v, %v", orphans, err)
+	}
+
+	// Without tracking readiness, the annotation is ignored
+	c, _, expect = setup(Config{})
+	c.SetPod(name, client(false, "10.0.0.2"))
+	mustFlush(t, c)
+	expect("10.0.0.2", 80, verdictAccept)
+}
+
+func TestPodIPs(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", nil, "10.0.0.2", "fd00::2"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", nil, "10.0.0.1"))
+	host := testPod("default", "host", nil, "192.0.2.1")
+	host.Spec.HostNetwork = true
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "host"}, host)
+	mustFlush(t, c)
+	expected := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")}
+	if ips := c.PodIPs(); !slices.Equal(ips, expected) {
+		t.Errorf("expected pod IPs %v without host-network pods, got %v", expected, ips)
+	}
+}
+
+func TestIPv6OnlyPod(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	nwp := denyAllPolicy("default", "allow")
+	nwp.Spec.PodSelector = metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}}
+	nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{
+		From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}}},
+	}}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, nwp)
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, testPod("default", "server", map[string]string{"role": "server"}, "fd00::1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, testPod("default", "client", map[string]string{"role": "client"}, "fd00::2"))
+	mustFlush(t, c)
+
+	elems := func(family nftables.TableFamily, name string) []nftables.SetElement {
+		t.Helper()
+		elems, err := mem.GetSetElements(&nftables.Set{Table: &nftables.Table{Name: defaultTableName, Family: family}, Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return elems
+	}
+	serverChain := c.pods[cache.ObjectName{Namespace: "default", Name: "server"}].ingressChain.Name
+	if v4 := elems(nftables.TableFamilyIPv4, "vmap_ing"); len(v4) != 0 {
+		t.Errorf("expected no IPv4 vmap elements for IPv6-only pods, got %v", v4)
+	}
+	if v6 := elems(nftables.TableFamilyIPv6, "vmap_ing"); len(v6) != 1 || v6[0].VerdictData.Chain != serverChain {
+		t.Errorf("expected a single IPv6 vmap element jumping to %s, got %v", serverChain, v6)
+	}
+	if v4 := elems(nftables.TableFamilyIPv4, "pol_default_allow_ing_0_podips"); len(v4) != 0 {
+		t.Errorf("expected no IPv4 peer elements for IPv6-only pods, got %v", v4)
+	}
+	if v6 := elems(nftables.TableFamilyIPv6, "pol_default_allow_ing_0_podips"); len(v6) != 1 || netip.AddrFrom16([16]byte(v6[0].Key)) != netip.MustParseAddr("fd00::2") {
+		t.Errorf("expected client as only IPv6 peer, got %v", v6)
+	}
+
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("fd00::2", "fd00::1", 80)); v != verdictAccept {
+		t.Errorf("expected traffic from client to be accepted, got %v", v)
+	}
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("fd00::3", "fd00::1", 80)); v != verdictReject {
+		t.Errorf("expected traffic from other addresses to be rejected, got %v", v)
+	}
+	// The IPv4 family is not affected by the pod
+	if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.0.2", "10.0.0.1", 80)); v != verdictAccept {
+		t.Errorf("expected unrelated IPv4 traffic to be accepted, got %v", v)
+	}
+
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "server"}, nil)
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "client"}, nil)
+	mustFlush(t, c)
+	if v6 := elems(nftables.TableFamilyIPv6, "vmap_ing"); len(v6) != 0 {
+		t.Errorf("expected IPv6 vmap elements to be deleted with the pod, got %v", v6)
+	}
+}
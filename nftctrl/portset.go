@@ -0,0 +1,78 @@
+package nftctrl
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+)
+
+// sharedPortSet is a named set of L4 protocols and ports referenced by all
+// rules with the same numbered ports.
+type sharedPortSet struct {
+	key  string
+	set  *nfds.Set
+	refs int
+}
+
+// portSetKey returns the canonical representation of a list of ports, which
+// does not depend on their order.
+func portSetKey(portProtos []RuleNumberedPortMeta) string {
+	sorted := slices.Clone(portProtos)
+	slices.SortFunc(sorted, func(a, b RuleNumberedPortMeta) int {
+		return cmp.Or(cmp.Compare(a.Protocol, b.Protocol), cmp.Compare(a.Port, b.Port), cmp.Compare(a.EndPort, b.EndPort))
+	})
+	sorted = slices.Compact(sorted)
+	var b strings.Builder
+	for i, p := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%d:%d-%d", p.Protocol, p.Port, p.EndPort)
+	}
+	return b.String()
+}
+
+// acquirePortSet returns the shared set containing portProtos, creating it
+// if necessary. Every call needs to be paired with a call to releasePortSet.
+func (c *Controller) acquirePortSet(portProtos []RuleNumberedPortMeta) *sharedPortSet {
+	key := portSetKey(portProtos)
+	if ps, ok := c.portSets[key]; ok {
+		ps.refs++
+		return ps
+	}
+	hash := sha256.Sum256([]byte(key))
+	ps := &sharedPortSet{
+		key: key,
+		set: &nfds.Set{
+			Table:         c.table,
+			Name:          "portset_" + hex.EncodeToString(hash[:8]),
+			Constant:      true,
+			Concatenation: true,
+			Interval:      true,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeInetProto, nftables.TypeInetService),
+			KeyByteOrder:  binaryutil.BigEndian,
+		},
+		refs: 1,
+	}
+	c.nftConn.AddSet(ps.set, portProtoElements(portProtos))
+	c.portSets[key] = ps
+	return ps
+}
+
+// releasePortSet drops a reference to ps, deleting it if it was the last one.
+// The rules referencing it need to be deleted beforehand.
+func (c *Controller) releasePortSet(ps *sharedPortSet) {
+	ps.refs--
+	if ps.refs > 0 {
+		return
+	}
+	c.nftConn.DelSet(ps.set)
+	delete(c.portSets, ps.key)
+}
@@ -0,0 +1,81 @@
+package nftctrl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSharedPortSets(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{SharedPortSetMin: 2})
+	policy := func(name string, ports ...int32) *nwkv1.NetworkPolicy {
+		var npPorts []nwkv1.NetworkPolicyPort
+		for _, p := range ports {
+			npPorts = append(npPorts, nwkv1.NetworkPolicyPort{Port: ptrIntStr(intstr.FromInt32(p))})
+		}
+		return &nwkv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: nwkv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+				Ingress:     []nwkv1.NetworkPolicyIngressRule{{Ports: npPorts}},
+			},
+		}
+	}
+	portSets := func() []string {
+		t.Helper()
+		sets, err := mem.GetSets(&nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, s := range sets {
+			if strings.HasPrefix(s.Name, "portset_") {
+				names = append(names, s.Name)
+			}
+		}
+		return names
+	}
+	a := cache.ObjectName{Namespace: "default", Name: "a"}
+	b := cache.ObjectName{Namespace: "default", Name: "b"}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", map[string]string{"app": "a"}, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", map[string]string{"app": "b"}, "10.0.0.2"))
+	c.SetNetworkPolicy(a, policy("a", 80, 443, 8080))
+	// Same ports in a different order
+	c.SetNetworkPolicy(b, policy("b", 8080, 80, 443))
+	// Single ports do not use sets
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "c"}, policy("c", 80))
+	mustFlush(t, c)
+	if sets := portSets(); len(sets) != 1 {
+		t.Fatalf("expected a single shared port set, got %v", sets)
+	}
+	for _, dst := range []string{"10.0.0.1", "10.0.0.2"} {
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", dst, 443)); v != verdictAccept {
+			t.Errorf("expected connection to %v:443 to be accepted, got %v", dst, v)
+		}
+		if v := evalPacket(t, mem, nftables.ChainHookForward, newConn("10.0.1.1", dst, 444)); v != verdictReject {
+			t.Errorf("expected connection to %v:444 to be rejected, got %v", dst, v)
+		}
+	}
+
+	c.SetNetworkPolicy(a, nil)
+	mustFlush(t, c)
+	if sets := portSets(); len(sets) != 1 {
+		t.Fatalf("expected shared port set to be kept while referenced, got %v", sets)
+	}
+	// Recreating a policy releases and acquires the set in one transaction
+	c.SetNetworkPolicy(b, policy("b", 80, 443))
+	mustFlush(t, c)
+	if sets := portSets(); len(sets) != 1 {
+		t.Fatalf("expected a single shared port set, got %v", sets)
+	}
+	c.SetNetworkPolicy(b, nil)
+	mustFlush(t, c)
+	if sets := portSets(); len(sets) != 0 {
+		t.Fatalf("expected unreferenced port set to be deleted, got %v", sets)
+	}
+}
@@ -0,0 +1,167 @@
+package nftctrl
+
+import (
+	"fmt"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// Diagnostic is an event emitted while reconciling an object.
+type Diagnostic struct {
+	Type    string
+	Reason  string
+	Message string
+}
+
+// ReconcileResult describes the changes made to the ruleset by reconciling an
+// object. Changes are counted once for both families when they are queued,
+// they are only applied by the next Flush.
+type ReconcileResult struct {
+	ChainsAdded     int
+	ChainsDeleted   int
+	RulesAdded      int
+	RulesDeleted    int
+	SetsAdded       int
+	SetsDeleted     int
+	ElementsAdded   int
+	ElementsDeleted int
+	// Diagnostics are the events emitted for any object, including ones
+	// suppressed by deduplication.
+	Diagnostics []Diagnostic
+}
+
+// Changed returns true if the ruleset was changed.
+func (r *ReconcileResult) Changed() bool {
+	return r.ChainsAdded+r.ChainsDeleted+r.RulesAdded+r.RulesDeleted+r.SetsAdded+r.SetsDeleted+r.ElementsAdded+r.ElementsDeleted > 0
+}
+
+// ReconcilePod is like SetPod, but returns the changes made.
+func (c *Controller) ReconcilePod(name cache.ObjectName, pod *corev1.Pod) ReconcileResult {
+	return c.reconcile(func() { c.SetPod(name, pod) })
+}
+
+// ReconcileNetworkPolicy is like SetNetworkPolicy, but returns the changes
+// made.
+func (c *Controller) ReconcileNetworkPolicy(name cache.ObjectName, nwp *nwkv1.NetworkPolicy) ReconcileResult {
+	return c.reconcile(func() { c.SetNetworkPolicy(name, nwp) })
+}
+
+// ReconcileNamespace is like SetNamespace, but returns the changes made.
+func (c *Controller) ReconcileNamespace(name string, ns *corev1.Namespace) ReconcileResult {
+	return c.reconcile(func() { c.SetNamespace(name, ns) })
+}
+
+func (c *Controller) reconcile(f func()) ReconcileResult {
+	var res ReconcileResult
+	before := c.nftConn.Stats()
+	c.diagnostics = &res.Diagnostics
+	f()
+	c.diagnostics = nil
+	after := c.nftConn.Stats()
+	res.ChainsAdded = int(after.ChainsAdded - before.ChainsAdded)
+	res.ChainsDeleted = int(after.ChainsDeleted - before.ChainsDeleted)
+	res.RulesAdded = int(after.RulesAdded - before.RulesAdded)
+	res.RulesDeleted = int(after.RulesDeleted - before.RulesDeleted)
+	res.SetsAdded = int(after.SetsAdded - before.SetsAdded)
+	res.SetsDeleted = int(after.SetsDeleted - before.SetsDeleted)
+	res.ElementsAdded = int(after.ElementsAdded - before.ElementsAdded)
+	res.ElementsDeleted = int(after.ElementsDeleted - before.ElementsDeleted)
+	return res
+}
+
+// ReconcileSets makes the elements of all sets which are updated as pods and
+// policies change match the in-memory model, repairing drift of the kernel
+// ruleset. Only missing elements are added and unexpected ones deleted. All
+// changes need to be flushed before, as the current elements are read from
+// the kernel.
+func (c *Controller) ReconcileSets() (ReconcileResult, error) {
+	var res ReconcileResult
+	want := make(map[*nfds.Set][]nftables.SetElement)
+	want[c.vmapIng] = nil
+	want[c.vmapEg] = nil
+	if c.vmapL2 != nil {
+		want[c.vmapL2] = nil
+	}
+	if c.ifaceGroupSet != nil {
+		want[c.ifaceGroupSet] = c.ifaceGroupElements()
+	}
+	if c.selfSet != nil {
+		want[c.selfSet] = nil
+		for k := range c.vmapClaims {
+			want[c.selfSet] = append(want[c.selfSet], selfElement(k, c.cfg.IfaceResolver != nil))
+		}
+	}
+	for _, p := range c.pods {
+		if p.ingressChain != nil || c.failClosed() {
+			want[c.vmapIng] = append(want[c.vmapIng], p.vmapElements(p.ingressChain)...)
+		}
+		if p.egressChain != nil || c.failClosed() {
+			want[c.vmapEg] = append(want[c.vmapEg], p.vmapElements(p.egressChain)...)
+		}
+		if p.l2Chain != nil {
+			want[c.vmapL2] = append(want[c.vmapL2], p.vmapElements(p.l2Chain)...)
+		}
+	}
+	for r := range c.rules {
+		if r.ownsPodIPs() {
+			want[r.PodIPSet] = nil
+		}
+		if r.NamedPortSet != nil {
+			want[r.NamedPortSet] = nil
+		}
+		if r.FQDNSet != nil {
+			want[r.FQDNSet] = r.fqdnElements()
+		}
+		for p := range r.podRefs {
+			if r.ownsPodIPs() && !r.overflowed {
+				want[r.PodIPSet] = append(want[r.PodIPSet], p.ipElements()...)
+			}
+			if r.NamedPortSet != nil {
+				want[r.NamedPortSet] = append(want[r.NamedPortSet], p.namedPortElements(r.NamedPortMeta)...)
+			}
+		}
+	}
+	for s, elems := range want {
+		added, deleted, err := c.nftConn.SetReconcileElements(s, elems)
+		res.ElementsAdded += added
+		res.ElementsDeleted += deleted
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// diagRecorder forwards events to rec and records them as diagnostics of the
+// current reconcile call of c, if any.
+type diagRecorder struct {
+	rec record.EventRecorder
+	c   *Controller
+}
+
+func (r *diagRecorder) record(eventtype, reason, message string) {
+	if r.c.diagnostics != nil {
+		*r.c.diagnostics = append(*r.c.diagnostics, Diagnostic{Type: eventtype, Reason: reason, Message: message})
+	}
+}
+
+func (r *diagRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.record(eventtype, reason, message)
+	r.rec.Event(object, eventtype, reason, message)
+}
+
+func (r *diagRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *diagRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	r.record(eventtype, reason, message)
+	r.rec.AnnotatedEventf(object, annotations, eventtype, reason, "%s", message)
+}
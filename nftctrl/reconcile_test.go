@@ -0,0 +1,113 @@
+package nftctrl
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/google/nftables"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestReconcileResult(t *testing.T) {
+	c, _, rec := newTestController(t, Config{})
+	nwp := denyAllPolicy("default", "deny")
+	nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{
+		From: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "invalid"}}},
+	}}
+	res := c.ReconcileNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, nwp)
+	if res.ChainsAdded == 0 {
+		t.Errorf("expected chains to be added, got %+v", res)
+	}
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Type != corev1.EventTypeWarning || res.Diagnostics[0].Reason != "InvalidPeer" {
+		t.Errorf("expected an InvalidPeer diagnostic, got %+v", res.Diagnostics)
+	}
+	if events := drainEvents(rec); len(events) != 1 {
+		t.Errorf("expected the diagnostic to be forwarded as event, got %v", events)
+	}
+	mustFlush(t, c)
+
+	res = c.ReconcilePod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", nil, "10.0.0.1"))
+	if res.ElementsAdded == 0 || len(res.Diagnostics) != 0 {
+		t.Errorf("expected elements to be added without diagnostics, got %+v", res)
+	}
+	mustFlush(t, c)
+
+	res = c.ReconcilePod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", nil, "10.0.0.1"))
+	if res.Changed() {
+		t.Errorf("expected unchanged pod to change nothing, got %+v", res)
+	}
+
+	res = c.ReconcileNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, nil)
+	if res.ChainsDeleted == 0 || res.ElementsDeleted == 0 {
+		t.Errorf("expected chains and elements to be deleted, got %+v", res)
+	}
+	mustFlush(t, c)
+}
+
+func TestReconcileSets(t *testing.T) {
+	c, mem, _ := newTestController(t, Config{})
+	table := &nftables.Table{Name: defaultTableName, Family: nftables.TableFamilyIPv4}
+	vmapIng := &nftables.Set{Table: table, Name: "vmap_ing"}
+	podIPSet := &nftables.Set{Table: table, Name: "pol_default_allow_ing_0_podips"}
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "a"}, testPod("default", "a", nil, "10.0.0.1"))
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, testPod("default", "b", nil, "10.0.0.2"))
+	nwp := denyAllPolicy("default", "allow")
+	nwp.Spec.Ingress = []nwkv1.NetworkPolicyIngressRule{{
+		From: []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+	}}
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, nwp)
+	mustFlush(t, c)
+
+	res, err := c.ReconcileSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed() {
+		t.Errorf("expected no changes without drift, got %+v", res)
+	}
+
+	// Simulate drift: the element of b went missing from both sets and a
+	// stale element appeared in the pod IP set.
+	elems, _ := mem.GetSetElements(vmapIng)
+	var bElem nftables.SetElement
+	for _, e := range elems {
+		if net.IP(e.Key).String() == "10.0.0.2" {
+			bElem = e
+		}
+	}
+	mem.SetDeleteElements(vmapIng, []nftables.SetElement{bElem})
+	mem.SetDeleteElements(podIPSet, []nftables.SetElement{{Key: net.ParseIP("10.0.0.2").To4()}})
+	mem.SetAddElements(podIPSet, []nftables.SetElement{{Key: net.ParseIP("10.9.9.9").To4()}})
+	if err := mem.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = c.ReconcileSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ElementsAdded != 2 || res.ElementsDeleted != 1 {
+		t.Errorf("expected 2 elements added and 1 deleted, got %+v", res)
+	}
+	mustFlush(t, c)
+	if elems, _ := mem.GetSetElements(vmapIng); len(elems) != 2 {
+		t.Errorf("expected elements of both pods in vmap, got %v", elems)
+	}
+	var ips []string
+	elems, _ = mem.GetSetElements(podIPSet)
+	for _, e := range elems {
+		ips = append(ips, net.IP(e.Key).String())
+	}
+	if !slices.Equal(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("expected pod IPs 10.0.0.1 and 10.0.0.2, got %v", ips)
+	}
+
+	// Regular updates still apply cleanly after reconciling
+	c.SetPod(cache.ObjectName{Namespace: "default", Name: "b"}, nil)
+	mustFlush(t, c)
+	checkRefs(t, c)
+}
@@ -0,0 +1,167 @@
+package nftctrl
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables/binaryutil"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// RouteIfaceResolver resolves the interface of pod IPs for
+// Config.IfaceResolver. Pods with the interface annotation use the interface
+// it names, all others the interface traffic to the IP is routed through
+// according to the main routing table of the current network namespace. It
+// is not safe for concurrent use.
+type RouteIfaceResolver struct {
+	// MaxAge is the time a dump of the routing table is reused for, so pods
+	// added in a burst, like during the initial sync, share a single dump.
+	MaxAge time.Duration
+
+	dumps map[int]routeDump
+
+	// The following fields replace the system in tests
+	now         func() time.Time
+	dumpRoutes  func(family int) ([]route, error)
+	ifaceByName func(name string) (uint32, error)
+}
+
+// route is a unicast route of the main routing table.
+type route struct {
+	dst     netip.Prefix
+	ifIndex uint32
+}
+
+type routeDump struct {
+	routes []route
+	time   time.Time
+}
+
+// Resolve returns the index of the interface ip of pod is reachable through.
+func (r *RouteIfaceResolver) Resolve(pod *corev1.Pod, ip netip.Addr) (uint32, error) {
+	if name, ok := pod.Annotations[annotationInterface]; ok {
+		ifaceByName := r.ifaceByName
+		if ifaceByName == nil {
+			ifaceByName = systemIfaceByName
+		}
+		ifIndex, err := ifaceByName(name)
+		if err != nil {
+			return 0, fmt.Errorf("annotation %s: %w", annotationInterface, err)
+		}
+		return ifIndex, nil
+	}
+	family := unix.AF_INET6
+	if ip.Is4() {
+		family = unix.AF_INET
+	}
+	routes, err := r.routes(family)
+	if err != nil {
+		return 0, err
+	}
+	return lookupRouteIface(routes, ip)
+}
+
+// routes returns the routes of family, dumping them if the last dump is
+// older than MaxAge.
+func (r *RouteIfaceResolver) routes(family int) ([]route, error) {
+	now := time.Now
+	if r.now != nil {
+		now = r.now
+	}
+	if d, ok := r.dumps[family]; ok && now().Sub(d.time) < r.MaxAge {
+		return d.routes, nil
+	}
+	dumpRoutes := r.dumpRoutes
+	if dumpRoutes == nil {
+		dumpRoutes = systemRoutes
+	}
+	routes, err := dumpRoutes(family)
+	if err != nil {
+		return nil, err
+	}
+	if r.dumps == nil {
+		r.dumps = make(map[int]routeDump)
+	}
+	r.dumps[family] = routeDump{routes: routes, time: now()}
+	return routes, nil
+}
+
+// lookupRouteIface returns the interface of the most specific route to ip.
+func lookupRouteIface(routes []route, ip netip.Addr) (uint32, error) {
+	bestLen := -1
+	var bestIndex uint32
+	for _, rt := range routes {
+		if !rt.dst.Contains(ip) || rt.dst.Bits() <= bestLen {
+			continue
+		}
+		bestLen = rt.dst.Bits()
+		bestIndex = rt.ifIndex
+	}
+	if bestLen < 0 {
+		return 0, fmt.Errorf("no route to %v", ip)
+	}
+	return bestIndex, nil
+}
+
+func systemIfaceByName(name string) (uint32, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(iface.Index), nil
+}
+
+// systemRoutes dumps the unicast routes with an output interface of the main
+// routing table.
+func systemRoutes(family int) ([]route, error) {
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump routes: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %w", err)
+	}
+	var routes []route
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWROUTE || len(m.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		// struct rtmsg: family, dst_len, src_len, tos, table, protocol, scope, type
+		dstLen, table, typ := m.Data[1], m.Data[4], m.Data[7]
+		if table != unix.RT_TABLE_MAIN || typ != unix.RTN_UNICAST {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			continue
+		}
+		dst := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		if family == unix.AF_INET {
+			dst = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		}
+		var oif uint32
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case unix.RTA_DST:
+				addr, ok := netip.AddrFromSlice(a.Value)
+				if !ok {
+					continue
+				}
+				dst = netip.PrefixFrom(addr, int(dstLen))
+			case unix.RTA_OIF:
+				if len(a.Value) == 4 {
+					oif = binaryutil.NativeEndian.Uint32(a.Value)
+				}
+			}
+		}
+		if oif != 0 {
+			routes = append(routes, route{dst: dst, ifIndex: oif})
+		}
+	}
+	return routes, nil
+}
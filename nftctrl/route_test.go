@@ -0,0 +1,64 @@
+package nftctrl
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRouteIfaceResolver(t *testing.T) {
+	now := time.Unix(0, 0)
+	var dumps int
+	r := &RouteIfaceResolver{
+		MaxAge: time.Second,
+		now:    func() time.Time { return now },
+		dumpRoutes: func(family int) ([]route, error) {
+			dumps++
+			if family != unix.AF_INET {
+				return nil, nil
+			}
+			return []route{
+				{dst: netip.MustParsePrefix("0.0.0.0/0"), ifIndex: 1},
+				{dst: netip.MustParsePrefix("10.0.0.0/24"), ifIndex: 2},
+				{dst: netip.MustParsePrefix("10.0.0.5/32"), ifIndex: 3},
+			}, nil
+		},
+		ifaceByName: func(name string) (uint32, error) {
+			if name != "veth1" {
+				return 0, errors.New("no such network interface")
+			}
+			return 7, nil
+		},
+	}
+	pod := &corev1.Pod{}
+	for ip, expected := range map[string]uint32{"10.0.0.1": 2, "10.0.0.5": 3, "192.0.2.1": 1} {
+		if ifIndex, err := r.Resolve(pod, netip.MustParseAddr(ip)); err != nil || ifIndex != expected {
+			t.Errorf("%s: expected interface %d, got %d (%v)", ip, expected, ifIndex, err)
+		}
+	}
+	if dumps != 1 {
+		t.Errorf("expected a single dump within MaxAge, got %d", dumps)
+	}
+	now = now.Add(time.Second)
+	r.Resolve(pod, netip.MustParseAddr("10.0.0.1"))
+	if dumps != 2 {
+		t.Errorf("expected routes to be dumped again after MaxAge, got %d dumps", dumps)
+	}
+	if _, err := r.Resolve(pod, netip.MustParseAddr("fd00::1")); err == nil {
+		t.Error("expected an error without a route")
+	}
+
+	pod = &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationInterface: "veth1"}}}
+	if ifIndex, err := r.Resolve(pod, netip.MustParseAddr("10.0.0.1")); err != nil || ifIndex != 7 {
+		t.Errorf("expected the annotated interface 7, got %d (%v)", ifIndex, err)
+	}
+	pod.Annotations[annotationInterface] = "missing"
+	if _, err := r.Resolve(pod, netip.MustParseAddr("10.0.0.1")); err == nil {
+		t.Error("expected an error for a missing annotated interface")
+	}
+}
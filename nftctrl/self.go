@@ -0,0 +1,84 @@
+package nftctrl
+
+import (
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// addSelfSet adds the set of source and destination address pairs of pods
+// sending traffic to themselves, which contains every pod IP paired with
+// itself. If the verdict maps are interface-scoped, the pairs are prefixed
+// by the input and output interface, which both need to be the interface of
+// the pod.
+func (c *Controller) addSelfSet() {
+	keyType := nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeIPAddr)
+	keyType6 := nftables.MustConcatSetType(nftables.TypeIP6Addr, nftables.TypeIP6Addr)
+	if c.cfg.IfaceResolver != nil {
+		keyType = nftables.MustConcatSetType(nftables.TypeIFIndex, nftables.TypeIFIndex, nftables.TypeIPAddr, nftables.TypeIPAddr)
+		keyType6 = nftables.MustConcatSetType(nftables.TypeIFIndex, nftables.TypeIFIndex, nftables.TypeIP6Addr, nftables.TypeIP6Addr)
+	}
+	c.selfSet = &nfds.Set{
+		Table:         c.table,
+		Name:          "self_ips",
+		KeyType:       keyType,
+		KeyType6:      keyType6,
+		KeyByteOrder:  binaryutil.BigEndian,
+		Concatenation: true,
+	}
+	c.nftConn.AddSet(c.selfSet, []nftables.SetElement{})
+}
+
+// selfElement returns the element of c.selfSet matching traffic of the pod
+// with the given verdict map key to itself.
+func selfElement(k vmapKey, ifaceScoped bool) nftables.SetElement {
+	key := append(k.ip.AsSlice(), k.ip.AsSlice()...)
+	if ifaceScoped {
+		iface := binaryutil.NativeEndian.PutUint32(k.ifIndex)
+		key = append(append(iface, iface...), key...)
+	}
+	return nftables.SetElement{Key: key}
+}
+
+// addSelfAcceptRule adds a rule to ch accepting traffic whose source and
+// destination are the same pod IP, like health checks of a pod reaching
+// itself through a service. The traffic needs to enter and leave through
+// the interface of the pod, or at least an interface in the pod interface
+// group, so other hosts cannot get spoofed packets accepted.
+func (c *Controller) addSelfAcceptRule(ch *nfds.Chain) {
+	var exprs []expr.Any
+	var ifaceRegs uint32
+	if c.cfg.IfaceResolver != nil {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyIIF, Register: newRegOffset + 0},
+			&expr.Meta{Key: expr.MetaKeyOIF, Register: newRegOffset + 1},
+		)
+		ifaceRegs = 2
+	} else {
+		for _, key := range []expr.MetaKey{expr.MetaKeyIIFGROUP, expr.MetaKeyOIFGROUP} {
+			exprs = append(exprs,
+				&expr.Meta{Key: key, Register: newRegOffset + 0},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: newRegOffset + 0, Data: binaryutil.NativeEndian.PutUint32(c.cfg.PodIfaceGroup)},
+			)
+		}
+	}
+	c.nftConn.AddRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: append(exprs,
+			loadIP(dirIngress, ifaceRegs),
+			// The destination directly follows the source, which takes up
+			// four registers for IPv6.
+			&expr.Dynamic{Expr: func(fam uint8) expr.Any {
+				if fam == unix.NFPROTO_IPV4 {
+					return loadIP(dirEgress, ifaceRegs+1).Expr(fam)
+				}
+				return loadIP(dirEgress, ifaceRegs+4).Expr(fam)
+			}},
+			lookup(Lookup{Set: c.selfSet, SourceRegister: newRegOffset + 0}),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		),
+	})
+}
@@ -0,0 +1,148 @@
+package nftctrl
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
+	"k8s.io/client-go/tools/cache"
+)
+
+// CanConnect determines whether a new connection from pod src to port of pod
+// dst using L4 protocol proto would be permitted by the ruleset. It only
+// evaluates the in-memory model and does not consult the kernel. The model is
+// evaluated the same way the generated ruleset is, including its handling of
+// named ports, which are resolved on the peer pod. Connections are checked for
+// every IP family both pods have addresses in; all of them need to be
+// permitted. The reason describes why the connection is permitted or not.
+func (c *Controller) CanConnect(src, dst cache.ObjectName, proto uint8, port uint16) (bool, string) {
+	srcPod, ok := c.pods[src]
+	if !ok {
+		return false, fmt.Sprintf("source pod %v not found", src)
+	}
+	dstPod, ok := c.pods[dst]
+	if !ok {
+		return false, fmt.Sprintf("destination pod %v not found", dst)
+	}
+	var reasons []string
+	for _, srcIP := range srcPod.IPs {
+		for _, dstIP := range dstPod.IPs {
+			if srcIP.Is4() != dstIP.Is4() {
+				continue
+			}
+			ok, reason := c.canConnectIP(srcPod, srcIP, dstPod, dstIP, proto, port)
+			if !ok {
+				return false, reason
+			}
+			reasons = append(reasons, reason)
+		}
+	}
+	if len(reasons) == 0 {
+		return false, "pods have no IPs of a common family"
+	}
+	return true, reasons[0]
+}
+
+func (c *Controller) canConnectIP(srcPod *Pod, srcIP netip.Addr, dstPod *Pod, dstIP netip.Addr, proto uint8, port uint16) (bool, string) {
+	egReason := "source is not isolated for egress"
+	if srcPod.egressChain != nil {
+		nwp := c.permittingPolicy(srcPod.egressPolicyRefs, dirEgress, dstPod, dstIP, proto, port)
+		switch {
+		case nwp != nil:
+			egReason = fmt.Sprintf("egress permitted by %s/%s", nwp.Namespace, nwp.Name)
+		case srcPod.egressAudit:
+			egReason = "egress not permitted by any policy, but only audited"
+		default:
+			return false, fmt.Sprintf("egress of %s/%s to %v is not permitted by any policy", srcPod.Namespace, srcPod.Name, dstIP)
+		}
+	}
+	ingReason := "destination is not isolated for ingress"
+	if dstPod.ingressChain != nil {
+		nwp := c.permittingPolicy(dstPod.ingressPolicyRefs, dirIngress, srcPod, srcIP, proto, port)
+		switch {
+		case nwp != nil:
+			ingReason = fmt.Sprintf("ingress permitted by %s/%s", nwp.Namespace, nwp.Name)
+		case dstPod.ingressAudit:
+			ingReason = "ingress not permitted by any policy, but only audited"
+		default:
+			return false, fmt.Sprintf("ingress of %s/%s from %v is not permitted by any policy", dstPod.Namespace, dstPod.Name, srcIP)
+		}
+	}
+	return true, egReason + ", " + ingReason
+}
+
+// permittingPolicy returns a policy out of policies with a rule in the given
+// direction permitting traffic with the given peer, or nil if none does.
+func (c *Controller) permittingPolicy(policies map[*Policy]*nfds.Rule, dir direction, peer *Pod, peerIP netip.Addr, proto uint8, port uint16) *Policy {
+	for nwp := range policies {
+		rules := nwp.IngressRuleMeta
+		if dir == dirEgress {
+			rules = nwp.EgressRuleMeta
+		}
+		for _, r := range rules {
+			if r.permits(peer, peerIP, proto, port) {
+				return nwp
+			}
+		}
+	}
+	return nil
+}
+
+// portKey returns the key of a protocol/port combination in port ranges.
+func portKey(proto uint8, port uint16) uint32 {
+	return uint32(proto)<<16 | uint32(port)
+}
+
+// allPorts covers all protocols and ports.
+var allPorts = ranges.Range[uint32]{Start: 0, End: portKey(math.MaxUint8, math.MaxUint16)}
+
+// permits mirrors the evaluation of the rules generated by createPeers.
+func (r *Rule) permits(peer *Pod, peerIP netip.Addr, proto uint8, port uint16) bool {
+	ports := ranges.New[uint32]()
+	r.addPermittedPorts(peer, peerIP, ports)
+	return containsKey(ports, portKey(proto, port))
+}
+
+// addPermittedPorts adds all protocol/port combinations the rule permits for
+// traffic with the given peer to ports.
+func (r *Rule) addPermittedPorts(peer *Pod, peerIP netip.Addr, ports *ranges.Ranges[uint32]) {
+	_, peerSelected := r.podRefs[peer]
+	if r.NamedPortSet != nil && peerSelected {
+		for _, nm := range r.NamedPortMeta {
+			if np, ok := peer.NamedPorts[nm.PortName]; ok && np.Protocol == nm.Protocol {
+				k := portKey(np.Protocol, np.Port)
+				ports.Add(ranges.Range[uint32]{Start: k, End: k})
+			}
+		}
+	}
+	if len(r.NumberedPortMeta) == 0 && !r.AllPorts {
+		// Only named (or invalid) ports
+		return
+	}
+	peerMatches := r.AllPeers || r.overflowed || (len(r.PodSelectors) > 0 && peerSelected) || r.fqdnIPs[peerIP] > 0
+	for it := r.IPBlocks.Iterator(); !peerMatches && it.Valid(); it.Next() {
+		rng := it.Item()
+		peerMatches = !lessAddrs(peerIP, rng.Start) && !lessAddrs(rng.End, peerIP)
+	}
+	if !peerMatches {
+		return
+	}
+	if r.AllPorts {
+		ports.Add(allPorts)
+		return
+	}
+	for _, p := range r.NumberedPortMeta {
+		ports.Add(ranges.Range[uint32]{Start: portKey(p.Protocol, p.Port), End: portKey(p.Protocol, p.EndPort)})
+	}
+}
+
+func containsKey(r *ranges.Ranges[uint32], k uint32) bool {
+	for it := r.Iterator(); it.Valid(); it.Next() {
+		if rng := it.Item(); rng.Start <= k && k <= rng.End {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package nftctrl
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	nwkv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestCanConnect(t *testing.T) {
+	c, _, _ := newTestController(t, Config{})
+	client := cache.ObjectName{Namespace: "default", Name: "client"}
+	server := cache.ObjectName{Namespace: "default", Name: "server"}
+	other := cache.ObjectName{Namespace: "default", Name: "other"}
+	c.SetPod(client, testPod("default", "client", map[string]string{"role": "client"}, "10.0.0.1", "fd00::1"))
+	serverPod := testPod("default", "server", map[string]string{"role": "server"}, "10.0.0.2", "fd00::2")
+	c.SetPod(server, serverPod)
+	otherPod := testPod("default", "other", map[string]string{"role": "other"}, "10.0.0.3")
+	otherPod.Spec.Containers = []corev1.Container{{Name: "main", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}
+	c.SetPod(other, otherPod)
+
+	expect := func(src, dst cache.ObjectName, port uint16, allowed bool) {
+		t.Helper()
+		ok, reason := c.CanConnect(src, dst, unix.IPPROTO_TCP, port)
+		if ok != allowed {
+			t.Errorf("%v -> %v:%d: expected %v, got %v (%s)", src, dst, port, allowed, ok, reason)
+		}
+	}
+
+	// No policies
+	expect(client, server, 80, true)
+
+	// Default deny ingress for the server
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "deny"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "deny"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeIngress},
+		},
+	})
+	expect(client, server, 80, false)
+	expect(server, client, 80, true)
+
+	// Permit ingress from the client on port 80
+	port80 := intstr.FromInt32(80)
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "allow"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "allow"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "server"}},
+			Ingress: []nwkv1.NetworkPolicyIngressRule{{
+				From:  []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &port80}},
+			}},
+		},
+	})
+	expect(client, server, 80, true)
+	expect(client, server, 81, false)
+	expect(other, server, 80, false)
+
+	// Egress from the client only to the named port of other and to an ipBlock
+	// covering the server's IPv4 address only.
+	namedPort := intstr.FromString("http")
+	c.SetNetworkPolicy(cache.ObjectName{Namespace: "default", Name: "egress"}, &nwkv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress"},
+		Spec: nwkv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"role": "client"}},
+			PolicyTypes: []nwkv1.PolicyType{nwkv1.PolicyTypeEgress},
+			Egress: []nwkv1.NetworkPolicyEgressRule{{
+				To:    []nwkv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "other"}}}},
+				Ports: []nwkv1.NetworkPolicyPort{{Port: &namedPort}},
+			}, {
+				To: []nwkv1.NetworkPolicyPeer{{IPBlock: &nwkv1.IPBlock{CIDR: "10.0.0.2/32"}}},
+			}},
+		},
+	})
+	expect(client, other, 8080, true)
+	expect(client, other, 80, false)
+	// The IPv6 connection is not permitted by the ipBlock
+	expect(client, server, 80, false)
+
+	if ok, _ := c.CanConnect(client, cache.ObjectName{Namespace: "default", Name: "missing"}, unix.IPPROTO_TCP, 80); ok {
+		t.Error("expected connection to unknown pod to be denied")
+	}
+}
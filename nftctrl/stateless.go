@@ -0,0 +1,107 @@
+package nftctrl
+
+import (
+	"errors"
+	"fmt"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nfds"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// reverse returns the opposite direction.
+func (d direction) reverse() direction {
+	if d == dirIngress {
+		return dirEgress
+	}
+	return dirIngress
+}
+
+// ruleSide describes the traffic matched by the rules generated for a policy
+// rule. The forward side matches the traffic permitted by the policy rule. If
+// Config.Stateless is set, the reply side matches the replies to it, which
+// have addresses and ports swapped.
+type ruleSide struct {
+	chain *nfds.Chain
+	// reply is set for the reply side.
+	reply bool
+	// peer is the direction whose address is the one of the peer.
+	peer direction
+	// loadDstPort and loadSrcPort load the port which is the destination and
+	// source port of the permitted traffic respectively.
+	loadDstPort, loadSrcPort func(dstReg uint32) *expr.Payload
+}
+
+// ruleSides returns the sides of a rule of the given direction whose forward
+// rules are added to ch and reply rules to rch. rch is nil if replies are
+// accepted by conntrack instead.
+func ruleSides(ch, rch *nfds.Chain, dir direction) []ruleSide {
+	sides := []ruleSide{{chain: ch, peer: dir, loadDstPort: loadDstPort, loadSrcPort: loadSrcPort}}
+	if rch != nil {
+		sides = append(sides, ruleSide{chain: rch, reply: true, peer: dir.reverse(), loadDstPort: loadSrcPort, loadSrcPort: loadDstPort})
+	}
+	return sides
+}
+
+// checkStateless returns an error if the configuration relies on conntrack
+// while Config.Stateless is set.
+func (c *Controller) checkStateless() error {
+	if !c.cfg.Stateless {
+		return nil
+	}
+	switch {
+	case len(c.cfg.CtZones) > 0:
+		return errors.New("conntrack zones cannot be used in stateless mode")
+	case c.cfg.EgressOriginalSource:
+		return errors.New("matching the original source cannot be used in stateless mode")
+	case c.cfg.EgressOriginalDestination:
+		return errors.New("matching the original destination cannot be used in stateless mode")
+	case c.cfg.DisableEgress:
+		// Replies to ingress traffic are matched by the egress chains
+		return errors.New("stateless mode cannot be used with egress disabled")
+	}
+	return nil
+}
+
+// addReplyChain adds the chain accepting the replies to the traffic permitted
+// by the policy chain ch if Config.Stateless is set. It returns nil
+// otherwise.
+func (c *Controller) addReplyChain(ch *nfds.Chain) *nfds.Chain {
+	if !c.cfg.Stateless {
+		return nil
+	}
+	return c.nftConn.AddChain(&nfds.Chain{
+		Table: c.table,
+		Type:  nftables.ChainTypeFilter,
+		Name:  fmt.Sprintf("%s_reply", ch.Name),
+	})
+}
+
+// addPodReplyJump adds a jump from ch, the chain of p for direction dir, to
+// the reply chain of nwp for the opposite direction, if both exist and the
+// jump does not exist yet. refs contains the jumps of ch.
+func (c *Controller) addPodReplyJump(ch *nfds.Chain, refs map[*Policy]*nfds.Rule, dir direction, nwp *Policy) {
+	replyChain := nwp.ingressReplyChain
+	if dir == dirIngress {
+		replyChain = nwp.egressReplyChain
+	}
+	if ch == nil || replyChain == nil {
+		return
+	}
+	if _, ok := refs[nwp]; ok {
+		return
+	}
+	refs[nwp] = c.nftConn.InsertRule(&nfds.Rule{
+		Table: c.table,
+		Chain: ch,
+		Exprs: nwp.jumpExprs(dir, replyChain.Name),
+	})
+}
+
+// delPodReplyJump deletes the jump added by addPodReplyJump, if any.
+func (c *Controller) delPodReplyJump(refs map[*Policy]*nfds.Rule, nwp *Policy) {
+	if r, ok := refs[nwp]; ok {
+		c.nftConn.DelRule(r)
+		delete(refs, nwp)
+	}
+}
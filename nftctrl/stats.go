@@ -0,0 +1,161 @@
+package nftctrl
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"unsafe"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/ranges"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PolicyStats describes the size of the ruleset generated for a policy.
+type PolicyStats struct {
+	Policy cache.ObjectName
+	// Rules is the number of ingress and egress rules.
+	Rules int
+	// SelectedPods is the number of pods the policy applies to.
+	SelectedPods int
+	// PeerPods is the number of pods selected as peers, summed over all
+	// rules.
+	PeerPods int
+}
+
+// PolicyStats returns statistics for every policy.
+func (c *Controller) PolicyStats() []PolicyStats {
+	out := make([]PolicyStats, 0, len(c.nwps))
+	for name, nwp := range c.nwps {
+		ps := PolicyStats{
+			Policy:       name,
+			Rules:        len(nwp.IngressRuleMeta) + len(nwp.EgressRuleMeta),
+			SelectedPods: len(nwp.podRefs),
+		}
+		for _, rules := range [][]*Rule{nwp.IngressRuleMeta, nwp.EgressRuleMeta} {
+			for _, r := range rules {
+				ps.PeerPods += len(r.podRefs)
+			}
+		}
+		out = append(out, ps)
+	}
+	return out
+}
+
+// PodIsolation describes in which directions a pod is isolated, i.e. only
+// permits the traffic permitted by policies. Pods whose chain of a direction
+// is only audited are not isolated in it.
+type PodIsolation struct {
+	Pod     cache.ObjectName
+	Ingress bool
+	Egress  bool
+}
+
+// PodIsolation returns the isolation status of every pod, sorted by name.
+func (c *Controller) PodIsolation() []PodIsolation {
+	out := make([]PodIsolation, 0, len(c.pods))
+	for name, p := range c.pods {
+		out = append(out, PodIsolation{
+			Pod:     name,
+			Ingress: p.ingressChain != nil && !p.ingressAudit,
+			Egress:  p.egressChain != nil && !p.egressAudit,
+		})
+	}
+	slices.SortFunc(out, func(a, b PodIsolation) int {
+		return cmp.Or(cmp.Compare(a.Pod.Namespace, b.Pod.Namespace), cmp.Compare(a.Pod.Name, b.Pod.Name))
+	})
+	return out
+}
+
+// ObjectFootprint describes how many objects of a kind the controller keeps
+// in memory.
+type ObjectFootprint struct {
+	Count int
+	// EstimatedBytes is a rough estimate of the memory used by the objects
+	// themselves. Shared data like the nftables objects they refer to and the
+	// policy specs, which are kept by the informer caches anyway, is not
+	// included.
+	EstimatedBytes int
+}
+
+// Footprint describes the objects kept in memory by the controller.
+type Footprint struct {
+	Pods     ObjectFootprint
+	Policies ObjectFootprint
+	Rules    ObjectFootprint
+}
+
+const (
+	// mapEntryOverhead approximates the per-entry overhead of a map in
+	// addition to its key and value.
+	mapEntryOverhead = 16
+	ptrSize          = int(unsafe.Sizeof(uintptr(0)))
+	stringSize       = int(unsafe.Sizeof(""))
+)
+
+// Footprint returns the number and estimated size of the pods, policies and
+// rules kept in memory. It walks all of them, so it should not be called for
+// every change.
+func (c *Controller) Footprint() Footprint {
+	var f Footprint
+	f.Pods.Count = len(c.pods)
+	for _, p := range c.pods {
+		f.Pods.EstimatedBytes += p.estimatedBytes()
+	}
+	f.Policies.Count = len(c.nwps)
+	for _, nwp := range c.nwps {
+		f.Policies.EstimatedBytes += nwp.estimatedBytes()
+	}
+	f.Rules.Count = len(c.rules)
+	for r := range c.rules {
+		f.Rules.EstimatedBytes += r.estimatedBytes()
+	}
+	return f
+}
+
+func (p *Pod) estimatedBytes() int {
+	n := int(unsafe.Sizeof(*p)) + len(p.Namespace) + len(p.Name) + len(p.ID) + len(p.comment) + len(p.mac)
+	for k, v := range p.Labels {
+		n += 2*stringSize + len(k) + len(v) + mapEntryOverhead
+	}
+	n += len(p.IPs) * int(unsafe.Sizeof(netip.Addr{}))
+	for name := range p.NamedPorts {
+		n += stringSize + len(name) + int(unsafe.Sizeof(NamedPort{})) + mapEntryOverhead
+	}
+	n += len(p.ifIndexes) * (int(unsafe.Sizeof(netip.Addr{})) + 4 + mapEntryOverhead)
+	n += len(p.shadowedKeys) * (int(unsafe.Sizeof(vmapKey{})) + mapEntryOverhead)
+	n += (len(p.ingressTerminal) + len(p.egressTerminal)) * ptrSize
+	n += len(p.ruleRefs) * (ptrSize + mapEntryOverhead)
+	n += (len(p.ingressPolicyRefs) + len(p.egressPolicyRefs) + len(p.ingressReplyRefs) + len(p.egressReplyRefs)) * (2*ptrSize + mapEntryOverhead)
+	return n
+}
+
+func (nwp *Policy) estimatedBytes() int {
+	n := int(unsafe.Sizeof(*nwp)) + len(nwp.Namespace) + len(nwp.Name) + len(nwp.ID)
+	n += (len(nwp.IngressRuleMeta) + len(nwp.EgressRuleMeta) + len(nwp.ruleChains)) * ptrSize
+	n += len(nwp.podRefs) * (ptrSize + mapEntryOverhead)
+	for k, v := range nwp.annotations {
+		n += 2*stringSize + len(k) + len(v) + mapEntryOverhead
+	}
+	return n
+}
+
+func (r *Rule) estimatedBytes() int {
+	n := int(unsafe.Sizeof(*r)) + len(r.Namespace)
+	n += len(r.PodSelectors) * int(unsafe.Sizeof(PodSelector{}))
+	n += len(r.NamedPortMeta) * int(unsafe.Sizeof(RuleNamedPortMeta{}))
+	for _, m := range r.NamedPortMeta {
+		n += len(m.PortName)
+	}
+	n += (len(r.NumberedPortMeta) + len(r.SourcePortMeta)) * int(unsafe.Sizeof(RuleNumberedPortMeta{}))
+	if r.IPBlocks != nil {
+		n += r.IPBlocks.Len() * int(unsafe.Sizeof(ranges.Range[netip.Addr]{}))
+	}
+	n += len(r.podRefs) * (ptrSize + mapEntryOverhead)
+	for _, name := range r.FQDNs {
+		n += stringSize + len(name)
+	}
+	n += len(r.fqdnIPs) * (int(unsafe.Sizeof(netip.Addr{})) + int(unsafe.Sizeof(0)) + mapEntryOverhead)
+	n += len(r.portSets) * ptrSize
+	n += len(r.sides) * int(unsafe.Sizeof(ruleSide{}))
+	return n
+}
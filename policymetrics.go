@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/metrics"
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/nftctrl"
+)
+
+// namespaceFilter selects namespaces by name.
+type namespaceFilter struct {
+	all   bool
+	names map[string]bool
+}
+
+// parseNamespaceFilter parses a comma-separated list of namespaces, where *
+// selects all of them.
+func parseNamespaceFilter(s string) namespaceFilter {
+	f := namespaceFilter{names: make(map[string]bool)}
+	for _, ns := range strings.Split(s, ",") {
+		ns = strings.TrimSpace(ns)
+		switch ns {
+		case "":
+		case "*":
+			f.all = true
+		default:
+			f.names[ns] = true
+		}
+	}
+	return f
+}
+
+func (f namespaceFilter) Matches(ns string) bool {
+	return f.all || f.names[ns]
+}
+
+// registerPolicyMetrics registers metrics describing the policies. To bound
+// their cardinality, they are aggregated per namespace, with per-policy
+// metrics only for the namespaces selected by detailed.
+func (c *Controller) registerPolicyMetrics(detailed namespaceFilter) {
+	stats := func() []nftctrl.PolicyStats {
+		c.nftMu.Lock()
+		defer c.nftMu.Unlock()
+		return c.nft.PolicyStats()
+	}
+	perNamespace := func(value func(nftctrl.PolicyStats) int) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			sums := make(map[string]int)
+			for _, ps := range stats() {
+				sums[ps.Policy.Namespace] += value(ps)
+			}
+			samples := make([]metrics.Sample, 0, len(sums))
+			for ns, sum := range sums {
+				samples = append(samples, metrics.Sample{LabelValues: []string{ns}, Value: float64(sum)})
+			}
+			sort.Slice(samples, func(i, j int) bool { return samples[i].LabelValues[0] < samples[j].LabelValues[0] })
+			return samples
+		}
+	}
+	perPolicy := func(value func(nftctrl.PolicyStats) int) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, ps := range stats() {
+				if detailed.Matches(ps.Policy.Namespace) {
+					samples = append(samples, metrics.Sample{LabelValues: []string{ps.Policy.Namespace, ps.Policy.Name}, Value: float64(value(ps))})
+				}
+			}
+			sort.Slice(samples, func(i, j int) bool {
+				a, b := samples[i].LabelValues, samples[j].LabelValues
+				return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+			})
+			return samples
+		}
+	}
+	policies := func(nftctrl.PolicyStats) int { return 1 }
+	rules := func(ps nftctrl.PolicyStats) int { return ps.Rules }
+	selectedPods := func(ps nftctrl.PolicyStats) int { return ps.SelectedPods }
+	peerPods := func(ps nftctrl.PolicyStats) int { return ps.PeerPods }
+
+	nsLabels := []string{"namespace"}
+	metrics.Default.NewGaugeVecFunc("npc_namespace_policies", "Number of NetworkPolicies in a namespace.", nsLabels, perNamespace(policies))
+	metrics.Default.NewGaugeVecFunc("npc_namespace_policy_rules", "Number of rules of all NetworkPolicies in a namespace.", nsLabels, perNamespace(rules))
+	metrics.Default.NewGaugeVecFunc("npc_namespace_policy_selected_pods", "Number of pods selected by NetworkPolicies in a namespace, counted once per policy.", nsLabels, perNamespace(selectedPods))
+	metrics.Default.NewGaugeVecFunc("npc_namespace_policy_peer_pods", "Number of pods selected as peers by rules of NetworkPolicies in a namespace, counted once per rule.", nsLabels, perNamespace(peerPods))
+
+	policyLabels := []string{"namespace", "policy"}
+	metrics.Default.NewGaugeVecFunc("npc_policy_rules", "Number of rules of a NetworkPolicy. Only exposed for namespaces in -detailed-metrics-namespaces.", policyLabels, perPolicy(rules))
+	metrics.Default.NewGaugeVecFunc("npc_policy_selected_pods", "Number of pods selected by a NetworkPolicy. Only exposed for namespaces in -detailed-metrics-namespaces.", policyLabels, perPolicy(selectedPods))
+	metrics.Default.NewGaugeVecFunc("npc_policy_peer_pods", "Number of pods selected as peers by the rules of a NetworkPolicy, counted once per rule. Only exposed for namespaces in -detailed-metrics-namespaces.", policyLabels, perPolicy(peerPods))
+}
+
+// registerIsolationMetrics registers metrics describing which pods are
+// isolated, i.e. covered by policies, aggregated per namespace. Per-pod
+// metrics are only exposed for the namespaces selected by detailed.
+func (c *Controller) registerIsolationMetrics(detailed namespaceFilter) {
+	isolation := func() []nftctrl.PodIsolation {
+		c.nftMu.Lock()
+		defer c.nftMu.Unlock()
+		return c.nft.PodIsolation()
+	}
+	directions := []struct {
+		name     string
+		isolated func(nftctrl.PodIsolation) bool
+	}{
+		{"ingress", func(pi nftctrl.PodIsolation) bool { return pi.Ingress }},
+		{"egress", func(pi nftctrl.PodIsolation) bool { return pi.Egress }},
+	}
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	metrics.Default.NewGaugeVecFunc("npc_namespace_pods", "Number of pods in a namespace.", []string{"namespace"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, pi := range isolation() {
+			if len(samples) > 0 && samples[len(samples)-1].LabelValues[0] == pi.Pod.Namespace {
+				samples[len(samples)-1].Value++
+			} else {
+				samples = append(samples, metrics.Sample{LabelValues: []string{pi.Pod.Namespace}, Value: 1})
+			}
+		}
+		return samples
+	})
+	metrics.Default.NewGaugeVecFunc("npc_namespace_isolated_pods", "Number of pods in a namespace which are isolated in a direction, i.e. only permit traffic permitted by policies.", []string{"namespace", "direction"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		// Pods are sorted by namespace, so the samples of a namespace are
+		// the last ones
+		for _, pi := range isolation() {
+			if len(samples) == 0 || samples[len(samples)-1].LabelValues[0] != pi.Pod.Namespace {
+				for _, d := range directions {
+					samples = append(samples, metrics.Sample{LabelValues: []string{pi.Pod.Namespace, d.name}})
+				}
+			}
+			nsSamples := samples[len(samples)-len(directions):]
+			for i, d := range directions {
+				nsSamples[i].Value += boolValue(d.isolated(pi))
+			}
+		}
+		return samples
+	})
+	metrics.Default.NewGaugeVecFunc("npc_pod_isolated", "Whether a pod is isolated in a direction. Only exposed for namespaces in -detailed-metrics-namespaces.", []string{"namespace", "pod", "direction"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, pi := range isolation() {
+			if !detailed.Matches(pi.Pod.Namespace) {
+				continue
+			}
+			for _, d := range directions {
+				samples = append(samples, metrics.Sample{LabelValues: []string{pi.Pod.Namespace, pi.Pod.Name, d.name}, Value: boolValue(d.isolated(pi))})
+			}
+		}
+		return samples
+	})
+}
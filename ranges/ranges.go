@@ -137,6 +137,46 @@ func (r *Ranges[T]) Add(a Range[T]) {
 	r.t.Set(a.Start, a.End)
 }
 
+// AddSorted adds all ranges in as, which need to be sorted by their start.
+// The result is the same as adding them one by one, but if they start after
+// all ranges already in r, as when loading a canonical list into an empty r,
+// adjacent and overlapping ranges are merged before inserting them and the
+// tree is not searched for neighbours, which saves CPU time. Every merged
+// range is still a separate tree node, so it allocates as much as Add.
+func (r *Ranges[T]) AddSorted(as []Range[T]) {
+	if len(as) == 0 {
+		return
+	}
+	if last := r.t.Reverse(); last.Valid() && !r.lessWithGap(last.Value(), as[0].Start) {
+		for _, a := range as {
+			r.Add(a)
+		}
+		return
+	}
+	pending := as[0]
+	r.assertValid(pending)
+	for _, a := range as[1:] {
+		r.assertValid(a)
+		if r.less(a.Start, pending.Start) {
+			panic(fmt.Sprintf("ranges not sorted: start %v after %v", pending.Start, a.Start))
+		}
+		if r.lessWithGap(pending.End, a.Start) {
+			r.t.Set(pending.Start, pending.End)
+			pending = a
+			continue
+		}
+		if r.less(pending.End, a.End) {
+			pending.End = a.End
+		}
+	}
+	r.t.Set(pending.Start, pending.End)
+}
+
+// Contains returns true if p is in a, using the comparison function of r.
+func (r Ranges[T]) Contains(a Range[T], p T) bool {
+	return !r.less(p, a.Start) && !r.less(a.End, p)
+}
+
 func (r *Ranges[T]) Len() int {
 	return r.t.Len()
 }
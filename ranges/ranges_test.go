@@ -1,6 +1,7 @@
 package ranges
 
 import (
+	"slices"
 	"testing"
 )
 
@@ -74,3 +75,85 @@ func FuzzRanges(f *testing.F) {
 		}
 	})
 }
+
+func TestContains(t *testing.T) {
+	r := New[int]()
+	a := Range[int]{Start: 3, End: 5}
+	for p, expected := range map[int]bool{2: false, 3: true, 4: true, 5: true, 6: false} {
+		if got := r.Contains(a, p); got != expected {
+			t.Errorf("Contains([3, 5], %d): expected %v, got %v", p, expected, got)
+		}
+	}
+	// The comparison function of r is used
+	rev := NewWithCompare(func(a, b int) bool { return a > b }, func(a int, before bool) int {
+		if before {
+			return a + 1
+		}
+		return a - 1
+	})
+	if !rev.Contains(Range[int]{Start: 5, End: 3}, 4) || rev.Contains(Range[int]{Start: 5, End: 3}, 6) {
+		t.Error("Contains does not use the stored comparison function")
+	}
+}
+
+func rangesOf[T any](r *Ranges[T]) []Range[T] {
+	var out []Range[T]
+	for it := r.Iterator(); it.Valid(); it.Next() {
+		out = append(out, it.Item())
+	}
+	return out
+}
+
+func TestAddSorted(t *testing.T) {
+	input := []Range[int]{{1, 2}, {3, 4}, {6, 10}, {7, 8}, {9, 12}, {20, 20}}
+	for _, initial := range [][]Range[int]{nil, {{-5, -3}}, {{-5, -1}}, {{5, 5}}, {{30, 40}}} {
+		expected := New[int]()
+		got := New[int]()
+		for _, a := range initial {
+			expected.Add(a)
+			got.Add(a)
+		}
+		for _, a := range input {
+			expected.Add(a)
+		}
+		got.AddSorted(input)
+		if !slices.Equal(rangesOf(got), rangesOf(expected)) {
+			t.Errorf("initial %v: expected %v, got %v", initial, rangesOf(expected), rangesOf(got))
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected unsorted ranges to panic")
+		}
+	}()
+	New[int]().AddSorted([]Range[int]{{5, 6}, {1, 2}})
+}
+
+// allowlist returns n disjoint ranges sorted by their start.
+func allowlist(n int) []Range[int] {
+	out := make([]Range[int], n)
+	for i := range out {
+		out[i] = Range[int]{Start: i * 4, End: i*4 + 1}
+	}
+	return out
+}
+
+func BenchmarkAdd(b *testing.B) {
+	in := allowlist(10000)
+	b.ReportAllocs()
+	for range b.N {
+		r := New[int]()
+		for _, a := range in {
+			r.Add(a)
+		}
+	}
+}
+
+func BenchmarkAddSorted(b *testing.B) {
+	in := allowlist(10000)
+	b.ReportAllocs()
+	for range b.N {
+		New[int]().AddSorted(in)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// hotReloadFlags can be changed by reloading the config file without
+// affecting the ruleset.
+var hotReloadFlags = map[string]bool{
+	"v":                    true,
+	"vmodule":              true,
+	"event-dedup-interval": true,
+}
+
+// rebuildFlags can be changed by reloading the config file, but cause the
+// ruleset to be rebuilt from scratch and atomically replaced.
+var rebuildFlags = map[string]bool{
+	"pod-interface-group":          true,
+	"element-comments":             true,
+	"interface-scoped":             true,
+	"ct-zones":                     true,
+	"base-chain-policy":            true,
+	"max-set-elements":             true,
+	"max-ipblock-ranges":           true,
+	"reject-with":                  true,
+	"reject-rate":                  true,
+	"default-deny-ingress":         true,
+	"default-deny-egress":          true,
+	"shared-port-set-min":          true,
+	"allow-multicast":              true,
+	"rule-counters":                true,
+	"policy-counters":              true,
+	"exclude-host-network-peers":   true,
+	"selector-annotations":         true,
+	"egress-original-source":       true,
+	"readable-ids":                 true,
+	"egress-original-destination":  true,
+	"rule-chains":                  true,
+	"allow-self-traffic":           true,
+	"allow-icmpv6-nd":              true,
+	"exclude-init-container-ports": true,
+	"bypass-cidrs":                 true,
+	"l2-anti-spoofing":             true,
+	"ready-peers":                  true,
+	"stateless":                    true,
+	"identity":                     true,
+	"disable-egress":               true,
+	"audit-named-ports":            true,
+}
+
+// readConfigFile reads flag values from a file containing name=value pairs,
+// one per line. Empty lines and lines starting with # are ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name=value", path, lineNo)
+		}
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", path, lineNo, name)
+		}
+		settings[name] = strings.TrimSpace(value)
+	}
+	return settings, s.Err()
+}
+
+// applySettings sets the flags given in settings. It returns the names of the
+// flags whose values changed and a function restoring their previous values.
+// If restricted, changing a flag which is neither hot-reloadable nor causes a
+// rebuild is an error. On errors, no flag is changed.
+func applySettings(settings map[string]string, restricted bool) ([]string, func(), error) {
+	// All values are validated before setting any flag, as flags which
+	// cannot be changed are read concurrently.
+	var toSet []string
+	for name, value := range settings {
+		f := flag.Lookup(name)
+		parsed, ok, err := parseFlagValue(f, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for -%s: %w", name, err)
+		}
+		if !ok {
+			parsed = value
+		}
+		if parsed == f.Value.String() {
+			continue
+		}
+		if restricted && !hotReloadFlags[name] && !rebuildFlags[name] {
+			return nil, nil, fmt.Errorf("-%s cannot be changed without a restart", name)
+		}
+		toSet = append(toSet, name)
+	}
+
+	old := make(map[string]string)
+	restore := func() {
+		for name, value := range old {
+			flag.Set(name, value)
+		}
+	}
+	var changed []string
+	for _, name := range toSet {
+		f := flag.Lookup(name)
+		prev := f.Value.String()
+		old[name] = prev
+		if err := f.Value.Set(settings[name]); err != nil {
+			restore()
+			return nil, nil, fmt.Errorf("invalid value for -%s: %w", name, err)
+		}
+		if f.Value.String() != prev {
+			changed = append(changed, name)
+		}
+	}
+	return changed, restore, nil
+}
+
+// parseFlagValue returns the string form f would have after setting it to
+// value, without changing f. This is only possible for the value types of
+// package flag, ok is false for others, like the verbosity of klog, whose
+// Set has side effects.
+func parseFlagValue(f *flag.Flag, value string) (parsed string, ok bool, err error) {
+	t := reflect.TypeOf(f.Value)
+	if t.Kind() != reflect.Pointer || t.Elem().PkgPath() != "flag" {
+		return "", false, nil
+	}
+	v := reflect.New(t.Elem()).Interface().(flag.Value)
+	if err := v.Set(value); err != nil {
+		return "", true, err
+	}
+	return v.String(), true, nil
+}
+
+// reload re-reads the config file and applies the changed settings.
+func (c *Controller) reload() error {
+	if !c.hasProcessed.HasSynced() {
+		// Rebuilding would flush a partial ruleset
+		return fmt.Errorf("initial sync has not completed yet")
+	}
+	settings, err := readConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+	changed, restore, err := applySettings(settings, true)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		klog.Info("Config file unchanged")
+		return nil
+	}
+	var needsRebuild bool
+	for _, name := range changed {
+		needsRebuild = needsRebuild || rebuildFlags[name]
+	}
+	nftCfg, err := nftConfig()
+	if err != nil {
+		restore()
+		return err
+	}
+	klog.Infof("Changed settings: %s", strings.Join(changed, ", "))
+	c.dedupRecorder.SetInterval(*eventDedupInterval)
+	if !needsRebuild {
+		return nil
+	}
+	c.nftMu.Lock()
+	defer c.nftMu.Unlock()
+	c.nftCfg = nftCfg
+	klog.Info("Rebuilding ruleset for changed settings")
+	if err := c.rebuild(); err != nil {
+		return fmt.Errorf("failed to rebuild ruleset: %w", err)
+	}
+	return nil
+}
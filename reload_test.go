@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestApplySettings(t *testing.T) {
+	prevInterval := flag.Lookup("event-dedup-interval").Value.String()
+	prevTable := *table
+	t.Cleanup(func() {
+		flag.Set("event-dedup-interval", prevInterval)
+		flag.Set("table", prevTable)
+	})
+
+	// Nothing is set if any flag cannot be changed
+	_, _, err := applySettings(map[string]string{"event-dedup-interval": "42s", "table": "other"}, true)
+	if err == nil {
+		t.Fatal("expected changing -table to be rejected")
+	}
+	if got := flag.Lookup("event-dedup-interval").Value.String(); got != prevInterval {
+		t.Errorf("expected -event-dedup-interval to be unchanged, got %v", got)
+	}
+
+	// Equal values in another form are not changes
+	changed, restore, err := applySettings(map[string]string{"event-dedup-interval": "42000ms", "table": prevTable}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "event-dedup-interval" {
+		t.Errorf("expected only -event-dedup-interval to change, got %v", changed)
+	}
+	restore()
+	if got := flag.Lookup("event-dedup-interval").Value.String(); got != prevInterval {
+		t.Errorf("expected -event-dedup-interval to be restored, got %v", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/dolansoft/k8s-nft-npc/metrics"
+	"k8s.io/client-go/tools/cache/synctrack"
+	"k8s.io/klog/v2"
+)
+
+// syncTracker is a synctrack.AsyncTracker which additionally keeps track of
+// how far along the initial sync is, as nothing is flushed before it
+// completed.
+type syncTracker struct {
+	synctrack.AsyncTracker[workItem]
+
+	mu sync.Mutex
+	// started is the time the informers were started.
+	started time.Time
+	// listed is the number of objects in the initial lists delivered so far
+	// and pending the ones of them which have not been processed yet.
+	listed  int
+	pending map[workItem]struct{}
+	// syncedAfter is the time the initial sync took once it completed.
+	syncedAfter time.Duration
+}
+
+func (t *syncTracker) Start(key workItem) {
+	t.mu.Lock()
+	if t.pending == nil {
+		t.pending = make(map[workItem]struct{})
+	}
+	if _, ok := t.pending[key]; !ok {
+		t.listed++
+		t.pending[key] = struct{}{}
+	}
+	t.mu.Unlock()
+	t.AsyncTracker.Start(key)
+}
+
+func (t *syncTracker) Finished(key workItem) {
+	t.mu.Lock()
+	delete(t.pending, key)
+	t.mu.Unlock()
+	t.AsyncTracker.Finished(key)
+}
+
+// progress returns the number of objects in the initial lists delivered so
+// far and how many of them are still pending.
+func (t *syncTracker) progress() (listed, pending int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.listed, len(t.pending)
+}
+
+// markStarted records the start of the initial sync.
+func (t *syncTracker) markStarted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started = time.Now()
+}
+
+// markSynced records the completion of the initial sync and logs how long it
+// took.
+func (t *syncTracker) markSynced() {
+	t.mu.Lock()
+	t.syncedAfter = time.Since(t.started)
+	listed, syncedAfter := t.listed, t.syncedAfter
+	t.mu.Unlock()
+	klog.Infof("Initial sync of %d objects completed after %v", listed, syncedAfter.Round(time.Millisecond))
+}
+
+// logProgress periodically logs the progress of the initial sync until it
+// completed, so it is visible why nothing is flushed yet on large clusters.
+func (t *syncTracker) logProgress(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if t.HasSynced() {
+			return
+		}
+		listed, pending := t.progress()
+		klog.Infof("Waiting for initial sync: %d of %d listed objects processed, informers synced: %v", listed-pending, listed, t.UpstreamHasSynced())
+	}
+}
+
+func (t *syncTracker) registerMetrics() {
+	metrics.Default.NewGaugeFunc("npc_initial_sync_pending_objects", "Number of objects of the initial informer lists which have not been processed yet. Nothing is flushed until this is zero and all informers are synced.", func() float64 {
+		_, pending := t.progress()
+		return float64(pending)
+	})
+	metrics.Default.NewGaugeFunc("npc_initial_sync_listed_objects", "Number of objects of the initial informer lists delivered so far.", func() float64 {
+		listed, _ := t.progress()
+		return float64(listed)
+	})
+	metrics.Default.NewGaugeFunc("npc_initial_sync_duration_seconds", "Time the initial sync took, or 0 if it has not completed yet.", func() float64 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.syncedAfter.Seconds()
+	})
+}